@@ -43,6 +43,10 @@ const (
 	SoundAAC = 10
 	// SoundSpeex denotes the codec of sound is speex
 	SoundSpeex = 11
+	// SoundOpus denotes the codec of sound is Opus, with the sound format
+	// most servers use for Opus in flv, it has a packet type like AAC: 0
+	// for the OpusHead and 1 for the frames
+	SoundOpus = 13
 
 	// Sound55kHz denotes the sampling of sound is 5 5kHz
 	Sound55kHz = 0
@@ -85,6 +89,9 @@ const (
 
 	// VideoH264 denotes the video is H.264
 	VideoH264 = 7
+	// VideoH265 denotes the video is H.265, with the codec id most CDNs
+	// use for HEVC in flv
+	VideoH265 = 12
 )
 
 var (
@@ -94,7 +101,9 @@ var (
 	PLAY = "play"
 )
 
-// Packet is the av packet
+// Packet is the av packet. Packets written to a stream are shared by all
+// its writers and must not be modified, a writer copies the packet if it
+// has to change it, and retains it if it keeps it after Write returns.
 type Packet struct {
 	IsAudio    bool
 	IsVideo    bool
@@ -103,6 +112,8 @@ type Packet struct {
 	StreamID   uint32
 	Header     PacketHeader
 	Data       []byte
+
+	payload *payload
 }
 
 // PacketHeader can be converted to AudioHeaderInfo or VideoHeaderInfo
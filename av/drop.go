@@ -0,0 +1,132 @@
+package av
+
+import (
+	"sync/atomic"
+)
+
+// IsKeyFrame returns if p is a video key frame, sequence headers excluded
+func IsKeyFrame(p *Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	vh, ok := p.Header.(VideoPacketHeader)
+	return ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
+
+// IsSpecial returns if p is metadata or a sequence header, which must never be dropped
+func IsSpecial(p *Packet) bool {
+	if p.IsMetadata {
+		return true
+	}
+	if p.IsVideo {
+		vh, ok := p.Header.(VideoPacketHeader)
+		return ok && vh.IsSeq()
+	}
+	ah, ok := p.Header.(AudioPacketHeader)
+	return ok && ah.SoundFormat() == SoundAAC && ah.AACPacketType() == AACSeqHeader
+}
+
+// DropStats is the number of packets and bytes dropped by a writer
+type DropStats struct {
+	Frames uint64 `json:"frames"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// DropStater is a writer which drops packets on congestion
+type DropStater interface {
+	DropStats() DropStats
+}
+
+// GopDropper is the drop strategy of congested writers: when the queue is
+// full, all queued frames are dropped but sequence headers and metadata,
+// and the following frames are dropped until the next key frame, so that
+// players never receive a broken gop. For audio only streams every audio
+// frame is a key frame.
+type GopDropper struct {
+	waitKey  bool
+	hasVideo bool
+	frames   uint64
+	bytes    uint64
+}
+
+// Keep returns if p should be queued, it must be called for every packet
+// written into the queue, the dropped packet is counted
+func (d *GopDropper) Keep(p *Packet) bool {
+	if p.IsVideo {
+		d.hasVideo = true
+	}
+	if !d.waitKey || IsSpecial(p) {
+		return true
+	}
+	if IsKeyFrame(p) || (!d.hasVideo && p.IsAudio) {
+		d.waitKey = false
+		return true
+	}
+	d.drop(p)
+	return false
+}
+
+func (d *GopDropper) drop(p *Packet) {
+	atomic.AddUint64(&d.frames, 1)
+	atomic.AddUint64(&d.bytes, uint64(len(p.Data)))
+}
+
+// Congest drops the queued packets but sequence headers and metadata,
+// it returns the packets to keep in order, the queue is reused.
+// The dropped packets are released.
+func (d *GopDropper) Congest(queued []*Packet) []*Packet {
+	kept := queued[:0]
+	for _, p := range queued {
+		if IsSpecial(p) {
+			kept = append(kept, p)
+		} else {
+			d.drop(p)
+			p.Release()
+		}
+	}
+	for i := len(kept); i < len(queued); i++ {
+		queued[i] = nil
+	}
+	d.waitKey = true
+	return kept
+}
+
+// CongestChan drains queue and puts back the packets to keep
+func (d *GopDropper) CongestChan(queue chan *Packet) {
+	var queued []*Packet
+drain:
+	for {
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				break drain
+			}
+			queued = append(queued, p)
+		default:
+			break drain
+		}
+	}
+	for _, p := range d.Congest(queued) {
+		queue <- p
+	}
+}
+
+// ReleaseChan releases the packets left in queue, e.g. of a closed writer
+func ReleaseChan(queue chan *Packet) {
+	for {
+		select {
+		case p := <-queue:
+			p.Release()
+		default:
+			return
+		}
+	}
+}
+
+// Stats returns the number of dropped packets and bytes
+func (d *GopDropper) Stats() DropStats {
+	return DropStats{
+		Frames: atomic.LoadUint64(&d.frames),
+		Bytes:  atomic.LoadUint64(&d.bytes),
+	}
+}
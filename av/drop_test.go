@@ -0,0 +1,118 @@
+package av
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testVideoHeader struct {
+	key bool
+	seq bool
+}
+
+func (h testVideoHeader) IsKeyFrame() bool       { return h.key }
+func (h testVideoHeader) IsSeq() bool            { return h.seq }
+func (h testVideoHeader) CodecID() uint8         { return VideoH264 }
+func (h testVideoHeader) CompositionTime() int32 { return 0 }
+
+type testAudioHeader struct {
+	seq bool
+}
+
+func (h testAudioHeader) SoundFormat() uint8 { return SoundAAC }
+func (h testAudioHeader) AACPacketType() uint8 {
+	if h.seq {
+		return AACSeqHeader
+	}
+	return AACRaw
+}
+
+func newVideo(key, seq bool, ts uint32) *Packet {
+	return &Packet{
+		IsVideo:   true,
+		TimeStamp: ts,
+		Header:    testVideoHeader{key: key, seq: seq},
+		Data:      make([]byte, 10),
+	}
+}
+
+func newAudio(seq bool, ts uint32) *Packet {
+	return &Packet{
+		IsAudio:   true,
+		TimeStamp: ts,
+		Header:    testAudioHeader{seq: seq},
+		Data:      make([]byte, 4),
+	}
+}
+
+func timestamps(packets []*Packet) []uint32 {
+	ts := make([]uint32, 0, len(packets))
+	for _, p := range packets {
+		ts = append(ts, p.TimeStamp)
+	}
+	return ts
+}
+
+func TestGopDropper(t *testing.T) {
+	at := assert.New(t)
+	var d GopDropper
+
+	queued := []*Packet{
+		{IsMetadata: true},
+		newVideo(true, true, 0),
+		newAudio(true, 0),
+		newVideo(true, false, 0),
+		newAudio(false, 20),
+		newVideo(false, false, 40),
+	}
+	for _, p := range queued {
+		at.True(d.Keep(p))
+	}
+	kept := d.Congest(queued)
+	at.Equal(3, len(kept))
+	at.True(kept[0].IsMetadata)
+	at.Equal(DropStats{Frames: 3, Bytes: 24}, d.Stats())
+
+	// wait for the next key frame, sequence headers are kept
+	at.False(d.Keep(newAudio(false, 60)))
+	at.False(d.Keep(newVideo(false, false, 80)))
+	at.True(d.Keep(newVideo(true, true, 90)))
+	at.True(d.Keep(newVideo(true, false, 100)))
+	at.True(d.Keep(newAudio(false, 120)))
+	at.True(d.Keep(newVideo(false, false, 140)))
+	at.Equal(DropStats{Frames: 5, Bytes: 38}, d.Stats())
+}
+
+func TestGopDropperAudioOnly(t *testing.T) {
+	at := assert.New(t)
+	var d GopDropper
+
+	queued := []*Packet{newAudio(true, 0), newAudio(false, 0), newAudio(false, 20)}
+	kept := d.Congest(queued)
+	at.Equal([]uint32{0}, timestamps(kept))
+	at.True(d.Keep(newAudio(false, 40)))
+	at.Equal(DropStats{Frames: 2, Bytes: 8}, d.Stats())
+}
+
+func TestGopDropperCongestChan(t *testing.T) {
+	at := assert.New(t)
+	var d GopDropper
+
+	queue := make(chan *Packet, 4)
+	for _, p := range []*Packet{
+		newVideo(true, true, 0),
+		newVideo(true, false, 0),
+		newVideo(false, false, 40),
+		newVideo(false, false, 80),
+	} {
+		at.True(d.Keep(p))
+		queue <- p
+	}
+	d.CongestChan(queue)
+	at.Equal(1, len(queue))
+	at.True((<-queue).Header.(VideoPacketHeader).IsSeq())
+	at.False(d.Keep(newVideo(false, false, 120)))
+	at.True(d.Keep(newVideo(true, false, 160)))
+	at.Equal(uint64(4), d.Stats().Frames)
+}
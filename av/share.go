@@ -0,0 +1,83 @@
+package av
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Recycler takes back the data of packets released by all their holders
+type Recycler interface {
+	Put(b []byte)
+}
+
+// payload is the reference counted data of a packet and its copies
+type payload struct {
+	refs int32
+	buf  []byte
+	r    Recycler
+
+	lock       sync.Mutex
+	serialized []serialized
+}
+
+// serialized is a representation of the data of a packet
+type serialized struct {
+	kind string
+	n    int
+	data []byte
+}
+
+// Share makes the data of p reference counted, it is given back to r once
+// p and all its copies are released. The caller holds the first reference.
+// A packet which is never released is simply garbage collected.
+func (p *Packet) Share(r Recycler) {
+	p.payload = &payload{
+		refs: 1,
+		buf:  p.Data,
+		r:    r,
+	}
+}
+
+// Shared returns if the data of p is reference counted
+func (p *Packet) Shared() bool {
+	return p.payload != nil
+}
+
+// Serialized returns the data of p serialized by fn with the parameter n,
+// e.g. split into rtmp chunks of size n. It is computed once for each kind
+// and n, and shared by p and all its copies, fn must only depend on p and n.
+// It is computed for every call if p is not shared.
+func (p *Packet) Serialized(kind string, n int, fn func(p *Packet, n int) []byte) []byte {
+	if p.payload == nil {
+		return fn(p, n)
+	}
+	p.payload.lock.Lock()
+	defer p.payload.lock.Unlock()
+	for _, s := range p.payload.serialized {
+		if s.kind == kind && s.n == n {
+			return s.data
+		}
+	}
+	data := fn(p, n)
+	p.payload.serialized = append(p.payload.serialized, serialized{kind, n, data})
+	return data
+}
+
+// Retain adds a reference to the data of p
+func (p *Packet) Retain() {
+	if p == nil || p.payload == nil {
+		return
+	}
+	atomic.AddInt32(&p.payload.refs, 1)
+}
+
+// Release drops a reference to the data of p, the data must not be used
+// after it
+func (p *Packet) Release() {
+	if p == nil || p.payload == nil {
+		return
+	}
+	if atomic.AddInt32(&p.payload.refs, -1) == 0 && p.payload.r != nil {
+		p.payload.r.Put(p.payload.buf)
+	}
+}
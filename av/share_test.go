@@ -0,0 +1,59 @@
+package av
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecycler struct {
+	put [][]byte
+}
+
+func (r *testRecycler) Put(b []byte) {
+	r.put = append(r.put, b)
+}
+
+func TestPacketShare(t *testing.T) {
+	at := assert.New(t)
+	r := &testRecycler{}
+
+	p := &Packet{Data: []byte{1, 2, 3}}
+	p.Share(r)
+	p.Retain()
+	copied := *p
+	copied.Data = copied.Data[1:]
+	copied.Retain()
+
+	p.Release()
+	p.Release()
+	at.Equal(0, len(r.put))
+	copied.Release()
+	at.Equal([][]byte{{1, 2, 3}}, r.put)
+
+	// packets not shared are garbage collected
+	var q *Packet
+	q.Release()
+	(&Packet{}).Release()
+}
+
+func TestPacketSerialized(t *testing.T) {
+	at := assert.New(t)
+	calls := 0
+	double := func(p *Packet, n int) []byte {
+		calls++
+		return append(append([]byte{}, p.Data...), byte(n))
+	}
+
+	p := &Packet{Data: []byte{1}}
+	at.Equal([]byte{1, 2}, p.Serialized("test", 2, double))
+	at.Equal([]byte{1, 2}, p.Serialized("test", 2, double))
+	at.Equal(2, calls)
+
+	p.Share(nil)
+	copied := *p
+	at.Equal([]byte{1, 2}, p.Serialized("test", 2, double))
+	at.Equal([]byte{1, 2}, copied.Serialized("test", 2, double))
+	at.Equal([]byte{1, 3}, copied.Serialized("test", 3, double))
+	at.Equal(4, calls)
+}
@@ -30,6 +30,55 @@ type Application struct {
 	Live       bool     `mapstructure:"live"`
 	Hls        bool     `mapstructure:"hls"`
 	StaticPush []string `mapstructure:"static_push"`
+	// PublishPolicy is what happens to a second publisher of a stream,
+	// takeover (default), reject or standby
+	PublishPolicy string `mapstructure:"publish_policy"`
+	// BackupSuffix enables backup inputs, e.g. with "_backup" the
+	// publisher of event_backup is the backup input of event
+	BackupSuffix string `mapstructure:"backup_suffix"`
+	// FailoverTimeout is how long in ms the active input may stall before
+	// switching to the other one
+	FailoverTimeout int `mapstructure:"failover_timeout"`
+	// Slate is a flv file under flv_dir played in loop to the players
+	// when the publishers of a stream drop, until one comes back
+	Slate string `mapstructure:"slate"`
+	// SlateGrace is how long in seconds the slate is played
+	SlateGrace int `mapstructure:"slate_grace"`
+	// Routes rewrite the keys of the publishers of the application
+	Routes []Route `mapstructure:"routes"`
+	// Aliases are other keys the players play the streams with
+	Aliases []Route `mapstructure:"aliases"`
+	// UDPInputs are the streams published from udp ts, e.g. multicast
+	UDPInputs []UDPStream `mapstructure:"udp_inputs"`
+	// UDPOutputs are the streams sent in udp ts
+	UDPOutputs []UDPStream `mapstructure:"udp_outputs"`
+	// StaticPull are the streams pulled from upstream HTTP-FLV urls, e.g.
+	// of an origin or a cdn the server is an edge of
+	StaticPull []StaticPull `mapstructure:"static_pull"`
+}
+
+// StaticPull is a stream of the application pulled from URL
+type StaticPull struct {
+	Name string `mapstructure:"name"`
+	URL  string `mapstructure:"url"`
+	// Key is the key of the stream, app/name
+	Key string `mapstructure:"-"`
+}
+
+// UDPStream is a stream of the application sent or received in udp ts,
+// Addr is a multicast group or a unicast address with the port
+type UDPStream struct {
+	Name string `mapstructure:"name"`
+	Addr string `mapstructure:"addr"`
+	// Interface is the name of the network interface of the multicast
+	// group, the system default if empty
+	Interface string `mapstructure:"interface"`
+	// RTP sends the ts in RTP, the inputs detect it
+	RTP bool `mapstructure:"rtp"`
+	// TTL is the ttl of the multicast packets sent, 1 if 0
+	TTL int `mapstructure:"ttl"`
+	// Key is the key of the stream, app/name
+	Key string `mapstructure:"-"`
 }
 
 // Applications is a collection of Application
@@ -46,16 +95,37 @@ type ServerCfg struct {
 	Level           string       `mapstructure:"level"`
 	ConfigFile      string       `mapstructure:"config_file"`
 	FLVDir          string       `mapstructure:"flv_dir"`
+	FLVPathTemplate string       `mapstructure:"flv_path_template"`
+	FLVRotateDur    int          `mapstructure:"flv_rotate_duration"`
+	FLVRotateSize   int64        `mapstructure:"flv_rotate_size"`
+	OnRecordDone    string       `mapstructure:"on_record_done"`
 	RTMPAddr        string       `mapstructure:"rtmp_addr"`
 	HTTPFLVAddr     string       `mapstructure:"httpflv_addr"`
 	HLSAddr         string       `mapstructure:"hls_addr"`
 	HLSKeepAfterEnd bool         `mapstructure:"hls_keep_after_end"`
+	VODAddr         string       `mapstructure:"vod_addr"`
+	SRTAddr         string       `mapstructure:"srt_addr"`
+	SRTLatency      int          `mapstructure:"srt_latency"`
+	WebRTCAddr      string       `mapstructure:"webrtc_addr"`
+	WebRTCUDPPort   int          `mapstructure:"webrtc_udp_port"`
+	WebRTCIPs       string       `mapstructure:"webrtc_ips"`
+	RTSPAddr        string       `mapstructure:"rtsp_addr"`
+	Timeshift       int          `mapstructure:"timeshift"`
+	TimeshiftStore  string       `mapstructure:"timeshift_storage"`
+	TimeshiftDir    string       `mapstructure:"timeshift_dir"`
 	APIAddr         string       `mapstructure:"api_addr"`
+	SnapshotCommand string       `mapstructure:"snapshot_command"`
 	RedisAddr       string       `mapstructure:"redis_addr"`
 	RedisPwd        string       `mapstructure:"redis_pwd"`
 	ReadTimeout     int          `mapstructure:"read_timeout"`
 	WriteTimeout    int          `mapstructure:"write_timeout"`
 	GopNum          int          `mapstructure:"gop_num"`
+	SubscriberQueue int          `mapstructure:"subscriber_queue"`
+	SubscriberOver  string       `mapstructure:"subscriber_overflow"`
+	RelayFlashVer   string       `mapstructure:"relay_flash_ver"`
+	RelaySwfURL     string       `mapstructure:"relay_swf_url"`
+	RelayPageURL    string       `mapstructure:"relay_page_url"`
+	RelayReconnect  int          `mapstructure:"relay_reconnect"`
 	JWT             JWT          `mapstructure:"jwt"`
 	Server          Applications `mapstructure:"server"`
 }
@@ -63,14 +133,25 @@ type ServerCfg struct {
 // defaultConfig is the default configuration
 var defaultConf = ServerCfg{
 	ConfigFile:      "livego.yaml",
+	FLVPathTemplate: "{app}/{stream}_{unix}.flv",
 	RTMPAddr:        ":1935",
 	HTTPFLVAddr:     ":7001",
 	HLSAddr:         ":7002",
 	HLSKeepAfterEnd: false,
+	VODAddr:         "",
+	SRTAddr:         "",
+	SRTLatency:      120,
+	WebRTCAddr:      "",
+	WebRTCUDPPort:   0,
+	RTSPAddr:        "",
+	TimeshiftStore:  "memory",
 	APIAddr:         ":8090",
 	WriteTimeout:    10,
 	ReadTimeout:     10,
 	GopNum:          1,
+	SubscriberQueue: 1024,
+	SubscriberOver:  "drop",
+	RelayReconnect:  30,
 	Server: Applications{{
 		Appname:    "live",
 		Live:       true,
@@ -102,13 +183,34 @@ func init() {
 	pflag.String("httpflv_addr", ":7001", "HTTP-FLV server listen address")
 	pflag.String("hls_addr", ":7002", "HLS server listen address")
 	pflag.String("api_addr", ":8090", "HTTP manage interface server listen address")
+	pflag.String("vod_addr", "", "HTTP VOD server listen address of the recorded flv files, empty means disabled")
+	pflag.String("srt_addr", "", "SRT server UDP listen address, empty means disabled")
+	pflag.Int("srt_latency", 120, "min latency in ms of the SRT connections")
+	pflag.String("webrtc_addr", "", "WebRTC WHEP and WHIP server listen address, empty means disabled")
+	pflag.Int("webrtc_udp_port", 0, "UDP port of the WebRTC media of all the sessions, 0 means a random port for each session")
+	pflag.String("webrtc_ips", "", "comma separated IPs announced to the WebRTC peers instead of the IPs of the host, e.g. behind a NAT")
+	pflag.String("rtsp_addr", "", "RTSP server listen address, empty means disabled")
 	pflag.String("config_file", "livego.yaml", "configure filename")
 	pflag.String("level", "info", "Log level")
 	pflag.Bool("hls_keep_after_end", false, "Maintains the HLS after the stream ends")
 	pflag.String("flv_dir", "tmp", "output flv file at flvDir/APP/KEY_TIME.flv")
+	pflag.String("flv_path_template", "{app}/{stream}_{unix}.flv", "flv file path under flv_dir, supports {app} {stream} {uid} {seq} {unix} and strftime fields")
+	pflag.Int("flv_rotate_duration", 0, "start a new flv file every N seconds, 0 means never")
+	pflag.Int64("flv_rotate_size", 0, "start a new flv file every N bytes, 0 means never")
+	pflag.String("on_record_done", "", "url to POST the information of finished flv files to")
+	pflag.Int("timeshift", 0, "keep the last N minutes of every stream for timeshift playback, 0 means disabled")
+	pflag.String("timeshift_storage", "memory", "where the timeshift window is kept, memory or disk")
+	pflag.String("timeshift_dir", "", "directory of the disk timeshift storage, default is TMPDIR/livego-timeshift")
+	pflag.String("snapshot_command", "", "command reading the Annex-B key frame from stdin and writing a jpeg to stdout for /control/snapshot?format=jpg")
 	pflag.Int("read_timeout", 10, "read time out")
 	pflag.Int("write_timeout", 10, "write time out")
 	pflag.Int("gop_num", 1, "gop num")
+	pflag.Int("subscriber_queue", 1024, "max packets queued for each player")
+	pflag.String("subscriber_overflow", "drop", "what to do when the queue of a player is full, drop (to the next key frame) or disconnect")
+	pflag.String("relay_flash_ver", "", "flashVer sent by relays and static pushes in the rtmp connect command")
+	pflag.String("relay_swf_url", "", "swfUrl sent by relays and static pushes in the rtmp connect command")
+	pflag.String("relay_page_url", "", "pageUrl sent by relays and static pushes in the rtmp connect command")
+	pflag.Int("relay_reconnect", 30, "max seconds between the reconnections of relays and static pushes, 0 means never reconnect")
 	pflag.Parse()
 	Config.BindPFlags(pflag.CommandLine)
 
@@ -164,3 +266,79 @@ func GetStaticPushURLList(appname string) ([]string, bool) {
 	}
 	return nil, false
 }
+
+// GetPublishPolicy gets the publish policy of appname from config
+func GetPublishPolicy(appname string) string {
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	for _, app := range apps {
+		if app.Appname == appname {
+			return app.PublishPolicy
+		}
+	}
+	return ""
+}
+
+// GetBackupInput gets the suffix of the backup input keys of appname and
+// the failover timeout in ms from config, suffix is empty if disabled
+func GetBackupInput(appname string) (suffix string, timeout int) {
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	for _, app := range apps {
+		if app.Appname == appname {
+			return app.BackupSuffix, app.FailoverTimeout
+		}
+	}
+	return "", 0
+}
+
+// GetSlate gets the slate file of appname and its grace period in
+// seconds from config, file is empty if disabled
+func GetSlate(appname string) (file string, grace int) {
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	for _, app := range apps {
+		if app.Appname == appname {
+			return app.Slate, app.SlateGrace
+		}
+	}
+	return "", 0
+}
+
+// GetUDPStreams gets the udp inputs and outputs of the live applications
+// from config
+func GetUDPStreams() (inputs, outputs []UDPStream) {
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	for _, app := range apps {
+		if !app.Live {
+			continue
+		}
+		for _, v := range app.UDPInputs {
+			v.Key = app.Appname + "/" + v.Name
+			inputs = append(inputs, v)
+		}
+		for _, v := range app.UDPOutputs {
+			v.Key = app.Appname + "/" + v.Name
+			outputs = append(outputs, v)
+		}
+	}
+	return
+}
+
+// GetStaticPulls gets the static pulls of the live applications from
+// config
+func GetStaticPulls() (pulls []StaticPull) {
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	for _, app := range apps {
+		if !app.Live {
+			continue
+		}
+		for _, v := range app.StaticPull {
+			v.Key = app.Appname + "/" + v.Name
+			pulls = append(pulls, v)
+		}
+	}
+	return
+}
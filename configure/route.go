@@ -0,0 +1,82 @@
+package configure
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Route maps the stream names of an application matching Match to the
+// stream key Key, a template which may refer to the submatches of Match
+// like $1 or ${name}, e.g. {match: "^(.*)_hd$", key: "live/$1"}.
+// A Key without application is in the same application.
+type Route struct {
+	Match string `mapstructure:"match"`
+	Key   string `mapstructure:"key"`
+}
+
+var regexps sync.Map
+
+// compile returns the compiled expr, nil if invalid
+func compile(expr string) *regexp.Regexp {
+	if v, ok := regexps.Load(expr); ok {
+		return v.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Warningf("invalid route match %q: %v", expr, err)
+		return nil
+	}
+	regexps.Store(expr, re)
+	return re
+}
+
+// rewrite returns the key of the first route of the application of key
+// matching its name, key if none
+func rewrite(key string, routes func(app Application) []Route) string {
+	paths := strings.SplitN(key, "/", 2)
+	if len(paths) != 2 {
+		return key
+	}
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	for _, app := range apps {
+		if app.Appname != paths[0] {
+			continue
+		}
+		for _, route := range routes(app) {
+			re := compile(route.Match)
+			if re == nil || route.Key == "" {
+				continue
+			}
+			match := re.FindStringSubmatchIndex(paths[1])
+			if match == nil {
+				continue
+			}
+			out := string(re.ExpandString(nil, route.Key, paths[1], match))
+			if out == "" {
+				continue
+			}
+			if !strings.Contains(out, "/") {
+				out = paths[0] + "/" + out
+			}
+			return out
+		}
+		break
+	}
+	return key
+}
+
+// RouteKey returns the key of the stream published as key according to
+// the routes of its application
+func RouteKey(key string) string {
+	return rewrite(key, func(app Application) []Route { return app.Routes })
+}
+
+// AliasKey returns the key of the stream played as key according to the
+// aliases of its application
+func AliasKey(key string) string {
+	return rewrite(key, func(app Application) []Route { return app.Aliases })
+}
@@ -2,9 +2,11 @@ package flv
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
@@ -18,6 +20,9 @@ import (
 
 var (
 	flvHeader = []byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09}
+
+	// ErrWriterClosed means the writer is closed
+	ErrWriterClosed = fmt.Errorf("flv writer closed")
 )
 
 /*
@@ -60,6 +65,31 @@ type Writer struct {
 	buf    []byte
 	closed chan struct{}
 	ctx    *os.File
+
+	// lock is held by Write and Close, which are called by the publisher
+	// and its stream
+	lock      sync.Mutex
+	isClosed  bool
+	closeOnce sync.Once
+
+	// fields below are only used by the dvr to split the record into parts
+	record         bool
+	publisher      string
+	pathTmpl       string
+	path           string
+	finished       bool
+	seq            int
+	size           int64
+	rotateDuration uint32
+	rotateSize     int64
+	startTime      time.Time
+	hasTimestamp   bool
+	hasVideo       bool
+	firstTimestamp uint32
+	lastTimestamp  uint32
+	metadata       *av.Packet
+	videoSeq       *av.Packet
+	audioSeq       *av.Packet
 }
 
 // NewWriter returns a writer
@@ -67,67 +97,265 @@ func NewWriter(app, title, url string, ctx *os.File) *Writer {
 	ret := &Writer{
 		RWBaser: av.NewRWBase(time.Second * 10),
 
-		uid:    uid.NewID(),
-		app:    app,
-		title:  title,
-		url:    url,
-		ctx:    ctx,
-		closed: make(chan struct{}),
-		buf:    make([]byte, headerLen),
+		uid:       uid.NewID(),
+		app:       app,
+		title:     title,
+		url:       url,
+		ctx:       ctx,
+		closed:    make(chan struct{}),
+		buf:       make([]byte, headerLen),
+		startTime: time.Now(),
 	}
 
-	ret.ctx.Write(flvHeader)
-	pio.PutI32BE(ret.buf[:4], 0)
-	ret.ctx.Write(ret.buf[:4])
+	ret.writeHeader()
 
 	return ret
 }
 
+func (writer *Writer) writeHeader() error {
+	if _, err := writer.ctx.Write(flvHeader); err != nil {
+		return err
+	}
+	pio.PutI32BE(writer.buf[:4], 0)
+	if _, err := writer.ctx.Write(writer.buf[:4]); err != nil {
+		return err
+	}
+	writer.size = int64(len(flvHeader) + 4)
+	return nil
+}
+
+func (writer *Writer) writeTag(typeID int, timestamp uint32, data []byte) error {
+	if err := writeTag(writer.ctx, writer.buf, typeID, timestamp, data); err != nil {
+		return err
+	}
+	writer.size += int64(len(data) + headerLen + 4)
+	if !writer.hasTimestamp {
+		writer.hasTimestamp = true
+		writer.firstTimestamp = timestamp
+	}
+	writer.lastTimestamp = timestamp
+	return nil
+}
+
+// writeTag writes a tag and its previous tag size, buf is at least headerLen bytes
+func writeTag(w io.Writer, buf []byte, typeID int, timestamp uint32, data []byte) error {
+	h := buf[:headerLen]
+	dataLen := len(data)
+	preDataLen := dataLen + headerLen
+	timestampbase := timestamp & 0xffffff
+	timestampExt := timestamp >> 24 & 0xff
+
+	pio.PutU8(h[0:1], uint8(typeID))
+	pio.PutI24BE(h[1:4], int32(dataLen))
+	pio.PutI24BE(h[4:7], int32(timestampbase))
+	pio.PutU8(h[7:8], uint8(timestampExt))
+
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	pio.PutI32BE(h[:4], int32(preDataLen))
+	if _, err := w.Write(h[:4]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteClip writes a standalone flv file of packets, e.g. the sequence
+// headers and one key frame, with all timestamps reset to 0
+func WriteClip(w io.Writer, packets ...*av.Packet) error {
+	buf := make([]byte, headerLen)
+	if _, err := w.Write(flvHeader); err != nil {
+		return err
+	}
+	pio.PutI32BE(buf[:4], 0)
+	if _, err := w.Write(buf[:4]); err != nil {
+		return err
+	}
+	for _, p := range packets {
+		typeID := av.TagAudio
+		if p.IsVideo {
+			typeID = av.TagVideo
+		} else if p.IsMetadata {
+			typeID = av.TagScriptDataAMF0
+		}
+		if err := writeTag(w, buf, typeID, 0, p.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Write write packet into writer
 func (writer *Writer) Write(p *av.Packet) error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.isClosed {
+		return ErrWriterClosed
+	}
 	writer.SetPreTime()
-	h := writer.buf[:headerLen]
 	typeID := av.TagVideo
 	if !p.IsVideo {
 		if p.IsMetadata {
-			var err error
 			typeID = av.TagScriptDataAMF0
-			p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
+			// p is shared with other writers
+			pkt := *p
+			var err error
+			pkt.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
 			if err != nil {
 				return err
 			}
+			p = &pkt
 		} else {
 			typeID = av.TagAudio
 		}
 	}
-	dataLen := len(p.Data)
 	timestamp := p.TimeStamp
 	timestamp += writer.BaseTimestamp()
 	writer.RecTimestamp(timestamp, uint32(typeID))
 
-	preDataLen := dataLen + headerLen
-	timestampbase := timestamp & 0xffffff
-	timestampExt := timestamp >> 24 & 0xff
+	if writer.record {
+		if writer.needRotate(p, timestamp) {
+			if err := writer.rotate(timestamp); err != nil {
+				return err
+			}
+		}
+		writer.keepSpecial(p)
+	}
 
-	pio.PutU8(h[0:1], uint8(typeID))
-	pio.PutI24BE(h[1:4], int32(dataLen))
-	pio.PutI24BE(h[4:7], int32(timestampbase))
-	pio.PutU8(h[7:8], uint8(timestampExt))
+	return writer.writeTag(typeID, timestamp, p.Data)
+}
+
+// keepSpecial keeps metadata and sequence headers to start every part with
+func (writer *Writer) keepSpecial(p *av.Packet) {
+	switch {
+	case p.IsMetadata:
+		keep(&writer.metadata, p)
+	case p.IsVideo:
+		writer.hasVideo = true
+		if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsSeq() {
+			keep(&writer.videoSeq, p)
+		}
+	case p.IsAudio:
+		if ah, ok := p.Header.(av.AudioPacketHeader); ok &&
+			ah.SoundFormat() == av.SoundAAC && ah.AACPacketType() == av.AACSeqHeader {
+			keep(&writer.audioSeq, p)
+		}
+	}
+}
+
+// keep retains p in dst and releases the packet it replaces
+func keep(dst **av.Packet, p *av.Packet) {
+	p.Retain()
+	(*dst).Release()
+	*dst = p
+}
 
-	if _, err := writer.ctx.Write(h); err != nil {
+// needRotate returns if a new part should be started before p, parts
+// are only split on key frames, or on any audio frame for audio only streams
+func (writer *Writer) needRotate(p *av.Packet, timestamp uint32) bool {
+	if writer.rotateDuration == 0 && writer.rotateSize == 0 {
+		return false
+	}
+	if p.IsMetadata || !writer.hasTimestamp {
+		return false
+	}
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok || !vh.IsKeyFrame() || vh.IsSeq() {
+			return false
+		}
+	} else if writer.hasVideo {
+		return false
+	}
+	if writer.rotateSize > 0 && writer.size >= writer.rotateSize {
+		return true
+	}
+	return writer.rotateDuration > 0 &&
+		timestamp-writer.firstTimestamp >= writer.rotateDuration
+}
+
+// rotate closes the current part and opens the next one, timestamps keep
+// increasing so that the parts can be played back to back
+func (writer *Writer) rotate(timestamp uint32) error {
+	writer.finishPart()
+	writer.seq++
+	if err := writer.openPart(); err != nil {
 		return err
 	}
+	if writer.metadata != nil {
+		if err := writer.writeTag(av.TagScriptDataAMF0, timestamp, writer.metadata.Data); err != nil {
+			return err
+		}
+	}
+	if writer.videoSeq != nil {
+		if err := writer.writeTag(av.TagVideo, timestamp, writer.videoSeq.Data); err != nil {
+			return err
+		}
+	}
+	if writer.audioSeq != nil {
+		if err := writer.writeTag(av.TagAudio, timestamp, writer.audioSeq.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if _, err := writer.ctx.Write(p.Data); err != nil {
+// openPart creates the file of current part and writes the flv header
+func (writer *Writer) openPart() error {
+	now := time.Now()
+	fileName, err := ResolveRecordFile(FormatRecordPath(writer.pathTmpl, writer.app, writer.title, writer.publisher, writer.seq, now))
+	if err != nil {
 		return err
 	}
+	if fileName == writer.path {
+		ext := filepath.Ext(fileName)
+		fileName = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(fileName, ext), writer.seq, ext)
+	}
 
-	pio.PutI32BE(h[:4], int32(preDataLen))
-	if _, err := writer.ctx.Write(h[:4]); err != nil {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	log.Debug("flv dvr save stream to: ", fileName)
+	w, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0755)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	writer.ctx = w
+	writer.path = fileName
+	writer.finished = false
+	writer.startTime = now
+	writer.hasTimestamp = false
+	return writer.writeHeader()
+}
+
+// finishPart closes the file of current part and reports it once
+func (writer *Writer) finishPart() {
+	writer.ctx.Close()
+	if writer.path == "" || writer.finished {
+		return
+	}
+	writer.finished = true
+	info := RecordInfo{
+		App:       writer.app,
+		Stream:    writer.title,
+		UID:       writer.publisher,
+		URL:       writer.url,
+		Path:      writer.path,
+		Seq:       writer.seq,
+		Size:      writer.size,
+		StartTime: writer.startTime,
+		EndTime:   time.Now(),
+	}
+	if writer.hasTimestamp {
+		info.Duration = writer.lastTimestamp - writer.firstTimestamp
+	}
+	notifyRecordDone(info)
 }
 
 // Wait waits for closing
@@ -140,8 +368,17 @@ func (writer *Writer) Wait() {
 
 // Close close the writer
 func (writer *Writer) Close(error) {
-	writer.ctx.Close()
-	close(writer.closed)
+	writer.closeOnce.Do(func() {
+		writer.lock.Lock()
+		writer.isClosed = true
+		writer.finishPart()
+		for _, p := range []**av.Packet{&writer.metadata, &writer.videoSeq, &writer.audioSeq} {
+			(*p).Release()
+			*p = nil
+		}
+		writer.lock.Unlock()
+		close(writer.closed)
+	})
 }
 
 // Info return the info
@@ -163,23 +400,31 @@ func (f *Dvr) Writer(info av.Info) av.WriteCloser {
 		return nil
 	}
 
-	flvDir := configure.Config.GetString("flv_dir")
-
-	err := os.MkdirAll(path.Join(flvDir, paths[0]), 0755)
-	if err != nil {
-		log.Error("mkdir error: ", err)
-		return nil
+	tmpl := configure.Config.GetString("flv_path_template")
+	if tmpl == "" {
+		tmpl = DefaultPathTemplate
 	}
 
-	fileName := fmt.Sprintf("%s_%d.%s", path.Join(flvDir, info.Key), time.Now().Unix(), "flv")
-	log.Debug("flv dvr save stream to: ", fileName)
-	w, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		log.Error("open file error: ", err)
+	writer := &Writer{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:            uid.NewID(),
+		app:            paths[0],
+		title:          paths[1],
+		url:            info.URL,
+		closed:         make(chan struct{}),
+		buf:            make([]byte, headerLen),
+		record:         true,
+		publisher:      info.UID,
+		pathTmpl:       tmpl,
+		rotateDuration: uint32(configure.Config.GetInt("flv_rotate_duration")) * 1000,
+		rotateSize:     configure.Config.GetInt64("flv_rotate_size"),
+	}
+	if err := writer.openPart(); err != nil {
+		log.Error("open flv file error: ", err)
 		return nil
 	}
 
-	writer := NewWriter(paths[0], paths[1], info.URL, w)
 	log.Debug("new flv dvr: ", writer.Info())
 	return writer
 }
@@ -0,0 +1,128 @@
+package flv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+var (
+	// ErrInvalidHeader means the data does not start with a flv header
+	ErrInvalidHeader = fmt.Errorf("invalid flv header")
+)
+
+// Reader reads packets from a flv file or a flv stream
+type Reader struct {
+	r          io.Reader
+	demuxer    Demuxer
+	gotHeader  bool
+	tagOffset  int64
+	buf        []byte
+	HasVideo   bool
+	HasAudio   bool
+	TotalBytes int64
+}
+
+// NewReader returns a Reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:       r,
+		demuxer: NewDemuxer(),
+		buf:     make([]byte, headerLen),
+	}
+}
+
+// NewTagReader returns a Reader reading from the middle of a flv,
+// r must be positioned at the beginning of a tag
+func NewTagReader(r io.Reader) *Reader {
+	reader := NewReader(r)
+	reader.gotHeader = true
+	return reader
+}
+
+// TagOffset returns the offset of the last tag read, relative to
+// where the reader started
+func (reader *Reader) TagOffset() int64 {
+	return reader.tagOffset
+}
+
+// readHeader reads the flv header and the first previous tag size
+func (reader *Reader) readHeader() error {
+	h := reader.buf[:9]
+	if _, err := io.ReadFull(reader.r, h); err != nil {
+		return err
+	}
+	if h[0] != 'F' || h[1] != 'L' || h[2] != 'V' {
+		return ErrInvalidHeader
+	}
+	reader.HasAudio = h[4]&0x04 != 0
+	reader.HasVideo = h[4]&0x01 != 0
+	offset := int64(pio.U32BE(h[5:9]))
+	if offset < 9 {
+		return ErrInvalidHeader
+	}
+	// skip the rest of header and the previous tag size 0
+	if _, err := io.CopyN(ioutil.Discard, reader.r, offset-9+4); err != nil {
+		return err
+	}
+	reader.TotalBytes += offset + 4
+	reader.gotHeader = true
+	return nil
+}
+
+// Read reads the next audio, video or metadata tag into p,
+// p.Data holds the whole tag body like packets read from rtmp
+func (reader *Reader) Read(p *av.Packet) error {
+	if !reader.gotHeader {
+		if err := reader.readHeader(); err != nil {
+			return err
+		}
+	}
+	for {
+		offset := reader.TotalBytes
+		h := reader.buf[:headerLen]
+		if _, err := io.ReadFull(reader.r, h); err != nil {
+			return err
+		}
+		typeID := pio.U8(h[0:1]) & 0x1f
+		dataLen := pio.U24BE(h[1:4])
+		timestamp := pio.U24BE(h[4:7]) | uint32(h[7])<<24
+
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(reader.r, data); err != nil {
+			return err
+		}
+		// previous tag size
+		if _, err := io.ReadFull(reader.r, reader.buf[:4]); err != nil {
+			return err
+		}
+		reader.TotalBytes += int64(headerLen + dataLen + 4)
+
+		switch typeID {
+		case av.TagAudio, av.TagVideo, av.TagScriptDataAMF0, av.TagScriptDataAMF3:
+		default:
+			continue
+		}
+		if dataLen == 0 {
+			continue
+		}
+
+		reader.tagOffset = offset
+		*p = av.Packet{
+			IsAudio:    typeID == av.TagAudio,
+			IsVideo:    typeID == av.TagVideo,
+			IsMetadata: typeID == av.TagScriptDataAMF0 || typeID == av.TagScriptDataAMF3,
+			TimeStamp:  timestamp,
+			Data:       data,
+		}
+		if !p.IsMetadata {
+			if err := reader.demuxer.DemuxH(p); err != nil {
+				continue
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderReadWriterOutput(t *testing.T) {
+	at := assert.New(t)
+	f, err := ioutil.TempFile("", "livego-reader")
+	at.Nil(err)
+	defer os.Remove(f.Name())
+
+	w := NewWriter("live", "test", "", f)
+	at.Nil(w.Write(newTestPacket(true, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}, 0)))
+	at.Nil(w.Write(newTestPacket(false, []byte{0xaf, 0x00, 0x12, 0x10}, 0)))
+	at.Nil(w.Write(newTestPacket(true, []byte{0x27, 0x01, 0x00, 0x00, 0x21, 0x02}, 0x01000040)))
+	w.Close(nil)
+
+	f, err = os.Open(f.Name())
+	at.Nil(err)
+	defer f.Close()
+	r := NewReader(f)
+
+	var p av.Packet
+	at.Nil(r.Read(&p))
+	at.True(p.IsVideo)
+	vh := p.Header.(av.VideoPacketHeader)
+	at.True(vh.IsSeq())
+
+	at.Nil(r.Read(&p))
+	at.True(p.IsAudio)
+	ah := p.Header.(av.AudioPacketHeader)
+	at.Equal(uint8(av.SoundAAC), ah.SoundFormat())
+	at.Equal(uint8(av.AACSeqHeader), ah.AACPacketType())
+	at.Equal([]byte{0xaf, 0x00, 0x12, 0x10}, p.Data)
+
+	at.Nil(r.Read(&p))
+	vh = p.Header.(av.VideoPacketHeader)
+	at.False(vh.IsKeyFrame())
+	at.Equal(int32(0x21), vh.CompositionTime())
+	at.Equal(uint32(0x01000040), p.TimeStamp)
+
+	at.Equal(io.EOF, r.Read(&p))
+}
+
+func TestReaderInvalidHeader(t *testing.T) {
+	at := assert.New(t)
+	r := NewReader(bytes.NewReader([]byte("GIF89a\x00\x00\x00\x00\x00\x00\x00")))
+	var p av.Packet
+	at.Equal(ErrInvalidHeader, r.Read(&p))
+}
+
+func TestWriteClip(t *testing.T) {
+	at := assert.New(t)
+	buf := bytes.NewBuffer(nil)
+	at.Nil(WriteClip(buf,
+		newTestPacket(true, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}, 100),
+		newTestPacket(true, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}, 100)))
+
+	r := NewReader(buf)
+	var p av.Packet
+	at.Nil(r.Read(&p))
+	at.True(p.Header.(av.VideoPacketHeader).IsSeq())
+	at.Nil(r.Read(&p))
+	at.True(p.Header.(av.VideoPacketHeader).IsKeyFrame())
+	at.Equal(uint32(0), p.TimeStamp)
+	at.Equal(io.EOF, r.Read(&p))
+}
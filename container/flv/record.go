@@ -0,0 +1,167 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPathTemplate keeps the historical flv_dir/APP/KEY_UNIXTIME.flv layout
+	DefaultPathTemplate = "{app}/{stream}_{unix}.flv"
+)
+
+var (
+	// ErrInvalidRecordFile means the file is out of flv_dir
+	ErrInvalidRecordFile = fmt.Errorf("invalid record file")
+)
+
+// RecordInfo describes a finished record file
+type RecordInfo struct {
+	App       string    `json:"app"`
+	Stream    string    `json:"stream"`
+	UID       string    `json:"uid"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	Seq       int       `json:"seq"`
+	Size      int64     `json:"size"`
+	Duration  uint32    `json:"duration"` // ms
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// RecordDoneHandler is called when a record file is closed
+type RecordDoneHandler func(RecordInfo)
+
+var (
+	recordDoneLock     sync.RWMutex
+	recordDoneHandlers []RecordDoneHandler
+)
+
+// OnRecordDone registers a handler which is called with every finished record file
+func OnRecordDone(h RecordDoneHandler) {
+	recordDoneLock.Lock()
+	recordDoneHandlers = append(recordDoneHandlers, h)
+	recordDoneLock.Unlock()
+}
+
+// notifyRecordDone runs the registered handlers and posts the record
+// information to the on_record_done url if it is configured
+func notifyRecordDone(info RecordInfo) {
+	log.Debugf("record done: %+v", info)
+
+	recordDoneLock.RLock()
+	handlers := recordDoneHandlers
+	recordDoneLock.RUnlock()
+	for _, h := range handlers {
+		h(info)
+	}
+
+	callback := configure.Config.GetString("on_record_done")
+	if callback == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(info)
+		if err != nil {
+			log.Warning("on_record_done marshal error: ", err)
+			return
+		}
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(callback, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Warning("on_record_done callback error: ", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Warningf("on_record_done callback %s returns %s", callback, resp.Status)
+		}
+	}()
+}
+
+// FormatRecordPath expands the record path template.
+// {app}, {stream}, {uid}, {seq} and {unix} are replaced by the application,
+// the stream name, the publisher UID, the part number and the unix time,
+// strftime fields (%Y %m %d %H %M %S %j %s %%) are replaced by t.
+// The names are inserted after the strftime fields with '%' and '/'
+// escaped, so that they are never expanded or split into directories.
+func FormatRecordPath(tmpl, app, stream, uid string, seq int, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i == len(tmpl)-1 {
+			b.WriteByte(tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(tmpl[i])
+		}
+	}
+
+	r := strings.NewReplacer(
+		"{app}", escapeRecordName(app),
+		"{stream}", escapeRecordName(stream),
+		"{uid}", escapeRecordName(uid),
+		"{seq}", strconv.Itoa(seq),
+		"{unix}", strconv.FormatInt(t.Unix(), 10),
+	)
+	return path.Clean(r.Replace(b.String()))
+}
+
+var recordNameEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "\\", "%5C")
+
+// escapeRecordName escapes name to a single path element
+func escapeRecordName(name string) string {
+	name = recordNameEscaper.Replace(name)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return name
+}
+
+// ResolveRecordFile resolves name to a file under flv_dir,
+// names escaping flv_dir are rejected
+func ResolveRecordFile(name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) {
+		return "", ErrInvalidRecordFile
+	}
+	dir := configure.Config.GetString("flv_dir")
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidRecordFile
+	}
+	return file, nil
+}
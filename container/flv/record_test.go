@@ -0,0 +1,187 @@
+package flv
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatRecordPath(t *testing.T) {
+	at := assert.New(t)
+	tm := time.Date(2020, 7, 3, 9, 5, 1, 0, time.UTC)
+
+	at.Equal("live/movie_1593767101.flv",
+		FormatRecordPath(DefaultPathTemplate, "live", "movie", "uid", 0, tm))
+	at.Equal("live/2020/07/03/movie-090501-abc-2.flv",
+		FormatRecordPath("{app}/%Y/%m/%d/{stream}-%H%M%S-{uid}-{seq}.flv", "live", "movie", "abc", 2, tm))
+	at.Equal("live/movie_%q_100%.flv",
+		FormatRecordPath("{app}/{stream}_%q_100%%.flv", "live", "movie", "", 0, tm))
+
+	// the names are never expanded nor split into directories
+	at.Equal("live/100%25Y_1593767101.flv",
+		FormatRecordPath(DefaultPathTemplate, "live", "100%Y", "uid", 0, tm))
+	at.Equal("live/..%2F..%2Fetc%2Fpasswd_1593767101.flv",
+		FormatRecordPath(DefaultPathTemplate, "live", "../../etc/passwd", "uid", 0, tm))
+	at.Equal("%2E%2E/%2E_1593767101.flv",
+		FormatRecordPath(DefaultPathTemplate, "..", ".", "uid", 0, tm))
+	at.Equal("%2E%2E",
+		FormatRecordPath("{stream}", "live", "..", "uid", 0, tm))
+
+	// a template out of flv_dir is rejected
+	_, err := ResolveRecordFile(FormatRecordPath("../{stream}.flv", "live", "movie", "uid", 0, tm))
+	at.Equal(ErrInvalidRecordFile, err)
+	_, err = ResolveRecordFile(FormatRecordPath("{app}/{stream}.flv", "..", "..", "uid", 0, tm))
+	at.Nil(err)
+}
+
+func newTestPacket(isVideo bool, data []byte, timestamp uint32) *av.Packet {
+	p := &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		TimeStamp: timestamp,
+		Data:      data,
+	}
+	var tag Tag
+	tag.ParseMediaTagHeader(data, isVideo)
+	p.Header = &tag
+	return p
+}
+
+func TestDvrRotate(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "livego-dvr")
+	at.Nil(err)
+	defer os.RemoveAll(dir)
+
+	configure.Config.Set("flv_dir", dir)
+	configure.Config.Set("flv_path_template", "{app}/{stream}-{seq}.flv")
+	configure.Config.Set("flv_rotate_duration", 2)
+	defer configure.Config.Set("flv_rotate_duration", 0)
+
+	defer func(handlers []RecordDoneHandler) {
+		recordDoneHandlers = handlers
+	}(recordDoneHandlers)
+	var done []RecordInfo
+	OnRecordDone(func(info RecordInfo) {
+		done = append(done, info)
+	})
+
+	w := new(Dvr).Writer(av.Info{Key: "live/test", UID: "publisher"})
+	at.NotNil(w)
+
+	seq := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}
+	key := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}
+	inter := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03}
+	at.Nil(w.Write(newTestPacket(true, seq, 0)))
+	for ts := uint32(0); ts <= 5000; ts += 500 {
+		data := inter
+		if ts%1000 == 0 {
+			data = key
+		}
+		at.Nil(w.Write(newTestPacket(true, data, ts)))
+	}
+	w.Close(nil)
+
+	at.Equal(3, len(done))
+	for i, info := range done {
+		at.Equal(i, info.Seq)
+		at.Equal("publisher", info.UID)
+		at.Equal(path.Join(dir, "live", "test-"+string('0'+rune(i))+".flv"), info.Path)
+		st, err := os.Stat(info.Path)
+		at.Nil(err)
+		at.Equal(st.Size(), info.Size)
+	}
+	at.Equal(uint32(1500), done[0].Duration)
+	at.Equal(uint32(1000), done[2].Duration)
+
+	// every part starts with the sequence header at the timestamp of its key frame
+	b, err := ioutil.ReadFile(done[1].Path)
+	at.Nil(err)
+	tagStart := len(flvHeader) + 4
+	at.Equal(byte(av.TagVideo), b[tagStart])
+	at.Equal([]byte{0x00, 0x07, 0xd0, 0x00}, b[tagStart+4:tagStart+8])
+	at.Equal(seq, b[tagStart+headerLen:tagStart+headerLen+len(seq)])
+}
+
+func TestDvrRotateError(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "livego-dvr")
+	at.Nil(err)
+	defer os.RemoveAll(dir)
+
+	defer configure.Config.Set("flv_dir", configure.Config.GetString("flv_dir"))
+	configure.Config.Set("flv_dir", dir)
+	configure.Config.Set("flv_path_template", "{app}/{stream}-{seq}.flv")
+	configure.Config.Set("flv_rotate_duration", 1)
+	defer configure.Config.Set("flv_rotate_duration", 0)
+
+	defer func(handlers []RecordDoneHandler) {
+		recordDoneHandlers = handlers
+	}(recordDoneHandlers)
+	var done []RecordInfo
+	OnRecordDone(func(info RecordInfo) {
+		done = append(done, info)
+	})
+
+	w := new(Dvr).Writer(av.Info{Key: "live/test", UID: "publisher"})
+	at.NotNil(w)
+	key := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}
+	at.Nil(w.Write(newTestPacket(true, key, 0)))
+
+	// the next part can not be created
+	at.Nil(ioutil.WriteFile(path.Join(dir, "file"), nil, 0644))
+	configure.Config.Set("flv_dir", path.Join(dir, "file"))
+	at.NotNil(w.Write(newTestPacket(true, key, 1000)))
+	w.Close(nil)
+	w.Close(nil)
+	at.Equal(1, len(done))
+	at.Equal(ErrWriterClosed, w.Write(newTestPacket(true, key, 2000)))
+}
+
+// countRecycler counts the packets given back
+type countRecycler struct {
+	put int
+}
+
+func (r *countRecycler) Put(b []byte) {
+	r.put++
+}
+
+func TestDvrRelease(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "livego-dvr")
+	at.Nil(err)
+	defer os.RemoveAll(dir)
+
+	defer configure.Config.Set("flv_dir", configure.Config.GetString("flv_dir"))
+	configure.Config.Set("flv_dir", dir)
+	configure.Config.Set("flv_path_template", "{app}/{stream}-{seq}.flv")
+
+	r := &countRecycler{}
+	shared := func(isVideo bool, data []byte) *av.Packet {
+		p := newTestPacket(isVideo, data, 0)
+		p.Share(r)
+		return p
+	}
+	w := new(Dvr).Writer(av.Info{Key: "live/test", UID: "publisher"})
+	at.NotNil(w)
+	for _, p := range []*av.Packet{
+		shared(true, []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}),
+		shared(false, []byte{0xaf, 0x00, 0x12, 0x10}),
+		shared(true, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}),
+	} {
+		at.Nil(w.Write(p))
+		p.Release()
+	}
+	// the sequence headers are kept for the next part
+	at.Equal(1, r.put)
+	w.Close(nil)
+	at.Equal(3, r.put)
+}
@@ -164,7 +164,7 @@ func (tag *Tag) parseAudioHeader(b []byte) (n int, err error) {
 	tag.mediat.soundType = flags & 0x1
 	n++
 	switch tag.mediat.soundFormat {
-	case av.SoundAAC:
+	case av.SoundAAC, av.SoundOpus:
 		tag.mediat.aacPacketType = b[1]
 		n++
 	}
@@ -0,0 +1,128 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+const (
+	timeScale     = 1000
+	frameDuration = 40 // ms
+)
+
+var (
+	// ErrEmptyFrame means there is no frame data
+	ErrEmptyFrame = fmt.Errorf("empty frame")
+)
+
+// matrix is the unity matrix of mvhd and tkhd
+var matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	pio.PutU16BE(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	pio.PutU32BE(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// box returns a box of typ with payloads
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, u32(uint32(size))...)
+	b = append(b, typ...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox returns a box with version and flags
+func fullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	vf := u32(flags)
+	vf[0] = version
+	return box(typ, append([][]byte{vf}, payloads...)...)
+}
+
+func matrixBytes() []byte {
+	b := make([]byte, 0, 36)
+	for _, v := range matrix {
+		b = append(b, u32(v)...)
+	}
+	return b
+}
+
+// moov returns the movie box describing one h264 sample at offset
+func moov(avcC []byte, sampleSize, width, height int, offset uint32) []byte {
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(timeScale), u32(frameDuration),
+		u32(0x00010000), u16(0x0100), zeros(10), matrixBytes(), zeros(24),
+		u32(2))
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(1), zeros(4), u32(frameDuration),
+		zeros(8), u16(0), u16(0), u16(0), zeros(2), matrixBytes(),
+		u32(uint32(width)<<16), u32(uint32(height)<<16))
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0), u32(timeScale), u32(frameDuration), u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0,
+		u32(0), []byte("vide"), zeros(12), []byte("VideoHandler\x00"))
+	vmhd := fullBox("vmhd", 0, 1, zeros(8))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+
+	avc1 := box("avc1",
+		zeros(6), u16(1), zeros(16),
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1),
+		zeros(32), u16(0x0018), u16(0xffff),
+		box("avcC", avcC))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), avc1),
+		fullBox("stts", 0, 0, u32(1), u32(1), u32(frameDuration)),
+		fullBox("stss", 0, 0, u32(1), u32(1)),
+		fullBox("stsc", 0, 0, u32(1), u32(1), u32(1), u32(1)),
+		fullBox("stsz", 0, 0, u32(0), u32(1), u32(uint32(sampleSize))),
+		fullBox("stco", 0, 0, u32(1), u32(offset)))
+
+	return box("moov",
+		mvhd,
+		box("trak",
+			tkhd,
+			box("mdia",
+				mdhd,
+				hdlr,
+				box("minf", vmhd, dinf, stbl))))
+}
+
+// WriteFrame writes an mp4 file with a single h264 key frame,
+// avcC is the AVCDecoderConfigurationRecord and sample is the frame
+// in length prefixed nalus, as they are carried in flv
+func WriteFrame(w io.Writer, avcC, sample []byte, width, height int) error {
+	if len(avcC) == 0 || len(sample) == 0 {
+		return ErrEmptyFrame
+	}
+	ftyp := box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2avc1mp41"))
+	// the size of moov does not depend on the offset
+	offset := len(ftyp) + len(moov(avcC, len(sample), width, height, 0)) + 8
+	m := moov(avcC, len(sample), width, height, uint32(offset))
+
+	for _, b := range [][]byte{ftyp, m, u32(uint32(len(sample) + 8)), []byte("mdat"), sample} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
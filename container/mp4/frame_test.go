@@ -0,0 +1,42 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gwuhaolin/livego/utils/pio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFrame(t *testing.T) {
+	at := assert.New(t)
+	avcC := []byte{0x01, 0x4d, 0x00, 0x1e, 0xff, 0xe1, 0x00, 0x02, 0x67, 0x4d, 0x01, 0x00, 0x01, 0x68}
+	sample := []byte{0x00, 0x00, 0x00, 0x02, 0x65, 0x88}
+
+	w := bytes.NewBuffer(nil)
+	at.Nil(WriteFrame(w, avcC, sample, 720, 576))
+	b := w.Bytes()
+
+	// top level boxes
+	var types []string
+	var offset int
+	for pos := 0; pos < len(b); {
+		size := int(pio.U32BE(b[pos:]))
+		types = append(types, string(b[pos+4:pos+8]))
+		if string(b[pos+4:pos+8]) == "mdat" {
+			offset = pos + 8
+		}
+		pos += size
+	}
+	at.Equal([]string{"ftyp", "moov", "mdat"}, types)
+	at.Equal(sample, b[offset:])
+
+	// stco points to the sample
+	i := bytes.Index(b, []byte("stco"))
+	at.True(i > 0)
+	at.Equal(uint32(offset), pio.U32BE(b[i+12:]))
+	at.True(bytes.Contains(b, append([]byte("avcC"), avcC...)))
+
+	at.Equal(ErrEmptyFrame, WriteFrame(w, nil, sample, 0, 0))
+}
@@ -0,0 +1,483 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+)
+
+const (
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+	streamTypeHEVC = 0x24
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+
+	aacFrameSamples = 1024
+
+	// timestampPeriod is the period of the 33 bits timestamps
+	timestampPeriod = 1 << 33
+	// maxTimestampJump is the max jump of the timestamps which is not a
+	// discontinuity, maxDiscontinuityJump the one after the discontinuity
+	// indicator of the PCR
+	maxTimestampJump     = 10 * 90000
+	maxDiscontinuityJump = 90000
+)
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// pesStream is an elementary stream being reassembled
+type pesStream struct {
+	streamType byte
+	buf        []byte
+}
+
+// Demuxer reads a ts stream and returns its H.264, HEVC and AAC frames as
+// flv packets like the ones read from rtmp, the sequence headers are made
+// from the in-band VPS, SPS, PPS and ADTS headers. The timestamps start
+// at 0 and go on over the wrap around of the 33 bits timestamps and the
+// discontinuities.
+type Demuxer struct {
+	r       io.Reader
+	pkt     [tsPacketLen]byte
+	pmtPID  int
+	pcrPID  int
+	streams map[uint16]*pesStream
+	queue   []*av.Packet
+	demuxer flv.Demuxer
+
+	// params are the VPS, SPS and PPS of the last sequence header
+	params    [3][]byte
+	aacConfig []byte
+
+	// ref is the last DTS extended to 64 bits, base the DTS of the
+	// timestamp 0 and last the last timestamp
+	hasRef        bool
+	ref           int64
+	base          int64
+	last          uint32
+	hasPCR        bool
+	pcr           int64
+	discontinuity bool
+}
+
+// NewDemuxer returns a Demuxer reading from r
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:       r,
+		pmtPID:  -1,
+		pcrPID:  -1,
+		streams: make(map[uint16]*pesStream),
+		demuxer: flv.NewDemuxer(),
+	}
+}
+
+// Read reads the next packet, the frames are returned in the order of
+// their elementary streams in the ts stream
+func (d *Demuxer) Read(p *av.Packet) error {
+	for len(d.queue) == 0 {
+		if err := d.readPacket(); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				d.flush()
+				if len(d.queue) > 0 {
+					break
+				}
+			}
+			return err
+		}
+	}
+	*p = *d.queue[0]
+	d.queue[0] = nil
+	d.queue = d.queue[1:]
+	return nil
+}
+
+// readPacket reads and handles a ts packet
+func (d *Demuxer) readPacket() error {
+	b := d.pkt[:]
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return err
+	}
+	for b[0] != 0x47 {
+		// lost the sync, look for the next sync byte
+		i := bytes.IndexByte(b[1:], 0x47)
+		if i < 0 {
+			if _, err := io.ReadFull(d.r, b); err != nil {
+				return err
+			}
+			continue
+		}
+		n := copy(b, b[i+1:])
+		if _, err := io.ReadFull(d.r, b[n:]); err != nil {
+			return err
+		}
+	}
+
+	pusi := b[1]&0x40 != 0
+	pid := uint16(b[1]&0x1f)<<8 | uint16(b[2])
+	afc := b[3] >> 4 & 0x03
+	payload := b[4:]
+	if afc&0x02 != 0 {
+		n := int(payload[0]) + 1
+		if n > len(payload) {
+			return nil
+		}
+		if int(pid) == d.pcrPID && n > 1 {
+			d.parseAdaptationField(payload[1:n])
+		}
+		payload = payload[n:]
+	}
+	if afc&0x01 == 0 || len(payload) == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == 0:
+		if pusi {
+			d.parsePAT(payload)
+		}
+	case int(pid) == d.pmtPID:
+		if pusi {
+			d.parsePMT(payload)
+		}
+	default:
+		s, ok := d.streams[pid]
+		if !ok {
+			return nil
+		}
+		if pusi {
+			if len(s.buf) > 0 {
+				d.parsePES(s, s.buf)
+			}
+			s.buf = s.buf[:0]
+		} else if len(s.buf) == 0 {
+			// waits for the beginning of a PES
+			return nil
+		}
+		s.buf = append(s.buf, payload...)
+		if len(s.buf) >= 6 {
+			if n := int(s.buf[4])<<8 | int(s.buf[5]); n > 0 && len(s.buf) >= n+6 {
+				d.parsePES(s, s.buf[:n+6])
+				s.buf = s.buf[:0]
+			}
+		}
+	}
+	return nil
+}
+
+// flush parses the PES packets being reassembled
+func (d *Demuxer) flush() {
+	for _, s := range d.streams {
+		if len(s.buf) > 0 {
+			d.parsePES(s, s.buf)
+			s.buf = s.buf[:0]
+		}
+	}
+}
+
+// parseAdaptationField checks the discontinuity indicator and the jumps
+// of the PCR
+func (d *Demuxer) parseAdaptationField(b []byte) {
+	if b[0]&0x80 != 0 {
+		d.discontinuity = true
+	}
+	if b[0]&0x10 == 0 || len(b) < 7 {
+		return
+	}
+	pcr := int64(b[1])<<25 | int64(b[2])<<17 | int64(b[3])<<9 | int64(b[4])<<1 | int64(b[5]>>7)
+	if d.hasPCR {
+		if jump := unwrap(pcr, d.pcr) - d.pcr; jump > maxTimestampJump || jump < -maxTimestampJump {
+			d.discontinuity = true
+		}
+	}
+	d.hasPCR = true
+	d.pcr = pcr
+}
+
+// unwrap returns the 33 bits timestamp ts extended to 64 bits next to ref
+func unwrap(ts, ref int64) int64 {
+	d := (ts - ref) & (timestampPeriod - 1)
+	if d >= timestampPeriod/2 {
+		d -= timestampPeriod
+	}
+	return ref + d
+}
+
+// section returns the section starting in the payload of a packet
+func section(payload []byte) []byte {
+	n := int(payload[0]) + 1
+	if n+3 > len(payload) {
+		return nil
+	}
+	s := payload[n:]
+	l := int(s[1]&0x0f)<<8 | int(s[2]) + 3
+	if l > len(s) || l < 12 {
+		return nil
+	}
+	// without the crc
+	return s[:l-4]
+}
+
+// parsePAT gets the PID of the PMT of the first program
+func (d *Demuxer) parsePAT(payload []byte) {
+	s := section(payload)
+	if s == nil || s[0] != 0x00 {
+		return
+	}
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := int(s[i])<<8 | int(s[i+1])
+		if program != 0 {
+			d.pmtPID = int(s[i+2]&0x1f)<<8 | int(s[i+3])
+			return
+		}
+	}
+}
+
+// parsePMT gets the PCR PID and the H.264, HEVC and AAC streams of the
+// program
+func (d *Demuxer) parsePMT(payload []byte) {
+	s := section(payload)
+	if s == nil || s[0] != 0x02 {
+		return
+	}
+	d.pcrPID = int(s[8]&0x1f)<<8 | int(s[9])
+	infoLen := int(s[10]&0x0f)<<8 | int(s[11])
+	for i := 12 + infoLen; i+5 <= len(s); {
+		streamType := s[i]
+		pid := uint16(s[i+1]&0x1f)<<8 | uint16(s[i+2])
+		esInfoLen := int(s[i+3]&0x0f)<<8 | int(s[i+4])
+		i += 5 + esInfoLen
+		switch streamType {
+		case streamTypeH264, streamTypeHEVC, streamTypeAAC:
+			if _, ok := d.streams[pid]; !ok {
+				d.streams[pid] = &pesStream{streamType: streamType}
+			}
+		}
+	}
+}
+
+// readTimestamp reads a 33 bits PTS or DTS
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// parsePES parses a PES packet into packets
+func (d *Demuxer) parsePES(s *pesStream, b []byte) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return
+	}
+	flags := b[7] >> 6
+	hlen := int(b[8])
+	if 9+hlen > len(b) || flags&0x02 == 0 || hlen < 5 {
+		return
+	}
+	pts := readTimestamp(b[9:])
+	dts := pts
+	if flags == 0x03 && hlen >= 10 {
+		dts = readTimestamp(b[14:])
+	}
+	data := b[9+hlen:]
+	dts, pts = d.extend(dts, pts)
+	switch s.streamType {
+	case streamTypeH264, streamTypeHEVC:
+		d.parseVideo(s.streamType == streamTypeHEVC, data, pts, dts)
+	case streamTypeAAC:
+		d.parseAAC(data, pts)
+	}
+}
+
+// extend extends the 33 bits DTS and PTS to 64 bits, after a
+// discontinuity the timestamps are rebased to go on from the last one
+func (d *Demuxer) extend(dts, pts int64) (int64, int64) {
+	if !d.hasRef {
+		d.hasRef = true
+		d.ref = dts
+		d.base = dts
+	}
+	max := int64(maxTimestampJump)
+	if d.discontinuity {
+		max = maxDiscontinuityJump
+	}
+	if jump := unwrap(dts, d.ref) - d.ref; jump > max || jump < -max {
+		d.ref = dts
+		d.base = dts - int64(d.last)*h264DefaultHZ
+	}
+	d.discontinuity = false
+	d.ref = unwrap(dts, d.ref)
+	return d.ref, unwrap(pts, d.ref)
+}
+
+// timestamp returns the timestamp in ms of a 90 kHz timestamp
+func (d *Demuxer) timestamp(ts int64) uint32 {
+	if ts < d.base {
+		return 0
+	}
+	return uint32((ts - d.base) / h264DefaultHZ)
+}
+
+// push queues a flv packet
+func (d *Demuxer) push(isVideo bool, ts uint32, data []byte) {
+	p := &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		TimeStamp: ts,
+		Data:      data,
+	}
+	if err := d.demuxer.DemuxH(p); err != nil {
+		return
+	}
+	if ts > d.last {
+		d.last = ts
+	}
+	d.queue = append(d.queue, p)
+}
+
+// splitNALUs returns the NAL units of an Annex-B access unit
+func splitNALUs(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && b[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, b[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return nalus
+}
+
+// parseVideo queues the sequence header if the parameter sets changed,
+// then the frame of the H.264 or HEVC access unit
+func (d *Demuxer) parseVideo(hevc bool, data []byte, pts, dts int64) {
+	var params [3][]byte
+	key := false
+	body := make([]byte, 5, len(data)+16)
+	for _, nalu := range splitNALUs(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		param := -1
+		if hevc {
+			switch typ := nalu[0] >> 1 & 0x3f; {
+			case typ == hevcNaluTypeVPS:
+				param = 0
+			case typ == hevcNaluTypeSPS:
+				param = 1
+			case typ == hevcNaluTypePPS:
+				param = 2
+			case typ == hevcNaluTypeAUD:
+				continue
+			case typ >= hevcNaluTypeIRAPFirst && typ <= hevcNaluTypeIRAPLast:
+				key = true
+			}
+		} else {
+			switch nalu[0] & 0x1f {
+			case naluTypeSPS:
+				param = 1
+			case naluTypePPS:
+				param = 2
+			case naluTypeAUD:
+				continue
+			case naluTypeIDR:
+				key = true
+			}
+		}
+		if param >= 0 {
+			params[param] = nalu
+			continue
+		}
+		n := len(nalu)
+		body = append(body, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		body = append(body, nalu...)
+	}
+	ts := d.timestamp(dts)
+	if params[1] != nil && params[2] != nil && (!hevc || params[0] != nil) &&
+		(!bytes.Equal(params[0], d.params[0]) || !bytes.Equal(params[1], d.params[1]) ||
+			!bytes.Equal(params[2], d.params[2])) {
+		if header := sequenceHeader(hevc, params); header != nil {
+			for i := range params {
+				d.params[i] = append([]byte(nil), params[i]...)
+			}
+			d.push(true, ts, header)
+		}
+	}
+	if d.params[1] == nil || len(body) == 5 {
+		return
+	}
+	codec := byte(av.VideoH264)
+	if hevc {
+		codec = av.VideoH265
+	}
+	body[0] = 0x20 | codec
+	if key {
+		body[0] = 0x10 | codec
+	}
+	body[1] = 1
+	cts := int32((pts - dts) / h264DefaultHZ)
+	body[2], body[3], body[4] = byte(cts>>16), byte(cts>>8), byte(cts)
+	d.push(true, ts, body)
+}
+
+// sequenceHeader returns the flv body of the sequence header of the
+// parameter sets, nil if they are invalid
+func sequenceHeader(hevc bool, params [3][]byte) []byte {
+	if hevc {
+		header, err := hevcSequenceHeader(params[0], params[1], params[2])
+		if err != nil {
+			return nil
+		}
+		return header
+	}
+	if len(params[1]) < 4 {
+		return nil
+	}
+	return h264.SequenceHeader(params[1], params[2])
+}
+
+// parseAAC queues the sequence header if the ADTS configuration changed,
+// then the frames of the PES
+func (d *Demuxer) parseAAC(data []byte, pts int64) {
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return
+		}
+		profile := data[2] >> 6
+		rateIndex := data[2] >> 2 & 0x0f
+		channels := (data[2]&0x01)<<2 | data[3]>>6
+		frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		headerLen := 7
+		if data[1]&0x01 == 0 {
+			headerLen = 9
+		}
+		if frameLen < headerLen || frameLen > len(data) || int(rateIndex) >= len(aacSampleRates) {
+			return
+		}
+		ts := d.timestamp(pts + int64(i*aacFrameSamples*90000/aacSampleRates[rateIndex]))
+		config := []byte{(profile+1)<<3 | rateIndex>>1, (rateIndex&0x01)<<7 | channels<<3}
+		if !bytes.Equal(config, d.aacConfig) {
+			d.aacConfig = config
+			d.push(false, ts, append([]byte{0xaf, 0x00}, config...))
+		}
+		body := make([]byte, 2, frameLen-headerLen+2)
+		body[0], body[1] = 0xaf, 0x01
+		d.push(false, ts, append(body, data[headerLen:frameLen]...))
+		data = data[frameLen:]
+	}
+}
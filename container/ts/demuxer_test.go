@@ -0,0 +1,321 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func flvPacket(isVideo bool, ts uint32, data ...byte) *av.Packet {
+	p := &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, TimeStamp: ts, Data: data}
+	flv.NewDemuxer().DemuxH(p)
+	return p
+}
+
+func TestStreamMuxerDemuxer(t *testing.T) {
+	at := assert.New(t)
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	vseq := h264.SequenceHeader(sps, pps)
+	idr := bytes.Repeat([]byte{0x65, 0x88, 0x84}, 100)
+	in := []*av.Packet{
+		flvPacket(true, 0, vseq...),
+		flvPacket(false, 0, 0xaf, 0x00, 0x12, 0x10),
+		flvPacket(true, 0, append([]byte{0x17, 0x01, 0, 0, 0, 0, 0, 1, 44}, idr...)...),
+		flvPacket(false, 10, 0xaf, 0x01, 0x21, 0x10, 0x04),
+		flvPacket(true, 40, 0x27, 0x01, 0, 0, 40, 0, 0, 0, 3, 0x41, 0x9a, 0x02),
+		flvPacket(false, 33, 0xaf, 0x01, 0x21, 0x10, 0x05),
+	}
+
+	var b bytes.Buffer
+	m := NewStreamMuxer()
+	for i, p := range in {
+		if i == 2 {
+			// dropped until the first key frame
+			at.Nil(m.Mux(flvPacket(false, 0, 0xaf, 0x01, 0x01), &b))
+			at.Equal(0, b.Len())
+		}
+		at.Nil(m.Mux(p, &b))
+	}
+	at.Equal(0, b.Len()%tsPacketLen)
+
+	d := NewDemuxer(&b)
+	var out []*av.Packet
+	for {
+		var p av.Packet
+		if err := d.Read(&p); err != nil {
+			at.Equal(io.EOF, err)
+			break
+		}
+		out = append(out, &p)
+	}
+	if at.Len(out, 6) {
+		at.Equal(vseq, out[0].Data)
+		at.Equal(in[2].Data, out[1].Data)
+		at.True(av.IsKeyFrame(out[1]))
+		at.Equal(in[1].Data, out[2].Data)
+		for i, j := range []int{3, 4, 5} {
+			at.Equal(in[j].Data, out[3+i].Data)
+			at.Equal(in[j].TimeStamp, out[3+i].TimeStamp)
+		}
+		at.Equal(int32(40), out[4].Header.(av.VideoPacketHeader).CompositionTime())
+	}
+}
+
+// writeTS writes data in ts packets of pid, the first one with the
+// adaptation field af if it is not nil
+func writeTS(w *bytes.Buffer, pid uint16, cc *byte, af []byte, data []byte) {
+	for first := true; len(data) > 0; first = false {
+		h := []byte{0x47, byte(pid >> 8), byte(pid), 0x10 | *cc&0x0f}
+		*cc++
+		var body []byte
+		if first {
+			h[1] |= 0x40
+			body = af
+		}
+		min := 0
+		if body != nil {
+			min = 1 + len(body)
+		}
+		n := len(data)
+		if n > tsPacketLen-4-min {
+			n = tsPacketLen - 4 - min
+		}
+		if l := tsPacketLen - 4 - n; l > 0 {
+			h[3] |= 0x20
+			field := []byte{byte(l - 1)}
+			if l > 1 {
+				if body == nil {
+					body = []byte{0x00}
+				}
+				field = append(field, body...)
+				for len(field) < l {
+					field = append(field, 0xff)
+				}
+			}
+			h = append(h, field...)
+		}
+		w.Write(h)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+// appendTimestamp appends a 33 bits PTS or DTS
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	ts &= timestampPeriod - 1
+	return append(b, prefix<<4|byte(ts>>29)&0x0e|1, byte(ts>>22), byte(ts>>14)|1, byte(ts>>7), byte(ts<<1)|1)
+}
+
+// pes returns a PES packet of a video stream
+func pes(pts, dts int64, data []byte) []byte {
+	b := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5}
+	if pts == dts {
+		b = appendTimestamp(b, 0x02, pts)
+	} else {
+		b[7], b[8] = 0xc0, 10
+		b = appendTimestamp(b, 0x03, pts)
+		b = appendTimestamp(b, 0x01, dts)
+	}
+	return append(b, data...)
+}
+
+// pcrField returns an adaptation field with the PCR pcr
+func pcrField(pcr int64, discontinuity bool) []byte {
+	b := []byte{0x10, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7e, 0}
+	if discontinuity {
+		b[0] |= 0x80
+	}
+	return b
+}
+
+// psi returns the PAT and the PMT of a video stream of streamType
+func psi(streamType byte) []byte {
+	m := NewMuxer()
+	b := append([]byte(nil), m.PAT()...)
+	pmt := append([]byte(nil), m.PMT(av.SoundAAC, true)...)
+	pmt[17] = streamType
+	crc := GenCrc32(pmt[5:27])
+	pmt[27], pmt[28], pmt[29], pmt[30] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	return append(b, pmt...)
+}
+
+// readAll reads the packets of d
+func readAll(t *testing.T, d *Demuxer) []*av.Packet {
+	var out []*av.Packet
+	for {
+		var p av.Packet
+		if err := d.Read(&p); err != nil {
+			assert.Equal(t, io.EOF, err)
+			return out
+		}
+		out = append(out, &p)
+	}
+}
+
+var (
+	h264Params = []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80}
+	h264IDR    = []byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x21}
+	h264Inter  = []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}
+)
+
+// h264Frames returns the ts of n H.264 frames every 40 ms from the DTS
+// start, the PCR jumps to pcr with the discontinuity indicator at the
+// frame jump
+func h264Frames(w *bytes.Buffer, cc *byte, start int64, n int, jump int, pcr int64) {
+	dts := start
+	for i := 0; i < n; i++ {
+		data := append(append([]byte(nil), h264Params...), h264IDR...)
+		if i%10 != 0 {
+			data = h264Inter
+		}
+		af := pcrField(dts-9000, false)
+		if i == jump {
+			dts = pcr + 9000
+			af = pcrField(pcr, true)
+		}
+		writeTS(w, 0x100, cc, af, pes(dts+3600, dts, data))
+		dts += 3600
+	}
+}
+
+func TestDemuxerTimestampWrap(t *testing.T) {
+	at := assert.New(t)
+
+	var b bytes.Buffer
+	var cc byte
+	b.Write(psi(streamTypeH264))
+	// crosses the wrap around of the 33 bits timestamps after 1 s
+	h264Frames(&b, &cc, timestampPeriod-90000, 50, -1, 0)
+	out := readAll(t, NewDemuxer(&b))
+	if at.Len(out, 51) {
+		at.True(av.IsSpecial(out[0]))
+		for i, p := range out[1:] {
+			at.Equal(uint32(i*40), p.TimeStamp)
+			at.Equal(int32(40), p.Header.(av.VideoPacketHeader).CompositionTime())
+		}
+	}
+}
+
+func TestDemuxerDiscontinuity(t *testing.T) {
+	at := assert.New(t)
+
+	var b bytes.Buffer
+	var cc byte
+	b.Write(psi(streamTypeH264))
+	// the timestamps go back to 0 with a discontinuity at the frame 20
+	h264Frames(&b, &cc, 900000, 40, 20, 0)
+	out := readAll(t, NewDemuxer(&b))
+	if at.Len(out, 41) {
+		last := uint32(0)
+		for _, p := range out[1:] {
+			at.True(p.TimeStamp >= last, "%d after %d", p.TimeStamp, last)
+			last = p.TimeStamp
+		}
+		at.Equal(uint32(19*40), out[20].TimeStamp)
+		at.Equal(uint32(19*40), out[21].TimeStamp)
+		at.Equal(uint32(20*40), out[22].TimeStamp)
+	}
+}
+
+// bitWriter writes the bits of a rbsp
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	n := 0
+	for (v+1)>>uint(n) > 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v+1, n+1)
+}
+
+// escape adds the emulation prevention bytes
+func escape(b []byte) []byte {
+	var ret []byte
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			ret = append(ret, 3)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+func TestDemuxerHEVC(t *testing.T) {
+	at := assert.New(t)
+
+	ptl := []byte{0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 0x5d}
+	w := &bitWriter{b: append([]byte{0x01}, ptl...), n: 13 * 8}
+	w.ue(0)
+	w.ue(1)
+	w.ue(1920)
+	w.ue(1080)
+	w.bits(0, 1)
+	w.ue(2)
+	w.ue(2)
+	w.bits(1, 1)
+	sps := append([]byte{0x42, 0x01}, escape(w.b)...)
+	vps := []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff}
+	pps := []byte{0x44, 0x01, 0xc1, 0x72}
+	aud := []byte{0x46, 0x01, 0x50}
+	idr := []byte{0x26, 0x01, 0xaf, 0x08}
+	trail := []byte{0x02, 0x01, 0xd0, 0x09}
+
+	annexB := func(nalus ...[]byte) []byte {
+		var b []byte
+		for _, nalu := range nalus {
+			b = append(append(b, 0, 0, 0, 1), nalu...)
+		}
+		return b
+	}
+	var b bytes.Buffer
+	var cc byte
+	b.Write(psi(streamTypeHEVC))
+	writeTS(&b, 0x100, &cc, pcrField(0, false), pes(9000, 9000, annexB(aud, vps, sps, pps, idr)))
+	writeTS(&b, 0x100, &cc, nil, pes(12600, 12600, annexB(aud, trail)))
+
+	out := readAll(t, NewDemuxer(&b))
+	if !at.Len(out, 3) {
+		return
+	}
+	vh := out[0].Header.(av.VideoPacketHeader)
+	at.True(vh.IsSeq())
+	at.Equal(uint8(av.VideoH265), vh.CodecID())
+	record := out[0].Data[5:]
+	at.Equal(ptl, record[1:13])
+	at.Equal([]byte{0xf0, 0x00, 0xfc, 0xfd, 0xfa, 0xfa, 0x00, 0x00, 0x0f, 3}, record[13:23])
+	at.Equal([]byte{0xa0, 0x00, 0x01, 0x00, byte(len(vps))}, record[23:28])
+	at.Equal(vps, record[28:28+len(vps)])
+
+	at.True(av.IsKeyFrame(out[1]))
+	at.Equal(append([]byte{0x1c, 0x01, 0, 0, 0, 0, 0, 0, 4}, idr...), out[1].Data)
+	at.Equal(append([]byte{0x2c, 0x01, 0, 0, 0, 0, 0, 0, 4}, trail...), out[2].Data)
+	at.Equal(uint32(40), out[2].TimeStamp)
+}
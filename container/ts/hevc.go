@@ -0,0 +1,197 @@
+package ts
+
+import (
+	"fmt"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+const (
+	hevcNaluTypeIRAPFirst = 16
+	hevcNaluTypeIRAPLast  = 23
+	hevcNaluTypeVPS       = 32
+	hevcNaluTypeSPS       = 33
+	hevcNaluTypePPS       = 34
+	hevcNaluTypeAUD       = 35
+
+	// hevcPTLLen is the length of the general profile, tier and level
+	hevcPTLLen = 12
+)
+
+var (
+	// ErrInvalidHEVCSPS means the HEVC sps can not be parsed
+	ErrInvalidHEVCSPS = fmt.Errorf("invalid hevc sps")
+)
+
+// hevcSPS is the information of a HEVC sps needed by the decoder
+// configuration record
+type hevcSPS struct {
+	ptl            [hevcPTLLen]byte
+	maxSubLayers   byte
+	temporalNested byte
+	chromaFormat   byte
+	bitDepthLuma   byte
+	bitDepthChroma byte
+}
+
+// bitReader reads exp-golomb coded rbsp
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			return 0, ErrInvalidHEVCSPS
+		}
+		v = v<<1 | uint(r.b[r.pos/8]>>(7-uint(r.pos%8)))&1
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		if zeros++; zeros > 31 {
+			return 0, ErrInvalidHEVCSPS
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return 1<<uint(zeros) - 1 + v, nil
+}
+
+// rbsp removes the emulation prevention bytes
+func rbsp(b []byte) []byte {
+	ret := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// parseHEVCSPS parses a sps nalu, which starts with the nalu header
+func parseHEVCSPS(nalu []byte) (*hevcSPS, error) {
+	if len(nalu) < 3+hevcPTLLen {
+		return nil, ErrInvalidHEVCSPS
+	}
+	b := rbsp(nalu[2:])
+	if len(b) < 1+hevcPTLLen {
+		return nil, ErrInvalidHEVCSPS
+	}
+	sps := &hevcSPS{
+		maxSubLayers:   b[0]>>1&0x07 + 1,
+		temporalNested: b[0] & 0x01,
+	}
+	copy(sps.ptl[:], b[1:])
+	r := &bitReader{b: b, pos: (1 + hevcPTLLen) * 8}
+
+	// the profile and level of the sub layers
+	subLayers := int(sps.maxSubLayers) - 1
+	var present []uint
+	for i := 0; i < subLayers; i++ {
+		v, err := r.bits(2)
+		if err != nil {
+			return nil, err
+		}
+		present = append(present, v)
+	}
+	if subLayers > 0 {
+		r.pos += 2 * (8 - subLayers)
+	}
+	for _, v := range present {
+		if v&0x02 != 0 {
+			r.pos += 88
+		}
+		if v&0x01 != 0 {
+			r.pos += 8
+		}
+	}
+
+	// sps_seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	chroma, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	sps.chromaFormat = byte(chroma)
+	if chroma == 3 {
+		// separate_colour_plane_flag
+		r.pos++
+	}
+	// pic_width_in_luma_samples, pic_height_in_luma_samples
+	for i := 0; i < 2; i++ {
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+	}
+	window, err := r.bits(1)
+	if err != nil {
+		return nil, err
+	}
+	if window == 1 {
+		for i := 0; i < 4; i++ {
+			if _, err := r.ue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	luma, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	chromaDepth, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	sps.bitDepthLuma = byte(luma)
+	sps.bitDepthChroma = byte(chromaDepth)
+	return sps, nil
+}
+
+// hevcSequenceHeader returns the flv body of the HEVC sequence header,
+// whose HEVCDecoderConfigurationRecord has the vps, sps and pps
+func hevcSequenceHeader(vps, sps, pps []byte) ([]byte, error) {
+	info, err := parseHEVCSPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	b := []byte{0x10 | av.VideoH265, 0x00, 0, 0, 0, 0x01}
+	b = append(b, info.ptl[:]...)
+	b = append(b, 0xf0, 0x00, 0xfc,
+		0xfc|info.chromaFormat&0x03,
+		0xf8|info.bitDepthLuma&0x07,
+		0xf8|info.bitDepthChroma&0x07,
+		0x00, 0x00,
+		info.maxSubLayers<<3|info.temporalNested<<2|0x03,
+		3)
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		b = append(b, 0x80|nalu[0]>>1&0x3f, 0x00, 0x01, byte(len(nalu)>>8), byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b, nil
+}
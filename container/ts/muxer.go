@@ -17,8 +17,13 @@ const (
 	audioSID = 0xc0
 )
 
-// Muxer is the ts muxer
+// Muxer is the ts muxer, a PCR is written with every video key frame
+// and, if PCRInterval is set, at least every PCRInterval ms
 type Muxer struct {
+	// PCRInterval is the max interval in ms between two PCR, 0 means a
+	// PCR is only written with the video key frames
+	PCRInterval uint32
+
 	videoCc  byte
 	audioCc  byte
 	patCc    byte
@@ -26,6 +31,10 @@ type Muxer struct {
 	pat      [tsPacketLen]byte
 	pmt      [tsPacketLen]byte
 	tsPacket [tsPacketLen]byte
+
+	audioOnly bool
+	hasPCR    bool
+	pcrTime   int64
 }
 
 // NewMuxer return a Muxer
@@ -55,6 +64,7 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 	if err != nil {
 		return err
 	}
+	pcr := muxer.needPCR(p, videoH, dts)
 	pesHeaderLen := pes.len
 	packetBytesLen := len(p.Data) + int(pesHeaderLen)
 
@@ -100,7 +110,7 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		i++
 
 		//关键帧需要加pcr
-		if first && p.IsVideo && videoH.IsKeyFrame() {
+		if first && pcr {
 			muxer.tsPacket[3] |= 0x20
 			muxer.tsPacket[i] = 7
 			i++
@@ -125,7 +135,15 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 			} else {
 				remainBytes = tsDefaultDataLen - dataLen
 			}
-			muxer.adaptationBufInit(muxer.tsPacket[i:], byte(remainBytes))
+			if i > 4 {
+				// stuffs the adaptation field with the pcr
+				muxer.tsPacket[4] += remainBytes
+				for j := byte(0); j < remainBytes; j++ {
+					muxer.tsPacket[i+j] = 0xff
+				}
+			} else {
+				muxer.adaptationBufInit(muxer.tsPacket[i:], byte(remainBytes))
+			}
 			i += remainBytes
 		}
 		if first && i < tsPacketLen && pesHeaderLen > 0 {
@@ -161,6 +179,23 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 	return nil
 }
 
+// needPCR returns if the first ts packet of p carries a PCR, the PCR is
+// in the packets of the PID the PMT declares
+func (muxer *Muxer) needPCR(p *av.Packet, videoH av.VideoPacketHeader, dts int64) bool {
+	if !(p.IsVideo && videoH.IsKeyFrame()) {
+		if muxer.PCRInterval == 0 || p.IsVideo == muxer.audioOnly {
+			return false
+		}
+		elapsed := dts - muxer.pcrTime
+		if muxer.hasPCR && elapsed >= 0 && elapsed < int64(muxer.PCRInterval)*h264DefaultHZ {
+			return false
+		}
+	}
+	muxer.hasPCR = true
+	muxer.pcrTime = dts
+	return true
+}
+
 // PAT return pat data
 func (muxer *Muxer) PAT() []byte {
 	i := 0
@@ -206,6 +241,7 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	remainBytes := int(0)
 	tsHeader := []byte{0x47, 0x50, 0x01, 0x10, 0x00}
 	pmtHeader := []byte{0x02, 0xb0, 0xff, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
+	muxer.audioOnly = !hasVideo
 	if !hasVideo {
 		pmtHeader[9] = 0x01
 		progInfo = []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
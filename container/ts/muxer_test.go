@@ -51,3 +51,25 @@ func TestTSEncoder(t *testing.T) {
 		0x80, 0x00, 0x5b, 0xb7, 0x78, 0x00, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x38, 0x30, 0x00,
 		0x06, 0x00, 0x38})
 }
+
+func TestMuxerPCRInterval(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	m.PCRInterval = 40
+	m.PMT(av.SoundAAC, false)
+
+	w := &TestWriter{}
+	var pcrs []uint32
+	for ts := uint32(0); ts < 200; ts += 20 {
+		p := av.Packet{
+			IsAudio:   true,
+			TimeStamp: ts,
+			Data:      []byte{0xaf, 0x01, 0x21},
+		}
+		at.Nil(m.Mux(&p, w))
+		if w.buf[3]&0x20 != 0 && w.buf[5]&0x10 != 0 {
+			pcrs = append(pcrs, ts)
+		}
+	}
+	at.Equal([]uint32{0, 40, 80, 120, 160}, pcrs)
+}
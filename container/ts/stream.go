@@ -0,0 +1,107 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser"
+)
+
+const (
+	// psiInterval is the max interval in ms between two PAT and PMT
+	psiInterval = 100
+	// pcrInterval is the max interval in ms between two PCR
+	pcrInterval = 40
+)
+
+// StreamMuxer muxes the flv packets of a stream into a continuous ts
+// stream, the PAT and PMT are written before every key frame and at least
+// every psiInterval, the packets before the first key frame are dropped
+type StreamMuxer struct {
+	muxer       *Muxer
+	demuxer     flv.Demuxer
+	parser      *parser.CodecParser
+	buf         bytes.Buffer
+	hasVideo    bool
+	soundFormat byte
+	started     bool
+	psiTime     uint32
+}
+
+// NewStreamMuxer returns a StreamMuxer
+func NewStreamMuxer() *StreamMuxer {
+	muxer := NewMuxer()
+	muxer.PCRInterval = pcrInterval
+	return &StreamMuxer{
+		muxer:       muxer,
+		demuxer:     flv.NewDemuxer(),
+		parser:      parser.NewCodecParser(),
+		soundFormat: av.SoundAAC,
+	}
+}
+
+// Mux muxes the H.264 or AAC packet p into w, p is not modified and
+// packets of other codecs are skipped
+func (m *StreamMuxer) Mux(p *av.Packet, w io.Writer) error {
+	if p.IsMetadata {
+		return nil
+	}
+	pkt := *p
+	if err := m.demuxer.Demux(&pkt); err != nil {
+		if err == flv.ErrAvcEndSEQ {
+			return nil
+		}
+		return err
+	}
+	key := false
+	if pkt.IsVideo {
+		vh := pkt.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VideoH264 {
+			return nil
+		}
+		m.hasVideo = true
+		if vh.IsSeq() {
+			return m.parser.Parse(&pkt, nil)
+		}
+		key = vh.IsKeyFrame()
+	} else {
+		ah := pkt.Header.(av.AudioPacketHeader)
+		if ah.SoundFormat() != av.SoundAAC {
+			return nil
+		}
+		m.soundFormat = ah.SoundFormat()
+		if ah.AACPacketType() == av.AACSeqHeader {
+			return m.parser.Parse(&pkt, nil)
+		}
+	}
+	if !m.started {
+		if m.hasVideo && !key {
+			return nil
+		}
+		m.started = true
+	}
+
+	m.buf.Reset()
+	if err := m.parser.Parse(&pkt, &m.buf); err != nil {
+		return err
+	}
+	pkt.Data = m.buf.Bytes()
+	if key || pkt.TimeStamp-m.psiTime >= psiInterval || pkt.TimeStamp < m.psiTime {
+		if err := m.writePSI(w, pkt.TimeStamp); err != nil {
+			return err
+		}
+	}
+	return m.muxer.Mux(&pkt, w)
+}
+
+// writePSI writes the PAT and PMT
+func (m *StreamMuxer) writePSI(w io.Writer, ts uint32) error {
+	m.psiTime = ts
+	if _, err := w.Write(m.muxer.PAT()); err != nil {
+		return err
+	}
+	_, err := w.Write(m.muxer.PMT(m.soundFormat, m.hasVideo))
+	return err
+}
@@ -12,6 +12,11 @@ import (
 	"github.com/gwuhaolin/livego/protocol/hls"
 	"github.com/gwuhaolin/livego/protocol/httpflv"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/protocol/rtsp"
+	"github.com/gwuhaolin/livego/protocol/srt"
+	"github.com/gwuhaolin/livego/protocol/udp"
+	"github.com/gwuhaolin/livego/protocol/vod"
+	"github.com/gwuhaolin/livego/protocol/webrtc"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -67,7 +72,7 @@ func startRtmp(stream *rtmp.Streams, hlsServer *hls.Server) {
 	rtmpServer.Serve(rtmpListen)
 }
 
-func startHTTPFlv(stream *rtmp.Streams) {
+func startHTTPFlv(stream *rtmp.Streams, hlsServer *hls.Server) {
 	httpflvAddr := configure.Config.GetString("httpflv_addr")
 
 	flvListen, err := net.Listen("tcp", httpflvAddr)
@@ -75,7 +80,12 @@ func startHTTPFlv(stream *rtmp.Streams) {
 		log.Fatal(err)
 	}
 
-	hdlServer := httpflv.NewServer(stream)
+	var hdlServer *httpflv.Server
+	if hlsServer == nil {
+		hdlServer = httpflv.NewServer(stream, nil)
+	} else {
+		hdlServer = httpflv.NewServer(stream, hlsServer)
+	}
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
@@ -87,7 +97,165 @@ func startHTTPFlv(stream *rtmp.Streams) {
 	}()
 }
 
-func startAPI(stream *rtmp.Streams) {
+func startVOD() {
+	vodAddr := configure.Config.GetString("vod_addr")
+
+	if vodAddr != "" {
+		vodListen, err := net.Listen("tcp", vodAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vodServer := vod.NewServer()
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("VOD server panic: ", r)
+				}
+			}()
+			log.Info("VOD listen On ", vodAddr)
+			vodServer.Serve(vodListen)
+		}()
+	}
+}
+
+func startSRT(stream *rtmp.Streams, hlsServer *hls.Server) {
+	srtAddr := configure.Config.GetString("srt_addr")
+
+	if srtAddr != "" {
+		var srtServer *srt.Server
+		if hlsServer == nil {
+			srtServer = srt.NewServer(stream, nil)
+		} else {
+			srtServer = srt.NewServer(stream, hlsServer)
+		}
+		cfg := srt.ListenConfig{
+			Latency: time.Duration(configure.Config.GetInt("srt_latency")) * time.Millisecond,
+			Check:   srtServer.Check,
+		}
+		srtListen, err := cfg.Listen(srtAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("SRT server panic: ", r)
+				}
+			}()
+			log.Info("SRT listen On ", srtAddr)
+			srtServer.Serve(srtListen)
+		}()
+	}
+}
+
+func startWebRTC(stream *rtmp.Streams, hlsServer *hls.Server) {
+	webrtcAddr := configure.Config.GetString("webrtc_addr")
+
+	if webrtcAddr != "" {
+		webrtcListen, err := net.Listen("tcp", webrtcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var webrtcServer *webrtc.Server
+		if hlsServer == nil {
+			webrtcServer, err = webrtc.NewServer(stream, nil)
+		} else {
+			webrtcServer, err = webrtc.NewServer(stream, hlsServer)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("WebRTC server panic: ", r)
+				}
+			}()
+			log.Info("WebRTC listen On ", webrtcAddr)
+			webrtcServer.Serve(webrtcListen)
+		}()
+	}
+}
+
+func startRTSP(stream *rtmp.Streams, hlsServer *hls.Server) {
+	rtspAddr := configure.Config.GetString("rtsp_addr")
+
+	if rtspAddr != "" {
+		rtspListen, err := net.Listen("tcp", rtspAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var rtspServer *rtsp.Server
+		if hlsServer == nil {
+			rtspServer = rtsp.NewServer(stream, nil)
+		} else {
+			rtspServer = rtsp.NewServer(stream, hlsServer)
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("RTSP server panic: ", r)
+				}
+			}()
+			log.Info("RTSP listen On ", rtspAddr)
+			rtspServer.Serve(rtspListen)
+		}()
+	}
+}
+
+func startUDP(stream *rtmp.Streams, hlsServer *hls.Server) {
+	inputs, outputs := configure.GetUDPStreams()
+	for _, cfg := range inputs {
+		var input *udp.Input
+		var err error
+		if hlsServer == nil {
+			input, err = udp.NewInput(cfg, stream, nil)
+		} else {
+			input, err = udp.NewInput(cfg, stream, hlsServer)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(cfg configure.UDPStream) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error("UDP input panic: ", r)
+				}
+			}()
+			log.Infof("UDP input of %s On %s", cfg.Key, cfg.Addr)
+			input.Serve()
+		}(cfg)
+	}
+	for _, cfg := range outputs {
+		output, err := udp.NewWriter(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("UDP output of %s To %s", cfg.Key, cfg.Addr)
+		stream.HandleWriter(output)
+	}
+}
+
+func startStaticPull(stream *rtmp.Streams, hlsServer *hls.Server) {
+	for _, cfg := range configure.GetStaticPulls() {
+		var pull *httpflv.Pull
+		var err error
+		if hlsServer == nil {
+			pull, err = httpflv.NewStaticPull(cfg, stream, nil)
+		} else {
+			pull, err = httpflv.NewStaticPull(cfg, stream, hlsServer)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Static pull of %s From %s", cfg.Key, cfg.URL)
+		if err := pull.Start(); err != nil {
+			log.Error("static pull error: ", err)
+		}
+	}
+}
+
+func startAPI(stream *rtmp.Streams, hlsServer *hls.Server) {
 	apiAddr := configure.Config.GetString("api_addr")
 
 	if apiAddr != "" {
@@ -95,7 +263,12 @@ func startAPI(stream *rtmp.Streams) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		opServer := api.NewServer(stream, rtmpAddr)
+		var opServer *api.Server
+		if hlsServer == nil {
+			opServer = api.NewServer(stream, nil, rtmpAddr)
+		} else {
+			opServer = api.NewServer(stream, hlsServer, rtmpAddr)
+		}
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
@@ -137,8 +310,14 @@ func main() {
 
 	stream := rtmp.NewStreams()
 	hlsServer := startHls()
-	startHTTPFlv(stream)
-	startAPI(stream)
+	startHTTPFlv(stream, hlsServer)
+	startVOD()
+	startSRT(stream, hlsServer)
+	startUDP(stream, hlsServer)
+	startStaticPull(stream, hlsServer)
+	startWebRTC(stream, hlsServer)
+	startRTSP(stream, hlsServer)
+	startAPI(stream, hlsServer)
 
 	startRtmp(stream, hlsServer)
 }
@@ -0,0 +1,317 @@
+package h264
+
+import (
+	"fmt"
+)
+
+var (
+	// ErrInvalidSPS means the sps can not be parsed
+	ErrInvalidSPS = fmt.Errorf("invalid sps")
+)
+
+// SPS is the information parsed from a sequence parameter set
+type SPS struct {
+	Profile byte
+	Level   byte
+	Width   int
+	Height  int
+}
+
+// bitReader reads exp-golomb coded rbsp
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.b)*8 {
+		return 0, ErrInvalidSPS
+	}
+	v := uint(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return v, nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, ErrInvalidSPS
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return 1<<uint(zeros) - 1 + v, nil
+}
+
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v&1 == 1 {
+		return int(v+1) / 2, nil
+	}
+	return -int(v / 2), nil
+}
+
+// rbsp removes the emulation prevention bytes
+func rbsp(b []byte) []byte {
+	ret := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// ParseSPS parses a sps nalu, which starts with the nalu header
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != naluTypeSps {
+		return nil, ErrInvalidSPS
+	}
+	sps := &SPS{
+		Profile: nalu[1],
+		Level:   nalu[3],
+	}
+	r := &bitReader{b: rbsp(nalu[4:])}
+
+	// seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	chromaFormat := uint(1)
+	separateColourPlane := uint(0)
+	switch sps.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormat, err = r.ue(); err != nil {
+			return nil, err
+		}
+		if chromaFormat == 3 {
+			if separateColourPlane, err = r.bit(); err != nil {
+				return nil, err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		for i := 0; i < 2; i++ {
+			if _, err := r.ue(); err != nil {
+				return nil, err
+			}
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+		present, err := r.bit()
+		if err != nil {
+			return nil, err
+		}
+		if present == 1 {
+			n := 8
+			if chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				flag, err := r.bit()
+				if err != nil {
+					return nil, err
+				}
+				if flag == 0 {
+					continue
+				}
+				size := 64
+				if i < 6 {
+					size = 16
+				}
+				if err := skipScalingList(r, size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	switch pocType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		for i := 0; i < 2; i++ {
+			if _, err := r.se(); err != nil {
+				return nil, err
+			}
+		}
+		n, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint(0); i < n; i++ {
+			if _, err := r.se(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// max_num_ref_frames
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err := r.bit(); err != nil {
+		return nil, err
+	}
+	widthInMbs, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	heightInMapUnits, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	if frameMbsOnly == 0 {
+		// mb_adaptive_frame_field_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err := r.bit(); err != nil {
+		return nil, err
+	}
+	cropping, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	var crop [4]uint
+	if cropping == 1 {
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	if chromaFormat != 0 && separateColourPlane == 0 {
+		if chromaFormat < 3 {
+			cropUnitX = 2
+		}
+		if chromaFormat == 1 {
+			cropUnitY *= 2
+		}
+	}
+	sps.Width = int((widthInMbs+1)*16 - (crop[0]+crop[1])*cropUnitX)
+	sps.Height = int((2-frameMbsOnly)*(heightInMapUnits+1)*16 - (crop[2]+crop[3])*cropUnitY)
+	return sps, nil
+}
+
+// ParseSequenceHeader parses the first sps in an AVCDecoderConfigurationRecord
+func ParseSequenceHeader(src []byte) (*SPS, error) {
+	if len(src) < 8 {
+		return nil, ErrSpsData
+	}
+	n := int(src[6])<<8 | int(src[7])
+	if n <= 0 || len(src[8:]) < n {
+		return nil, ErrSpsData
+	}
+	return ParseSPS(src[8 : 8+n])
+}
+
+// ParameterSets returns the first sps and the first pps of an
+// AVCDecoderConfigurationRecord
+func ParameterSets(src []byte) (sps, pps []byte, err error) {
+	if len(src) < 8 {
+		return nil, nil, ErrSpsData
+	}
+	n := int(src[6])<<8 | int(src[7])
+	if n <= 0 || len(src[8:]) < n {
+		return nil, nil, ErrSpsData
+	}
+	sps, src = src[8:8+n], src[8+n:]
+	if len(src) < 3 || src[0] == 0 {
+		return nil, nil, ErrPpsHeader
+	}
+	n = int(src[1])<<8 | int(src[2])
+	if n <= 0 || len(src[3:]) < n {
+		return nil, nil, ErrPpsData
+	}
+	return sps, src[3 : 3+n], nil
+}
+
+// SequenceHeader returns the flv body of the AVC sequence header, whose
+// AVCDecoderConfigurationRecord has the sps and the pps
+func SequenceHeader(sps, pps []byte) []byte {
+	b := []byte{0x17, 0x00, 0, 0, 0,
+		0x01, sps[1], sps[2], sps[3], 0xff, 0xe1,
+		byte(len(sps) >> 8), byte(len(sps))}
+	b = append(b, sps...)
+	b = append(b, 0x01, byte(len(pps)>>8), byte(len(pps)))
+	return append(b, pps...)
+}
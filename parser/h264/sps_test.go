@@ -0,0 +1,43 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSequenceHeader(t *testing.T) {
+	at := assert.New(t)
+	seq := []byte{
+		0x01, 0x4d, 0x00, 0x1e, 0xff, 0xe1, 0x00, 0x17, 0x67, 0x4d, 0x00,
+		0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28, 0x28, 0x2f,
+		0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a, 0x01, 0x00,
+		0x04, 0x68, 0xde, 0x31, 0x12,
+	}
+	sps, err := ParseSequenceHeader(seq)
+	at.Nil(err)
+	at.Equal(byte(0x4d), sps.Profile)
+	at.Equal(byte(0x1e), sps.Level)
+	at.Equal(720, sps.Width)
+	at.Equal(576, sps.Height)
+	sps2, pps, err := ParameterSets(seq)
+	at.Nil(err)
+	at.Equal(seq, SequenceHeader(sps2, pps)[5:])
+
+	// high profile with frame cropping
+	sps, err = ParseSPS([]byte{
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0,
+		0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+		0x60, 0xc6, 0x58,
+	})
+	at.Nil(err)
+	at.Equal(1920, sps.Width)
+	at.Equal(1080, sps.Height)
+
+	_, err = ParseSequenceHeader(seq[:6])
+	at.Equal(ErrSpsData, err)
+	_, _, err = ParameterSets(seq[:34])
+	at.Equal(ErrPpsData, err)
+	_, err = ParseSPS([]byte{0x68, 0xde, 0x31, 0x12})
+	at.Equal(ErrInvalidSPS, err)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chanReader publishes the packets sent to it until closed
+type chanReader struct {
+	av.RWBaser
+	packets chan *av.Packet
+}
+
+func newChanReader() *chanReader {
+	return &chanReader{
+		RWBaser: av.NewRWBase(time.Second),
+		packets: make(chan *av.Packet),
+	}
+}
+
+func (r *chanReader) Read(p *av.Packet) error {
+	pkt, ok := <-r.packets
+	if !ok {
+		return io.EOF
+	}
+	*p = *pkt
+	return nil
+}
+
+func (r *chanReader) Close(err error) {}
+
+func (r *chanReader) Info() av.Info {
+	return av.Info{Key: "live/test", UID: "test"}
+}
+
+func newTestVideo(data []byte, timestamp uint32) *av.Packet {
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, true)
+	return &av.Packet{IsVideo: true, TimeStamp: timestamp, Header: &tag, Data: data}
+}
+
+func getSnapshot(s *Server, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handleSnapshot(w, httptest.NewRequest("GET", "/control/snapshot?"+query, nil))
+	return w
+}
+
+// waitSnapshot gets the snapshot until its status is not code
+func waitSnapshot(s *Server, query string, code int) *httptest.ResponseRecorder {
+	w := getSnapshot(s, query)
+	for i := 0; i < 100 && w.Code == code; i++ {
+		time.Sleep(10 * time.Millisecond)
+		w = getSnapshot(s, query)
+	}
+	return w
+}
+
+func TestHandleSnapshot(t *testing.T) {
+	at := assert.New(t)
+	streams := rtmp.NewStreams()
+	s := NewServer(streams, nil, "")
+
+	at.Equal(http.StatusBadRequest, getSnapshot(s, "app=live").Code)
+	at.Equal(http.StatusNotFound, getSnapshot(s, "app=live&name=test").Code)
+
+	// published, but no key frame yet
+	r := newChanReader()
+	defer close(r.packets)
+	streams.HandleReader(r)
+	sps := []byte{0x67, 0x4d, 0x00, 0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28,
+		0x28, 0x2f, 0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a}
+	pps := []byte{0x68, 0xde, 0x31, 0x12}
+	r.packets <- newTestVideo(h264.SequenceHeader(sps, pps), 0)
+	w := getSnapshot(s, "app=live&name=test")
+	at.Equal(http.StatusNotFound, w.Code)
+	at.Contains(w.Body.String(), "no key frame")
+
+	r.packets <- newTestVideo([]byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 4, 0x65, 0x88, 0x84, 0x21}, 1000)
+	w = waitSnapshot(s, "app=live&name=test", http.StatusNotFound)
+	at.Equal(http.StatusOK, w.Code)
+	at.Equal("video/h264", w.Header().Get("Content-Type"))
+	at.Equal("1000", w.Header().Get("X-Snapshot-Timestamp"))
+	at.Equal([]byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x21}, w.Body.Bytes()[w.Body.Len()-8:])
+
+	at.Equal(http.StatusBadRequest, getSnapshot(s, "app=live&name=test&format=gif").Code)
+}
@@ -0,0 +1,233 @@
+package filesource
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// fileGap is the timestamp gap inserted between two files of the playlist
+	fileGap = 40
+)
+
+var (
+	// ErrEmptyPlaylist means no file is given
+	ErrEmptyPlaylist = fmt.Errorf("empty playlist")
+	// ErrClosed means the source is closed
+	ErrClosed = fmt.Errorf("file source closed")
+)
+
+// Source publishes flv files as a live stream, packets are paced by
+// their timestamps and the playlist can be played in loop
+type Source struct {
+	av.RWBaser
+
+	uid   string
+	app   string
+	name  string
+	files []string
+	loop  bool
+
+	lock    sync.Mutex
+	index   int
+	file    *os.File
+	reader  *flv.Reader
+	closed  bool
+	closeCh chan struct{}
+
+	started   bool
+	startTime time.Time
+	startTs   uint32
+	offset    uint32
+	fileFirst bool
+	lastTs    uint32
+}
+
+// NewSource returns a Source publishing files to app/name,
+// the files are relative to flv_dir
+func NewSource(app, name string, files []string, loop bool) (*Source, error) {
+	if len(files) == 0 {
+		return nil, ErrEmptyPlaylist
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		p, err := flv.ResolveRecordFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(p); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+
+	s := &Source{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:     uid.NewID(),
+		app:     app,
+		name:    name,
+		files:   paths,
+		loop:    loop,
+		index:   -1,
+		closeCh: make(chan struct{}),
+	}
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Files returns the playlist
+func (s *Source) Files() []string {
+	return s.files
+}
+
+// Loop returns if the playlist is played in loop
+func (s *Source) Loop() bool {
+	return s.loop
+}
+
+// Current returns the file being played
+func (s *Source) Current() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.index < 0 || s.index >= len(s.files) {
+		return ""
+	}
+	return s.files[s.index]
+}
+
+// IsClosed returns if the source is closed or has played to the end
+func (s *Source) IsClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// next opens the next file of the playlist
+func (s *Source) next() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	index := s.index + 1
+	if index >= len(s.files) {
+		if !s.loop {
+			return io.EOF
+		}
+		index = 0
+	}
+	f, err := os.Open(s.files[index])
+	if err != nil {
+		return err
+	}
+	log.Debugf("file source [%s/%s] play %s", s.app, s.name, s.files[index])
+	s.index = index
+	s.file = f
+	s.reader = flv.NewReader(f)
+	s.fileFirst = true
+	return nil
+}
+
+// readPacket reads the next packet with continuous timestamps
+func (s *Source) readPacket(p *av.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	emptyFiles := 0
+	for {
+		if s.closed {
+			return ErrClosed
+		}
+		err := s.reader.Read(p)
+		if err == nil {
+			break
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Warningf("file source read %s error: %v", s.files[s.index], err)
+		}
+		if s.fileFirst {
+			emptyFiles++
+			if emptyFiles >= len(s.files) {
+				return fmt.Errorf("no packet in playlist")
+			}
+		}
+		if err = s.next(); err != nil {
+			return err
+		}
+	}
+
+	if s.fileFirst {
+		s.fileFirst = false
+		if s.started {
+			s.offset = s.lastTs + fileGap - p.TimeStamp
+		} else {
+			s.offset = -p.TimeStamp
+		}
+	}
+	p.TimeStamp += s.offset
+	if !p.IsMetadata && p.TimeStamp > s.lastTs {
+		s.lastTs = p.TimeStamp
+	}
+	return nil
+}
+
+// Read reads a packet, and waits until it is time to send it
+func (s *Source) Read(p *av.Packet) error {
+	if err := s.readPacket(p); err != nil {
+		s.Close(err)
+		return err
+	}
+	s.SetPreTime()
+
+	if !s.started {
+		s.started = true
+		s.startTime = time.Now()
+		s.startTs = p.TimeStamp
+		return nil
+	}
+	if p.TimeStamp > s.startTs {
+		due := s.startTime.Add(time.Duration(p.TimeStamp-s.startTs) * time.Millisecond)
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-s.closeCh:
+				return ErrClosed
+			}
+		}
+	}
+	return nil
+}
+
+// Info returns the info
+func (s *Source) Info() (ret av.Info) {
+	ret.UID = s.uid
+	ret.Key = s.app + "/" + s.name
+	ret.URL = "file://" + filepath.ToSlash(s.Current())
+	return
+}
+
+// Close closes the source
+func (s *Source) Close(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	log.Debugf("file source [%s/%s] closed: %v", s.app, s.name, err)
+	s.closed = true
+	close(s.closeCh)
+	if s.file != nil {
+		s.file.Close()
+	}
+}
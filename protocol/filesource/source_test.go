@@ -0,0 +1,161 @@
+package filesource
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain plays the files of a temporary flv_dir
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "livego-filesource")
+	if err != nil {
+		panic(err)
+	}
+	configure.Config.Set("flv_dir", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// flvTag returns a video tag with its previous tag size
+func flvTag(timestamp uint32) []byte {
+	data := []byte{0x17, 0x01, 0, 0, 0, 0xaa}
+	n := len(data)
+	b := []byte{av.TagVideo, byte(n >> 16), byte(n >> 8), byte(n),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0}
+	b = append(b, data...)
+	size := uint32(len(b))
+	return append(b, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+}
+
+// writeTestFile writes a flv of video frames at timestamps under flv_dir,
+// with a truncated tag at the end if truncated
+func writeTestFile(t *testing.T, name string, truncated bool, timestamps ...uint32) {
+	b := []byte{'F', 'L', 'V', 0x01, 0x01, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	for _, ts := range timestamps {
+		b = append(b, flvTag(ts)...)
+	}
+	if truncated {
+		b = append(b, flvTag(0)[:8]...)
+	}
+	file := filepath.Join(configure.Config.GetString("flv_dir"), name)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTimestamps reads n packets, or until an error
+func readTimestamps(s *Source, n int) ([]uint32, error) {
+	var ret []uint32
+	for len(ret) < n {
+		var p av.Packet
+		if err := s.Read(&p); err != nil {
+			return ret, err
+		}
+		ret = append(ret, p.TimeStamp)
+	}
+	return ret, nil
+}
+
+func TestSourcePacing(t *testing.T) {
+	at := assert.New(t)
+	writeTestFile(t, "pacing.flv", false, 5000, 5200, 5400, 5600)
+	s, err := NewSource("live", "pacing", []string{"pacing.flv"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the packets are read at the pace of their timestamps
+	start := time.Now()
+	timestamps, err := readTimestamps(s, 3)
+	at.Nil(err)
+	at.Equal([]uint32{0, 200, 400}, timestamps)
+	elapsed := time.Since(start)
+	at.True(elapsed >= 380*time.Millisecond, elapsed.String())
+	at.True(elapsed < time.Second, elapsed.String())
+
+	// closing stops the wait
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Close(nil)
+	}()
+	start = time.Now()
+	var p av.Packet
+	at.Equal(ErrClosed, s.Read(&p))
+	at.True(time.Since(start) < 150*time.Millisecond)
+	at.True(s.IsClosed())
+}
+
+func TestSourcePlaylist(t *testing.T) {
+	at := assert.New(t)
+	writeTestFile(t, "a.flv", false, 1000, 1040, 1080)
+	writeTestFile(t, "b.flv", false, 500, 540)
+	s, err := NewSource("live", "playlist", []string{"a.flv", "b.flv"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal("live/playlist", s.Info().Key)
+
+	// every file starts fileGap after the last packet of the previous one
+	timestamps, err := readTimestamps(s, 10)
+	at.Equal(io.EOF, err)
+	at.Equal([]uint32{0, 40, 80, 80 + fileGap, 120 + fileGap}, timestamps)
+	at.True(s.IsClosed())
+}
+
+func TestSourceLoop(t *testing.T) {
+	at := assert.New(t)
+	writeTestFile(t, "loop.flv", false, 200, 240)
+	s, err := NewSource("live", "loop", []string{"loop.flv"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.True(s.Loop())
+
+	timestamps, err := readTimestamps(s, 6)
+	at.Nil(err)
+	at.Equal([]uint32{0, 40, 80, 120, 160, 200}, timestamps)
+	s.Close(nil)
+	_, err = readTimestamps(s, 1)
+	at.Equal(ErrClosed, err)
+}
+
+func TestSourceEmptyAndTruncated(t *testing.T) {
+	at := assert.New(t)
+	writeTestFile(t, "empty.flv", false)
+	writeTestFile(t, "truncated.flv", true, 0, 40)
+	writeTestFile(t, "c.flv", false, 0)
+
+	// empty files are skipped, a truncated tag ends its file
+	s, err := NewSource("live", "skip", []string{"empty.flv", "truncated.flv", "empty.flv", "c.flv"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, err := readTimestamps(s, 10)
+	at.Equal(io.EOF, err)
+	at.Equal([]uint32{0, 40, 40 + fileGap}, timestamps)
+
+	// a playlist of empty files is not played in loop forever
+	s, err = NewSource("live", "empty", []string{"empty.flv", "empty.flv"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, err = readTimestamps(s, 1)
+	at.NotNil(err)
+	at.Empty(timestamps)
+	at.True(s.IsClosed())
+
+	_, err = NewSource("live", "none", nil, false)
+	at.Equal(ErrEmptyPlaylist, err)
+	_, err = NewSource("live", "none", []string{"../a.flv"}, false)
+	at.NotNil(err)
+}
@@ -78,8 +78,9 @@ func (server *Server) Writer(info av.Info) av.WriteCloser {
 	return s
 }
 
+// getConn returns the source of the stream played as key
 func (server *Server) getConn(key string) *Source {
-	v, ok := server.conns.Get(key)
+	v, ok := server.conns.Get(configure.AliasKey(key))
 	if !ok {
 		return nil
 	}
@@ -108,6 +109,10 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 	switch path.Ext(r.URL.Path) {
 	case ".m3u8":
 		key, _ := server.parseM3u8(r.URL.Path)
+		if delay := r.URL.Query().Get("timeshift"); delay != "" {
+			server.serveTimeshiftPlaylist(w, key, delay)
+			return
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
@@ -132,6 +137,10 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		w.Write(body)
 	case ".ts":
 		key, _ := server.parseTs(r.URL.Path)
+		if isTimeshiftSegment(r.URL.Path) {
+			server.serveTimeshiftSegment(w, key, r.URL.Path)
+			return
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
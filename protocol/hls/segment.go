@@ -0,0 +1,77 @@
+package hls
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/parser"
+)
+
+// SegmentMuxer muxes flv packets into one standalone ts segment,
+// it is used to generate segments out of the live pipeline
+type SegmentMuxer struct {
+	w        io.Writer
+	hasVideo bool
+	started  bool
+	demuxer  flv.Demuxer
+	codec    *parser.CodecParser
+	muxer    *ts.Muxer
+	buf      *bytes.Buffer
+}
+
+// NewSegmentMuxer returns a SegmentMuxer writing into w
+func NewSegmentMuxer(w io.Writer, hasVideo bool) *SegmentMuxer {
+	return &SegmentMuxer{
+		w:        w,
+		hasVideo: hasVideo,
+		demuxer:  flv.NewDemuxer(),
+		codec:    parser.NewCodecParser(),
+		muxer:    ts.NewMuxer(),
+		buf:      bytes.NewBuffer(nil),
+	}
+}
+
+// Write muxes a packet whose data is the whole flv tag body, sequence
+// headers are only parsed and packets of unsupported codecs are skipped
+func (m *SegmentMuxer) Write(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	if !m.started {
+		m.started = true
+		if _, err := m.w.Write(m.muxer.PAT()); err != nil {
+			return err
+		}
+		if _, err := m.w.Write(m.muxer.PMT(av.SoundAAC, m.hasVideo)); err != nil {
+			return err
+		}
+	}
+
+	pkt := *p
+	if err := m.demuxer.Demux(&pkt); err != nil {
+		return nil
+	}
+	isSeq := false
+	if pkt.IsVideo {
+		vh := pkt.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VideoH264 {
+			return nil
+		}
+		isSeq = vh.IsSeq()
+	} else {
+		ah := pkt.Header.(av.AudioPacketHeader)
+		if ah.SoundFormat() != av.SoundAAC {
+			return nil
+		}
+		isSeq = ah.AACPacketType() == av.AACSeqHeader
+	}
+	m.buf.Reset()
+	if err := m.codec.Parse(&pkt, m.buf); err != nil || isSeq {
+		return nil
+	}
+	pkt.Data = m.buf.Bytes()
+	return m.muxer.Mux(&pkt, m.w)
+}
@@ -3,6 +3,7 @@ package hls
 import (
 	"bytes"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/configure"
@@ -23,6 +24,11 @@ const (
 	defaultH264Hz uint64 = 90
 )
 
+var (
+	// ErrSourceClosed means the hls source is closed
+	ErrSourceClosed = fmt.Errorf("hls source closed")
+)
+
 // Source is the source of hls
 type Source struct {
 	av.RWBaser
@@ -41,6 +47,9 @@ type Source struct {
 	tsparser    *parser.CodecParser
 	closed      bool
 	packetQueue chan *av.Packet
+	dropper     av.GopDropper
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
 // NewSource returns a Source
@@ -59,10 +68,11 @@ func NewSource(info av.Info) *Source {
 		tsparser:    parser.NewCodecParser(),
 		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
+		done:        make(chan struct{}),
 	}
 	go func() {
 		err := s.SendPacket()
-		if err != nil {
+		if err != nil && err != ErrSourceClosed {
 			log.Warning("send packet error: ", err)
 			s.closed = true
 		}
@@ -75,56 +85,45 @@ func (source *Source) GetCacheInc() *TSCacheItem {
 	return source.tsCache
 }
 
-// DropPacket drops packet due to queue max
-func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Warningf("[%v] packet queue max!!!", info)
-	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
-		// try to don't drop audio
-		if ok && tmpPkt.IsAudio {
-			if len(pktQue) > maxQueueNum-2 {
-				<-pktQue
-			} else {
-				pktQue <- tmpPkt
-			}
-		}
-
-		if ok && tmpPkt.IsVideo {
-			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-			// dont't drop sps config and dont't drop key frame
-			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				pktQue <- tmpPkt
-			}
-			if len(pktQue) > maxQueueNum-10 {
-				<-pktQue
-			}
-		}
-
-	}
-	log.Debug("packet queue len: ", len(pktQue))
-}
-
 // Write writes packet
-func (source *Source) Write(p *av.Packet) (err error) {
-	err = nil
+func (source *Source) Write(p *av.Packet) error {
 	if source.closed {
-		err = fmt.Errorf("hls source closed")
-		return
+		return ErrSourceClosed
 	}
 	source.SetPreTime()
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("hls source has already been closed:%v", e)
-		}
-	}()
+	if !source.dropper.Keep(p) {
+		return nil
+	}
 	if len(source.packetQueue) >= maxQueueNum-24 {
-		source.DropPacket(source.packetQueue, source.info)
-	} else {
-		if !source.closed {
-			source.packetQueue <- p
+		log.Warningf("[%v] packet queue max!!!", source.info)
+		source.dropper.CongestChan(source.packetQueue)
+		if !source.dropper.Keep(p) {
+			return nil
 		}
 	}
-	return
+
+	// p is shared with other writers and the muxer modifies it
+	pkt := *p
+	pkt.Retain()
+	select {
+	case source.packetQueue <- &pkt:
+	case <-source.done:
+		pkt.Release()
+		return ErrSourceClosed
+	}
+	// the packet may be queued after Close released the queue
+	select {
+	case <-source.done:
+		av.ReleaseChan(source.packetQueue)
+		return ErrSourceClosed
+	default:
+	}
+	return nil
+}
+
+// DropStats returns the number of dropped packets and bytes
+func (source *Source) DropStats() av.DropStats {
+	return source.dropper.Stats()
 }
 
 // SendPacket sends packet
@@ -138,42 +137,48 @@ func (source *Source) SendPacket() error {
 
 	log.Debugf("[%v] hls sender start", source.info)
 	for {
-		if source.closed {
-			return fmt.Errorf("closed")
+		select {
+		case p := <-source.packetQueue:
+			err := source.sendPacket(p)
+			p.Release()
+			if err != nil {
+				return err
+			}
+		case <-source.done:
+			return ErrSourceClosed
 		}
+	}
+}
 
-		p, ok := <-source.packetQueue
-		if ok {
-			if p.IsMetadata {
-				continue
-			}
+// sendPacket muxes one packet into the current segment
+func (source *Source) sendPacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
 
-			err := source.demuxer.Demux(p)
-			if err == flv.ErrAvcEndSEQ {
-				log.Warning(err)
-				continue
-			} else {
-				if err != nil {
-					log.Warning(err)
-					return err
-				}
-			}
-			compositionTime, isSeq, err := source.parse(p)
-			if err != nil {
-				log.Warning(err)
-			}
-			if err != nil || isSeq {
-				continue
-			}
-			if source.btswriter != nil {
-				source.stat.update(p.IsVideo, p.TimeStamp)
-				source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
-				source.tsMux(p)
-			}
-		} else {
-			return fmt.Errorf("closed")
+	err := source.demuxer.Demux(p)
+	if err == flv.ErrAvcEndSEQ {
+		log.Warning(err)
+		return nil
+	} else {
+		if err != nil {
+			log.Warning(err)
+			return err
 		}
 	}
+	compositionTime, isSeq, err := source.parse(p)
+	if err != nil {
+		log.Warning(err)
+	}
+	if err != nil || isSeq {
+		return nil
+	}
+	if source.btswriter != nil {
+		source.stat.update(p.IsVideo, p.TimeStamp)
+		source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
+		source.tsMux(p)
+	}
+	return nil
 }
 
 // Info returns info
@@ -182,7 +187,6 @@ func (source *Source) Info() (ret av.Info) {
 }
 
 func (source *Source) cleanup() {
-	close(source.packetQueue)
 	source.bwriter = nil
 	source.btswriter = nil
 	source.cache = nil
@@ -192,6 +196,10 @@ func (source *Source) cleanup() {
 // Close closes the source
 func (source *Source) Close(err error) {
 	log.Debug("hls source closed: ", source.info)
+	source.closeOnce.Do(func() {
+		close(source.done)
+		av.ReleaseChan(source.packetQueue)
+	})
 	if !source.closed && !configure.Config.GetBool("hls_keep_after_end") {
 		source.cleanup()
 	}
@@ -0,0 +1,95 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/timeshift"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	timeshiftPrefix = "timeshift-"
+)
+
+// isTimeshiftSegment returns if the ts path is a segment of the timeshift playlist
+func isTimeshiftSegment(pathstr string) bool {
+	return strings.HasPrefix(path.Base(pathstr), timeshiftPrefix)
+}
+
+// serveTimeshiftPlaylist serves APP/NAME.m3u8?timeshift=N, a live playlist
+// N seconds behind live generated from the timeshift buffer
+func (server *Server) serveTimeshiftPlaylist(w http.ResponseWriter, key, delay string) {
+	n, err := strconv.Atoi(delay)
+	if err != nil || n < 0 {
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+		return
+	}
+	buffer := timeshift.Get(configure.AliasKey(key))
+	if buffer == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+		return
+	}
+	segments := buffer.Segments(uint32(n)*1000, maxTSCacheNum)
+	if len(segments) == 0 {
+		http.Error(w, timeshift.ErrNoSegment.Error(), http.StatusNotFound)
+		return
+	}
+
+	var maxDuration uint32
+	for _, s := range segments {
+		if s.Duration > maxDuration {
+			maxDuration = s.Duration
+		}
+	}
+	body := bytes.NewBuffer(nil)
+	fmt.Fprintf(body,
+		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
+		maxDuration/1000+1, segments[0].N)
+	name := path.Base(key)
+	for _, s := range segments {
+		fmt.Fprintf(body, "#EXTINF:%.3f,\n%s/%s%d.ts\n", float64(s.Duration)/1000, name, timeshiftPrefix, s.N)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Write(body.Bytes())
+}
+
+// serveTimeshiftSegment serves APP/NAME/timeshift-N.ts
+func (server *Server) serveTimeshiftSegment(w http.ResponseWriter, key, pathstr string) {
+	n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(path.Base(pathstr), timeshiftPrefix), ".ts"), 10, 64)
+	if err != nil {
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+		return
+	}
+	buffer := timeshift.Get(configure.AliasKey(key))
+	if buffer == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+		return
+	}
+
+	body := bytes.NewBuffer(nil)
+	muxer := NewSegmentMuxer(body, buffer.HasVideo())
+	if err := buffer.WriteSegment(n, func(p *av.Packet) error {
+		return muxer.Write(p)
+	}); err != nil {
+		log.Debug("timeshift segment error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/mp2ts")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Write(body.Bytes())
+}
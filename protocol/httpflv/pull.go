@@ -0,0 +1,286 @@
+package httpflv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrIdle means no data came from the upstream for read_timeout
+	ErrIdle = fmt.Errorf("http flv upstream idle")
+	// ErrNotConnected means the upstream has not answered yet
+	ErrNotConnected = fmt.Errorf("http flv upstream not connected")
+)
+
+// Pull publishes the flv stream of an http(s) url, e.g. of an upstream
+// cdn. The url is requested again when the stream fails, or when no data
+// comes for read_timeout.
+type Pull struct {
+	av.RWBaser
+
+	uid          string
+	app, key     string
+	title        string
+	url          string
+	static       bool
+	timeout      time.Duration
+	handler      av.Handler
+	getter       av.GetWriter
+	lock         sync.Mutex
+	body         *idleReader
+	reader       *flv.Reader
+	offset, last uint32
+	rebase       bool
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+// NewPull returns a Pull of rawurl publishing the stream of the room key
+// of app
+func NewPull(rawurl, app, key string, h av.Handler, getter av.GetWriter) (*Pull, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid http flv url %s", rawurl)
+	}
+	return &Pull{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:     uid.NewID(),
+		app:     app,
+		key:     key,
+		url:     rawurl,
+		timeout: time.Duration(configure.Config.GetInt("read_timeout")) * time.Second,
+		handler: h,
+		getter:  getter,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// NewStaticPull returns the Pull of a static pull from config, the
+// stream is published even if the upstream does not answer yet
+func NewStaticPull(cfg configure.StaticPull, h av.Handler, getter av.GetWriter) (*Pull, error) {
+	p, err := NewPull(cfg.URL, "", "", h, getter)
+	if err != nil {
+		return nil, err
+	}
+	p.app = strings.SplitN(cfg.Key, "/", 2)[0]
+	p.title = cfg.Name
+	p.static = true
+	return p, nil
+}
+
+// Start requests the url and publishes its stream
+func (p *Pull) Start() error {
+	if !p.static {
+		channel, err := rtmp.PublishChannel(p.app, p.key)
+		if err != nil {
+			return err
+		}
+		p.title = channel
+	}
+	body, reader, err := p.connect()
+	if err != nil {
+		if !p.static {
+			return err
+		}
+		log.Warningf("http flv pull %s error: %v", p.url, err)
+	}
+	p.body, p.reader = body, reader
+	return rtmp.HandlePublisher(p.handler, p.getter, p)
+}
+
+// connect requests the url, the request is canceled when idle
+func (p *Pull) connect() (*idleReader, *flv.Reader, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "livego")
+	body := &idleReader{timeout: p.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(p.timeout, body.expire)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		body.timer.Stop()
+		cancel()
+		if atomic.LoadInt32(&body.idle) == 1 {
+			err = ErrIdle
+		}
+		return nil, nil, err
+	}
+	body.body = resp.Body
+	if resp.StatusCode != http.StatusOK {
+		body.Close()
+		return nil, nil, fmt.Errorf("http status %s", resp.Status)
+	}
+	return body, flv.NewReader(body), nil
+}
+
+// Stop stops the pull
+func (p *Pull) Stop() {
+	p.Close(nil)
+}
+
+// Read reads a packet, the timestamps go on from the previous request
+// after reconnecting
+func (p *Pull) Read(pkt *av.Packet) error {
+	for {
+		err := ErrNotConnected
+		if p.reader != nil {
+			if err = p.reader.Read(pkt); err == nil {
+				if p.rebase {
+					// the metadata and the sequence headers before the
+					// first frame are moved to it, the frames go on
+					// from the previous request
+					if av.IsSpecial(pkt) {
+						pkt.TimeStamp = p.last
+						p.SetPreTime()
+						return nil
+					}
+					p.offset = p.last - pkt.TimeStamp
+					p.rebase = false
+				}
+				pkt.TimeStamp += p.offset
+				if !pkt.IsMetadata {
+					p.last = pkt.TimeStamp
+				}
+				p.SetPreTime()
+				return nil
+			}
+		}
+		if !p.reconnect(err) {
+			p.Close(err)
+			return err
+		}
+	}
+}
+
+// reconnect requests the url again until it succeeds, it returns false if
+// reconnecting is disabled or the pull is stopped first
+func (p *Pull) reconnect(err error) bool {
+	p.lock.Lock()
+	if p.body != nil {
+		p.body.Close()
+	}
+	p.lock.Unlock()
+	select {
+	case <-p.stop:
+		return false
+	default:
+	}
+	max := time.Duration(configure.Config.GetInt("relay_reconnect")) * time.Second
+	if max <= 0 {
+		log.Warningf("http flv pull %s error: %v", p.url, err)
+		return false
+	}
+	log.Warningf("http flv pull %s error: %v, reconnecting", p.url, err)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	delay := time.Second
+	for {
+		deadline := time.After(delay)
+	wait:
+		for {
+			select {
+			case <-p.stop:
+				return false
+			case <-ticker.C:
+				// the publisher is alive while reconnecting
+				p.SetPreTime()
+			case <-deadline:
+				break wait
+			}
+		}
+		body, reader, err := p.connect()
+		if err == nil {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			select {
+			case <-p.stop:
+				body.Close()
+				return false
+			default:
+			}
+			p.body, p.reader = body, reader
+			p.rebase = true
+			return true
+		}
+		log.Debugf("http flv pull %s reconnect error: %v", p.url, err)
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+}
+
+// Close stops the pull and closes the request
+func (p *Pull) Close(err error) {
+	p.stopOnce.Do(func() {
+		log.Debugf("http flv pull %s closed: %v", p.url, err)
+		p.lock.Lock()
+		close(p.stop)
+		if p.body != nil {
+			p.body.Close()
+		}
+		p.lock.Unlock()
+	})
+}
+
+// Info returns the information
+func (p *Pull) Info() (ret av.Info) {
+	ret.UID = p.uid
+	ret.URL = p.url
+	ret.Key = p.app + "/" + p.title
+	return
+}
+
+// idleReader reads the body of a response, its request is canceled when
+// no data comes for timeout
+type idleReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	idle    int32
+}
+
+func (r *idleReader) expire() {
+	atomic.StoreInt32(&r.idle, 1)
+	r.cancel()
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && atomic.LoadInt32(&r.idle) == 1 {
+		err = ErrIdle
+	}
+	return n, err
+}
+
+// Close cancels the request
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
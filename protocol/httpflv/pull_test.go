@@ -0,0 +1,188 @@
+package httpflv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain records the streams of the tests to a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "livego-httpflv")
+	if err != nil {
+		panic(err)
+	}
+	configure.Config.Set("flv_dir", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type testHandler struct {
+	readers chan av.ReadCloser
+	writers chan av.WriteCloser
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{
+		readers: make(chan av.ReadCloser, 1),
+		writers: make(chan av.WriteCloser, 1),
+	}
+}
+
+func (h *testHandler) HandleReader(r av.ReadCloser) {
+	h.readers <- r
+}
+
+func (h *testHandler) HandleWriter(w av.WriteCloser) {
+	h.writers <- w
+}
+
+// close closes the writers of the publisher
+func (h *testHandler) close() {
+	for {
+		select {
+		case w := <-h.writers:
+			w.Close(fmt.Errorf("test done"))
+		default:
+			return
+		}
+	}
+}
+
+// flvTag returns a tag with its previous tag size
+func flvTag(typeID uint8, timestamp uint32, data []byte) []byte {
+	n := len(data)
+	b := []byte{typeID, byte(n >> 16), byte(n >> 8), byte(n),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0}
+	b = append(b, data...)
+	size := uint32(len(b))
+	return append(b, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+}
+
+// upstream serves the sequence headers at 0 then frames video frames from
+// timestamp 1000, and waits for the request to be canceled if stall
+func upstream(requests *int32, frames int, stall bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Header().Set("Content-Type", "video/x-flv")
+		w.Write([]byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0})
+		w.Write(flvTag(av.TagVideo, 0, []byte{0x17, 0x00, 0, 0, 0, 0x01}))
+		w.Write(flvTag(av.TagAudio, 0, []byte{0xaf, 0x00, 0x12, 0x10}))
+		for i := 0; i < frames; i++ {
+			data := []byte{0x27, 0x01, 0, 0, 0, 0xaa}
+			if i == 0 {
+				data[0] = 0x17
+			}
+			w.Write(flvTag(av.TagVideo, 1000+uint32(i)*40, data))
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if stall {
+			<-r.Context().Done()
+		}
+	}
+}
+
+func startTestPull(t *testing.T, url string, timeout time.Duration) (*Pull, *testHandler) {
+	handler := newTestHandler()
+	key, _ := configure.RoomKeys.GetKey("pull")
+	p, err := NewPull(url, "live", key, handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout > 0 {
+		p.timeout = timeout
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-handler.readers
+	return p, handler
+}
+
+func TestPull(t *testing.T) {
+	at := assert.New(t)
+	var requests int32
+	srv := httptest.NewServer(upstream(&requests, 5, false))
+	defer srv.Close()
+
+	p, handler := startTestPull(t, srv.URL+"/live/movie.flv", 0)
+	defer handler.close()
+	defer p.Stop()
+	at.Equal("live/pull", p.Info().Key)
+
+	// the url is requested again when the response ends, the sequence
+	// headers are moved to the first frame and the frames go on
+	var timestamps []uint32
+	for len(timestamps) < 12 {
+		var pkt av.Packet
+		if err := p.Read(&pkt); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.IsVideo {
+			timestamps = append(timestamps, pkt.TimeStamp)
+		}
+	}
+	at.Equal(int32(2), atomic.LoadInt32(&requests))
+	at.Equal([]uint32{0, 1000, 1040, 1080, 1120, 1160, 1160, 1160, 1200, 1240, 1280, 1320}, timestamps)
+}
+
+func TestPullIdle(t *testing.T) {
+	at := assert.New(t)
+	defer configure.Config.Set("relay_reconnect", configure.Config.GetInt("relay_reconnect"))
+	configure.Config.Set("relay_reconnect", 0)
+	var requests int32
+	srv := httptest.NewServer(upstream(&requests, 1, true))
+	defer srv.Close()
+
+	p, handler := startTestPull(t, srv.URL+"/live/movie.flv", 200*time.Millisecond)
+	defer handler.close()
+
+	var pkt av.Packet
+	n := 0
+	err := p.Read(&pkt)
+	for ; err == nil; n++ {
+		err = p.Read(&pkt)
+	}
+	at.Equal(ErrIdle, err)
+	// the sequence headers and the frame
+	at.Equal(3, n)
+	at.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestPullStopReconnecting(t *testing.T) {
+	at := assert.New(t)
+	var requests int32
+	srv := httptest.NewServer(upstream(&requests, 1, false))
+	defer srv.Close()
+
+	p, handler := startTestPull(t, srv.URL+"/live/movie.flv", 0)
+	defer handler.close()
+
+	var pkt av.Packet
+	for i := 0; i < 3; i++ {
+		at.Nil(p.Read(&pkt))
+	}
+	// the response ends and the pull waits a second before requesting
+	// the url again
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		p.Stop()
+	}()
+	start := time.Now()
+	at.Equal(io.EOF, p.Read(&pkt))
+	at.True(time.Since(start) < 500*time.Millisecond)
+	at.Equal(int32(1), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,80 @@
+package httpflv
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrReaderClosed means the publisher is closed
+	ErrReaderClosed = fmt.Errorf("http flv publisher closed")
+)
+
+// Reader is a publisher pushing flv in the body of a http request
+type Reader struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	reader          *flv.Reader
+	closed          bool
+	closeOnce       sync.Once
+	closedChan      chan struct{}
+}
+
+// NewReader returns a publisher reading the flv body
+func NewReader(app, title, url string, body io.Reader) *Reader {
+	return &Reader{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:        uid.NewID(),
+		app:        app,
+		title:      title,
+		url:        url,
+		reader:     flv.NewReader(body),
+		closedChan: make(chan struct{}),
+	}
+}
+
+// Read reads a packet
+func (flvReader *Reader) Read(p *av.Packet) error {
+	if flvReader.closed {
+		return ErrReaderClosed
+	}
+	if err := flvReader.reader.Read(p); err != nil {
+		flvReader.Close(err)
+		return err
+	}
+	flvReader.SetPreTime()
+	return nil
+}
+
+// Wait waits for the reader closing
+func (flvReader *Reader) Wait() {
+	<-flvReader.closedChan
+}
+
+// Close closes the reader
+func (flvReader *Reader) Close(err error) {
+	flvReader.closeOnce.Do(func() {
+		log.Debugf("http flv publisher [%s/%s] closed: %v", flvReader.app, flvReader.title, err)
+		flvReader.closed = true
+		close(flvReader.closedChan)
+	})
+}
+
+// Info returns the information
+func (flvReader *Reader) Info() (ret av.Info) {
+	ret.UID = flvReader.uid
+	ret.URL = flvReader.url
+	ret.Key = flvReader.app + "/" + flvReader.title
+	return
+}
@@ -2,12 +2,16 @@ package httpflv
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/protocol/timeshift"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -15,6 +19,7 @@ import (
 // Server is the http flv server
 type Server struct {
 	handler av.Handler
+	getter  av.GetWriter
 }
 
 type stream struct {
@@ -27,10 +32,12 @@ type streams struct {
 	Players    []stream `json:"players"`
 }
 
-// NewServer returns a server
-func NewServer(h av.Handler) *Server {
+// NewServer returns a server, getter gives the writers (e.g. hls) of the
+// streams published over http
+func NewServer(h av.Handler, getter av.GetWriter) *Server {
 	return &Server{
 		handler: h,
+		getter:  getter,
 	}
 }
 
@@ -107,6 +114,16 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		server.handlePublish(w, r, paths[0], paths[1])
+		return
+	}
+	key := configure.AliasKey(path)
+
+	if v := r.URL.Query().Get("timeshift"); v != "" {
+		server.handleTimeshift(w, r, paths[0], paths[1], url, key, v)
+		return
+	}
 
 	// 判断视屏流是否发布,如果没有发布,直接返回404
 	msgs := server.getStreams(w, r)
@@ -117,7 +134,7 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 
 	include := false
 	for _, item := range msgs.Publishers {
-		if item.Key == path {
+		if item.Key == key {
 			include = true
 			break
 		}
@@ -127,9 +144,71 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	writer := NewWriter(paths[0], paths[1], url, w)
+	server.play(w, r, paths[0], paths[1], url, server.handler.HandleWriter)
+}
 
-	server.handler.HandleWriter(writer)
+// handlePublish publishes the flv in the body of r, name is the room key
+// like for rtmp publishers
+func (server *Server) handlePublish(w http.ResponseWriter, r *http.Request, app, name string) {
+	channel, err := rtmp.PublishChannel(app, name)
+	if err != nil {
+		log.Error("CheckKey err: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	url := fmt.Sprintf("http://%s/%s/%s.flv", r.Host, app, channel)
+	reader := NewReader(app, channel, url, r.Body)
+	if err := rtmp.HandlePublisher(server.handler, server.getter, reader); err != nil {
+		log.Warningf("[%v] http flv publisher refused: %v", reader.Info(), err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	reader.Wait()
+}
+
+// play plays to the http or WebSocket player of r, start starts
+// writing the stream to the writer
+func (server *Server) play(w http.ResponseWriter, r *http.Request, app, name, url string, start func(av.WriteCloser)) {
+	if !isWebSocket(r) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writer := NewWriter(app, name, url, w)
+		start(writer)
+		writer.WaitSent()
+		return
+	}
+	ws, err := upgrade(w, r)
+	if err != nil {
+		log.Warning("websocket upgrade error: ", err)
+		return
+	}
+	defer ws.Close()
+	writer := NewWriter(app, name, url, ws)
+	go func() {
+		writer.Close(ws.serve())
+	}()
+	start(writer)
 	writer.Wait()
 }
+
+// handleTimeshift plays the stream from N seconds behind live
+func (server *Server) handleTimeshift(w http.ResponseWriter, r *http.Request, app, name, url, key, delay string) {
+	n, err := strconv.Atoi(delay)
+	if err != nil || n < 0 {
+		http.Error(w, "invalid timeshift", http.StatusBadRequest)
+		return
+	}
+	buffer := timeshift.Get(key)
+	if buffer == nil {
+		http.Error(w, "timeshift not available", http.StatusNotFound)
+		return
+	}
+	reader, err := buffer.NewReader(uint32(n) * 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	server.play(w, r, app, name, url, func(writer av.WriteCloser) {
+		go reader.Play(writer)
+	})
+}
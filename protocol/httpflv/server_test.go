@@ -0,0 +1,88 @@
+package httpflv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getPublished plays url once the stream is published
+func getPublished(t *testing.T, url string) *http.Response {
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			return resp
+		}
+		resp.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("stream not published")
+	return nil
+}
+
+func TestServerPublish(t *testing.T) {
+	at := assert.New(t)
+	streams := rtmp.NewStreams()
+	srv := httptest.NewServer(http.HandlerFunc(NewServer(streams, nil).handleConn))
+	defer srv.Close()
+
+	// unknown room keys are refused
+	resp, err := http.Post(srv.URL+"/live/nokey.flv", "video/x-flv", nil)
+	at.Nil(err)
+	resp.Body.Close()
+	at.Equal(http.StatusForbidden, resp.StatusCode)
+
+	key, _ := configure.RoomKeys.GetKey("post")
+	pr, pw := io.Pipe()
+	published := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/live/"+key+".flv", "video/x-flv", pr)
+		if err != nil {
+			published <- 0
+			return
+		}
+		resp.Body.Close()
+		published <- resp.StatusCode
+	}()
+	go writeTestStream(pw, 250)
+
+	// played over http flv like a rtmp publisher
+	resp = getPublished(t, srv.URL+"/live/post.flv")
+	at.Equal(http.StatusOK, resp.StatusCode)
+	defer resp.Body.Close()
+	r := flv.NewReader(resp.Body)
+	var videos [][]byte
+	for len(videos) < 3 {
+		var p av.Packet
+		if err := r.Read(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.IsVideo && (len(videos) != 1 || p.Data[0] == testKeyFrame[0]) {
+			videos = append(videos, p.Data)
+		}
+	}
+	at.Equal(testVideoSeq, videos[0])
+	at.Equal(testKeyFrame, videos[1])
+	at.Equal(testFrame, videos[2])
+
+	// the request ends with the stream
+	pw.Close()
+	at.Equal(http.StatusOK, <-published)
+	var p av.Packet
+	for err == nil {
+		err = r.Read(&p)
+	}
+	at.Equal(io.EOF, err)
+}
@@ -0,0 +1,239 @@
+package httpflv
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+
+	// wsPingInterval is how often the players are pinged, they are not
+	// alive after wsPongTimeout without a pong
+	wsPingInterval = 5 * time.Second
+	wsPongTimeout  = 10 * time.Second
+)
+
+var (
+	// ErrWebSocketFrame means a frame of the player breaks the protocol
+	ErrWebSocketFrame = fmt.Errorf("invalid websocket frame")
+)
+
+// isWebSocket returns if r asks for a WebSocket upgrade
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// wsConn is the server side of a WebSocket connection, it writes every
+// message as a binary message
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	wmu    sync.Mutex
+	header [10]byte
+
+	lock     sync.Mutex
+	lastPong time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// upgrade switches the connection of r to WebSocket and pings it until
+// it is closed, it answers r with an error if it can not
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "invalid websocket request", http.StatusBadRequest)
+		return nil, ErrWebSocketFrame
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("http.ResponseWriter is not a http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws := &wsConn{
+		conn:     conn,
+		r:        brw.Reader,
+		lastPong: time.Now(),
+		closed:   make(chan struct{}),
+	}
+	go ws.keepalive()
+	return ws, nil
+}
+
+// writeFrame writes a frame of op made of parts
+func (ws *wsConn) writeFrame(op byte, parts ...[]byte) error {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	h := ws.header[:2]
+	h[0] = 0x80 | op
+	switch {
+	case n < 126:
+		h[1] = byte(n)
+	case n <= 0xffff:
+		h[1] = 126
+		h = ws.header[:4]
+		binary.BigEndian.PutUint16(h[2:], uint16(n))
+	default:
+		h[1] = 127
+		h = ws.header[:10]
+		binary.BigEndian.PutUint64(h[2:], uint64(n))
+	}
+	bufs := append(net.Buffers{h}, parts...)
+	_, err := bufs.WriteTo(ws.conn)
+	return err
+}
+
+// Write writes b as a message
+func (ws *wsConn) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteMessage writes the parts as a single message
+func (ws *wsConn) WriteMessage(parts ...[]byte) error {
+	return ws.writeFrame(wsOpBinary, parts...)
+}
+
+// readFrame reads a frame of the player, the payload of data frames is
+// discarded
+func (ws *wsConn) readFrame() (op byte, payload []byte, err error) {
+	var h [8]byte
+	if _, err = io.ReadFull(ws.r, h[:2]); err != nil {
+		return
+	}
+	op = h[0] & 0x0f
+	if h[1]&0x80 == 0 {
+		// frames of clients are masked
+		return 0, nil, ErrWebSocketFrame
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err = io.ReadFull(ws.r, h[:2]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err = io.ReadFull(ws.r, h[:8]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(h[:8])
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+		return
+	}
+	if op < wsOpClose {
+		_, err = io.CopyN(ioutil.Discard, ws.r, int64(n))
+		return
+	}
+	if n > 125 {
+		return 0, nil, ErrWebSocketFrame
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// serve handles the frames of the player until it closes the connection
+func (ws *wsConn) serve() error {
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpPong:
+			ws.lock.Lock()
+			ws.lastPong = time.Now()
+			ws.lock.Unlock()
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, payload)
+			return io.EOF
+		}
+	}
+}
+
+// keepalive pings the player until the connection is closed
+func (ws *wsConn) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ws.closed:
+			return
+		case <-ticker.C:
+			if err := ws.writeFrame(wsOpPing); err != nil {
+				log.Debug("websocket ping error: ", err)
+				return
+			}
+		}
+	}
+}
+
+// Alive returns if the player answered the pings
+func (ws *wsConn) Alive() bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return time.Since(ws.lastPong) < wsPongTimeout
+}
+
+// Close closes the connection
+func (ws *wsConn) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		close(ws.closed)
+		err = ws.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,170 @@
+package httpflv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testVideoSeq = []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e}
+	testAudioSeq = []byte{0xaf, 0x00, 0x12, 0x10}
+	testKeyFrame = append([]byte{0x17, 0x01, 0, 0, 0}, bytes.Repeat([]byte{0xaa}, 1000)...)
+	testFrame    = append([]byte{0x27, 0x01, 0, 0, 0}, bytes.Repeat([]byte{0xbb}, 500)...)
+)
+
+// writeTestStream writes a flv of frames 25fps video frames with a key
+// frame every 5 frames, at their pace, until w fails
+func writeTestStream(w io.Writer, frames int) {
+	b := []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	b = append(b, flvTag(av.TagVideo, 0, testVideoSeq)...)
+	b = append(b, flvTag(av.TagAudio, 0, testAudioSeq)...)
+	if _, err := w.Write(b); err != nil {
+		return
+	}
+	for i := 0; i < frames; i++ {
+		data := testFrame
+		if i%5 == 0 {
+			data = testKeyFrame
+		}
+		if _, err := w.Write(flvTag(av.TagVideo, uint32(i)*40, data)); err != nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// readWSFrame reads a frame of the server, which is not masked
+func readWSFrame(r io.Reader) (byte, []byte, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:2]); err != nil {
+		return 0, nil, err
+	}
+	if h[1]&0x80 != 0 {
+		return 0, nil, ErrWebSocketFrame
+	}
+	op := h[0] & 0x0f
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(r, h[:2]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, h[:8]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(h[:8])
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return op, payload, err
+}
+
+// writeWSFrame writes a masked frame of a client
+func writeWSFrame(w io.Writer, op byte, payload []byte) error {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b := append([]byte{0x80 | op, 0x80 | byte(len(payload))}, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readWSControl reads the frames until a control frame of op, the flv
+// tags before are skipped
+func readWSControl(r io.Reader, op byte) ([]byte, error) {
+	for {
+		o, payload, err := readWSFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if o == op {
+			return payload, nil
+		}
+	}
+}
+
+func TestWebSocketPlay(t *testing.T) {
+	at := assert.New(t)
+	streams := rtmp.NewStreams()
+	srv := httptest.NewServer(http.HandlerFunc(NewServer(streams, nil).handleConn))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	streams.HandleReader(NewReader("live", "ws", "", pr))
+	go writeTestStream(pw, 250)
+
+	nc, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(nc, "GET /live/ws.flv HTTP/1.1\r\nHost: %s\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		srv.Listener.Addr())
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	at.Equal("s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	// the flv header then a tag with its previous tag size in every message
+	op, payload, err := readWSFrame(br)
+	at.Nil(err)
+	at.Equal(byte(wsOpBinary), op)
+	at.Equal([]byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}, payload)
+	var videos [][]byte
+	for len(videos) < 3 {
+		op, payload, err := readWSFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != wsOpBinary {
+			continue
+		}
+		n := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+		at.Equal(headerLen+n+4, len(payload))
+		at.Equal(uint32(headerLen+n), binary.BigEndian.Uint32(payload[headerLen+n:]))
+		// the player may join in the middle of a gop, the frames before
+		// the first key frame are left out
+		data := payload[headerLen : headerLen+n]
+		if payload[0] == av.TagVideo && (len(videos) != 1 || data[0] == testKeyFrame[0]) {
+			videos = append(videos, data)
+		}
+	}
+	at.Equal(testVideoSeq, videos[0])
+	at.Equal(testKeyFrame, videos[1])
+	at.Equal(testFrame, videos[2])
+
+	// the pings of the player are answered, and its close
+	at.Nil(writeWSFrame(nc, wsOpPing, []byte("ping")))
+	payload, err = readWSControl(br, wsOpPong)
+	at.Nil(err)
+	at.Equal([]byte("ping"), payload)
+	at.Nil(writeWSFrame(nc, wsOpClose, []byte{0x03, 0xe8}))
+	payload, err = readWSControl(br, wsOpClose)
+	at.Nil(err)
+	at.Equal([]byte{0x03, 0xe8}, payload)
+	_, err = readWSControl(br, wsOpClose)
+	at.Equal(io.EOF, err)
+}
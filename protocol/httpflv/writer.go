@@ -2,7 +2,8 @@ package httpflv
 
 import (
 	"fmt"
-	"net/http"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
@@ -13,154 +14,110 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	headerLen   = 11
-	maxQueueNum = 1024
-)
+const headerLen = 11
 
-// Writer is a http flv writer
+// Writer is a http flv writer, the packets are queued by the subscriber of
+// the stream and written as they come
 type Writer struct {
 	av.RWBaser
 
 	uid             string
 	app, title, url string
+	lock            sync.Mutex
 	buf             []byte
-	closed          bool
+	closeOnce       sync.Once
 	closedChan      chan struct{}
-	ctx             http.ResponseWriter
-	packetQueue     chan *av.Packet
+	ctx             io.Writer
+}
+
+// messageWriter writes every flv tag with the previous tag size following
+// it as one message, e.g. a WebSocket message
+type messageWriter interface {
+	WriteMessage(parts ...[]byte) error
 }
 
 // NewWriter returns a FLV writer
-func NewWriter(app, title, url string, ctx http.ResponseWriter) *Writer {
+func NewWriter(app, title, url string, ctx io.Writer) *Writer {
 	ret := &Writer{
 		RWBaser: av.NewRWBase(time.Second * 10),
 
-		uid:         uid.NewID(),
-		app:         app,
-		title:       title,
-		url:         url,
-		ctx:         ctx,
-		closedChan:  make(chan struct{}),
-		buf:         make([]byte, headerLen),
-		packetQueue: make(chan *av.Packet, maxQueueNum),
+		uid:        uid.NewID(),
+		app:        app,
+		title:      title,
+		url:        url,
+		ctx:        ctx,
+		closedChan: make(chan struct{}),
+		buf:        make([]byte, headerLen+4),
 	}
 
-	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09})
-	pio.PutI32BE(ret.buf[:4], 0)
-	ret.ctx.Write(ret.buf[:4])
-	go func() {
-		err := ret.SendPacket()
-		if err != nil {
-			log.Error("SendPacket error: ", err)
-			ret.closed = true
-		}
-	}()
+	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00})
 	return ret
 }
 
-// DropPacket drops packets due to queue max
-func (flvWriter *Writer) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Warningf("[%v] packet queue max!!!", info)
-	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
-		if ok && tmpPkt.IsVideo {
-			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-			// dont't drop sps config and dont't drop key frame
-			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				log.Debug("insert keyframe to queue")
-				pktQue <- tmpPkt
-			}
-
-			if len(pktQue) > maxQueueNum-10 {
-				<-pktQue
-			}
-			// drop other packet
-			<-pktQue
-		}
-		// try to don't drop audio
-		if ok && tmpPkt.IsAudio {
-			log.Debug("insert audio to queue")
-			pktQue <- tmpPkt
-		}
-	}
-	log.Debug("packet queue len: ", len(pktQue))
-}
-
-// Write writes packet
-func (flvWriter *Writer) Write(p *av.Packet) (err error) {
-	err = nil
-	if flvWriter.closed {
-		err = fmt.Errorf("flvwrite source closed")
-		return
+// Write writes packet, the writer is closed if it fails
+func (flvWriter *Writer) Write(p *av.Packet) error {
+	flvWriter.lock.Lock()
+	defer flvWriter.lock.Unlock()
+	select {
+	case <-flvWriter.closedChan:
+		return fmt.Errorf("flvwrite source closed")
+	default:
 	}
-
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("FLVWriter has already been closed:%v", e)
-		}
-	}()
-
-	if len(flvWriter.packetQueue) >= maxQueueNum-24 {
-		flvWriter.DropPacket(flvWriter.packetQueue, flvWriter.Info())
-	} else {
-		flvWriter.packetQueue <- p
+	if err := flvWriter.writeTag(p); err != nil {
+		log.Errorf("[%v] http flv write error: %v", flvWriter.Info(), err)
+		flvWriter.Close(err)
+		return err
 	}
-
-	return
+	return nil
 }
 
-// SendPacket sends packet
-func (flvWriter *Writer) SendPacket() error {
-	for {
-		p, ok := <-flvWriter.packetQueue
-		if ok {
-			flvWriter.SetPreTime()
-			h := flvWriter.buf[:headerLen]
-			typeID := av.TagVideo
-			if !p.IsVideo {
-				if p.IsMetadata {
-					var err error
-					typeID = av.TagScriptDataAMF0
-					p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
-					if err != nil {
-						return err
-					}
-				} else {
-					typeID = av.TagAudio
-				}
-			}
-			dataLen := len(p.Data)
-			timestamp := p.TimeStamp
-			timestamp += flvWriter.BaseTimestamp()
-			flvWriter.RecTimestamp(timestamp, uint32(typeID))
-
-			preDataLen := dataLen + headerLen
-			timestampbase := timestamp & 0xffffff
-			timestampExt := timestamp >> 24 & 0xff
-
-			pio.PutU8(h[0:1], uint8(typeID))
-			pio.PutI24BE(h[1:4], int32(dataLen))
-			pio.PutI24BE(h[4:7], int32(timestampbase))
-			pio.PutU8(h[7:8], uint8(timestampExt))
-
-			if _, err := flvWriter.ctx.Write(h); err != nil {
-				return err
-			}
-
-			if _, err := flvWriter.ctx.Write(p.Data); err != nil {
-				return err
-			}
-
-			pio.PutI32BE(h[:4], int32(preDataLen))
-			if _, err := flvWriter.ctx.Write(h[:4]); err != nil {
+// writeTag writes p as a flv tag, p is shared with other writers
+func (flvWriter *Writer) writeTag(p *av.Packet) error {
+	flvWriter.SetPreTime()
+	h := flvWriter.buf[:headerLen]
+	typeID := av.TagVideo
+	data := p.Data
+	if !p.IsVideo {
+		if p.IsMetadata {
+			var err error
+			typeID = av.TagScriptDataAMF0
+			data, err = amf.MetaDataReform(data, amf.DEL)
+			if err != nil {
 				return err
 			}
 		} else {
-			return fmt.Errorf("closed")
+			typeID = av.TagAudio
 		}
+	}
+	dataLen := len(data)
+	timestamp := p.TimeStamp
+	timestamp += flvWriter.BaseTimestamp()
+	flvWriter.RecTimestamp(timestamp, uint32(typeID))
+
+	preDataLen := dataLen + headerLen
+	timestampbase := timestamp & 0xffffff
+	timestampExt := timestamp >> 24 & 0xff
+
+	pio.PutU8(h[0:1], uint8(typeID))
+	pio.PutI24BE(h[1:4], int32(dataLen))
+	pio.PutI24BE(h[4:7], int32(timestampbase))
+	pio.PutU8(h[7:8], uint8(timestampExt))
+
+	if mw, ok := flvWriter.ctx.(messageWriter); ok {
+		tail := flvWriter.buf[headerLen:]
+		pio.PutI32BE(tail, int32(preDataLen))
+		return mw.WriteMessage(h, data, tail)
+	}
 
+	if _, err := flvWriter.ctx.Write(h); err != nil {
+		return err
+	}
+	if _, err := flvWriter.ctx.Write(data); err != nil {
+		return err
 	}
+	pio.PutI32BE(h[:4], int32(preDataLen))
+	_, err := flvWriter.ctx.Write(h[:4])
+	return err
 }
 
 // Wait waits for writer closing
@@ -171,14 +128,29 @@ func (flvWriter *Writer) Wait() {
 	}
 }
 
+// WaitSent waits for the writer closing and its last write, e.g. before
+// its http handler returns
+func (flvWriter *Writer) WaitSent() {
+	flvWriter.Wait()
+	flvWriter.lock.Lock()
+	flvWriter.lock.Unlock()
+}
+
+// Alive returns if the writer is alive, a WebSocket player must also
+// answer the pings
+func (flvWriter *Writer) Alive() bool {
+	if a, ok := flvWriter.ctx.(av.Aliver); ok && !a.Alive() {
+		return false
+	}
+	return flvWriter.RWBaser.Alive()
+}
+
 // Close closes the writer
 func (flvWriter *Writer) Close(error) {
 	log.Debug("http flv closed")
-	if !flvWriter.closed {
-		close(flvWriter.packetQueue)
+	flvWriter.closeOnce.Do(func() {
 		close(flvWriter.closedChan)
-	}
-	flvWriter.closed = true
+	})
 }
 
 // Info returns the information
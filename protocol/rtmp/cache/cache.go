@@ -1,12 +1,15 @@
 package cache
 
 import (
+	"sync"
+
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
 )
 
 // Cache is a cache of rtmp
 type Cache struct {
+	lock     sync.RWMutex
 	gop      *GopCache
 	videoSeq *SpecialCache
 	audioSeq *SpecialCache
@@ -23,10 +26,13 @@ func NewCache() *Cache {
 	}
 }
 
-// Write writes packet
-func (cache *Cache) Write(p av.Packet) {
+// Write writes packet, the cache retains the packets it keeps
+func (cache *Cache) Write(p *av.Packet) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
 	if p.IsMetadata {
-		cache.metadata.Write(&p)
+		cache.metadata.Write(p)
 		return
 	}
 
@@ -35,21 +41,74 @@ func (cache *Cache) Write(p av.Packet) {
 		if ok {
 			if ah.SoundFormat() == av.SoundAAC &&
 				ah.AACPacketType() == av.AACSeqHeader {
-				cache.audioSeq.Write(&p)
+				cache.audioSeq.Write(p)
 			}
 			return
 		}
 	} else {
 		vh, ok := p.Header.(av.VideoPacketHeader)
-		if ok {
-			if vh.IsSeq() {
-				cache.videoSeq.Write(&p)
-			}
+		if !ok {
+			return
+		}
+		if vh.IsSeq() {
+			cache.videoSeq.Write(p)
 			return
 		}
 	}
 
-	cache.gop.Write(&p)
+	cache.gop.Write(p)
+}
+
+// Reset releases all cached packets, e.g. when another publisher takes
+// over the stream
+func (cache *Cache) Reset() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.gop.Reset()
+	cache.videoSeq.Reset()
+	cache.audioSeq.Reset()
+	cache.metadata.Reset()
+}
+
+// KeyFrame returns the video sequence header and the latest key frame,
+// they are nil if not received yet, they are retained and must be released
+func (cache *Cache) KeyFrame() (seq *av.Packet, key *av.Packet) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	seq, key = cache.videoSeq.Packet(), cache.gop.KeyFrame()
+	seq.Retain()
+	key.Retain()
+	return
+}
+
+// SequenceHeaders returns the video and the audio sequence headers, they
+// are nil if not received yet, they are retained and must be released
+func (cache *Cache) SequenceHeaders() (video *av.Packet, audio *av.Packet) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	video, audio = cache.videoSeq.Packet(), cache.audioSeq.Packet()
+	video.Retain()
+	audio.Retain()
+	return
+}
+
+// Packets returns the cached packets in the order of Send, so that they
+// can be sent out of the publisher goroutine, they are retained and must
+// be released
+func (cache *Cache) Packets() []*av.Packet {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	var packets []*av.Packet
+	for _, p := range []*av.Packet{cache.metadata.Packet(), cache.videoSeq.Packet(), cache.audioSeq.Packet()} {
+		if p != nil {
+			packets = append(packets, p)
+		}
+	}
+	packets = append(packets, cache.gop.Packets()...)
+	for _, p := range packets {
+		p.Retain()
+	}
+	return packets
 }
 
 // Send send the packets to WriteCloser
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVideo(isKey bool, timestamp uint32) *av.Packet {
+	if isKey {
+		return newTestPacket([]byte{0x17, 0x01, 0, 0, 0, 0xaa}, timestamp)
+	}
+	return newTestPacket([]byte{0x27, 0x01, 0, 0, 0, 0xaa}, timestamp)
+}
+
+func newTestPacket(data []byte, timestamp uint32) *av.Packet {
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, true)
+	return &av.Packet{IsVideo: true, TimeStamp: timestamp, Header: &tag, Data: data}
+}
+
+func TestGopCachePackets(t *testing.T) {
+	at := assert.New(t)
+	for _, num := range []int{1, 2, 3} {
+		c := &Cache{
+			gop:      NewGopCache(num),
+			videoSeq: NewSpecialCache(),
+			audioSeq: NewSpecialCache(),
+			metadata: NewSpecialCache(),
+		}
+		c.Write(newTestPacket([]byte{0x17, 0x00, 0, 0, 0, 0x01}, 0))
+
+		// 4 gops of 2 frames
+		for ts := uint32(0); ts < 8; ts++ {
+			c.Write(newTestVideo(ts%2 == 0, ts))
+		}
+
+		packets := c.Packets()
+		at.True(packets[0].Header.(av.VideoPacketHeader).IsSeq())
+		var timestamps []uint32
+		for _, p := range packets[1:] {
+			timestamps = append(timestamps, p.TimeStamp)
+		}
+		var expected []uint32
+		for ts := uint32(8 - 2*num); ts < 8; ts++ {
+			expected = append(expected, ts)
+		}
+		at.Equal(expected, timestamps)
+
+		_, key := c.KeyFrame()
+		at.Equal(uint32(6), key.TimeStamp)
+	}
+}
+
+type testRecycler struct {
+	put int
+}
+
+func (r *testRecycler) Put(b []byte) {
+	r.put++
+}
+
+func TestCacheRelease(t *testing.T) {
+	at := assert.New(t)
+	c := &Cache{
+		gop:      NewGopCache(1),
+		videoSeq: NewSpecialCache(),
+		audioSeq: NewSpecialCache(),
+		metadata: NewSpecialCache(),
+	}
+	r := &testRecycler{}
+	write := func(p *av.Packet) {
+		p.Share(r)
+		c.Write(p)
+		p.Release()
+	}
+
+	write(newTestPacket([]byte{0x17, 0x00, 0, 0, 0, 0x01}, 0))
+	for ts := uint32(0); ts < 4; ts++ {
+		write(newTestVideo(ts%2 == 0, ts))
+	}
+	// the first gop is released
+	at.Equal(2, r.put)
+
+	packets := c.Packets()
+	write(newTestVideo(true, 4))
+	at.Equal(2, r.put)
+	for _, p := range packets {
+		p.Release()
+	}
+	at.Equal(4, r.put)
+
+	// a new sequence header releases the old one
+	write(newTestPacket([]byte{0x17, 0x00, 0, 0, 0, 0x02}, 5))
+	at.Equal(5, r.put)
+
+	// reset releases everything, the gop starts again at a key frame
+	c.Reset()
+	at.Equal(7, r.put)
+	write(newTestVideo(false, 6))
+	at.Empty(c.Packets())
+	write(newTestVideo(true, 7))
+	at.Equal(1, len(c.Packets()))
+}
@@ -26,7 +26,12 @@ func newArray() *array {
 	return ret
 }
 
+// reset releases all packets in this array
 func (array *array) reset() {
+	for i, p := range array.packets {
+		p.Release()
+		array.packets[i] = nil
+	}
 	array.index = 0
 	array.packets = array.packets[:0]
 }
@@ -35,21 +40,15 @@ func (array *array) write(packet *av.Packet) error {
 	if array.index >= maxGOPCap {
 		return ErrGopTooBig
 	}
+	packet.Retain()
 	array.packets = append(array.packets, packet)
 	array.index++
 	return nil
 }
 
-// send send all packet in this array to WriteCloser
-func (array *array) send(w av.WriteCloser) error {
-	var err error
-	for i := 0; i < array.index; i++ {
-		packet := array.packets[i]
-		if err = w.Write(packet); err != nil {
-			return err
-		}
-	}
-	return err
+// appendTo appends all packets in this array to packets
+func (array *array) appendTo(packets []*av.Packet) []*av.Packet {
+	return append(packets, array.packets[:array.index]...)
 }
 
 // GopCache is a gop cache
@@ -59,6 +58,7 @@ type GopCache struct {
 	count     int
 	nextindex int
 	gops      []*array
+	keyFrame  *av.Packet
 }
 
 // NewGopCache returns a GopCache
@@ -82,13 +82,18 @@ func (gopCache *GopCache) writeToArray(chunk *av.Packet, startNew bool) error {
 		}
 		gopCache.nextindex = (gopCache.nextindex + 1) % gopCache.count
 	} else {
-		ginc = gopCache.gops[(gopCache.nextindex+1)%gopCache.count]
+		ginc = gopCache.gops[gopCache.last()]
 	}
 	ginc.write(chunk)
 
 	return nil
 }
 
+// last returns the index of the latest gop
+func (gopCache *GopCache) last() int {
+	return (gopCache.nextindex - 1 + gopCache.count) % gopCache.count
+}
+
 // Write writes a packet
 func (gopCache *GopCache) Write(p *av.Packet) {
 	var ok bool
@@ -98,30 +103,55 @@ func (gopCache *GopCache) Write(p *av.Packet) {
 			ok = true
 		}
 	}
+	if ok {
+		gopCache.keyFrame = p
+	}
 	if ok || gopCache.start {
 		gopCache.start = true
 		gopCache.writeToArray(p, ok)
 	}
 }
 
-func (gopCache *GopCache) sendTo(w av.WriteCloser) error {
-	var err error
-	pos := (gopCache.nextindex + 1) % gopCache.count
+// Reset releases all gops, the cache starts again at the next key frame
+func (gopCache *GopCache) Reset() {
+	for i, gop := range gopCache.gops {
+		if gop != nil {
+			gop.reset()
+			gopCache.gops[i] = nil
+		}
+	}
+	gopCache.start = false
+	gopCache.num = 0
+	gopCache.nextindex = 0
+	gopCache.keyFrame = nil
+}
+
+// Packets returns all packets in the cache, from the oldest gop
+func (gopCache *GopCache) Packets() []*av.Packet {
+	var packets []*av.Packet
+	pos := gopCache.last()
 	for i := 0; i < gopCache.num; i++ {
 		index := (pos - gopCache.num + 1) + i
 		if index < 0 {
 			index += gopCache.count
 		}
-		g := gopCache.gops[index]
-		err = g.send(w)
-		if err != nil {
+		packets = gopCache.gops[index].appendTo(packets)
+	}
+	return packets
+}
+
+// Send sends all packet into WriteCloser
+func (gopCache *GopCache) Send(w av.WriteCloser) error {
+	for _, p := range gopCache.Packets() {
+		packet := *p
+		if err := w.Write(&packet); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Send sends all packet into WriteCloser
-func (gopCache *GopCache) Send(w av.WriteCloser) error {
-	return gopCache.sendTo(w)
+// KeyFrame returns the latest key frame
+func (gopCache *GopCache) KeyFrame() *av.Packet {
+	return gopCache.keyFrame
 }
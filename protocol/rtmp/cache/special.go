@@ -38,16 +38,35 @@ func NewSpecialCache() *SpecialCache {
 	return &SpecialCache{}
 }
 
-// Write write packet
+// Write write packet, the previous one is released
 func (specialCache *SpecialCache) Write(p *av.Packet) {
+	p.Retain()
+	specialCache.p.Release()
 	specialCache.p = p
 	specialCache.full = true
 }
 
+// Reset releases the packet
+func (specialCache *SpecialCache) Reset() {
+	specialCache.p.Release()
+	specialCache.p = nil
+	specialCache.full = false
+}
+
 // Send send packet to WriteCloser
 func (specialCache *SpecialCache) Send(w av.WriteCloser) error {
 	if !specialCache.full {
 		return nil
 	}
-	return w.Write(specialCache.p)
+	// writers may modify the packet, e.g. hls demuxes it in place
+	p := *specialCache.p
+	return w.Write(&p)
+}
+
+// Packet returns the packet, nil if the cache is empty
+func (specialCache *SpecialCache) Packet() *av.Packet {
+	if !specialCache.full {
+		return nil
+	}
+	return specialCache.p
 }
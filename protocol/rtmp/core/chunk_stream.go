@@ -23,6 +23,7 @@ type ChunkStream struct {
 	got       bool
 	tmpFromat uint32
 	Data      []byte
+	pool      *pool.Pool
 }
 
 func (chunkStream *ChunkStream) full() bool {
@@ -34,6 +35,13 @@ func (chunkStream *ChunkStream) new(pool *pool.Pool) {
 	chunkStream.index = 0
 	chunkStream.remain = chunkStream.Length
 	chunkStream.Data = pool.Get(int(chunkStream.Length))
+	chunkStream.pool = pool
+}
+
+// Pool returns the pool Data is allocated from, nil if Data is not read
+// from a connection
+func (chunkStream *ChunkStream) Pool() *pool.Pool {
+	return chunkStream.pool
 }
 
 func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
@@ -81,13 +89,64 @@ END:
 	return w.WriteError()
 }
 
+// appendHeader appends the type 0 header of the first chunk to b
+func (chunkStream *ChunkStream) appendHeader(b []byte) ([]byte, error) {
+	if chunkStream.CSID >= 64 {
+		return b, fmt.Errorf("csid=%d", chunkStream.CSID)
+	}
+	if chunkStream.Length > 0xffffff {
+		return b, fmt.Errorf("length=%d", chunkStream.Length)
+	}
+	ts := chunkStream.Timestamp
+	if ts > 0xffffff {
+		ts = 0xffffff
+	}
+	b = append(b, byte(chunkStream.CSID),
+		byte(ts>>16), byte(ts>>8), byte(ts),
+		byte(chunkStream.Length>>16), byte(chunkStream.Length>>8), byte(chunkStream.Length),
+		byte(chunkStream.TypeID))
+	b = append(b, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], chunkStream.StreamID)
+	if ts >= 0xffffff {
+		b = append(b, make([]byte, 4)...)
+		binary.BigEndian.PutUint32(b[len(b)-4:], chunkStream.Timestamp)
+	}
+	return b, nil
+}
+
+// chunkCSID returns the chunk stream id of messages of typeID, 0 if the
+// message is not audio, video or metadata
+func chunkCSID(typeID uint32) uint32 {
+	switch typeID {
+	case av.TagAudio:
+		return 4
+	case av.TagVideo, av.TagScriptDataAMF0, av.TagScriptDataAMF3:
+		return 6
+	}
+	return 0
+}
+
+// ChunkBody splits the data of a message of typeID into chunks of
+// chunkSize, each chunk but the first one starts with its type 3 header.
+// It does not depend on the connection, so that it is computed once and
+// shared by all the connections with the same chunk size.
+func ChunkBody(typeID uint32, data []byte, chunkSize int) []byte {
+	n := 0
+	if len(data) > 0 {
+		n = (len(data) - 1) / chunkSize
+	}
+	body := make([]byte, 0, len(data)+n)
+	for len(data) > chunkSize {
+		body = append(body, data[:chunkSize]...)
+		body = append(body, 0xc0|byte(chunkCSID(typeID)))
+		data = data[chunkSize:]
+	}
+	return append(body, data...)
+}
+
 func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
-	if chunkStream.TypeID == av.TagAudio {
-		chunkStream.CSID = 4
-	} else if chunkStream.TypeID == av.TagVideo ||
-		chunkStream.TypeID == av.TagScriptDataAMF0 ||
-		chunkStream.TypeID == av.TagScriptDataAMF3 {
-		chunkStream.CSID = 6
+	if csid := chunkCSID(chunkStream.TypeID); csid != 0 {
+		chunkStream.CSID = csid
 	}
 
 	totalLen := uint32(0)
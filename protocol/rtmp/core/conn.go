@@ -31,6 +31,11 @@ type Conn struct {
 	rw                  *ReadWriter
 	pool                *pool.Pool
 	chunks              map[uint32]ChunkStream
+
+	// header, vec and bufs are reused by WriteChunked
+	header []byte
+	vec    [2][]byte
+	bufs   net.Buffers
 }
 
 // NewConn returns a rtmp connection
@@ -89,6 +94,40 @@ func (conn *Conn) Write(c *ChunkStream) error {
 	return c.writeChunk(conn.rw, int(conn.chunkSize))
 }
 
+// ChunkSize returns the chunk size for writing
+func (conn *Conn) ChunkSize() uint32 {
+	return conn.chunkSize
+}
+
+// WriteChunked writes an audio, video or metadata message, body is its
+// data split by ChunkBody with the chunk size of conn. The buffered bytes
+// are flushed, then the header and the body are written at once with
+// vectored I/O.
+func (conn *Conn) WriteChunked(c *ChunkStream, body []byte) error {
+	c.CSID = chunkCSID(c.TypeID)
+	c.Format = 0
+	if c.CSID == 0 || c.Length == 0 || c.Timestamp >= 0xffffff {
+		// the body can not be split in advance, e.g. the type 3 headers
+		// carry the extended timestamp
+		if err := c.writeChunk(conn.rw, int(conn.chunkSize)); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}
+	var err error
+	if conn.header, err = c.appendHeader(conn.header[:0]); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	conn.vec[0], conn.vec[1] = conn.header, body
+	conn.bufs = conn.vec[:]
+	_, err = conn.bufs.WriteTo(conn.Conn)
+	conn.vec[1] = nil
+	return err
+}
+
 // Flush flushes unwritten bytes
 func (conn *Conn) Flush() error {
 	return conn.rw.Flush()
@@ -211,6 +250,15 @@ func (conn *Conn) SetBegin() {
 	conn.Write(&ret)
 }
 
+// SetEOF sets stream EOF message
+func (conn *Conn) SetEOF() {
+	ret := conn.userControlMsg(streamEOF, 4)
+	for i := 0; i < 4; i++ {
+		ret.Data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
+	}
+	conn.Write(&ret)
+}
+
 // SetRecorded sets recorded message
 func (conn *Conn) SetRecorded() {
 	ret := conn.userControlMsg(streamIsRecorded, 4)
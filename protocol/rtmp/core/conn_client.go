@@ -8,6 +8,7 @@ import (
 	"net"
 	neturl "net/url"
 	"strings"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
@@ -23,17 +24,59 @@ var (
 	playStart      = "NetStream.Play.Start"
 	connectSuccess = "NetConnection.Connect.Success"
 	onBWDone       = "onBWDone"
+	cmdFCSubscribe = "FCSubscribe"
+	levelError     = "error"
+)
+
+const (
+	defaultFlashVer = "FMS.3.1"
+	// startTimeout bounds the handshake and the commands of Start
+	startTimeout = 10 * time.Second
 )
 
 var (
 	// ErrResponse means response error
 	ErrResponse = fmt.Errorf("response err")
+	// ErrClientStopped means the client stopped reconnecting
+	ErrClientStopped = fmt.Errorf("client stopped")
 )
 
+// StatusError is the _error or error onStatus answered to a command
+type StatusError struct {
+	Command     string
+	Code        string
+	Description string
+}
+
+func newStatusError(cmd string, info amf.Object) *StatusError {
+	err := &StatusError{Command: cmd, Code: respError}
+	if code, ok := info["code"].(string); ok {
+		err.Code = code
+	}
+	if description, ok := info["description"].(string); ok {
+		err.Description = description
+	}
+	return err
+}
+
+func (e *StatusError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("%s: %s", e.Command, e.Code)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Command, e.Code, e.Description)
+}
+
 // ConnClient is the connection client
 type ConnClient struct {
+	// FlashVer, SwfURL and PageURL are sent in the connect command,
+	// the URLs are omitted if empty
+	FlashVer string
+	SwfURL   string
+	PageURL  string
+
 	done       bool
 	transID    int
+	method     string
 	url        string
 	tcurl      string
 	app        string
@@ -50,10 +93,11 @@ type ConnClient struct {
 // NewConnClient returns a ConnClient
 func NewConnClient() *ConnClient {
 	return &ConnClient{
-		transID: 1,
-		bytesw:  bytes.NewBuffer(nil),
-		encoder: &amf.Encoder{},
-		decoder: &amf.Decoder{},
+		FlashVer: defaultFlashVer,
+		transID:  1,
+		bytesw:   bytes.NewBuffer(nil),
+		encoder:  &amf.Encoder{},
+		decoder:  &amf.Decoder{},
 	}
 }
 
@@ -63,73 +107,94 @@ func (connClient *ConnClient) DecodeBatch(r io.Reader, ver amf.Version) (ret []i
 	return vs, err
 }
 
+// readRespMsg reads the messages of the server until the response to the
+// current command, the other commands are ignored
 func (connClient *ConnClient) readRespMsg() error {
-	var err error
 	var rc ChunkStream
 	for {
-		if err = connClient.conn.Read(&rc); err != nil {
+		if err := connClient.conn.Read(&rc); err != nil {
 			return err
 		}
-		if err != nil && err != io.EOF {
-			return err
+		if rc.TypeID != 20 && rc.TypeID != 17 {
+			continue
 		}
-		switch rc.TypeID {
-		case 20, 17:
-			r := bytes.NewReader(rc.Data)
-			vs, _ := connClient.decoder.DecodeBatch(r, amf.AMF0)
-
-			log.Debugf("readRespMsg: vs=%v", vs)
-			for k, v := range vs {
-				switch v.(type) {
-				case string:
-					switch connClient.curcmdName {
-					case cmdConnect, cmdCreateStream:
-						if v.(string) != respResult {
-							return fmt.Errorf(v.(string))
-						}
-
-					case cmdPublish:
-						if v.(string) != onStatus {
-							return ErrResponse
-						}
-					}
-				case float64:
-					switch connClient.curcmdName {
-					case cmdConnect, cmdCreateStream:
-						id := int(v.(float64))
-
-						if k == 1 {
-							if id != connClient.transID {
-								return ErrResponse
-							}
-						} else if k == 3 {
-							connClient.streamid = uint32(id)
-						}
-					case cmdPublish:
-						if int(v.(float64)) != 0 {
-							return ErrResponse
-						}
-					}
-				case amf.Object:
-					objmap := v.(amf.Object)
-					switch connClient.curcmdName {
-					case cmdConnect:
-						code, ok := objmap["code"]
-						if ok && code.(string) != connectSuccess {
-							return ErrResponse
-						}
-					case cmdPublish:
-						code, ok := objmap["code"]
-						if ok && code.(string) != publishStart {
-							return ErrResponse
-						}
-					}
-				}
+		data := rc.Data
+		if rc.TypeID == 17 && len(data) > 0 {
+			data = data[1:]
+		}
+		vs, _ := connClient.decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+		log.Debugf("readRespMsg: vs=%v", vs)
+		if len(vs) < 2 {
+			continue
+		}
+		name, _ := vs[0].(string)
+		id, _ := vs[1].(float64)
+		switch name {
+		case respResult, respError:
+			// e.g. the results of releaseStream and FCPublish
+			if int(id) != connClient.transID {
+				continue
+			}
+			if name == respError {
+				return newStatusError(connClient.curcmdName, infoObject(vs[2:]))
+			}
+			return connClient.result(vs[2:])
+		case onStatus:
+			if done, err := connClient.status(infoObject(vs[2:])); done {
+				return err
 			}
+		default:
+			log.Debugf("readRespMsg: ignore %s", name)
+		}
+	}
+}
 
-			return nil
+// infoObject returns the information object of the arguments of a
+// response, nil if none
+func infoObject(args []interface{}) amf.Object {
+	for i := len(args) - 1; i >= 0; i-- {
+		if obj, ok := args[i].(amf.Object); ok {
+			return obj
 		}
 	}
+	return nil
+}
+
+// result handles the _result of the current command
+func (connClient *ConnClient) result(args []interface{}) error {
+	switch connClient.curcmdName {
+	case cmdConnect:
+		info := infoObject(args)
+		if code, ok := info["code"].(string); ok && code != connectSuccess {
+			return newStatusError(cmdConnect, info)
+		}
+	case cmdCreateStream:
+		if len(args) < 2 {
+			return ErrResponse
+		}
+		id, ok := args[1].(float64)
+		if !ok {
+			return ErrResponse
+		}
+		connClient.streamid = uint32(id)
+	}
+	return nil
+}
+
+// status handles an onStatus of the current command, done is set once
+// the command succeeded or failed
+func (connClient *ConnClient) status(info amf.Object) (done bool, err error) {
+	if level, _ := info["level"].(string); level == levelError {
+		return true, newStatusError(connClient.curcmdName, info)
+	}
+	code, _ := info["code"].(string)
+	switch connClient.curcmdName {
+	case cmdPublish:
+		return code == publishStart, nil
+	case cmdPlay:
+		return code == playStart, nil
+	}
+	return false, nil
 }
 
 func (connClient *ConnClient) writeMsg(args ...interface{}) error {
@@ -157,8 +222,14 @@ func (connClient *ConnClient) writeConnectMsg() error {
 	event := make(amf.Object)
 	event["app"] = connClient.app
 	event["type"] = "nonprivate"
-	event["flashVer"] = "FMS.3.1"
+	event["flashVer"] = connClient.FlashVer
 	event["tcUrl"] = connClient.tcurl
+	if connClient.SwfURL != "" {
+		event["swfUrl"] = connClient.SwfURL
+	}
+	if connClient.PageURL != "" {
+		event["pageUrl"] = connClient.PageURL
+	}
 	connClient.curcmdName = cmdConnect
 
 	log.Debugf("writeConnectMsg: connClient.transID=%d, event=%v", connClient.transID, event)
@@ -176,19 +247,15 @@ func (connClient *ConnClient) writeCreateStreamMsg() error {
 	if err := connClient.writeMsg(cmdCreateStream, connClient.transID, nil); err != nil {
 		return err
 	}
+	return connClient.readRespMsg()
+}
 
-	for {
-		err := connClient.readRespMsg()
-		if err == nil {
-			return err
-		}
-
-		if err == ErrResponse {
-			log.Debugf("writeCreateStreamMsg readRespMsg err=%v", err)
-			return err
-		}
-	}
-
+// writeStreamCmdMsg sends a command about the stream like releaseStream,
+// its response is not waited for as some servers do not answer it
+func (connClient *ConnClient) writeStreamCmdMsg(cmd string) error {
+	connClient.transID++
+	log.Debugf("writeStreamCmdMsg: connClient.transID=%d, cmd=%s", connClient.transID, cmd)
+	return connClient.writeMsg(cmd, connClient.transID, nil, connClient.title)
 }
 
 func (connClient *ConnClient) writePublishMsg() error {
@@ -218,6 +285,9 @@ func (connClient *ConnClient) Start(url string, method string) error {
 	if err != nil {
 		return err
 	}
+	connClient.transID = 1
+	connClient.streamid = 0
+	connClient.method = method
 	connClient.url = url
 	path := strings.TrimLeft(u.Path, "/")
 	ps := strings.SplitN(path, "/", 2)
@@ -270,7 +340,17 @@ func (connClient *ConnClient) Start(url string, method string) error {
 	log.Debug("connection:", "local:", conn.LocalAddr(), "remote:", conn.RemoteAddr())
 
 	connClient.conn = NewConn(conn, 4*1024)
+	connClient.conn.SetDeadline(time.Now().Add(startTimeout))
+	if err := connClient.start(method); err != nil {
+		return err
+	}
+	return connClient.conn.SetDeadline(time.Time{})
+}
 
+// start runs the handshake and the commands of method, FCPublish and
+// releaseStream before publishing and FCSubscribe before playing are
+// expected by CDNs
+func (connClient *ConnClient) start(method string) error {
 	log.Debug("HandshakeClient....")
 	if err := connClient.conn.HandshakeClient(); err != nil {
 		return err
@@ -280,6 +360,19 @@ func (connClient *ConnClient) Start(url string, method string) error {
 	if err := connClient.writeConnectMsg(); err != nil {
 		return err
 	}
+	switch method {
+	case av.PUBLISH:
+		if err := connClient.writeStreamCmdMsg(cmdReleaseStream); err != nil {
+			return err
+		}
+		if err := connClient.writeStreamCmdMsg(cmdFcpublish); err != nil {
+			return err
+		}
+	case av.PLAY:
+		if err := connClient.writeStreamCmdMsg(cmdFCSubscribe); err != nil {
+			return err
+		}
+	}
 	log.Debug("writeCreateStreamMsg....")
 	if err := connClient.writeCreateStreamMsg(); err != nil {
 		log.Debug("writeCreateStreamMsg error", err)
@@ -300,6 +393,32 @@ func (connClient *ConnClient) Start(url string, method string) error {
 	return nil
 }
 
+// Reconnect closes the connection and starts it again with the url and
+// method of Start until it succeeds, the delay between the attempts
+// doubles from a second up to max. It returns ErrClientStopped once stop
+// is closed.
+func (connClient *ConnClient) Reconnect(max time.Duration, stop <-chan struct{}) error {
+	connClient.Close(nil)
+	delay := time.Second
+	for {
+		select {
+		case <-stop:
+			return ErrClientStopped
+		case <-time.After(delay):
+		}
+		err := connClient.Start(connClient.url, connClient.method)
+		if err == nil {
+			log.Infof("reconnected to %s", connClient.url)
+			return nil
+		}
+		connClient.Close(err)
+		if delay *= 2; delay > max {
+			delay = max
+		}
+		log.Warningf("reconnect to %s error: %v, retry in %v", connClient.url, err, delay)
+	}
+}
+
 func (connClient *ConnClient) Write(c ChunkStream) error {
 	if c.TypeID == av.TagScriptDataAMF0 ||
 		c.TypeID == av.TagScriptDataAMF3 {
@@ -336,5 +455,7 @@ func (connClient *ConnClient) StreamID() uint32 {
 
 // Close closes thie ConnClient
 func (connClient *ConnClient) Close(err error) {
-	connClient.conn.Close()
+	if connClient.conn != nil {
+		connClient.conn.Close()
+	}
 }
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveOne accepts one client on l and answers its publish with start or
+// BadName, it returns the ConnServer once the command is handled
+func serveOne(l net.Listener, badName bool) chan *ConnServer {
+	done := make(chan *ConnServer, 1)
+	go func() {
+		defer close(done)
+		netconn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := NewConn(netconn, 4*1024)
+		if err := conn.HandshakeServer(); err != nil {
+			return
+		}
+		connServer := NewConnServer(conn)
+		if err := connServer.ReadMsg(); err != nil {
+			return
+		}
+		if connServer.IsPublisher() {
+			if badName {
+				connServer.PublishBadName()
+			} else {
+				connServer.PublishStart()
+			}
+		}
+		done <- connServer
+	}()
+	return done
+}
+
+func TestConnClientStart(t *testing.T) {
+	at := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	url := fmt.Sprintf("rtmp://%s/live/test", l.Addr())
+
+	for _, method := range []string{av.PUBLISH, av.PLAY} {
+		done := serveOne(l, false)
+		c := NewConnClient()
+		c.PageURL = "http://example.com/"
+		at.Nil(c.Start(url, method), method)
+		at.Equal(uint32(1), c.StreamID())
+		if s := <-done; at.NotNil(s) {
+			at.Equal(method == av.PUBLISH, s.IsPublisher())
+			at.Equal("test", s.PublishInfo.Name)
+			s.Close(nil)
+		}
+		c.Close(nil)
+	}
+
+	done := serveOne(l, true)
+	c := NewConnClient()
+	err = c.Start(url, av.PUBLISH)
+	if se, ok := err.(*StatusError); at.True(ok, fmt.Sprint(err)) {
+		at.Equal(cmdPublish, se.Command)
+		at.Equal("NetStream.Publish.BadName", se.Code)
+	}
+	<-done
+	c.Close(nil)
+}
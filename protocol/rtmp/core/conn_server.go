@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
@@ -31,6 +32,12 @@ var (
 	cmdFCUnpublish   = "FCUnpublish"
 	cmdDeleteStream  = "deleteStream"
 	cmdPlay          = "play"
+	cmdPause         = "pause"
+	cmdSeek          = "seek"
+	cmdReceiveAudio  = "receiveAudio"
+	cmdReceiveVideo  = "receiveVideo"
+	cmdCloseStream   = "closeStream"
+	cmdGetStreamLen  = "getStreamLength"
 )
 
 // ConnectInfo is the connection information
@@ -65,6 +72,15 @@ type PublishInfo struct {
 	Type string
 }
 
+// playState is the delivery a player asked for with its commands
+type playState struct {
+	sync.Mutex
+	paused  bool
+	noAudio bool
+	noVideo bool
+	waitKey bool
+}
+
 // ConnServer is the connection server
 type ConnServer struct {
 	ConnInfo    ConnectInfo
@@ -72,12 +88,18 @@ type ConnServer struct {
 
 	done          bool
 	streamID      int
+	publishCSID   uint32
+	publishStream uint32
 	isPublisher   bool
 	conn          *Conn
 	transactionID int
 	decoder       *amf.Decoder
 	encoder       *amf.Encoder
 	bytesw        *bytes.Buffer
+	// wmu serializes the responses to the commands of a player with
+	// its media
+	wmu  sync.Mutex
+	play playState
 }
 
 // NewConnServer returns a new connection server
@@ -204,12 +226,23 @@ func (connServer *ConnServer) publishOrPlay(vs []interface{}) error {
 	return nil
 }
 
-func (connServer *ConnServer) publishResp(cur *ChunkStream) error {
+func (connServer *ConnServer) publishResp(level, code, description string) error {
 	event := make(amf.Object)
-	event["level"] = "status"
-	event["code"] = "NetStream.Publish.Start"
-	event["description"] = "Start publising."
-	return connServer.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event)
+	event["level"] = level
+	event["code"] = code
+	event["description"] = description
+	return connServer.writeMsg(connServer.publishCSID, connServer.publishStream, "onStatus", 0, nil, event)
+}
+
+// PublishStart accepts the publisher, the publish request is only answered
+// once the publisher is accepted or refused
+func (connServer *ConnServer) PublishStart() error {
+	return connServer.publishResp("status", "NetStream.Publish.Start", "Start publising.")
+}
+
+// PublishBadName refuses the publisher as the stream is already published
+func (connServer *ConnServer) PublishBadName() error {
+	return connServer.publishResp("error", "NetStream.Publish.BadName", "Stream already publishing.")
 }
 
 func (connServer *ConnServer) playResp(cur *ChunkStream) error {
@@ -247,6 +280,112 @@ func (connServer *ConnServer) playResp(cur *ChunkStream) error {
 	return connServer.conn.Flush()
 }
 
+func (connServer *ConnServer) statusResp(cur *ChunkStream, code, description string) error {
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = code
+	event["description"] = description
+	return connServer.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event)
+}
+
+// flag returns the boolean argument of pause, receiveAudio and receiveVideo
+func flag(vs []interface{}) bool {
+	if len(vs) > 3 {
+		if v, ok := vs[3].(bool); ok {
+			return v
+		}
+	}
+	return true
+}
+
+// playCmd handles the commands of a player once it plays, the replies
+// are sent after the play state is unlocked
+func (connServer *ConnServer) playCmd(cmd string, vs []interface{}, c *ChunkStream) error {
+	if reply := connServer.updatePlay(cmd, vs, c); reply != nil {
+		return reply()
+	}
+	return nil
+}
+
+// updatePlay updates the play state for cmd and returns the reply to
+// send, nil if none
+func (connServer *ConnServer) updatePlay(cmd string, vs []interface{}, c *ChunkStream) func() error {
+	s := &connServer.play
+	s.Lock()
+	defer s.Unlock()
+	switch cmd {
+	case cmdPause:
+		if flag(vs) {
+			s.paused = true
+			return func() error {
+				connServer.conn.SetEOF()
+				return connServer.statusResp(c, "NetStream.Pause.Notify", "Paused stream.")
+			}
+		}
+		s.paused = false
+		s.waitKey = true
+		return func() error {
+			connServer.conn.SetBegin()
+			return connServer.statusResp(c, "NetStream.Unpause.Notify", "Unpaused stream.")
+		}
+	case cmdSeek:
+		// a live stream goes on from now, at its next key frame
+		s.waitKey = true
+	case cmdReceiveAudio:
+		s.noAudio = !flag(vs)
+		if s.noAudio {
+			return nil
+		}
+	case cmdReceiveVideo:
+		s.noVideo = !flag(vs)
+		if s.noVideo {
+			return nil
+		}
+		s.waitKey = true
+	case cmdCloseStream, cmdDeleteStream:
+		if s.paused {
+			return nil
+		}
+		s.paused = true
+		return func() error {
+			return connServer.statusResp(c, "NetStream.Play.Stop", "Stopped playing stream.")
+		}
+	case cmdPlay:
+		// playing again goes on with the same stream
+		s.paused, s.noAudio, s.noVideo, s.waitKey = false, false, false, true
+		return func() error {
+			return connServer.playResp(c)
+		}
+	}
+	return func() error {
+		if err := connServer.statusResp(c, "NetStream.Seek.Notify", "Seeking to the live point."); err != nil {
+			return err
+		}
+		return connServer.statusResp(c, "NetStream.Play.Start", "Started playing stream.")
+	}
+}
+
+// Delivers returns if the packet p is sent to the player, according to
+// its pause, seek, receiveAudio and receiveVideo commands. Video goes on
+// at a key frame, metadata and sequence headers are always sent.
+func (connServer *ConnServer) Delivers(p *av.Packet) bool {
+	s := &connServer.play
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case av.IsSpecial(p):
+		return true
+	case p.IsAudio:
+		return !s.paused && !s.noAudio
+	case s.paused || s.noVideo:
+		return false
+	case s.waitKey && !av.IsKeyFrame(p):
+		return false
+	}
+	s.waitKey = false
+	return true
+}
+
 func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 	amfType := amf.AMF0
 	if c.TypeID == 17 {
@@ -258,6 +397,13 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 		return err
 	}
 	// log.Debugf("rtmp req: %#v", vs)
+	cmd, _ := vs[0].(string)
+	if connServer.done && !connServer.isPublisher {
+		switch cmd {
+		case cmdPause, cmdSeek, cmdReceiveAudio, cmdReceiveVideo, cmdCloseStream, cmdDeleteStream, cmdPlay:
+			return connServer.playCmd(cmd, vs, c)
+		}
+	}
 	switch vs[0].(type) {
 	case string:
 		switch vs[0].(string) {
@@ -279,9 +425,8 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			if err = connServer.publishOrPlay(vs[1:]); err != nil {
 				return err
 			}
-			if err = connServer.publishResp(c); err != nil {
-				return err
-			}
+			connServer.publishCSID = c.CSID
+			connServer.publishStream = c.StreamID
 			connServer.done = true
 			connServer.isPublisher = true
 			log.Debug("handle publish req done")
@@ -299,6 +444,16 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			connServer.fcPublish(vs)
 		case cmdReleaseStream:
 			connServer.releaseStream(vs)
+		case cmdGetStreamLen:
+			if len(vs) > 1 {
+				if id, ok := vs[1].(float64); ok {
+					connServer.transactionID = int(id)
+				}
+			}
+			// live streams have no length
+			if err = connServer.writeMsg(c.CSID, c.StreamID, "_result", connServer.transactionID, nil, 0); err != nil {
+				return err
+			}
 		case cmdFCUnpublish:
 		case cmdDeleteStream:
 		default:
@@ -335,6 +490,8 @@ func (connServer *ConnServer) IsPublisher() bool {
 }
 
 func (connServer *ConnServer) Write(c ChunkStream) error {
+	connServer.wmu.Lock()
+	defer connServer.wmu.Unlock()
 	if c.TypeID == av.TagScriptDataAMF0 ||
 		c.TypeID == av.TagScriptDataAMF3 {
 		var err error
@@ -346,13 +503,43 @@ func (connServer *ConnServer) Write(c ChunkStream) error {
 	return connServer.conn.Write(&c)
 }
 
+// ChunkSize returns the chunk size for writing
+func (connServer *ConnServer) ChunkSize() uint32 {
+	return connServer.conn.ChunkSize()
+}
+
+// WriteChunked writes an audio or video message, body is its data split
+// by ChunkBody with the chunk size of the connection
+func (connServer *ConnServer) WriteChunked(c ChunkStream, body []byte) error {
+	connServer.wmu.Lock()
+	defer connServer.wmu.Unlock()
+	return connServer.conn.WriteChunked(&c, body)
+}
+
 // Flush does flushing
 func (connServer *ConnServer) Flush() error {
+	connServer.wmu.Lock()
+	defer connServer.wmu.Unlock()
 	return connServer.conn.Flush()
 }
 
+// Read reads a message, the commands of a player are handled and not
+// returned
 func (connServer *ConnServer) Read(c *ChunkStream) (err error) {
-	return connServer.conn.Read(c)
+	for {
+		if err = connServer.conn.Read(c); err != nil {
+			return err
+		}
+		if !connServer.done || connServer.isPublisher || (c.TypeID != 20 && c.TypeID != 17) {
+			return nil
+		}
+		connServer.wmu.Lock()
+		err = connServer.handleCmdMsg(c)
+		connServer.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
 }
 
 // GetInfo gets information
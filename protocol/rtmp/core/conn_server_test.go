@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendCmd sends the command of a player, if any, followed by
+// getStreamLength and returns the code of the first onStatus answered
+// before its _result
+func sendCmd(c *ConnClient, args ...interface{}) (string, error) {
+	if len(args) > 0 {
+		if err := c.writeMsg(args...); err != nil {
+			return "", err
+		}
+	}
+	if err := c.writeMsg(cmdGetStreamLen, 0, nil, "test"); err != nil {
+		return "", err
+	}
+	code := ""
+	var rc ChunkStream
+	for {
+		if err := c.conn.Read(&rc); err != nil {
+			return "", err
+		}
+		if rc.TypeID != 20 {
+			continue
+		}
+		vs, err := c.decoder.DecodeBatch(bytes.NewReader(rc.Data), amf.AMF0)
+		if err != nil && len(vs) == 0 {
+			return "", err
+		}
+		switch vs[0] {
+		case respResult:
+			if vs[1] == float64(0) {
+				return code, nil
+			}
+		case "onStatus":
+			if code == "" {
+				code, _ = infoObject(vs)["code"].(string)
+			}
+		}
+	}
+}
+
+// tagPacket returns a packet of the flv tag data
+func tagPacket(data ...byte) *av.Packet {
+	p := &av.Packet{IsVideo: data[0]&0x0f == av.VideoH264, Data: data}
+	p.IsAudio = !p.IsVideo
+	tag := &flv.Tag{}
+	tag.ParseMediaTagHeader(data, p.IsVideo)
+	p.Header = tag
+	return p
+}
+
+func TestConnServerPlayCmd(t *testing.T) {
+	at := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := serveOne(l, false)
+	c := NewConnClient()
+	if err := c.Start(fmt.Sprintf("rtmp://%s/live/test", l.Addr()), av.PLAY); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(nil)
+	s := <-done
+	if s == nil {
+		t.Fatal("no player")
+	}
+	go func() {
+		var cs ChunkStream
+		for s.Read(&cs) == nil {
+		}
+	}()
+
+	seq := tagPacket(0x17, 0x00, 0, 0, 0)
+	key := tagPacket(0x17, 0x01, 0, 0, 0)
+	inter := tagPacket(0x27, 0x01, 0, 0, 0)
+	audio := tagPacket(0xaf, 0x01)
+	cmd := func(args ...interface{}) string {
+		code, err := sendCmd(c, args...)
+		at.Nil(err)
+		return code
+	}
+
+	// the end of the play responses
+	at.Equal("NetStream.Data.Start", cmd())
+	at.True(s.Delivers(inter))
+	at.Equal("", cmd(cmdGetStreamLen, 3, nil, "test"))
+
+	at.Equal("NetStream.Pause.Notify", cmd(cmdPause, 4, nil, true, 1000))
+	at.False(s.Delivers(key))
+	at.False(s.Delivers(audio))
+	at.True(s.Delivers(seq))
+	at.Equal("NetStream.Unpause.Notify", cmd(cmdPause, 5, nil, false, 1000))
+	at.True(s.Delivers(audio))
+	at.False(s.Delivers(inter))
+	at.True(s.Delivers(key))
+	at.True(s.Delivers(inter))
+
+	at.Equal("", cmd(cmdReceiveVideo, 6, nil, false))
+	at.False(s.Delivers(key))
+	at.True(s.Delivers(audio))
+	at.Equal("NetStream.Seek.Notify", cmd(cmdReceiveVideo, 7, nil, true))
+	at.False(s.Delivers(inter))
+	at.True(s.Delivers(key))
+
+	at.Equal("", cmd(cmdReceiveAudio, 8, nil, false))
+	at.False(s.Delivers(audio))
+	at.True(s.Delivers(inter))
+
+	at.Equal("NetStream.Play.Stop", cmd(cmdCloseStream, 9, nil))
+	at.False(s.Delivers(key))
+	at.Equal("NetStream.Play.Reset", cmd(cmdPlay, 10, nil, "test"))
+	at.True(s.Delivers(audio))
+	at.False(s.Delivers(inter))
+	at.True(s.Delivers(key))
+}
+
+func TestConnServerPlayCmdBlocked(t *testing.T) {
+	at := assert.New(t)
+	nc, peer := net.Pipe()
+	defer nc.Close()
+	s := NewConnServer(NewConn(nc, 1024))
+
+	// the player reads nothing, the replies block
+	replied := make(chan error, 1)
+	go func() {
+		replied <- s.playCmd(cmdPlay, []interface{}{cmdPlay, 1, nil, "test"}, &ChunkStream{CSID: 5, StreamID: 1})
+	}()
+	delivered := make(chan bool, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		delivered <- s.Delivers(tagPacket(0x17, 0x01, 0, 0, 0))
+	}()
+	select {
+	case ok := <-delivered:
+		at.True(ok)
+	case <-time.After(5 * time.Second):
+		t.Error("packets are blocked by the replies")
+	}
+	peer.Close()
+	at.NotNil(<-replied)
+}
@@ -3,8 +3,11 @@ package core
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"net"
 	"testing"
 
+	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/utils/pool"
 
 	"github.com/stretchr/testify/assert"
@@ -250,3 +253,92 @@ func TestConnWrite(t *testing.T) {
 	conn.Flush()
 	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0xa0, 0x0, 0x0, 0x4, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
 }
+
+// discardConn is a net.Conn which discards what is written
+type discardConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func newWriteConn(w io.Writer, chunkSize uint32) *Conn {
+	c := &discardConn{w: w}
+	return &Conn{
+		Conn:      c,
+		rw:        NewReadWriter(c, 1024),
+		chunkSize: chunkSize,
+	}
+}
+
+func TestConnWriteChunked(t *testing.T) {
+	at := assert.New(t)
+	for _, size := range []int{1, 127, 128, 129, 307, 4096} {
+		for _, ts := range []uint32{40, 0xffffff, 0x1000000} {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			c := ChunkStream{
+				TypeID:    av.TagVideo,
+				StreamID:  1,
+				Timestamp: ts,
+				Length:    uint32(size),
+				Data:      data,
+			}
+
+			expected := bytes.NewBuffer(nil)
+			conn := newWriteConn(expected, 128)
+			cc := c
+			at.Nil(conn.Write(&cc))
+			at.Nil(conn.Flush())
+
+			got := bytes.NewBuffer(nil)
+			conn = newWriteConn(got, 128)
+			cc = c
+			at.Nil(conn.WriteChunked(&cc, ChunkBody(c.TypeID, data, 128)))
+			at.Equal(expected.Bytes(), got.Bytes(), "size %d, timestamp %d", size, ts)
+		}
+	}
+}
+
+func BenchmarkConnWrite(b *testing.B) {
+	const players = 100
+	data := make([]byte, 16*1024)
+	c := ChunkStream{
+		TypeID:    av.TagVideo,
+		StreamID:  1,
+		Timestamp: 40,
+		Length:    uint32(len(data)),
+		Data:      data,
+	}
+	conns := make([]*Conn, players)
+	for i := range conns {
+		conns[i] = newWriteConn(ioutil.Discard, 4096)
+	}
+
+	b.Run("chunk", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data) * players))
+		for i := 0; i < b.N; i++ {
+			for _, conn := range conns {
+				cc := c
+				conn.Write(&cc)
+				conn.Flush()
+			}
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data) * players))
+		for i := 0; i < b.N; i++ {
+			body := ChunkBody(c.TypeID, data, 4096)
+			for _, conn := range conns {
+				cc := c
+				conn.WriteChunked(&cc, body)
+			}
+		}
+	})
+}
@@ -0,0 +1,423 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/filesource"
+	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFailoverTimeout = 3000
+	defaultSlateGrace      = 30
+	// publishInput is the policy of a publisher becoming an input of a
+	// Failover which already feeds the stream
+	publishInput = "input"
+)
+
+// the inputs of a Failover by priority
+const (
+	inputPrimary = iota
+	inputBackup
+	inputSlate
+	inputNum
+)
+
+// failoverInput returns the info of the stream fed by the publisher of
+// info and if the publisher is its backup input, ok is false if the
+// application of info has neither backup inputs nor slate
+func failoverInput(info av.Info) (out av.Info, backup bool, ok bool) {
+	app := strings.SplitN(info.Key, "/", 2)[0]
+	suffix, _ := configure.GetBackupInput(app)
+	slate, _ := configure.GetSlate(app)
+	if suffix == "" && slate == "" {
+		return info, false, false
+	}
+	out = info
+	if suffix != "" && strings.HasSuffix(info.Key, suffix) {
+		out.Key = strings.TrimSuffix(info.Key, suffix)
+		out.URL = strings.TrimSuffix(info.URL, suffix)
+		backup = true
+	}
+	return out, backup, true
+}
+
+// input is a publisher of a Failover
+type input struct {
+	r        av.ReadCloser
+	kind     int
+	cache    *cache.Cache
+	last     time.Time
+	hasVideo bool
+
+	// the timestamps of the input are mapped from base to start once it
+	// is active, pending until its first packet
+	pending bool
+	base    uint32
+	start   uint32
+}
+
+// Failover is the reader of a stream fed by a primary and a backup input.
+// It reads the primary and switches to the backup when the primary stalls
+// longer than the failover timeout, and back to the primary at its next
+// key frame. When both are gone, the slate flv of the application is
+// played in loop until one comes back within the grace period. Every
+// switch sends the sequence headers of the new input and rebases its
+// timestamps, so that the stream goes on for the players.
+type Failover struct {
+	av.RWBaser
+
+	info    av.Info
+	timeout time.Duration
+	slate   string
+	grace   time.Duration
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	inputs [inputNum]*input
+	active *input
+	queue  []*av.Packet
+	lastTs uint32
+	closed bool
+}
+
+// NewFailover returns the Failover of the stream of info, it reads
+// nothing until inputs are set
+func NewFailover(info av.Info) *Failover {
+	app := strings.SplitN(info.Key, "/", 2)[0]
+	_, timeout := configure.GetBackupInput(app)
+	if timeout <= 0 {
+		timeout = defaultFailoverTimeout
+	}
+	slate, grace := configure.GetSlate(app)
+	if grace <= 0 {
+		grace = defaultSlateGrace
+	}
+	info.UID = uid.NewID()
+	f := &Failover{
+		RWBaser: av.NewRWBase(time.Second * time.Duration(readTimeout)),
+		info:    info,
+		timeout: time.Duration(timeout) * time.Millisecond,
+		slate:   slate,
+		grace:   time.Duration(grace) * time.Second,
+	}
+	f.cond = sync.NewCond(&f.lock)
+	go f.check()
+	return f
+}
+
+func kind(backup bool) int {
+	if backup {
+		return inputBackup
+	}
+	return inputPrimary
+}
+
+func newInput(r av.ReadCloser, kind int) *input {
+	return &input{
+		r:     r,
+		kind:  kind,
+		cache: cache.NewCache(),
+		last:  time.Now(),
+	}
+}
+
+// SetInput sets the primary or backup input, the previous one is closed
+func (f *Failover) SetInput(r av.ReadCloser, backup bool) {
+	in := newInput(r, kind(backup))
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		r.Close(fmt.Errorf("failover closed"))
+		return
+	}
+	old := f.inputs[in.kind]
+	f.inputs[in.kind] = in
+	if old != nil {
+		old.cache.Reset()
+		if f.active == old {
+			f.active = nil
+		}
+	}
+	f.lock.Unlock()
+	if old != nil {
+		old.r.Close(fmt.Errorf("replaced"))
+	}
+	go f.run(in)
+}
+
+// Inputs returns the primary and backup inputs, nil if missing
+func (f *Failover) Inputs() (primary, backup av.ReadCloser) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if in := f.inputs[inputPrimary]; in != nil {
+		primary = in.r
+	}
+	if in := f.inputs[inputBackup]; in != nil {
+		backup = in.r
+	}
+	return
+}
+
+// Active returns the input being read, nil if none
+func (f *Failover) Active() av.ReadCloser {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.active == nil {
+		return nil
+	}
+	return f.active.r
+}
+
+// hasInput returns if the primary or backup input is set
+func (f *Failover) hasInput(backup bool) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.inputs[kind(backup)] != nil
+}
+
+// Closed returns if all inputs are gone
+func (f *Failover) Closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+// run reads the input until it fails or is replaced
+func (f *Failover) run(in *input) {
+	for {
+		p := &av.Packet{}
+		if err := in.r.Read(p); err != nil {
+			f.removeInput(in, err)
+			return
+		}
+		if !p.Shared() {
+			p.Share(nil)
+		}
+
+		f.lock.Lock()
+		if f.inputs[in.kind] != in {
+			f.lock.Unlock()
+			p.Release()
+			return
+		}
+		in.last = time.Now()
+		if p.IsVideo {
+			in.hasVideo = true
+		}
+		// an input is switched back to at its next key frame
+		if (f.active == nil || in.kind < f.active.kind) && in.isKey(p) {
+			log.Infof("[%v] switch to input [%v]", f.info, in.r.Info())
+			f.activate(in, false)
+		}
+		if f.active == in {
+			f.emit(in, p)
+		}
+		in.cache.Write(p)
+		f.lock.Unlock()
+		p.Release()
+	}
+}
+
+// isKey returns if the input may be switched to at p
+func (in *input) isKey(p *av.Packet) bool {
+	return av.IsKeyFrame(p) || (!in.hasVideo && p.IsAudio)
+}
+
+// removeInput removes the failed input, the next one by priority becomes
+// active and the slate is started when no publisher is left
+func (f *Failover) removeInput(in *input, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.inputs[in.kind] != in {
+		return
+	}
+	log.Debugf("[%v] input [%v] closed: %v", f.info, in.r.Info(), err)
+	f.inputs[in.kind] = nil
+	in.cache.Reset()
+	if in.kind != inputSlate && f.inputs[inputPrimary] == nil && f.inputs[inputBackup] == nil {
+		f.startSlate()
+	}
+	if f.active == in {
+		f.active = nil
+		for _, other := range f.inputs {
+			if other != nil {
+				log.Infof("[%v] switch to input [%v]", f.info, other.r.Info())
+				f.activate(other, true)
+				break
+			}
+		}
+	}
+	if f.inputs == [inputNum]*input{} {
+		f.closed = true
+		f.cond.Broadcast()
+	}
+}
+
+// startSlate plays the slate in loop until a publisher comes back or the
+// grace period is over
+func (f *Failover) startSlate() {
+	if f.slate == "" || f.inputs[inputSlate] != nil {
+		return
+	}
+	paths := strings.SplitN(f.info.Key, "/", 2)
+	if len(paths) != 2 {
+		return
+	}
+	src, err := filesource.NewSource(paths[0], paths[1], []string{f.slate}, true)
+	if err != nil {
+		log.Warningf("[%v] slate %s error: %v", f.info, f.slate, err)
+		return
+	}
+	log.Infof("[%v] publishers gone, play slate %s for %v", f.info, f.slate, f.grace)
+	in := newInput(src, inputSlate)
+	f.inputs[inputSlate] = in
+	go f.run(in)
+	time.AfterFunc(f.grace, func() {
+		src.Close(fmt.Errorf("slate grace period over"))
+	})
+}
+
+// stopSlate stops the slate once a publisher is active
+func (f *Failover) stopSlate() {
+	in := f.inputs[inputSlate]
+	if in == nil || f.active == in {
+		return
+	}
+	f.inputs[inputSlate] = nil
+	in.cache.Reset()
+	in.r.Close(fmt.Errorf("publisher back"))
+}
+
+// check switches to another input when the active one stalls
+func (f *Failover) check() {
+	interval := f.timeout / 10
+	if interval < 50*time.Millisecond {
+		interval = 50 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.lock.Lock()
+		if f.closed {
+			f.lock.Unlock()
+			return
+		}
+		if a := f.active; a != nil && time.Since(a.last) > f.timeout {
+			for _, other := range f.inputs {
+				if other != nil && other != a && time.Since(other.last) < f.timeout {
+					log.Warningf("[%v] input [%v] stalled, switch to input [%v]", f.info, a.r.Info(), other.r.Info())
+					f.activate(other, true)
+					break
+				}
+			}
+		}
+		f.lock.Unlock()
+	}
+}
+
+// activate makes in the active input, its cached sequence headers are
+// sent first, followed by its cached gop if replay
+func (f *Failover) activate(in *input, replay bool) {
+	f.active = in
+	in.pending = true
+	for _, p := range in.cache.Packets() {
+		if replay || av.IsSpecial(p) {
+			f.emit(in, p)
+		}
+		p.Release()
+	}
+	f.stopSlate()
+}
+
+// emit queues p of the active input with its rebased timestamp
+func (f *Failover) emit(in *input, p *av.Packet) {
+	ts := f.lastTs
+	if in.pending && !av.IsSpecial(p) {
+		in.pending = false
+		in.base = p.TimeStamp
+		in.start = f.lastTs
+	}
+	if !in.pending {
+		if d := int32(p.TimeStamp - in.base); d > 0 {
+			ts = in.start + uint32(d)
+		} else {
+			ts = in.start
+		}
+	}
+	if ts > f.lastTs {
+		f.lastTs = ts
+	}
+
+	p.Retain()
+	pkt := *p
+	pkt.TimeStamp = ts
+	f.queue = append(f.queue, &pkt)
+	f.cond.Signal()
+}
+
+// Read reads the next packet of the active input
+func (f *Failover) Read(p *av.Packet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.queue) == 0 && !f.closed {
+		f.cond.Wait()
+	}
+	if len(f.queue) == 0 {
+		return io.EOF
+	}
+	*p = *f.queue[0]
+	f.queue[0] = nil
+	f.queue = f.queue[1:]
+	return nil
+}
+
+// Alive returns if any input is alive
+func (f *Failover) Alive() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, in := range f.inputs {
+		if in != nil && in.r.Alive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Info returns the info of the stream
+func (f *Failover) Info() av.Info {
+	return f.info
+}
+
+// Close closes all inputs
+func (f *Failover) Close(err error) {
+	f.lock.Lock()
+	inputs := f.inputs
+	f.inputs = [inputNum]*input{}
+	f.active = nil
+	f.closed = true
+	for _, in := range inputs {
+		if in != nil {
+			in.cache.Reset()
+		}
+	}
+	release(f.queue)
+	f.queue = nil
+	f.cond.Broadcast()
+	f.lock.Unlock()
+
+	for _, in := range inputs {
+		if in != nil {
+			in.r.Close(err)
+		}
+	}
+}
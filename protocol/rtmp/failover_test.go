@@ -0,0 +1,224 @@
+package rtmp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"github.com/stretchr/testify/assert"
+)
+
+// newInputVideo returns a sequence header, key or inter frame of the
+// input id, which is the last byte of its data
+func newInputVideo(kind string, timestamp uint32, id byte) *av.Packet {
+	data := []byte{0x27, 0x01, 0, 0, 0, id}
+	switch kind {
+	case "seq":
+		data[0], data[1] = 0x17, 0x00
+	case "key":
+		data[0] = 0x17
+	}
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, true)
+	return &av.Packet{IsVideo: true, TimeStamp: timestamp, Header: &tag, Data: data}
+}
+
+// readInput reads the next packet of f, it returns its input id
+func readInput(t *testing.T, f *Failover) (id byte, kind string, timestamp uint32) {
+	p := &av.Packet{}
+	if err := f.Read(p); err != nil {
+		t.Fatal(err)
+	}
+	kind = "inter"
+	if av.IsSpecial(p) {
+		kind = "seq"
+	} else if av.IsKeyFrame(p) {
+		kind = "key"
+	}
+	return p.Data[5], kind, p.TimeStamp
+}
+
+// feed sends inter frames to r every 10ms until stop is closed
+func feed(r *chanReader, ts uint32, id byte, stop chan struct{}) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ; ; ts += 40 {
+			select {
+			case r.packets <- newInputVideo("inter", ts, id):
+			case <-stop:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return done
+}
+
+func TestFailover(t *testing.T) {
+	at := assert.New(t)
+	defer setApp(map[string]interface{}{"backup_suffix": "_backup", "failover_timeout": 100})()
+
+	f := NewFailover(av.Info{Key: "live/test"})
+	primary, backup := newChanReader("primary"), newChanReader("backup")
+	f.SetInput(primary, false)
+	f.SetInput(backup, true)
+
+	primary.packets <- newInputVideo("seq", 0, 1)
+	primary.packets <- newInputVideo("key", 0, 1)
+	primary.packets <- newInputVideo("inter", 40, 1)
+	backup.packets <- newInputVideo("seq", 5000, 2)
+	backup.packets <- newInputVideo("key", 5000, 2)
+	for _, want := range []struct {
+		kind string
+		ts   uint32
+	}{{"seq", 0}, {"key", 0}, {"inter", 40}} {
+		id, kind, ts := readInput(t, f)
+		at.Equal([]interface{}{byte(1), want.kind, want.ts}, []interface{}{id, kind, ts})
+	}
+	at.Equal(primary, f.Active())
+
+	// the primary stalls, the backup goes on from its sequence header and
+	// gop with the timestamps following the primary
+	stop := make(chan struct{})
+	done := feed(backup, 5040, 2, stop)
+	for _, want := range []struct {
+		kind string
+		ts   uint32
+	}{{"seq", 40}, {"key", 40}, {"inter", 80}, {"inter", 120}} {
+		id, kind, ts := readInput(t, f)
+		at.Equal([]interface{}{byte(2), want.kind, want.ts}, []interface{}{id, kind, ts})
+	}
+	at.Equal(backup, f.Active())
+
+	// the primary recovers at its next key frame
+	primary.packets <- newInputVideo("inter", 1000, 1)
+	primary.packets <- newInputVideo("key", 1040, 1)
+	var last uint32
+	id, kind, ts := readInput(t, f)
+	for ; id == 2; id, kind, ts = readInput(t, f) {
+		at.True(ts >= last)
+		last = ts
+	}
+	at.Equal([]interface{}{"seq", last}, []interface{}{kind, ts})
+	_, kind, ts = readInput(t, f)
+	at.Equal([]interface{}{"key", last}, []interface{}{kind, ts})
+	primary.packets <- newInputVideo("inter", 1080, 1)
+	id, _, ts = readInput(t, f)
+	at.Equal([]interface{}{byte(1), last + 40}, []interface{}{id, ts})
+	close(stop)
+	<-done
+
+	// the backup takes over at once when the primary is gone
+	close(primary.packets)
+	id, kind, _ = readInput(t, f)
+	at.Equal([]interface{}{byte(2), "seq"}, []interface{}{id, kind})
+	close(backup.packets)
+	for err := error(nil); err == nil; err = f.Read(&av.Packet{}) {
+	}
+	at.True(f.Closed())
+}
+
+func TestFailoverSlate(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "livego-slate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flvDir := configure.Config.GetString("flv_dir")
+	defer configure.Config.Set("flv_dir", flvDir)
+	configure.Config.Set("flv_dir", dir)
+	file, err := os.Create(filepath.Join(dir, "slate.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flv.WriteClip(file, newInputVideo("seq", 0, 3), newInputVideo("key", 0, 3))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setApp(map[string]interface{}{"slate": "slate.flv", "slate_grace": 1})()
+
+	f := NewFailover(av.Info{Key: "live/test"})
+	primary := newChanReader("primary")
+	f.SetInput(primary, false)
+	primary.packets <- newInputVideo("seq", 0, 1)
+	primary.packets <- newInputVideo("key", 0, 1)
+	primary.packets <- newInputVideo("inter", 40, 1)
+	for i := 0; i < 3; i++ {
+		readInput(t, f)
+	}
+
+	// the slate goes on when the publisher drops
+	close(primary.packets)
+	for _, want := range []struct {
+		kind string
+		ts   uint32
+	}{{"seq", 40}, {"key", 40}, {"seq", 80}, {"key", 80}} {
+		id, kind, ts := readInput(t, f)
+		at.Equal([]interface{}{byte(3), want.kind, want.ts}, []interface{}{id, kind, ts})
+	}
+
+	// the publisher comes back within the grace period
+	primary = newChanReader("primary")
+	f.SetInput(primary, false)
+	primary.packets <- newInputVideo("seq", 9000, 1)
+	primary.packets <- newInputVideo("key", 9000, 1)
+	last := uint32(80)
+	id, kind, ts := readInput(t, f)
+	for ; id == 3; id, kind, ts = readInput(t, f) {
+		at.True(ts >= last)
+		last = ts
+	}
+	at.Equal([]interface{}{"seq", last}, []interface{}{kind, ts})
+	_, kind, ts = readInput(t, f)
+	at.Equal([]interface{}{"key", last}, []interface{}{kind, ts})
+	at.Equal(primary, f.Active())
+	f.lock.Lock()
+	at.Nil(f.inputs[inputSlate])
+	f.lock.Unlock()
+
+	// the stream ends when the grace period is over
+	close(primary.packets)
+	start := time.Now()
+	for err := error(nil); err == nil; err = f.Read(&av.Packet{}) {
+	}
+	at.True(time.Since(start) >= 900*time.Millisecond)
+	at.True(f.Closed())
+}
+
+func TestStreamsBackupInput(t *testing.T) {
+	at := assert.New(t)
+	defer setApp(map[string]interface{}{"backup_suffix": "_backup"})()
+	rs := &Streams{streams: cmap.New()}
+
+	primary, backup := newChanReader("primary"), newChanReader("backup")
+	backup.key = "live/test_backup"
+	at.Equal("", rs.PublishPolicy(backup.Info()))
+	rs.HandleReader(backup)
+	at.Equal(publishInput, rs.PublishPolicy(primary.Info()))
+	rs.HandleReader(primary)
+
+	at.False(rs.streams.Has("live/test_backup"))
+	i, _ := rs.streams.Get("live/test")
+	f, ok := i.(*Stream).Reader().(*Failover)
+	if at.True(ok) {
+		p, b := f.Inputs()
+		at.Equal(primary, p)
+		at.Equal(backup, b)
+		at.Equal("live/test", f.Info().Key)
+	}
+	w := newTsWriter()
+	rs.HandleWriter(w)
+	close(primary.packets)
+	close(backup.packets)
+	<-w.closed
+}
@@ -129,9 +129,8 @@ func (s *Server) handleConn(conn *core.Conn) error {
 
 	log.Debugf("handleConn: IsPublisher=%v", connServer.IsPublisher())
 	if connServer.IsPublisher() {
-		channel, err := configure.RoomKeys.GetChannel(name)
+		channel, err := PublishChannel(appname, name)
 		if err != nil {
-			err := fmt.Errorf("invalid key")
 			conn.Close()
 			log.Error("CheckKey err: ", err)
 			return err
@@ -141,17 +140,20 @@ func (s *Server) handleConn(conn *core.Conn) error {
 			log.Debugf("GetStaticPushUrlList: %v", pushlist)
 		}
 		reader := NewVirReader(connServer)
-		s.handler.HandleReader(reader)
-		log.Debugf("new publisher: %+v", reader.Info())
-
-		if s.getter != nil {
-			writeType := reflect.TypeOf(s.getter)
-			log.Debugf("handleConn:writeType=%v", writeType)
-			writer := s.getter.Writer(reader.Info())
-			s.handler.HandleWriter(writer)
+		if publishPolicy(s.handler, reader.Info()) == PublishReject {
+			connServer.PublishBadName()
+			conn.Close()
+			log.Warningf("[%v] stream already publishing, publisher refused", reader.Info())
+			return ErrPublishBadName
+		}
+		if err := connServer.PublishStart(); err != nil {
+			conn.Close()
+			log.Error("handleConn publish response err: ", err)
+			return err
+		}
+		if err := HandlePublisher(s.handler, s.getter, reader); err != nil {
+			return err
 		}
-		flvWriter := new(flv.Dvr)
-		s.handler.HandleWriter(flvWriter.Writer(reader.Info()))
 	} else {
 		writer := NewVirWriter(connServer)
 		log.Debugf("new player: %+v", writer.Info())
@@ -161,6 +163,89 @@ func (s *Server) handleConn(conn *core.Conn) error {
 	return nil
 }
 
+// publishPolicier is a handler with a publish policy, i.e. Streams
+type publishPolicier interface {
+	PublishPolicy(info av.Info) string
+}
+
+// publishPolicy returns the policy applying to a new publisher of info,
+// it is empty if the stream is not published
+func publishPolicy(handler av.Handler, info av.Info) string {
+	if pp, ok := handler.(publishPolicier); ok {
+		return pp.PublishPolicy(info)
+	}
+	return ""
+}
+
+// publishHandler is a handler which returns the policy it applied to a
+// new publisher, i.e. Streams
+type publishHandler interface {
+	publish(r av.ReadCloser) string
+}
+
+// publish hands r over to handler, it returns the policy applied to r,
+// which may differ from the one checked before if another publisher came
+// in between
+func publish(handler av.Handler, r av.ReadCloser) string {
+	if ph, ok := handler.(publishHandler); ok {
+		return ph.publish(r)
+	}
+	handler.HandleReader(r)
+	return ""
+}
+
+// PublishChannel checks the room key of a publisher of appname, it
+// returns the channel the key is for
+func PublishChannel(appname, key string) (string, error) {
+	if !configure.CheckAppName(appname) {
+		return "", fmt.Errorf("application name=%s is not configured", appname)
+	}
+	channel, err := configure.RoomKeys.GetChannel(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid key")
+	}
+	routed := configure.RouteKey(appname + "/" + channel)
+	if app := strings.SplitN(routed, "/", 2)[0]; !configure.CheckAppName(app) {
+		return "", fmt.Errorf("application name=%s of %s is not configured", app, routed)
+	}
+	return channel, nil
+}
+
+// HandlePublisher hands a publisher over to handler, together with the
+// writer from getter (e.g. hls) and the flv dvr when it publishes a new
+// stream or takes one over.
+// The publisher is closed with ErrPublishBadName if the stream is already
+// published and its application rejects other publishers.
+func HandlePublisher(handler av.Handler, getter av.GetWriter, reader av.ReadCloser) error {
+	switch publish(handler, reader) {
+	case PublishReject:
+		return ErrPublishBadName
+	case PublishStandby, publishInput:
+		// the writers of the stream are kept for the standby or input
+		return nil
+	}
+	log.Debugf("new publisher: %+v", reader.Info())
+	// the writers of a routed publisher or of a backup input write the
+	// stream it feeds
+	info := reader.Info()
+	info.Key = configure.RouteKey(info.Key)
+	if out, _, ok := failoverInput(info); ok {
+		info = out
+	}
+
+	if getter != nil {
+		writeType := reflect.TypeOf(getter)
+		log.Debugf("HandlePublisher: writeType=%v", writeType)
+		writer := getter.Writer(info)
+		handler.HandleWriter(writer)
+	}
+	flvWriter := new(flv.Dvr)
+	if writer := flvWriter.Writer(info); writer != nil {
+		handler.HandleWriter(writer)
+	}
+	return nil
+}
+
 // GetInfo returns a struct that can return a info
 type GetInfo interface {
 	GetInfo() (string, string, string)
@@ -196,6 +281,7 @@ type VirWriter struct {
 	closed      bool
 	conn        StreamReadWriteCloser
 	packetQueue chan *av.Packet
+	dropper     av.GopDropper
 	WriteBWInfo StaticsBW
 }
 
@@ -256,38 +342,6 @@ func (v *VirWriter) Check() {
 	}
 }
 
-// DropPacket drops packet due to queue max
-func (v *VirWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
-	log.Warningf("[%v] packet queue max!!!", info)
-	for i := 0; i < maxQueueNum-84; i++ {
-		tmpPkt, ok := <-pktQue
-		// try to don't drop audio
-		if ok && tmpPkt.IsAudio {
-			if len(pktQue) > maxQueueNum-2 {
-				log.Debug("drop audio pkt")
-				<-pktQue
-			} else {
-				pktQue <- tmpPkt
-			}
-
-		}
-
-		if ok && tmpPkt.IsVideo {
-			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
-			// dont't drop sps config and dont't drop key frame
-			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
-				pktQue <- tmpPkt
-			}
-			if len(pktQue) > maxQueueNum-10 {
-				log.Debug("drop video pkt")
-				<-pktQue
-			}
-		}
-
-	}
-	log.Debug("packet queue len: ", len(pktQue))
-}
-
 // Write writes packet
 func (v *VirWriter) Write(p *av.Packet) (err error) {
 	err = nil
@@ -301,15 +355,52 @@ func (v *VirWriter) Write(p *av.Packet) (err error) {
 			err = fmt.Errorf("VirWriter has already been closed:%v", e)
 		}
 	}()
+	if !v.dropper.Keep(p) {
+		return
+	}
 	if len(v.packetQueue) >= maxQueueNum-24 {
-		v.DropPacket(v.packetQueue, v.Info())
-	} else {
-		v.packetQueue <- p
+		log.Warningf("[%v] packet queue max!!!", v.Info())
+		v.dropper.CongestChan(v.packetQueue)
+		if !v.dropper.Keep(p) {
+			return
+		}
 	}
-
+	p.Retain()
+	v.packetQueue <- p
 	return
 }
 
+// DropStats returns the number of dropped packets and bytes
+func (v *VirWriter) DropStats() av.DropStats {
+	return v.dropper.Stats()
+}
+
+// chunkedWriter writes audio and video messages split into chunks in
+// advance, so that the chunks of a packet are shared by all the players
+// with the same chunk size
+type chunkedWriter interface {
+	ChunkSize() uint32
+	WriteChunked(core.ChunkStream, []byte) error
+}
+
+// playController is a player connection which may pause or leave out
+// the audio or the video of the stream
+type playController interface {
+	Delivers(*av.Packet) bool
+}
+
+// chunkKind is the kind of av.Packet.Serialized for rtmp chunks
+const chunkKind = "rtmp"
+
+// chunkBody splits the data of p into chunks of chunkSize
+func chunkBody(p *av.Packet, chunkSize int) []byte {
+	typeID := uint32(av.TagAudio)
+	if p.IsVideo {
+		typeID = av.TagVideo
+	}
+	return core.ChunkBody(typeID, p.Data, chunkSize)
+}
+
 // SendPacket sends packet
 func (v *VirWriter) SendPacket() error {
 	Flush := reflect.ValueOf(v.conn).MethodByName("Flush")
@@ -317,6 +408,12 @@ func (v *VirWriter) SendPacket() error {
 	for {
 		p, ok := <-v.packetQueue
 		if ok {
+			// a paused player is alive while its packets are left out
+			v.SetPreTime()
+			if pc, ok := v.conn.(playController); ok && !pc.Delivers(p) {
+				p.Release()
+				continue
+			}
 			cs.Data = p.Data
 			cs.Length = uint32(len(p.Data))
 			cs.StreamID = p.StreamID
@@ -334,14 +431,22 @@ func (v *VirWriter) SendPacket() error {
 			}
 
 			v.SaveStatics(p.StreamID, uint64(cs.Length), p.IsVideo)
-			v.SetPreTime()
 			v.RecTimestamp(cs.Timestamp, cs.TypeID)
-			err := v.conn.Write(cs)
+			var err error
+			if cw, ok := v.conn.(chunkedWriter); ok && !p.IsMetadata {
+				body := p.Serialized(chunkKind, int(cw.ChunkSize()), chunkBody)
+				err = cw.WriteChunked(cs, body)
+			} else {
+				err = v.conn.Write(cs)
+				if err == nil {
+					Flush.Call(nil)
+				}
+			}
+			p.Release()
 			if err != nil {
 				v.closed = true
 				return err
 			}
-			Flush.Call(nil)
 		} else {
 			return fmt.Errorf("closed")
 		}
@@ -460,6 +565,9 @@ func (v *VirReader) Read(p *av.Packet) (err error) {
 	p.StreamID = cs.StreamID
 	p.Data = cs.Data
 	p.TimeStamp = cs.Timestamp
+	if pool := cs.Pool(); pool != nil {
+		p.Share(pool)
+	}
 
 	v.SaveStatics(p.StreamID, uint64(len(p.Data)), p.IsVideo)
 	v.demuxer.DemuxH(p)
@@ -0,0 +1,81 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pausedConn is a player connection which is paused, it delivers no
+// packet
+type pausedConn struct {
+	lock   sync.Mutex
+	closed error
+	done   chan struct{}
+}
+
+func newPausedConn() *pausedConn {
+	return &pausedConn{done: make(chan struct{})}
+}
+
+func (c *pausedConn) GetInfo() (string, string, string) {
+	return "live", "test", "rtmp://127.0.0.1/live/test"
+}
+
+func (c *pausedConn) Read(*core.ChunkStream) error {
+	<-c.done
+	return fmt.Errorf("closed")
+}
+
+func (c *pausedConn) Write(core.ChunkStream) error {
+	return fmt.Errorf("paused player written")
+}
+
+func (c *pausedConn) Flush() error {
+	return nil
+}
+
+func (c *pausedConn) Delivers(*av.Packet) bool {
+	return false
+}
+
+func (c *pausedConn) Close(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed == nil {
+		c.closed = err
+		close(c.done)
+	}
+}
+
+func (c *pausedConn) Closed() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+func TestVirWriterPaused(t *testing.T) {
+	at := assert.New(t)
+	defer func(timeout int) {
+		writeTimeout = timeout
+	}(writeTimeout)
+	writeTimeout = 1
+
+	conn := newPausedConn()
+	v := NewVirWriter(conn)
+	defer conn.Close(fmt.Errorf("test done"))
+
+	// paused longer than the write timeout while the stream goes on
+	for ts := uint32(0); ts < 1500; ts += 100 {
+		at.Nil(v.Write(newTestVideo(ts == 0, ts)))
+		time.Sleep(100 * time.Millisecond)
+	}
+	at.True(v.Alive())
+	at.Nil(conn.Closed())
+}
@@ -0,0 +1,73 @@
+package rtmprelay
+
+import (
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newConnClient returns a ConnClient with the connect fields from config
+func newConnClient() *core.ConnClient {
+	c := core.NewConnClient()
+	if v := configure.Config.GetString("relay_flash_ver"); v != "" {
+		c.FlashVer = v
+	}
+	c.SwfURL = configure.Config.GetString("relay_swf_url")
+	c.PageURL = configure.Config.GetString("relay_page_url")
+	return c
+}
+
+// reconnect reconnects c failed with err until it succeeds, it returns
+// false if reconnecting is disabled or stop is closed first
+func reconnect(c *core.ConnClient, err error, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	max := configure.Config.GetInt("relay_reconnect")
+	_, _, url := c.GetInfo()
+	if max <= 0 {
+		log.Warningf("relay %s error: %v", url, err)
+		return false
+	}
+	log.Warningf("relay %s error: %v, reconnecting", url, err)
+	return c.Reconnect(time.Duration(max)*time.Second, stop) == nil
+}
+
+// headerSlot returns the slot of the metadata or sequence header p
+// among the headers sent again after reconnecting, -1 for other packets
+func headerSlot(p *av.Packet) int {
+	switch {
+	case !av.IsSpecial(p):
+		return -1
+	case p.IsMetadata:
+		return 0
+	case p.IsVideo:
+		return 1
+	}
+	return 2
+}
+
+// chunkPacket returns the packet of the chunk c with its parsed header
+func chunkPacket(c *core.ChunkStream) *av.Packet {
+	p := &av.Packet{
+		IsVideo:    c.TypeID == av.TagVideo,
+		IsAudio:    c.TypeID == av.TagAudio,
+		IsMetadata: c.TypeID == av.TagScriptDataAMF0 || c.TypeID == av.TagScriptDataAMF3,
+		TimeStamp:  c.Timestamp,
+		Data:       c.Data,
+	}
+	if p.IsVideo || p.IsAudio {
+		tag := &flv.Tag{}
+		if _, err := tag.ParseMediaTagHeader(c.Data, p.IsVideo); err == nil {
+			p.Header = tag
+		}
+	}
+	return p
+}
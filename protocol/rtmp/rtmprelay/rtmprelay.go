@@ -3,24 +3,21 @@ package rtmprelay
 import (
 	"bytes"
 	"fmt"
-	"io"
 
+	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/gwuhaolin/livego/protocol/rtmp/core"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	stopCtrl = "RTMPRELAY_STOP"
-)
-
-// RtmpRelay is a relay for rtmp stream
+// RtmpRelay is a relay for rtmp stream, both sides are reconnected when
+// they fail
 type RtmpRelay struct {
 	PlayURL              string
 	PublishURL           string
 	csChan               chan core.ChunkStream
-	sndctrlChan          chan string
+	stop                 chan struct{}
 	connectPlayClient    *core.ConnClient
 	connectPublishClient *core.ConnClient
 	startflag            bool
@@ -32,7 +29,6 @@ func NewRtmpRelay(playURL *string, publishURL *string) *RtmpRelay {
 		PlayURL:              *playURL,
 		PublishURL:           *publishURL,
 		csChan:               make(chan core.ChunkStream, 500),
-		sndctrlChan:          make(chan string),
 		connectPlayClient:    nil,
 		connectPublishClient: nil,
 		startflag:            false,
@@ -42,18 +38,26 @@ func NewRtmpRelay(playURL *string, publishURL *string) *RtmpRelay {
 // rcvPlayChunkStream received play chunk stream
 func (relay *RtmpRelay) rcvPlayChunkStream() {
 	log.Debug("rcvPlayRtmpMediaPacket connectClient.Read...")
+	// the timestamps go on from last after reconnecting
+	var offset, last uint32
+	rebase := false
 	for {
 		var rc core.ChunkStream
 
-		if relay.startflag == false {
+		err := relay.connectPlayClient.Read(&rc)
+		if err != nil {
+			if !reconnect(relay.connectPlayClient, err, relay.stop) {
+				break
+			}
+			rebase = true
+			continue
+		}
+		select {
+		case <-relay.stop:
 			relay.connectPlayClient.Close(nil)
 			log.Debugf("rcvPlayChunkStream close: playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
-			break
-		}
-		err := relay.connectPlayClient.Read(&rc)
-
-		if err != nil && err == io.EOF {
-			break
+			return
+		default:
 		}
 		//log.Debugf("connectPlayClient.Read return rc.TypeID=%v length=%d, err=%v", rc.TypeID, len(rc.Data), err)
 		switch rc.TypeID {
@@ -65,24 +69,65 @@ func (relay *RtmpRelay) rcvPlayChunkStream() {
 		case 18:
 			log.Debug("rcvPlayRtmpMediaPacket: metadata....")
 		case 8, 9:
-			relay.csChan <- rc
+			if rebase {
+				offset = last - rc.Timestamp
+				rebase = false
+			}
+			rc.Timestamp += offset
+			last = rc.Timestamp
+			select {
+			case relay.csChan <- rc:
+			case <-relay.stop:
+				relay.connectPlayClient.Close(nil)
+				return
+			}
 		}
 	}
+	relay.connectPlayClient.Close(nil)
 }
 
-// sendPublishChunkStream sends publish chunk stream
+// sendPublishChunkStream sends publish chunk stream, the sequence headers
+// are sent again after reconnecting and the video waits for a key frame
 func (relay *RtmpRelay) sendPublishChunkStream() {
+	var headers [3]*core.ChunkStream
+	waitKey := false
 	for {
 		select {
 		case rc := <-relay.csChan:
 			//log.Debugf("sendPublishChunkStream: rc.TypeID=%v length=%d", rc.TypeID, len(rc.Data))
-			relay.connectPublishClient.Write(rc)
-		case ctrlcmd := <-relay.sndctrlChan:
-			if ctrlcmd == stopCtrl {
+			p := chunkPacket(&rc)
+			if i := headerSlot(p); i >= 0 {
+				c := rc
+				headers[i] = &c
+			} else if waitKey && p.IsVideo {
+				if !av.IsKeyFrame(p) {
+					continue
+				}
+				waitKey = false
+			}
+			rc.StreamID = relay.connectPublishClient.StreamID()
+			err := relay.connectPublishClient.Write(rc)
+			if err == nil && len(relay.csChan) == 0 {
+				err = relay.connectPublishClient.Flush()
+			}
+			if err == nil {
+				continue
+			}
+			if !reconnect(relay.connectPublishClient, err, relay.stop) {
 				relay.connectPublishClient.Close(nil)
-				log.Debugf("sendPublishChunkStream close: playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
-				break
+				return
+			}
+			for _, c := range headers {
+				if c != nil {
+					c.StreamID = relay.connectPublishClient.StreamID()
+					relay.connectPublishClient.Write(*c)
+				}
 			}
+			waitKey = true
+		case <-relay.stop:
+			relay.connectPublishClient.Close(nil)
+			log.Debugf("sendPublishChunkStream close: playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
+			return
 		}
 	}
 }
@@ -93,8 +138,8 @@ func (relay *RtmpRelay) Start() error {
 		return fmt.Errorf("The rtmprelay already started, playurl=%s, publishurl=%s", relay.PlayURL, relay.PublishURL)
 	}
 
-	relay.connectPlayClient = core.NewConnClient()
-	relay.connectPublishClient = core.NewConnClient()
+	relay.connectPlayClient = newConnClient()
+	relay.connectPublishClient = newConnClient()
 
 	log.Debugf("play server addr:%v starting....", relay.PlayURL)
 	err := relay.connectPlayClient.Start(relay.PlayURL, "play")
@@ -112,6 +157,7 @@ func (relay *RtmpRelay) Start() error {
 	}
 
 	relay.startflag = true
+	relay.stop = make(chan struct{})
 	go relay.rcvPlayChunkStream()
 	go relay.sendPublishChunkStream()
 
@@ -126,5 +172,5 @@ func (relay *RtmpRelay) Stop() {
 	}
 
 	relay.startflag = false
-	relay.sndctrlChan <- stopCtrl
+	close(relay.stop)
 }
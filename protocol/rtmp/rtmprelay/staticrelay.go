@@ -11,11 +11,11 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// StaticPush is a static push
+// StaticPush is a static push, it reconnects when the push fails
 type StaticPush struct {
 	RtmpURL       string
 	packetChan    chan *av.Packet
-	sndctrlChan   chan string
+	stop          chan struct{}
 	connectClient *core.ConnClient
 	startflag     bool
 }
@@ -25,7 +25,6 @@ func NewStaticPush(rtmpurl string) *StaticPush {
 	return &StaticPush{
 		RtmpURL:       rtmpurl,
 		packetChan:    make(chan *av.Packet, 500),
-		sndctrlChan:   make(chan string),
 		connectClient: nil,
 		startflag:     false,
 	}
@@ -34,10 +33,6 @@ func NewStaticPush(rtmpurl string) *StaticPush {
 var staticPushMap = make(map[string](*StaticPush))
 var mapLock = new(sync.RWMutex)
 
-var (
-	staticRelayStopCtrl = "STATIC_RTMPRELAY_STOP"
-)
-
 // GetStaticPushList get the static push list of an application
 func GetStaticPushList(appname string) ([]string, error) {
 	pushurlList, ok := configure.GetStaticPushURLList(appname)
@@ -103,7 +98,7 @@ func (sp *StaticPush) Start() error {
 		return fmt.Errorf("StaticPush already start %s", sp.RtmpURL)
 	}
 
-	sp.connectClient = core.NewConnClient()
+	sp.connectClient = newConnClient()
 
 	log.Debugf("static publish server addr:%v starting....", sp.RtmpURL)
 	err := sp.connectClient.Start(sp.RtmpURL, "publish")
@@ -112,9 +107,9 @@ func (sp *StaticPush) Start() error {
 		return err
 	}
 	log.Debugf("static publish server addr:%v started, streamid=%d", sp.RtmpURL, sp.connectClient.StreamID())
-	go sp.Handle()
-
 	sp.startflag = true
+	sp.stop = make(chan struct{})
+	go sp.Handle()
 	return nil
 }
 
@@ -125,23 +120,30 @@ func (sp *StaticPush) Stop() {
 	}
 
 	log.Debugf("StaticPush Stop: %s", sp.RtmpURL)
-	sp.sndctrlChan <- staticRelayStopCtrl
+	close(sp.stop)
 	sp.startflag = false
 }
 
-// Write writes a packet
+// Write writes a packet, it is retained until sent. It is dropped if the
+// push is too late, e.g. while reconnecting.
 func (sp *StaticPush) Write(packet *av.Packet) {
 	if !sp.startflag {
 		return
 	}
 
-	sp.packetChan <- packet
+	packet.Retain()
+	select {
+	case sp.packetChan <- packet:
+	default:
+		log.Debugf("static push %s too late, packet dropped", sp.RtmpURL)
+		packet.Release()
+	}
 }
 
 // Send send packet
-func (sp *StaticPush) Send(p *av.Packet) {
+func (sp *StaticPush) Send(p *av.Packet) error {
 	if !sp.startflag {
-		return
+		return nil
 	}
 	var cs core.ChunkStream
 
@@ -163,26 +165,63 @@ func (sp *StaticPush) Send(p *av.Packet) {
 		}
 	}
 
-	sp.connectClient.Write(cs)
+	if err := sp.connectClient.Write(cs); err != nil {
+		return err
+	}
+	if len(sp.packetChan) == 0 {
+		return sp.connectClient.Flush()
+	}
+	return nil
 }
 
-// Handle handles packet
+// Handle handles packet, the metadata and sequence headers are sent again
+// after reconnecting and the video waits for a key frame
 func (sp *StaticPush) Handle() {
 	if !sp.IsStart() {
 		log.Debugf("static push %s not started", sp.RtmpURL)
 		return
 	}
 
+	var headers [3]*av.Packet
+	defer func() {
+		for _, p := range headers {
+			p.Release()
+		}
+	}()
+	waitKey := false
 	for {
 		select {
 		case packet := <-sp.packetChan:
-			sp.Send(packet)
-		case ctrlcmd := <-sp.sndctrlChan:
-			if ctrlcmd == staticRelayStopCtrl {
+			if i := headerSlot(packet); i >= 0 {
+				packet.Retain()
+				headers[i].Release()
+				headers[i] = packet
+			} else if waitKey && packet.IsVideo {
+				if !av.IsKeyFrame(packet) {
+					packet.Release()
+					continue
+				}
+				waitKey = false
+			}
+			err := sp.Send(packet)
+			packet.Release()
+			if err == nil {
+				continue
+			}
+			if !reconnect(sp.connectClient, err, sp.stop) {
 				sp.connectClient.Close(nil)
-				log.Debugf("Static HandleAvPacket close: publishurl=%s", sp.RtmpURL)
-				break
+				return
+			}
+			for _, p := range headers {
+				if p != nil {
+					sp.Send(p)
+				}
 			}
+			waitKey = true
+		case <-sp.stop:
+			sp.connectClient.Close(nil)
+			log.Debugf("Static HandleAvPacket close: publishurl=%s", sp.RtmpURL)
+			return
 		}
 	}
 }
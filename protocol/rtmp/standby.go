@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"sync"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// standby is a publisher kept hot while another one publishes the same
+// stream, its packets since the last key frame are cached so that it
+// takes over from a key frame
+type standby struct {
+	r     av.ReadCloser
+	cache *cache.Cache
+
+	lock     sync.Mutex
+	promoted bool
+	// next is the first packet read after promotion, nil if r failed
+	next *av.Packet
+	done chan struct{}
+}
+
+func newStandby(r av.ReadCloser) *standby {
+	sb := &standby{
+		r:     r,
+		cache: cache.NewCache(),
+		done:  make(chan struct{}),
+	}
+	go sb.run()
+	return sb
+}
+
+// run reads the standby until it fails or is promoted
+func (sb *standby) run() {
+	defer close(sb.done)
+	for {
+		p := &av.Packet{}
+		if err := sb.r.Read(p); err != nil {
+			log.Debugf("[%v] standby publisher closed: %v", sb.r.Info(), err)
+			sb.cache.Reset()
+			return
+		}
+		if !p.Shared() {
+			p.Share(nil)
+		}
+		sb.lock.Lock()
+		if sb.promoted {
+			sb.next = p
+			sb.lock.Unlock()
+			return
+		}
+		sb.cache.Write(p)
+		sb.lock.Unlock()
+		p.Release()
+	}
+}
+
+// promote stops reading the standby and returns the packets to start the
+// stream with, they are nil if the standby failed
+func (sb *standby) promote() []*av.Packet {
+	sb.lock.Lock()
+	sb.promoted = true
+	sb.lock.Unlock()
+	<-sb.done
+	if sb.next == nil {
+		return nil
+	}
+	packets := append(sb.cache.Packets(), sb.next)
+	sb.cache.Reset()
+	return packets
+}
+
+// close closes the standby publisher
+func (sb *standby) close(err error) {
+	sb.r.Close(err)
+}
@@ -3,18 +3,36 @@ package rtmp
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
 	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
 	"github.com/gwuhaolin/livego/protocol/rtmp/rtmprelay"
+	"github.com/gwuhaolin/livego/protocol/timeshift"
 
 	cmap "github.com/orcaman/concurrent-map"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// PublishTakeover stops the publisher of the stream for the new one
+	PublishTakeover = "takeover"
+	// PublishReject refuses the new publisher with NetStream.Publish.BadName
+	PublishReject = "reject"
+	// PublishStandby keeps the new publisher as a hot standby which takes
+	// over when the publisher dies
+	PublishStandby = "standby"
+)
+
 var (
 	emptyID = ""
+
+	// ErrPublishBadName means the stream is already published
+	ErrPublishBadName = fmt.Errorf("stream already publishing")
 )
 
 // Streams is the streams of rtmp
@@ -31,14 +49,45 @@ func NewStreams() *Streams {
 	return ret
 }
 
-// HandleReader handles reader
+// HandleReader handles reader, it publishes the stream of the key given
+// by the routes of its application
 func (rs *Streams) HandleReader(r av.ReadCloser) {
+	rs.publish(r)
+}
+
+// publish publishes the stream of r, it returns the policy applied to r,
+// empty if r publishes a new stream
+func (rs *Streams) publish(r av.ReadCloser) string {
 	info := r.Info()
 	log.Debugf("HandleReader: info[%v]", info)
+	if key := configure.RouteKey(info.Key); key != info.Key {
+		log.Infof("[%v] published as [%s]", info, key)
+		info.Key = key
+	}
+
+	if out, backup, ok := failoverInput(info); ok {
+		if policy := rs.addInput(out.Key, r, backup); policy != "" {
+			return policy
+		}
+		f := NewFailover(out)
+		f.SetInput(r, backup)
+		r, info = f, f.Info()
+	}
 
 	var stream *Stream
+	var policy string
 	i, ok := rs.streams.Get(info.Key)
 	if stream, ok = i.(*Stream); ok {
+		switch policy = stream.publishPolicy(info); policy {
+		case PublishReject:
+			log.Warningf("[%v] stream already publishing, publisher refused", info)
+			r.Close(ErrPublishBadName)
+			return policy
+		case PublishStandby:
+			log.Infof("[%v] stream already publishing, publisher kept as standby", info)
+			stream.setStandby(r)
+			return policy
+		}
 		stream.TransStop()
 		id := stream.ID()
 		if id != emptyID && id != info.UID {
@@ -54,12 +103,71 @@ func (rs *Streams) HandleReader(r av.ReadCloser) {
 	}
 
 	stream.AddReader(r)
+	return policy
+}
+
+// failover returns the Failover reading the stream of key, nil if the
+// stream is not read by a Failover
+func (rs *Streams) failover(key string) *Failover {
+	i, ok := rs.streams.Get(key)
+	if !ok {
+		return nil
+	}
+	s := i.(*Stream)
+	if f, ok := s.Reader().(*Failover); ok && s.isStart && !f.Closed() {
+		return f
+	}
+	return nil
 }
 
-// HandleWriter handles writer
+// addInput sets r as an input of the Failover reading the stream of key,
+// it returns the policy applied to r, empty if there is no Failover
+func (rs *Streams) addInput(key string, r av.ReadCloser, backup bool) string {
+	f := rs.failover(key)
+	if f == nil {
+		return ""
+	}
+	info := r.Info()
+	if f.hasInput(backup) && inputPolicy(key) == PublishReject {
+		log.Warningf("[%v] input already publishing, publisher refused", info)
+		r.Close(ErrPublishBadName)
+		return PublishReject
+	}
+	log.Infof("[%v] new input of [%s], backup: %v", info, key, backup)
+	f.SetInput(r, backup)
+	return publishInput
+}
+
+// inputPolicy returns the policy of the application of key
+func inputPolicy(key string) string {
+	return configure.GetPublishPolicy(strings.SplitN(key, "/", 2)[0])
+}
+
+// PublishPolicy returns the policy applying to a new publisher of info,
+// it is empty if the stream is not published
+func (rs *Streams) PublishPolicy(info av.Info) string {
+	info.Key = configure.RouteKey(info.Key)
+	if out, backup, ok := failoverInput(info); ok {
+		if f := rs.failover(out.Key); f != nil {
+			if f.hasInput(backup) && inputPolicy(out.Key) == PublishReject {
+				return PublishReject
+			}
+			return publishInput
+		}
+		info = out
+	}
+	if i, ok := rs.streams.Get(info.Key); ok {
+		return i.(*Stream).publishPolicy(info)
+	}
+	return ""
+}
+
+// HandleWriter handles writer, it plays the stream of the key given by
+// the aliases of its application
 func (rs *Streams) HandleWriter(w av.WriteCloser) {
 	info := w.Info()
 	log.Debugf("HandleWriter: info[%v]", info)
+	info.Key = configure.AliasKey(info.Key)
 
 	var s *Stream
 	ok := rs.streams.Has(info.Key)
@@ -67,6 +175,10 @@ func (rs *Streams) HandleWriter(w av.WriteCloser) {
 		s = NewStream()
 		rs.streams.Set(info.Key, s)
 		s.info = info
+		if !info.IsInterval() {
+			// e.g. an output, it waits for the publisher
+			s.AddWriter(w)
+		}
 	} else {
 		item, ok := rs.streams.Get(info.Key)
 		if ok {
@@ -96,22 +208,22 @@ func (rs *Streams) CheckAlive() {
 
 // Stream is one rtmp stream
 type Stream struct {
-	isStart bool
-	cache   *cache.Cache
-	r       av.ReadCloser
-	ws      cmap.ConcurrentMap
-	info    av.Info
-}
-
-// PackWriterCloser is a WriteCloser for packet
-type PackWriterCloser struct {
-	init bool
-	w    av.WriteCloser
-}
-
-// Writer gets WriteCloser
-func (p *PackWriterCloser) Writer() av.WriteCloser {
-	return p.w
+	isStart   bool
+	cache     *cache.Cache
+	timeshift *timeshift.Buffer
+	r         av.ReadCloser
+	ws        cmap.ConcurrentMap
+	info      av.Info
+
+	// wsChanged is set when ws changes, so that the publisher refreshes
+	// its list of subscribers
+	wsChanged int32
+
+	lock    sync.Mutex
+	standby *standby
+	// tsOffset is subtracted from the timestamps of a standby which took
+	// over, so that they start from 0 like a new publisher
+	tsOffset uint32
 }
 
 // NewStream returns a Stream
@@ -135,32 +247,208 @@ func (s *Stream) Reader() av.ReadCloser {
 	return s.r
 }
 
+// KeyFrame returns the video sequence header and the latest key frame in
+// gop cache, they must be released
+func (s *Stream) KeyFrame() (seq *av.Packet, key *av.Packet) {
+	return s.cache.KeyFrame()
+}
+
+// SequenceHeaders returns the video and the audio sequence headers of the
+// stream, they must be released
+func (s *Stream) SequenceHeaders() (video *av.Packet, audio *av.Packet) {
+	return s.cache.SequenceHeaders()
+}
+
 // Ws returns a ws
 func (s *Stream) Ws() cmap.ConcurrentMap {
 	return s.ws
 }
 
-// Copy copy this stream to dst stream
+// Copy copy this stream to dst stream, the records of the publisher are
+// closed instead
 func (s *Stream) Copy(dst *Stream) {
 	for item := range s.ws.IterBuffered() {
 		v := item.Val.(*PackWriterCloser)
-		s.ws.Remove(item.Key)
-		v.w.CalcBaseTimestamp()
-		dst.AddWriter(v.w)
+		s.removeWriter(item.Key)
+		v.close()
+		if isRecord(v.w) {
+			v.w.Close(fmt.Errorf("publisher replaced"))
+			continue
+		}
+		// the writer continues after the old subscriber is done
+		dst.setWriter(item.Key, newPackWriterCloser(v.w, v))
+	}
+}
+
+// isRecord returns if w records a publisher to flv files, every publisher
+// is recorded in its own files
+func isRecord(w av.WriteCloser) bool {
+	_, ok := w.(*flv.Writer)
+	return ok
+}
+
+// closeRecords closes the records of the publisher
+func (s *Stream) closeRecords(err error) {
+	for item := range s.ws.IterBuffered() {
+		v := item.Val.(*PackWriterCloser)
+		if v.w != nil && isRecord(v.w) {
+			s.removeWriter(item.Key)
+			v.close()
+			v.w.Close(err)
+		}
 	}
 }
 
 // AddReader add a reader
 func (s *Stream) AddReader(r av.ReadCloser) {
 	s.r = r
+	s.isStart = true
 	go s.TransStart()
 }
 
+// publishPolicy returns the policy applying to a new publisher of info,
+// it is empty if the stream is not published by another one
+func (s *Stream) publishPolicy(info av.Info) string {
+	if !s.isStart || s.r == nil || s.ID() == info.UID {
+		return ""
+	}
+	app := strings.SplitN(info.Key, "/", 2)[0]
+	switch policy := configure.GetPublishPolicy(app); policy {
+	case PublishReject, PublishStandby:
+		return policy
+	}
+	return PublishTakeover
+}
+
+// Standby returns the standby publisher, nil if none
+func (s *Stream) Standby() av.ReadCloser {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.standby == nil {
+		return nil
+	}
+	return s.standby.r
+}
+
+// setStandby keeps r as the standby of the publisher, replacing the
+// previous standby
+func (s *Stream) setStandby(r av.ReadCloser) {
+	sb := newStandby(r)
+	s.lock.Lock()
+	prev := s.standby
+	s.standby = sb
+	s.lock.Unlock()
+	if prev != nil {
+		prev.close(fmt.Errorf("replaced by another standby"))
+	}
+}
+
+// takeStandby removes the standby and returns it, nil if none
+func (s *Stream) takeStandby() *standby {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sb := s.standby
+	s.standby = nil
+	return sb
+}
+
+// dropStandby closes sb and removes it if it is still the standby
+func (s *Stream) dropStandby(sb *standby, err error) {
+	s.lock.Lock()
+	if s.standby == sb {
+		s.standby = nil
+	}
+	s.lock.Unlock()
+	sb.close(err)
+}
+
+// takeOver replaces the dead publisher with the standby, it returns the
+// packets to continue with, nil if there is no standby
+func (s *Stream) takeOver() []*av.Packet {
+	sb := s.takeStandby()
+	if sb == nil {
+		return nil
+	}
+	packets := sb.promote()
+	if packets == nil {
+		return nil
+	}
+	log.Infof("[%v] standby takes over from [%v]", sb.r.Info(), s.r.Info())
+	s.r = sb.r
+	info := sb.r.Info()
+	info.Key = s.info.Key
+	s.info = info
+	s.cache.Reset()
+	s.startTimeshift()
+	s.closeRecords(fmt.Errorf("publisher replaced by standby"))
+	if w := new(flv.Dvr).Writer(s.info); w != nil {
+		s.AddWriter(w)
+	}
+
+	// the timestamps start from the first frame, the metadata and the
+	// sequence headers before it are moved to it
+	s.tsOffset = 0
+	for _, p := range packets {
+		if !av.IsSpecial(p) {
+			s.tsOffset = p.TimeStamp
+			break
+		}
+	}
+	for _, p := range packets {
+		if av.IsSpecial(p) && p.TimeStamp < s.tsOffset {
+			p.TimeStamp = s.tsOffset
+		}
+	}
+	// the writers calculate their base timestamp once they have written
+	// the packets of the dead publisher
+	for item := range s.ws.IterBuffered() {
+		if v := item.Val.(*PackWriterCloser); v.init {
+			if err := v.rebase(); err != nil {
+				s.dropSubscriber(item.Key, v, err)
+			}
+		}
+	}
+	return packets
+}
+
 // AddWriter add a writer
 func (s *Stream) AddWriter(w av.WriteCloser) {
 	info := w.Info()
-	pw := &PackWriterCloser{w: w}
-	s.ws.Set(info.UID, pw)
+	pw := newPackWriterCloser(w, nil)
+	s.setWriter(info.UID, pw)
+}
+
+func (s *Stream) setWriter(key string, pw *PackWriterCloser) {
+	s.ws.Set(key, pw)
+	atomic.StoreInt32(&s.wsChanged, 1)
+}
+
+func (s *Stream) removeWriter(key string) {
+	s.ws.Remove(key)
+	atomic.StoreInt32(&s.wsChanged, 1)
+}
+
+// dropSubscriber removes a subscriber which failed to queue a packet, its
+// writer is closed on overflow
+func (s *Stream) dropSubscriber(key string, v *PackWriterCloser, err error) {
+	log.Debugf("[%s] push packet error: %v, remove", v.w.Info(), err)
+	s.removeWriter(key)
+	if err == ErrSubscriberOverflow {
+		v.w.Close(err)
+	}
+}
+
+// subscribers refreshes subs if ws changed since the last call,
+// iterating ws for every packet is too expensive
+func (s *Stream) subscribers(subs []cmap.Tuple) []cmap.Tuple {
+	if atomic.SwapInt32(&s.wsChanged, 0) == 0 {
+		return subs
+	}
+	subs = subs[:0]
+	for item := range s.ws.IterBuffered() {
+		subs = append(subs, item)
+	}
+	return subs
 }
 
 // StartStaticPush starts push if static_push is set
@@ -287,7 +575,7 @@ func (s *Stream) IsSendStaticPush() bool {
 }
 
 // SendStaticPush sends static push
-func (s *Stream) SendStaticPush(packet av.Packet) {
+func (s *Stream) SendStaticPush(packet *av.Packet) {
 	key := s.info.Key
 
 	dscr := strings.Split(key, "/")
@@ -316,7 +604,7 @@ func (s *Stream) SendStaticPush(packet av.Packet) {
 
 		staticpushObj, err := rtmprelay.GetStaticPushObject(pushurl)
 		if (staticpushObj != nil) && (err == nil) {
-			staticpushObj.Write(&packet)
+			staticpushObj.Write(packet)
 			//log.Debugf("SendStaticPush: WriteAvPacket %s ", pushurl)
 		} else {
 			log.Debugf("SendStaticPush GetStaticPushObject %s error", pushurl)
@@ -326,52 +614,91 @@ func (s *Stream) SendStaticPush(packet av.Packet) {
 
 // TransStart start the transport
 func (s *Stream) TransStart() {
-	s.isStart = true
-	var p av.Packet
+	atomic.StoreInt32(&s.wsChanged, 1)
+	var subs []cmap.Tuple
 
 	log.Debugf("TransStart: %v", s.info)
 
 	s.StartStaticPush()
+	// decoding the config for every packet is too expensive
+	staticPush := s.IsSendStaticPush()
+
+	s.startTimeshift()
 
 	for {
 		if !s.isStart {
 			s.closeInter()
 			return
 		}
-		err := s.r.Read(&p)
+		// p is shared by all subscribers without copy
+		p := &av.Packet{}
+		err := s.r.Read(p)
 		if err != nil {
+			if packets := s.takeOver(); packets != nil {
+				for _, p := range packets {
+					subs = s.dispatch(p, subs, staticPush)
+				}
+				continue
+			}
 			s.closeInter()
 			s.isStart = false
 			return
 		}
+		if !p.Shared() {
+			// so that writers share what they make of p, e.g. rtmp chunks
+			p.Share(nil)
+		}
+		subs = s.dispatch(p, subs, staticPush)
+	}
+}
 
-		if s.IsSendStaticPush() {
-			s.SendStaticPush(p)
+// startTimeshift starts a new timeshift buffer if enabled
+func (s *Stream) startTimeshift() {
+	if s.timeshift != nil {
+		s.timeshift.End()
+		s.timeshift = nil
+	}
+	if timeshift.Enabled() {
+		var err error
+		if s.timeshift, err = timeshift.NewBuffer(s.info.Key); err != nil {
+			log.Warningf("[%v] timeshift buffer error: %v", s.info, err)
 		}
+	}
+}
 
-		s.cache.Write(p)
+// dispatch sends p to the subscribers and releases it, subs is the list
+// of subscribers refreshed by subscribers
+func (s *Stream) dispatch(p *av.Packet, subs []cmap.Tuple, staticPush bool) []cmap.Tuple {
+	if p.TimeStamp >= s.tsOffset {
+		p.TimeStamp -= s.tsOffset
+	} else {
+		p.TimeStamp = 0
+	}
 
-		for item := range s.ws.IterBuffered() {
-			v := item.Val.(*PackWriterCloser)
-			if !v.init {
-				//log.Debugf("cache.send: %v", v.w.Info())
-				if err = s.cache.Send(v.w); err != nil {
-					log.Debugf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
-					continue
-				}
-				v.init = true
-			} else {
-				newPacket := p
-				//writeType := reflect.TypeOf(v.w)
-				//log.Debugf("w.Write: type=%v, %v", writeType, v.w.Info())
-				if err = v.w.Write(&newPacket); err != nil {
-					log.Debugf("[%s] write packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
-				}
-			}
+	if staticPush {
+		s.SendStaticPush(p)
+	}
+
+	s.cache.Write(p)
+	if s.timeshift != nil {
+		s.timeshift.Write(p)
+	}
+
+	subs = s.subscribers(subs)
+	for _, item := range subs {
+		v := item.Val.(*PackWriterCloser)
+		if !v.init {
+			// the cache already contains p
+			v.start(s.cache.Packets())
+			v.init = true
+			continue
+		}
+		if err := v.push(p); err != nil {
+			s.dropSubscriber(item.Key, v, err)
 		}
 	}
+	p.Release()
+	return subs
 }
 
 // TransStop stops the transport
@@ -381,6 +708,9 @@ func (s *Stream) TransStop() {
 	if s.isStart && s.r != nil {
 		s.r.Close(fmt.Errorf("stop old"))
 	}
+	if sb := s.takeStandby(); sb != nil {
+		sb.close(fmt.Errorf("stop old"))
+	}
 
 	s.isStart = false
 }
@@ -394,11 +724,23 @@ func (s *Stream) CheckAlive() (n int) {
 			s.r.Close(fmt.Errorf("read timeout"))
 		}
 	}
+	s.lock.Lock()
+	sb := s.standby
+	s.lock.Unlock()
+	if sb != nil {
+		if !s.isStart {
+			// the publisher died before the standby was set
+			s.dropStandby(sb, fmt.Errorf("publisher closed"))
+		} else if !sb.r.Alive() {
+			s.dropStandby(sb, fmt.Errorf("read timeout"))
+		}
+	}
 	for item := range s.ws.IterBuffered() {
 		v := item.Val.(*PackWriterCloser)
 		if v.w != nil {
 			if !v.w.Alive() && s.isStart {
-				s.ws.Remove(item.Key)
+				s.removeWriter(item.Key)
+				v.close()
 				v.w.Close(fmt.Errorf("write timeout"))
 				continue
 			}
@@ -414,13 +756,19 @@ func (s *Stream) closeInter() {
 		s.StopStaticPush()
 		log.Debugf("[%v] publisher closed", s.r.Info())
 	}
+	if s.timeshift != nil {
+		s.timeshift.End()
+		s.timeshift = nil
+	}
 
+	s.closeRecords(fmt.Errorf("publisher closed"))
 	for item := range s.ws.IterBuffered() {
 		v := item.Val.(*PackWriterCloser)
 		if v.w != nil {
 			if v.w.Info().IsInterval() {
+				v.close()
 				v.w.Close(fmt.Errorf("closed"))
-				s.ws.Remove(item.Key)
+				s.removeWriter(item.Key)
 				log.Debugf("[%v] player closed and remove\n", v.w.Info())
 			}
 		}
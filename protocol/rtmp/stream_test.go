@@ -0,0 +1,483 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/utils/pool"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	benchGop       = 50
+	benchFrameSize = 4096
+)
+
+// benchReader publishes n video frames with a key frame every benchGop
+// frames, its data comes from a pool like the rtmp reader. It waits for
+// the subscribers to drain their queues before every key frame, so that
+// nothing is dropped.
+type benchReader struct {
+	av.RWBaser
+	n       int
+	ts      uint32
+	pool    *pool.Pool
+	key     *flv.Tag
+	inter   *flv.Tag
+	drained func() bool
+}
+
+func newBenchReader(n int, drained func() bool) *benchReader {
+	r := &benchReader{
+		RWBaser: av.NewRWBase(time.Second),
+		n:       n,
+		pool:    pool.NewPool(),
+		key:     &flv.Tag{},
+		inter:   &flv.Tag{},
+		drained: drained,
+	}
+	r.key.ParseMediaTagHeader([]byte{0x17, 0x01, 0, 0, 0}, true)
+	r.inter.ParseMediaTagHeader([]byte{0x27, 0x01, 0, 0, 0}, true)
+	return r
+}
+
+func (r *benchReader) Read(p *av.Packet) error {
+	if r.n == 0 || r.ts%benchGop == 0 {
+		for !r.drained() {
+			runtime.Gosched()
+		}
+	}
+	if r.n == 0 {
+		return io.EOF
+	}
+	p.IsVideo = true
+	p.TimeStamp = r.ts
+	p.Header = r.inter
+	if r.ts%benchGop == 0 {
+		p.Header = r.key
+	}
+	p.Data = r.pool.Get(benchFrameSize)
+	p.Share(r.pool)
+	r.n--
+	r.ts++
+	return nil
+}
+
+func (r *benchReader) Close(err error) {}
+
+func (r *benchReader) Info() av.Info {
+	return av.Info{Key: "live/bench", UID: "publisher"}
+}
+
+// discardWriter counts the written packets
+type discardWriter struct {
+	av.RWBaser
+	uid     string
+	written uint64
+}
+
+func (w *discardWriter) Write(p *av.Packet) error {
+	atomic.AddUint64(&w.written, 1)
+	return nil
+}
+
+func (w *discardWriter) Close(err error) {}
+
+func (w *discardWriter) Info() av.Info {
+	return av.Info{Key: "live/bench", UID: w.uid, Inter: true}
+}
+
+func BenchmarkStream(b *testing.B) {
+	for _, n := range []int{1, 1000} {
+		b.Run(fmt.Sprintf("subscribers-%d", n), func(b *testing.B) {
+			s := NewStream()
+			for i := 0; i < n; i++ {
+				s.AddWriter(&discardWriter{
+					RWBaser: av.NewRWBase(time.Second),
+					uid:     fmt.Sprintf("player-%d", i),
+				})
+			}
+			var subs []*PackWriterCloser
+			for item := range s.ws.IterBuffered() {
+				subs = append(subs, item.Val.(*PackWriterCloser))
+			}
+			s.isStart = true
+			s.r = newBenchReader(b.N, func() bool {
+				for _, pw := range subs {
+					if pw.Queued() > 0 {
+						return false
+					}
+				}
+				return true
+			})
+			s.info = s.r.Info()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(benchFrameSize * n))
+			b.ResetTimer()
+			s.TransStart()
+		})
+	}
+}
+
+// chanReader publishes the packets sent to it until packets is closed
+type chanReader struct {
+	av.RWBaser
+	key     string
+	uid     string
+	packets chan *av.Packet
+
+	lock   sync.Mutex
+	closed error
+}
+
+func newChanReader(uid string) *chanReader {
+	return &chanReader{
+		RWBaser: av.NewRWBase(time.Second),
+		key:     "live/test",
+		uid:     uid,
+		packets: make(chan *av.Packet),
+	}
+}
+
+func (r *chanReader) Read(p *av.Packet) error {
+	pkt, ok := <-r.packets
+	if !ok {
+		return io.EOF
+	}
+	*p = *pkt
+	return nil
+}
+
+func (r *chanReader) Close(err error) {
+	r.lock.Lock()
+	r.closed = err
+	r.lock.Unlock()
+}
+
+func (r *chanReader) Closed() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+func (r *chanReader) Info() av.Info {
+	return av.Info{Key: r.key, UID: r.uid}
+}
+
+// tsWriter records the timestamps it writes with its base timestamp
+type tsWriter struct {
+	av.RWBaser
+	key     string
+	lock    sync.Mutex
+	written []uint32
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func newTsWriter() *tsWriter {
+	return &tsWriter{
+		RWBaser: av.NewRWBase(time.Second),
+		key:     "live/test",
+		closed:  make(chan struct{}),
+	}
+}
+
+func (w *tsWriter) Write(p *av.Packet) error {
+	ts := p.TimeStamp + w.BaseTimestamp()
+	w.RecTimestamp(ts, av.TagVideo)
+	w.lock.Lock()
+	w.written = append(w.written, ts)
+	w.lock.Unlock()
+	return nil
+}
+
+func (w *tsWriter) Close(err error) {
+	w.once.Do(func() { close(w.closed) })
+}
+
+func (w *tsWriter) Info() av.Info {
+	return av.Info{Key: w.key, UID: "player", Inter: true}
+}
+
+func (w *tsWriter) waitWritten(n int) []uint32 {
+	for i := 0; i < 100; i++ {
+		w.lock.Lock()
+		written := append([]uint32(nil), w.written...)
+		w.lock.Unlock()
+		if len(written) >= n || i == 99 {
+			return written
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// setApp sets the config of the live application, the returned func
+// restores it
+func setApp(conf map[string]interface{}) func() {
+	server := configure.Config.Get("server")
+	app := map[string]interface{}{"appname": "live", "live": true}
+	for k, v := range conf {
+		app[k] = v
+	}
+	configure.Config.Set("server", []map[string]interface{}{app})
+	return func() { configure.Config.Set("server", server) }
+}
+
+func setPublishPolicy(policy string) func() {
+	return setApp(map[string]interface{}{"publish_policy": policy})
+}
+
+// setFlvDir records to a temporary directory until the returned function
+// is called
+func setFlvDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "livego-rtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flvDir := configure.Config.GetString("flv_dir")
+	configure.Config.Set("flv_dir", dir)
+	return func() {
+		configure.Config.Set("flv_dir", flvDir)
+		os.RemoveAll(dir)
+	}
+}
+
+// record returns the record of the stream of key, nil if none
+func record(rs *Streams, key string) *flv.Writer {
+	i, ok := rs.streams.Get(key)
+	if !ok {
+		return nil
+	}
+	for item := range i.(*Stream).Ws().IterBuffered() {
+		if w, ok := item.Val.(*PackWriterCloser).w.(*flv.Writer); ok {
+			return w
+		}
+	}
+	return nil
+}
+
+// closed returns if w is closed within a second
+func closed(w *flv.Writer) bool {
+	done := make(chan struct{})
+	go func() {
+		w.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestStreamsRecord(t *testing.T) {
+	at := assert.New(t)
+	defer setFlvDir(t)()
+	rs := &Streams{streams: cmap.New()}
+
+	r1, r2 := newChanReader("p1"), newChanReader("p2")
+	defer close(r1.packets)
+	at.Nil(HandlePublisher(rs, nil, r1))
+	rec1 := record(rs, "live/test")
+	if !at.NotNil(rec1) {
+		return
+	}
+	r1.packets <- newTestVideo(true, 0)
+
+	// every publisher is recorded in its own files
+	at.Nil(HandlePublisher(rs, nil, r2))
+	at.True(closed(rec1))
+	rec2 := record(rs, "live/test")
+	if !at.NotNil(rec2) {
+		return
+	}
+	at.True(rec1 != rec2)
+	r2.packets <- newTestVideo(true, 0)
+
+	// the record is closed with its publisher
+	close(r2.packets)
+	at.True(closed(rec2))
+	at.Nil(record(rs, "live/test"))
+}
+
+// countGetter counts the writers it returns
+type countGetter struct {
+	n int
+	w *tsWriter
+}
+
+func (g *countGetter) Writer(info av.Info) av.WriteCloser {
+	g.n++
+	g.w = newTsWriter()
+	return g.w
+}
+
+// staleStreams checks no policy, like the one of a publisher checked
+// before another one comes in
+type staleStreams struct {
+	*Streams
+}
+
+func (s staleStreams) PublishPolicy(info av.Info) string {
+	return ""
+}
+
+func TestHandlePublisherPolicy(t *testing.T) {
+	at := assert.New(t)
+	defer setPublishPolicy(PublishStandby)()
+	defer setFlvDir(t)()
+	rs := staleStreams{&Streams{streams: cmap.New()}}
+	g := &countGetter{}
+
+	r1, r2 := newChanReader("p1"), newChanReader("p2")
+	at.Nil(HandlePublisher(rs, g, r1))
+	at.Equal(1, g.n)
+	// the standby gets no writers although the policy checked first is empty
+	at.Nil(HandlePublisher(rs, g, r2))
+	at.Equal(1, g.n)
+	at.Equal(r2, rs.streams.Items()["live/test"].(*Stream).Standby())
+	close(r2.packets)
+	close(r1.packets)
+	<-g.w.closed
+}
+
+func TestStreamsPublishReject(t *testing.T) {
+	at := assert.New(t)
+	defer setPublishPolicy(PublishReject)()
+	rs := &Streams{streams: cmap.New()}
+
+	r1, r2 := newChanReader("p1"), newChanReader("p2")
+	at.Equal("", rs.PublishPolicy(r1.Info()))
+	rs.HandleReader(r1)
+	w := newTsWriter()
+	rs.HandleWriter(w)
+	at.Equal("", rs.PublishPolicy(r1.Info()))
+	at.Equal(PublishReject, rs.PublishPolicy(r2.Info()))
+
+	rs.HandleReader(r2)
+	at.Equal(ErrPublishBadName, r2.Closed())
+	at.Nil(r1.Closed())
+	i, _ := rs.streams.Get("live/test")
+	at.Equal(r1, i.(*Stream).Reader())
+	close(r1.packets)
+	<-w.closed
+}
+
+// newTestSeqHeader returns a video or audio sequence header at 0
+func newTestSeqHeader(isVideo bool) *av.Packet {
+	data := []byte{0xaf, 0x00, 0x12, 0x10}
+	if isVideo {
+		data = []byte{0x17, 0x00, 0, 0, 0, 0x01}
+	}
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, isVideo)
+	return &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, Header: &tag, Data: data}
+}
+
+func TestStreamsPublishStandby(t *testing.T) {
+	at := assert.New(t)
+	defer setPublishPolicy(PublishStandby)()
+	defer setFlvDir(t)()
+	rs := &Streams{streams: cmap.New()}
+
+	r1, r2 := newChanReader("p1"), newChanReader("p2")
+	rs.HandleReader(r1)
+	w := newTsWriter()
+	rs.HandleWriter(w)
+	for ts := uint32(0); ts <= 80; ts += 40 {
+		r1.packets <- newTestVideo(ts == 0, ts)
+	}
+	at.Equal([]uint32{0, 40, 80}, w.waitWritten(3))
+
+	at.Equal(PublishStandby, rs.PublishPolicy(r2.Info()))
+	rs.HandleReader(r2)
+	i, _ := rs.streams.Get("live/test")
+	s := i.(*Stream)
+	at.Equal(r2, s.Standby())
+	// the standby is read, but not published
+	r2.packets <- newTestSeqHeader(true)
+	r2.packets <- newTestSeqHeader(false)
+	r2.packets <- newTestVideo(false, 9960)
+	r2.packets <- newTestVideo(true, 10000)
+	r2.packets <- newTestVideo(false, 10040)
+	time.Sleep(50 * time.Millisecond)
+	at.Equal(3, len(w.waitWritten(3)))
+
+	// the standby takes over from its sequence headers and key frame, the
+	// timestamps follow
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for ts := uint32(10080); ; ts += 40 {
+			select {
+			case r2.packets <- newTestVideo(false, ts):
+			case <-stop:
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	close(r1.packets)
+	written := w.waitWritten(8)
+	if at.True(len(written) >= 8, fmt.Sprint(written)) {
+		at.Equal([]uint32{0, 40, 80, 80, 80, 80, 120, 160}, written[:8])
+	}
+	at.Equal(r2, s.Reader())
+	at.Nil(s.Standby())
+	close(stop)
+	<-done
+	close(r2.packets)
+	<-w.closed
+}
+
+func TestStreamsRoute(t *testing.T) {
+	at := assert.New(t)
+	defer setApp(map[string]interface{}{
+		"publish_policy": PublishReject,
+		"routes": []map[string]interface{}{
+			{"match": "^ingest_(.*)$", "key": "main_$1"},
+			{"match": "^other$", "key": "other/${0}"},
+		},
+		"aliases": []map[string]interface{}{
+			{"match": "^(tv|web)$", "key": "live/main_xyz"},
+		},
+	})()
+	at.Equal("live/main_xyz", configure.RouteKey("live/ingest_xyz"))
+	at.Equal("other/other", configure.RouteKey("live/other"))
+	at.Equal("live/test", configure.RouteKey("live/test"))
+	at.Equal("live/main_xyz", configure.AliasKey("live/web"))
+	at.Equal("live/main_xyz", configure.AliasKey("live/main_xyz"))
+	rs := &Streams{streams: cmap.New()}
+
+	r1, r2 := newChanReader("p1"), newChanReader("p2")
+	r1.key, r2.key = "live/ingest_xyz", "live/ingest_xyz"
+	rs.HandleReader(r1)
+	at.True(rs.streams.Has("live/main_xyz"))
+	at.False(rs.streams.Has("live/ingest_xyz"))
+	at.Equal(PublishReject, rs.PublishPolicy(r2.Info()))
+
+	// the players of an alias play the stream
+	w := newTsWriter()
+	w.key = "live/tv"
+	rs.HandleWriter(w)
+	r1.packets <- newTestVideo(true, 0)
+	r1.packets <- newTestVideo(false, 40)
+	at.Equal([]uint32{0, 40}, w.waitWritten(2))
+	close(r1.packets)
+	<-w.closed
+}
@@ -0,0 +1,278 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultQueueSize = 1024
+
+	// OverflowDrop drops the queued packets and waits for the next key frame
+	OverflowDrop = "drop"
+	// OverflowDisconnect closes the subscriber
+	OverflowDisconnect = "disconnect"
+)
+
+var (
+	// ErrSubscriberClosed means the subscriber is closed
+	ErrSubscriberClosed = fmt.Errorf("subscriber closed")
+	// ErrSubscriberOverflow means the subscriber queue is full
+	ErrSubscriberOverflow = fmt.Errorf("subscriber queue overflow")
+)
+
+// rebasePacket is queued when another publisher takes over the stream, it
+// is kept on overflow like metadata and never written
+var rebasePacket = &av.Packet{IsMetadata: true}
+
+// PackWriterCloser is a subscriber of a stream, packets are queued in a
+// bounded ring buffer by the publisher and written to the WriteCloser by
+// its own goroutine, so that a slow writer never blocks the publisher
+type PackWriterCloser struct {
+	init bool
+	w    av.WriteCloser
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []*av.Packet
+	head     int
+	size     int
+	replay   []*av.Packet
+	overflow string
+	dropper  av.GopDropper
+	closed   bool
+	done     chan struct{}
+
+	inTs  uint32
+	outTs uint32
+}
+
+// newPackWriterCloser returns a subscriber of w, it starts writing after
+// prev is done, prev is nil if w is new
+func newPackWriterCloser(w av.WriteCloser, prev *PackWriterCloser) *PackWriterCloser {
+	size := configure.Config.GetInt("subscriber_queue")
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	p := &PackWriterCloser{
+		w:        w,
+		queue:    make([]*av.Packet, size),
+		overflow: configure.Config.GetString("subscriber_overflow"),
+		done:     make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.lock)
+	go p.run(prev)
+	return p
+}
+
+// Writer gets WriteCloser
+func (p *PackWriterCloser) Writer() av.WriteCloser {
+	return p.w
+}
+
+// Queued returns the number of packets waiting to be written
+func (p *PackWriterCloser) Queued() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size + len(p.replay)
+}
+
+// DropStats returns the number of packets and bytes dropped due to
+// overflow, including the ones dropped by the writer
+func (p *PackWriterCloser) DropStats() av.DropStats {
+	stats := p.dropper.Stats()
+	if ds, ok := p.w.(av.DropStater); ok {
+		ws := ds.DropStats()
+		stats.Frames += ws.Frames
+		stats.Bytes += ws.Bytes
+	}
+	return stats
+}
+
+// Lag returns how far the subscriber is behind the publisher in ms
+func (p *PackWriterCloser) Lag() uint32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.inTs < p.outTs {
+		return 0
+	}
+	return p.inTs - p.outTs
+}
+
+// start queues the retained cached packets which are replayed before
+// live packets
+func (p *PackWriterCloser) start(packets []*av.Packet) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		release(packets)
+		return
+	}
+	p.replay = packets
+	if n := len(packets); n > 0 {
+		p.inTs = packets[n-1].TimeStamp
+	}
+	p.lock.Unlock()
+	p.cond.Signal()
+}
+
+// push queues a packet shared with the other subscribers, it never blocks
+func (p *PackWriterCloser) push(pkt *av.Packet) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return ErrSubscriberClosed
+	}
+	if !p.dropper.Keep(pkt) {
+		return nil
+	}
+	if p.size == len(p.queue) {
+		if err := p.makeRoom(); err != nil {
+			return err
+		}
+		if !p.dropper.Keep(pkt) {
+			return nil
+		}
+	}
+
+	pkt.Retain()
+	p.queue[(p.head+p.size)%len(p.queue)] = pkt
+	p.size++
+	p.inTs = pkt.TimeStamp
+	p.cond.Signal()
+	return nil
+}
+
+// rebase queues a mark after the packets of the previous publisher, there
+// the writer calculates its base timestamp so that the timestamps of the
+// new publisher follow the previous ones
+func (p *PackWriterCloser) rebase() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return ErrSubscriberClosed
+	}
+	if p.size == len(p.queue) {
+		if err := p.makeRoom(); err != nil {
+			return err
+		}
+	}
+	p.queue[(p.head+p.size)%len(p.queue)] = rebasePacket
+	p.size++
+	p.cond.Signal()
+	return nil
+}
+
+// makeRoom applies the overflow policy to the full queue, the subscriber
+// is closed by the disconnect policy, or when only sequence headers and
+// metadata are queued and nothing is left to drop
+func (p *PackWriterCloser) makeRoom() error {
+	if p.overflow != OverflowDisconnect {
+		p.congest()
+		if p.size < len(p.queue) {
+			return nil
+		}
+	}
+	p.closed = true
+	p.drain()
+	p.cond.Signal()
+	return ErrSubscriberOverflow
+}
+
+// congest drops the queued packets to the next key frame
+func (p *PackWriterCloser) congest() {
+	queued := make([]*av.Packet, p.size)
+	for i := range queued {
+		queued[i] = p.queue[(p.head+i)%len(p.queue)]
+		p.queue[(p.head+i)%len(p.queue)] = nil
+	}
+	kept := p.dropper.Congest(queued)
+	p.head = 0
+	p.size = copy(p.queue, kept)
+	log.Warningf("[%v] subscriber queue overflow, %d packets dropped", p.w.Info(), p.dropper.Stats().Frames)
+}
+
+// pop returns the next packet to write, nil if closed
+func (p *PackWriterCloser) pop() *av.Packet {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for !p.closed && p.size == 0 && len(p.replay) == 0 {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return nil
+	}
+	if len(p.replay) > 0 {
+		pkt := p.replay[0]
+		p.replay = p.replay[1:]
+		return pkt
+	}
+	pkt := p.queue[p.head]
+	p.queue[p.head] = nil
+	p.head = (p.head + 1) % len(p.queue)
+	p.size--
+	return pkt
+}
+
+// run writes the queued packets until closed or the writer fails
+func (p *PackWriterCloser) run(prev *PackWriterCloser) {
+	defer close(p.done)
+	if prev != nil {
+		<-prev.done
+		p.w.CalcBaseTimestamp()
+	}
+	for {
+		pkt := p.pop()
+		if pkt == nil {
+			return
+		}
+		if pkt == rebasePacket {
+			p.w.CalcBaseTimestamp()
+			continue
+		}
+		// pkt may be recycled once released
+		ts := pkt.TimeStamp
+		err := p.w.Write(pkt)
+		pkt.Release()
+		if err != nil {
+			log.Debugf("[%s] write packet error: %v, remove", p.w.Info(), err)
+			p.close()
+			return
+		}
+		p.lock.Lock()
+		p.outTs = ts
+		p.lock.Unlock()
+	}
+}
+
+// close stops the subscriber and releases the queued packets, the writer
+// is not closed
+func (p *PackWriterCloser) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.drain()
+	p.lock.Unlock()
+	p.cond.Signal()
+}
+
+// drain releases the queued packets
+func (p *PackWriterCloser) drain() {
+	release(p.replay)
+	p.replay = nil
+	for ; p.size > 0; p.size-- {
+		p.queue[p.head].Release()
+		p.queue[p.head] = nil
+		p.head = (p.head + 1) % len(p.queue)
+	}
+}
+
+func release(packets []*av.Packet) {
+	for _, p := range packets {
+		p.Release()
+	}
+}
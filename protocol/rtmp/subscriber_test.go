@@ -0,0 +1,215 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingWriter blocks in Write until unblock is closed
+type blockingWriter struct {
+	av.RWBaser
+	lock    sync.Mutex
+	unblock chan struct{}
+	written []uint32
+	closed  error
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{
+		RWBaser: av.NewRWBase(time.Second),
+		unblock: make(chan struct{}),
+	}
+}
+
+func (w *blockingWriter) Write(p *av.Packet) error {
+	<-w.unblock
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.written = append(w.written, p.TimeStamp)
+	return nil
+}
+
+func (w *blockingWriter) Close(err error) {
+	w.closed = err
+}
+
+func (w *blockingWriter) Info() av.Info {
+	return av.Info{Key: "live/test", UID: "test"}
+}
+
+func (w *blockingWriter) Written() []uint32 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]uint32(nil), w.written...)
+}
+
+func newTestVideo(isKey bool, timestamp uint32) *av.Packet {
+	data := []byte{0x27, 0x01, 0, 0, 0, 0xaa}
+	if isKey {
+		data[0] = 0x17
+	}
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, true)
+	return &av.Packet{IsVideo: true, TimeStamp: timestamp, Header: &tag, Data: data}
+}
+
+func waitWritten(w *blockingWriter, n int) []uint32 {
+	for i := 0; i < 100 && len(w.Written()) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return w.Written()
+}
+
+func TestSubscriberOverflowDrop(t *testing.T) {
+	at := assert.New(t)
+	configure.Config.Set("subscriber_queue", 4)
+	configure.Config.Set("subscriber_overflow", OverflowDrop)
+	defer configure.Config.Set("subscriber_queue", 1024)
+
+	w := newBlockingWriter()
+	pw := newPackWriterCloser(w, nil)
+	pw.start([]*av.Packet{newTestVideo(true, 0)})
+
+	// never blocks although the writer does
+	for ts := uint32(40); ts <= 320; ts += 40 {
+		at.Nil(pw.push(newTestVideo(ts == 200, ts)))
+	}
+	at.True(pw.DropStats().Frames > 0)
+	at.True(pw.Lag() > 0)
+
+	close(w.unblock)
+	// continues from the key frame after the overflow
+	at.Equal([]uint32{0, 200, 240, 280, 320}, waitWritten(w, 5))
+	pw.close()
+}
+
+func TestSubscriberOverflowDisconnect(t *testing.T) {
+	at := assert.New(t)
+	configure.Config.Set("subscriber_queue", 2)
+	configure.Config.Set("subscriber_overflow", OverflowDisconnect)
+	defer configure.Config.Set("subscriber_queue", 1024)
+	defer configure.Config.Set("subscriber_overflow", OverflowDrop)
+
+	w := newBlockingWriter()
+	pw := newPackWriterCloser(w, nil)
+	pw.start(nil)
+	var err error
+	for ts := uint32(0); err == nil && ts < 400; ts += 40 {
+		err = pw.push(newTestVideo(ts == 0, ts))
+	}
+	at.Equal(ErrSubscriberOverflow, err)
+	at.Equal(ErrSubscriberClosed, pw.push(newTestVideo(true, 1000)))
+	close(w.unblock)
+}
+
+func TestSubscriberRebaseOverflow(t *testing.T) {
+	at := assert.New(t)
+	configure.Config.Set("subscriber_queue", 2)
+	defer configure.Config.Set("subscriber_queue", 1024)
+
+	w := newBlockingWriter()
+	pw := newPackWriterCloser(w, nil)
+	pw.start(nil)
+	at.Nil(pw.push(newTestVideo(true, 0)))
+	for i := 0; i < 100 && pw.Queued() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the frames are dropped for the mark
+	at.Nil(pw.push(newTestVideo(false, 40)))
+	at.Nil(pw.push(newTestVideo(false, 80)))
+	at.Nil(pw.rebase())
+	at.Equal(1, pw.Queued())
+	at.Equal(uint64(2), pw.DropStats().Frames)
+
+	// nothing is left to drop but the sequence headers and the mark
+	seq := newTestVideo(true, 120)
+	seq.Data[1] = av.AVCSeqHeader
+	seq.Header.(*flv.Tag).ParseMediaTagHeader(seq.Data, true)
+	at.Nil(pw.push(seq))
+	at.Equal(ErrSubscriberOverflow, pw.rebase())
+	at.Equal(0, pw.Queued())
+	at.Equal(ErrSubscriberClosed, pw.push(newTestVideo(true, 160)))
+	close(w.unblock)
+}
+
+func TestSubscriberTakeover(t *testing.T) {
+	at := assert.New(t)
+	w := newBlockingWriter()
+	old := newPackWriterCloser(w, nil)
+	old.start(nil)
+	at.Nil(old.push(newTestVideo(true, 0)))
+
+	// the new subscriber waits for the old one
+	old.close()
+	pw := newPackWriterCloser(w, old)
+	pw.start([]*av.Packet{newTestVideo(true, 5000)})
+	close(w.unblock)
+	written := waitWritten(w, 1)
+	at.Contains([][]uint32{{5000}, {0, 5000}}, written, fmt.Sprint(written))
+	pw.close()
+}
+
+// countRecycler counts the packets given back
+type countRecycler struct {
+	put int32
+}
+
+func (r *countRecycler) Put(b []byte) {
+	atomic.AddInt32(&r.put, 1)
+}
+
+func (r *countRecycler) Count() int {
+	return int(atomic.LoadInt32(&r.put))
+}
+
+func TestSubscriberRelease(t *testing.T) {
+	at := assert.New(t)
+	r := &countRecycler{}
+	shared := func(isKey bool, timestamp uint32) *av.Packet {
+		p := newTestVideo(isKey, timestamp)
+		p.Share(r)
+		return p
+	}
+
+	w := newBlockingWriter()
+	pw := newPackWriterCloser(w, nil)
+	pw.start([]*av.Packet{shared(true, 0)})
+	for ts := uint32(40); ts <= 120; ts += 40 {
+		p := shared(false, ts)
+		at.Nil(pw.push(p))
+		// the publisher releases its reference once pushed
+		p.Release()
+	}
+	at.Equal(0, r.Count())
+
+	close(w.unblock)
+	waitWritten(w, 4)
+	for i := 0; i < 100 && r.Count() < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.Equal(4, r.Count())
+
+	// queued packets are released on close
+	w.unblock = make(chan struct{})
+	for ts := uint32(160); ts <= 240; ts += 40 {
+		p := shared(false, ts)
+		at.Nil(pw.push(p))
+		p.Release()
+	}
+	pw.close()
+	close(w.unblock)
+	for i := 0; i < 100 && r.Count() < 7; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	at.Equal(7, r.Count())
+}
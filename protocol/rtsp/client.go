@@ -0,0 +1,375 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dialTimeout is the timeout of connecting to a server
+	dialTimeout = 10 * time.Second
+	defaultPort = "554"
+)
+
+var (
+	// ErrUnauthorized means the server refuses the credentials of the url
+	ErrUnauthorized = fmt.Errorf("rtsp unauthorized")
+	// ErrUnsupportedTransport means the server does not send a track in
+	// the connection
+	ErrUnsupportedTransport = fmt.Errorf("rtsp transport not interleaved")
+)
+
+// client is an RTSP client playing the H.264 and AAC tracks of a url in
+// rtp interleaved in the connection
+type client struct {
+	url             *url.URL
+	user            *url.Userinfo
+	nc              net.Conn
+	br              *bufio.Reader
+	wlock           sync.Mutex
+	cseq            int
+	auth            func(method, uri string) string
+	session         string
+	timeout         time.Duration
+	keepAliveMethod string
+	base            string
+	// the tracks of the interleaved rtp channels
+	channels map[int]int
+	// the error ending serve
+	err error
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// dialClient connects to the server of u, the credentials of u are used
+// if asked
+func dialClient(u *url.URL) (*client, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	nc, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	noUser := *u
+	noUser.User = nil
+	return &client{
+		url:             &noUser,
+		user:            u.User,
+		nc:              nc,
+		br:              bufio.NewReader(nc),
+		timeout:         sessionTimeout,
+		keepAliveMethod: "OPTIONS",
+		channels:        make(map[int]int),
+		done:            make(chan struct{}),
+	}, nil
+}
+
+// readTimeout returns the timeout of the reads of the connections
+func readTimeout() time.Duration {
+	return time.Duration(configure.Config.GetInt("read_timeout")) * time.Second
+}
+
+// write writes a request of the session
+func (c *client) write(method, uri string, header map[string]string) error {
+	if header == nil {
+		header = make(map[string]string)
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.cseq++
+	header["CSeq"] = strconv.Itoa(c.cseq)
+	header["User-Agent"] = "livego"
+	if c.session != "" {
+		header["Session"] = c.session
+	}
+	if c.auth != nil {
+		header["Authorization"] = c.auth(method, uri)
+	}
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout()))
+	return writeRequest(c.nc, method, uri, header, nil)
+}
+
+// do sends a request and reads its response, the request is sent again
+// with the credentials if asked
+func (c *client) do(method, uri string, header map[string]string) (int, textproto.MIMEHeader, []byte, error) {
+	for retry := true; ; retry = false {
+		h := make(map[string]string, len(header))
+		for k, v := range header {
+			h[k] = v
+		}
+		if err := c.write(method, uri, h); err != nil {
+			return 0, nil, nil, err
+		}
+		c.nc.SetReadDeadline(time.Now().Add(readTimeout()))
+		code, respHeader, body, err := readResponse(c.br)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if code != 401 {
+			return code, respHeader, body, nil
+		}
+		if !retry || c.user == nil {
+			return 0, nil, nil, ErrUnauthorized
+		}
+		if c.auth = authorization(c.user, respHeader["Www-Authenticate"]); c.auth == nil {
+			return 0, nil, nil, ErrUnauthorized
+		}
+	}
+}
+
+// authorization returns the Authorization of user to a challenge of
+// WWW-Authenticate, Digest before Basic, nil if none is supported
+func authorization(user *url.Userinfo, challenges []string) func(method, uri string) string {
+	name := user.Username()
+	password, _ := user.Password()
+	for _, challenge := range challenges {
+		if len(challenge) < 7 || !strings.EqualFold(challenge[:7], "Digest ") {
+			continue
+		}
+		params := authParams(challenge[7:])
+		realm, nonce, opaque := params["realm"], params["nonce"], params["opaque"]
+		qop := ""
+		for _, v := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(v) == "auth" {
+				qop = "auth"
+			}
+		}
+		ha1 := md5Hex(name + ":" + realm + ":" + password)
+		nc := 0
+		return func(method, uri string) string {
+			ha2 := md5Hex(method + ":" + uri)
+			v := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, name, realm, nonce, uri)
+			if qop == "" {
+				v += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+			} else {
+				nc++
+				b := make([]byte, 8)
+				rand.Read(b)
+				cnonce := hex.EncodeToString(b)
+				response := md5Hex(fmt.Sprintf("%s:%s:%08x:%s:%s:%s", ha1, nonce, nc, cnonce, qop, ha2))
+				v += fmt.Sprintf(`, response="%s", qop=%s, nc=%08x, cnonce="%s"`, response, qop, nc, cnonce)
+			}
+			if opaque != "" {
+				v += fmt.Sprintf(`, opaque="%s"`, opaque)
+			}
+			return v
+		}
+	}
+	for _, challenge := range challenges {
+		if len(challenge) >= 5 && strings.EqualFold(challenge[:5], "Basic") {
+			v := "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+password))
+			return func(method, uri string) string {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// authParams returns the parameters of a challenge like
+// realm="x", nonce="y"
+func authParams(v string) map[string]string {
+	params := make(map[string]string)
+	for v = strings.TrimSpace(v); v != ""; v = strings.TrimLeft(v, ", ") {
+		i := strings.IndexByte(v, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(v[:i]))
+		v = v[i+1:]
+		var value string
+		if strings.HasPrefix(v, `"`) {
+			end := strings.IndexByte(v[1:], '"')
+			if end < 0 {
+				value, v = v[1:], ""
+			} else {
+				value, v = v[1:1+end], v[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(v, ',')
+			if end < 0 {
+				end = len(v)
+			}
+			value, v = strings.TrimSpace(v[:end]), v[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// controlURL returns the url of a track control relative to base
+func controlURL(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(strings.ToLower(control), "rtsp://") {
+		return control
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + control
+}
+
+// play sets up the H.264 and AAC tracks of the url and plays them, their
+// packets are read by the returned publisher once served
+func (c *client) play(app, title string) (*Reader, error) {
+	uri := c.url.String()
+	code, header, _, err := c.do("OPTIONS", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code == 200 && strings.Contains(header.Get("Public"), "GET_PARAMETER") {
+		c.keepAliveMethod = "GET_PARAMETER"
+	}
+	code, header, body, err := c.do("DESCRIBE", uri, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("rtsp DESCRIBE %s: status %d", uri, code)
+	}
+	tracks, err := parseSDP(body)
+	if err != nil {
+		return nil, err
+	}
+	c.base = uri
+	if v := header.Get("Content-Base"); v != "" {
+		c.base = v
+	} else if v := header.Get("Content-Location"); v != "" {
+		c.base = v
+	}
+
+	for i, t := range tracks {
+		if !readable(t) {
+			continue
+		}
+		channel := 2 * i
+		code, header, _, err := c.do("SETUP", controlURL(c.base, t.control), map[string]string{
+			"Transport": fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if code != 200 {
+			return nil, fmt.Errorf("rtsp SETUP %s: status %d", t.control, code)
+		}
+		if c.session == "" {
+			params := strings.Split(header.Get("Session"), ";")
+			c.session = strings.TrimSpace(params[0])
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "timeout") {
+					continue
+				}
+				if n, err := strconv.Atoi(kv[1]); err == nil && n > 0 {
+					c.timeout = time.Duration(n) * time.Second
+				}
+			}
+		}
+		tr, err := parseTransport(header.Get("Transport"))
+		if err != nil || !tr.tcp {
+			return nil, ErrUnsupportedTransport
+		}
+		if tr.interleaved != [2]int{} {
+			channel = tr.interleaved[0]
+		}
+		c.channels[channel] = i
+	}
+	if len(c.channels) == 0 {
+		return nil, ErrNoTracks
+	}
+
+	r := newReader(app, title, uri, tracks)
+	code, _, _, err = c.do("PLAY", c.base, map[string]string{"Range": "npt=0.000-"})
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("rtsp PLAY %s: status %d", uri, code)
+	}
+	return r, nil
+}
+
+// serve writes the rtp packets of the session to r until the connection
+// fails, the session is kept alive meanwhile
+func (c *client) serve(r *Reader) {
+	go c.keepAlive()
+	buf := make([]byte, maxPacket)
+	var err error
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(readTimeout()))
+		var b []byte
+		if b, err = c.br.Peek(1); err != nil {
+			break
+		}
+		if b[0] != '$' {
+			// the response to a keepalive
+			if _, _, _, err = readResponse(c.br); err != nil {
+				break
+			}
+			continue
+		}
+		var channel int
+		if channel, b, err = readInterleaved(c.br, buf); err != nil {
+			break
+		}
+		if index, ok := c.channels[channel]; ok {
+			r.writeRTP(index, b)
+		}
+	}
+	c.err = err
+	r.Close(err)
+	c.close()
+}
+
+// keepAlive sends a request every half of the session timeout
+func (c *client) keepAlive() {
+	ticker := time.NewTicker(c.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(c.keepAliveMethod, c.base, nil); err != nil {
+				log.Debugf("rtsp keepalive %s error: %v", c.url, err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close tears the session down and closes the connection
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.session != "" {
+			c.write("TEARDOWN", c.base, nil)
+		}
+		c.nc.Close()
+	})
+}
@@ -0,0 +1,244 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtspVersion = "RTSP/1.0"
+	// maxBodyLen is the max length of the body of a message, e.g. the sdp
+	maxBodyLen = 64 << 10
+)
+
+var (
+	// ErrInvalidMessage means a message is not a valid RTSP message
+	ErrInvalidMessage = fmt.Errorf("invalid rtsp message")
+)
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	403: "Forbidden",
+	404: "Not Found",
+	409: "Conflict",
+	415: "Unsupported Media Type",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+}
+
+// Request is an RTSP request
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// Response is an RTSP response, the header names are written as is
+type Response struct {
+	StatusCode int
+	Header     map[string]string
+	Body       []byte
+}
+
+// readHeader reads the header and the body of a message
+func readHeader(tp *textproto.Reader) (textproto.MIMEHeader, []byte, error) {
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	var body []byte
+	if v := header.Get("Content-Length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxBodyLen {
+			return nil, nil, ErrInvalidMessage
+		}
+		body = make([]byte, n)
+		if _, err := io.ReadFull(tp.R, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return header, body, nil
+}
+
+// readRequest reads a request
+func readRequest(br *bufio.Reader) (*Request, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[2] != rtspVersion {
+		return nil, ErrInvalidMessage
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	header, body, err := readHeader(tp)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		Method: parts[0],
+		URL:    u,
+		Header: header,
+		Body:   body,
+	}, nil
+}
+
+// write writes the response to the request of cseq
+func (resp *Response) write(w io.Writer, cseq string) error {
+	var b bytes.Buffer
+	text := statusText[resp.StatusCode]
+	fmt.Fprintf(&b, "%s %d %s\r\nCSeq: %s\r\n", rtspVersion, resp.StatusCode, text, cseq)
+	writeHeader(&b, resp.Header, resp.Body)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeRequest writes a request, the header names are written as is
+func writeRequest(w io.Writer, method, uri string, header map[string]string, body []byte) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s %s\r\n", method, uri, rtspVersion)
+	writeHeader(&b, header, body)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeHeader writes the sorted header and the body of a message
+func writeHeader(b *bytes.Buffer, header map[string]string, body []byte) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s: %s\r\n", k, header[k])
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+}
+
+// readResponse reads a response, it returns its status code, its header
+// and its body
+func readResponse(br *bufio.Reader) (int, textproto.MIMEHeader, []byte, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || parts[0] != rtspVersion {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+	header, body, err := readHeader(tp)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return code, header, body, nil
+}
+
+// readInterleaved reads a packet interleaved in the connection, it
+// returns its channel
+func readInterleaved(br *bufio.Reader, buf []byte) (int, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != '$' {
+		return 0, nil, ErrInvalidMessage
+	}
+	n := int(header[2])<<8 | int(header[3])
+	if n > len(buf) {
+		return 0, nil, ErrInvalidMessage
+	}
+	if _, err := io.ReadFull(br, buf[:n]); err != nil {
+		return 0, nil, err
+	}
+	return int(header[1]), buf[:n], nil
+}
+
+// interleaved returns the interleaved packet of b on channel
+func interleaved(channel int, b []byte) []byte {
+	return append([]byte{'$', byte(channel), byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+// transport is the Transport of a track, in the connection or in udp
+type transport struct {
+	tcp         bool
+	interleaved [2]int
+	clientPorts [2]int
+	record      bool
+}
+
+// parseTransport returns the first unicast transport of RTP/AVP in the
+// Transport header v
+func parseTransport(v string) (*transport, error) {
+	for _, spec := range strings.Split(v, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		t := &transport{}
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			t.tcp = true
+		default:
+			continue
+		}
+		ok := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			switch strings.ToLower(kv[0]) {
+			case "multicast":
+				ok = false
+			case "mode":
+				t.record = len(kv) == 2 && strings.EqualFold(strings.Trim(kv[1], `"`), "record")
+			case "interleaved":
+				ok = ok && len(kv) == 2 && parsePorts(kv[1], &t.interleaved)
+			case "client_port":
+				ok = ok && len(kv) == 2 && parsePorts(kv[1], &t.clientPorts)
+			}
+		}
+		if ok && (t.tcp || t.clientPorts[0] > 0) {
+			return t, nil
+		}
+	}
+	return nil, ErrInvalidMessage
+}
+
+// parsePorts parses a range of ports or of channels like 0-1, the second
+// one is the next of the first if omitted
+func parsePorts(v string, ports *[2]int) bool {
+	parts := strings.SplitN(v, "-", 2)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 65535 {
+			return false
+		}
+		ports[i] = n
+	}
+	if len(parts) == 1 {
+		ports[1] = ports[0] + 1
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLate is how many rtp packets a frame waits for the missing ones
+	maxLate = 256
+)
+
+var (
+	// ErrClosed means the publisher is closed
+	ErrClosed = fmt.Errorf("rtsp publisher closed")
+)
+
+// inTrack turns the rtp packets of a track into flv packets
+type inTrack interface {
+	write(p *rtp.Packet, r *Reader)
+}
+
+// Reader is an RTSP publisher, the rtp packets of its H.264 and AAC tracks
+// are read as flv packets. The timestamps of a track start when its first
+// packet is received.
+type Reader struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	tracks          []inTrack
+	demuxer         flv.Demuxer
+	start           time.Time
+	packets         chan *av.Packet
+	closeOnce       sync.Once
+	done            chan struct{}
+}
+
+// newReader returns a publisher of the tracks of a session, the tracks of
+// other codecs are not read
+func newReader(app, title, url string, tracks []*track) *Reader {
+	r := &Reader{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:     uid.NewID(),
+		app:     app,
+		title:   title,
+		url:     url,
+		tracks:  make([]inTrack, len(tracks)),
+		demuxer: flv.NewDemuxer(),
+		start:   time.Now(),
+		packets: make(chan *av.Packet, maxQueueNum),
+		done:    make(chan struct{}),
+	}
+	for i, t := range tracks {
+		switch {
+		case !readable(t):
+			log.Infof("[%v] rtsp track %s not read", r.Info(), t.codec)
+		case t.codec == codecH264:
+			r.tracks[i] = newH264Track(t)
+		default:
+			r.tracks[i] = newAACTrack(t)
+		}
+	}
+	return r
+}
+
+// readable returns if the track is H.264, or AAC of a valid config
+func readable(t *track) bool {
+	if t.codec == codecAAC {
+		_, _, err := aacConfig(t.config)
+		return err == nil
+	}
+	return t.codec == codecH264
+}
+
+// writeRTP writes an rtp packet of the track index, b is copied as the
+// packets are kept until their frame is complete
+func (r *Reader) writeRTP(index int, b []byte) {
+	if index < 0 || index >= len(r.tracks) || r.tracks[index] == nil {
+		return
+	}
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(append([]byte(nil), b...)); err != nil {
+		return
+	}
+	r.tracks[index].write(p, r)
+}
+
+// h264Track reads the H.264 access units of a track from the first key
+// frame, and again after a loss
+type h264Track struct {
+	builder *samplebuilder.SampleBuilder
+	clock   clock
+	sps     []byte
+	pps     []byte
+	changed bool
+	waitKey bool
+}
+
+// newH264Track returns an h264Track, the sps and the pps of the sdp are
+// used until others are received
+func newH264Track(t *track) *h264Track {
+	return &h264Track{
+		builder: samplebuilder.New(maxLate, &codecs.H264Packet{IsAVC: true}, uint32(t.clockRate)),
+		clock:   clock{rate: int64(t.clockRate)},
+		sps:     t.sps,
+		pps:     t.pps,
+		changed: t.sps != nil && t.pps != nil,
+		waitKey: true,
+	}
+}
+
+func (t *h264Track) write(p *rtp.Packet, r *Reader) {
+	t.builder.Push(p)
+	for sample := t.builder.Pop(); sample != nil; sample = t.builder.Pop() {
+		ts := t.clock.time(sample.PacketTimestamp, r.start)
+		if sample.PrevDroppedPackets > 0 && !t.waitKey {
+			log.Debugf("[%v] %d rtp packets lost", r.Info(), sample.PrevDroppedPackets)
+			t.waitKey = true
+		}
+		body := []byte{0x27, 0x01, 0, 0, 0}
+		key := false
+		for data := sample.Data; len(data) > 4; {
+			n := int(binary.BigEndian.Uint32(data))
+			if n > len(data)-4 {
+				break
+			}
+			nalu := data[4 : 4+n]
+			data = data[4+n:]
+			if n == 0 {
+				continue
+			}
+			switch nalu[0] & 0x1f {
+			case naluTypeSPS:
+				if !bytes.Equal(nalu, t.sps) {
+					t.sps = append([]byte(nil), nalu...)
+					t.changed = true
+				}
+				continue
+			case naluTypePPS:
+				if !bytes.Equal(nalu, t.pps) {
+					t.pps = append([]byte(nil), nalu...)
+					t.changed = true
+				}
+				continue
+			case naluTypeAUD:
+				continue
+			case naluTypeIDR:
+				key = true
+			}
+			body = append(body, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+			body = append(body, nalu...)
+		}
+		if t.changed && len(t.sps) >= 4 && t.pps != nil {
+			t.changed = false
+			r.push(true, ts, h264.SequenceHeader(t.sps, t.pps))
+		}
+		if t.waitKey {
+			if !key || t.sps == nil || t.pps == nil {
+				continue
+			}
+			t.waitKey = false
+		}
+		if len(body) == 5 {
+			continue
+		}
+		if key {
+			body[0] = 0x17
+		}
+		r.push(true, ts, body)
+	}
+}
+
+// aacTrack reads the AAC frames of a track, after the sequence header of
+// the AudioSpecificConfig of the sdp
+type aacTrack struct {
+	depacketizer *aacDepacketizer
+	clock        clock
+	config       []byte
+	received     bool
+	seq          uint16
+	started      bool
+}
+
+func newAACTrack(t *track) *aacTrack {
+	return &aacTrack{
+		depacketizer: newAACDepacketizer(t.fmtp),
+		clock:        clock{rate: int64(t.clockRate)},
+		config:       t.config,
+	}
+}
+
+func (t *aacTrack) write(p *rtp.Packet, r *Reader) {
+	if t.received {
+		if int16(p.SequenceNumber-t.seq) <= 0 {
+			// late or duplicated
+			return
+		}
+		if p.SequenceNumber != t.seq+1 {
+			// the rest of a fragmented frame is lost
+			t.depacketizer.fragment = nil
+		}
+	}
+	t.received = true
+	t.seq = p.SequenceNumber
+	frames, err := t.depacketizer.depacketize(p.Payload, p.Marker)
+	if err != nil {
+		log.Debugf("[%v] aac: %v", r.Info(), err)
+	}
+	for i, frame := range frames {
+		ts := t.clock.time(p.Timestamp+uint32(i*aacFrameLen), r.start)
+		if !t.started {
+			t.started = true
+			r.push(false, ts, append([]byte{0xaf, av.AACSeqHeader}, t.config...))
+		}
+		r.push(false, ts, append([]byte{0xaf, av.AACRaw}, frame...))
+	}
+}
+
+// push queues a packet of the flv body data
+func (r *Reader) push(isVideo bool, ts uint32, data []byte) {
+	p := &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		TimeStamp: ts,
+		Data:      data,
+	}
+	if err := r.demuxer.DemuxH(p); err != nil {
+		return
+	}
+	select {
+	case r.packets <- p:
+	case <-r.done:
+	}
+}
+
+// Read reads a packet
+func (r *Reader) Read(p *av.Packet) error {
+	select {
+	case pkt := <-r.packets:
+		*p = *pkt
+		r.SetPreTime()
+		return nil
+	case <-r.done:
+		return ErrClosed
+	}
+}
+
+// Done returns a channel closed when the reader is closed
+func (r *Reader) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close closes the reader, the connection is closed when it is done
+func (r *Reader) Close(err error) {
+	r.closeOnce.Do(func() {
+		log.Debugf("rtsp publisher [%s/%s] closed: %v", r.app, r.title, err)
+		close(r.done)
+	})
+}
+
+// Info returns the information
+func (r *Reader) Info() (ret av.Info) {
+	ret.UID = r.uid
+	ret.URL = r.url
+	ret.Key = r.app + "/" + r.title
+	return
+}
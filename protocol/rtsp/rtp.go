@@ -0,0 +1,176 @@
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// mtu is the max size of the rtp payloads
+	mtu = 1400
+	// maxPacket is the max size of the packets received
+	maxPacket = 65536
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+
+	// aacFrameLen is the number of samples of an AAC frame
+	aacFrameLen = 1024
+)
+
+var (
+	// ErrInvalidPayload means an rtp payload is invalid for its codec
+	ErrInvalidPayload = fmt.Errorf("invalid rtp payload")
+	// ErrNoPorts means no pair of udp ports is free
+	ErrNoPorts = fmt.Errorf("no free udp ports")
+)
+
+// aacPayload returns the rtp payload of an AAC frame in the AAC-hbr mode
+// of RFC 3640, an AU header of 13 bits of size and 3 bits of index
+func aacPayload(frame []byte) []byte {
+	n := len(frame)
+	return append([]byte{0x00, 0x10, byte(n >> 5), byte(n << 3)}, frame...)
+}
+
+// aacDepacketizer returns the AAC frames of the rtp payloads of RFC 3640,
+// a frame may be fragmented in several payloads
+type aacDepacketizer struct {
+	sizeLength       int
+	indexLength      int
+	indexDeltaLength int
+	fragment         []byte
+	fragmentLen      int
+}
+
+// newAACDepacketizer returns an aacDepacketizer of the fmtp parameters
+func newAACDepacketizer(fmtp map[string]string) *aacDepacketizer {
+	param := func(name string, value int) int {
+		if n, err := strconv.Atoi(fmtp[name]); err == nil {
+			return n
+		}
+		return value
+	}
+	return &aacDepacketizer{
+		sizeLength:       param("sizelength", 13),
+		indexLength:      param("indexlength", 3),
+		indexDeltaLength: param("indexdeltalength", 3),
+	}
+}
+
+// bits returns n bits of b from the bit offset
+func bits(b []byte, offset, n int) int {
+	v := 0
+	for i := offset; i < offset+n; i++ {
+		v = v<<1 | int(b[i/8]>>(7-uint(i%8))&1)
+	}
+	return v
+}
+
+// depacketize returns the frames completed by the payload
+func (d *aacDepacketizer) depacketize(payload []byte, marker bool) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, ErrInvalidPayload
+	}
+	headersLen := int(payload[0])<<8 | int(payload[1])
+	headersBytes := (headersLen + 7) / 8
+	if headersLen == 0 || len(payload) < 2+headersBytes {
+		return nil, ErrInvalidPayload
+	}
+	headers, data := payload[2:2+headersBytes], payload[2+headersBytes:]
+	var sizes []int
+	for offset := 0; offset+d.sizeLength <= headersLen; {
+		sizes = append(sizes, bits(headers, offset, d.sizeLength))
+		offset += d.sizeLength
+		if len(sizes) == 1 {
+			offset += d.indexLength
+		} else {
+			offset += d.indexDeltaLength
+		}
+	}
+	if len(sizes) == 0 {
+		return nil, ErrInvalidPayload
+	}
+
+	if len(sizes) == 1 && (sizes[0] > len(data) || d.fragment != nil) {
+		// a fragment of a frame
+		if d.fragment == nil {
+			d.fragmentLen = sizes[0]
+		}
+		d.fragment = append(d.fragment, data...)
+		if !marker {
+			return nil, nil
+		}
+		frame := d.fragment
+		d.fragment = nil
+		if len(frame) != d.fragmentLen {
+			return nil, ErrInvalidPayload
+		}
+		return [][]byte{frame}, nil
+	}
+	frames := make([][]byte, 0, len(sizes))
+	for _, size := range sizes {
+		if size > len(data) {
+			return frames, ErrInvalidPayload
+		}
+		frames = append(frames, data[:size])
+		data = data[size:]
+	}
+	return frames, nil
+}
+
+// clock converts the rtp timestamps of a track to the ms of the stream
+type clock struct {
+	rate    int64
+	started bool
+	base    int64
+	last    uint32
+	ticks   int64
+}
+
+// time returns the ms of the rtp timestamp ts, the first one is when it is
+// received
+func (c *clock) time(ts uint32, start time.Time) uint32 {
+	if !c.started {
+		c.started = true
+		c.base = int64(time.Since(start) / time.Millisecond)
+		c.last = ts
+	}
+	c.ticks += int64(int32(ts - c.last))
+	c.last = ts
+	if ms := c.base + c.ticks*1000/c.rate; ms > 0 {
+		return uint32(ms)
+	}
+	return 0
+}
+
+// ntpTime returns the NTP timestamp of t
+func ntpTime(t time.Time) uint64 {
+	const ntpEpochOffset = 2208988800
+	s := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return s<<32 | frac
+}
+
+// listenPair listens on an even udp port for rtp and on the next one for
+// rtcp
+func listenPair(ip net.IP) (rtp, rtcp *net.UDPConn, err error) {
+	for i := 0; i < 100; i++ {
+		rtp, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 && port < 65535 {
+			rtcp, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port + 1})
+			if err == nil {
+				return rtp, rtcp, nil
+			}
+		}
+		rtp.Close()
+	}
+	return nil, nil, ErrNoPorts
+}
@@ -0,0 +1,486 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain records the streams of the tests to a temporary directory, it
+// is set once since the streams are closed in the background
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "livego-rtsp")
+	if err != nil {
+		panic(err)
+	}
+	configure.Config.Set("flv_dir", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var (
+	testSPS    = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	testPPS    = []byte{0x68, 0xce, 0x3c, 0x80}
+	testConfig = []byte{0x12, 0x10}
+)
+
+func TestSDP(t *testing.T) {
+	at := assert.New(t)
+
+	video := &av.Packet{IsVideo: true, Data: h264.SequenceHeader(testSPS, testPPS)}
+	audio := &av.Packet{IsAudio: true, Data: append([]byte{0xaf, 0x00}, testConfig...)}
+	tracks, err := parseSDP(marshalSDP(streamTracks(video, audio)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Len(tracks, 2) {
+		return
+	}
+	at.True(tracks[0].video)
+	at.Equal(codecH264, tracks[0].codec)
+	at.Equal(uint8(payloadTypeH264), tracks[0].payloadType)
+	at.Equal(90000, tracks[0].clockRate)
+	at.Equal(testSPS, tracks[0].sps)
+	at.Equal(testPPS, tracks[0].pps)
+	at.Equal("trackID=0", tracks[0].control)
+
+	at.False(tracks[1].video)
+	at.Equal(codecAAC, tracks[1].codec)
+	at.Equal(44100, tracks[1].clockRate)
+	at.Equal(2, tracks[1].channels)
+	at.Equal(testConfig, tracks[1].config)
+	at.Equal("13", tracks[1].fmtp["sizelength"])
+	at.Equal("trackID=1", tracks[1].control)
+
+	// no sequence header of a known codec
+	at.Empty(streamTracks(nil, &av.Packet{IsAudio: true, Data: []byte{0xaf, 0x00, 0xff}}))
+}
+
+func TestAACDepacketize(t *testing.T) {
+	at := assert.New(t)
+
+	d := newAACDepacketizer(map[string]string{})
+	frame := bytes.Repeat([]byte{1, 2, 3}, 100)
+	frames, err := d.depacketize(aacPayload(frame), true)
+	at.Nil(err)
+	at.Equal([][]byte{frame}, frames)
+
+	// two frames in a payload
+	payload := []byte{0x00, 0x20, 0x00, 0x18, 0x00, 0x10, 1, 2, 3, 4, 5}
+	frames, err = d.depacketize(payload, true)
+	at.Nil(err)
+	at.Equal([][]byte{{1, 2, 3}, {4, 5}}, frames)
+
+	// a frame in two fragments
+	payload = aacPayload(frame)
+	frames, err = d.depacketize(payload[:100], false)
+	at.Nil(err)
+	at.Empty(frames)
+	frames, err = d.depacketize(append(payload[:4:4], payload[100:]...), true)
+	at.Nil(err)
+	at.Equal([][]byte{frame}, frames)
+
+	_, err = d.depacketize([]byte{0x00}, true)
+	at.Equal(ErrInvalidPayload, err)
+}
+
+func TestParseTransport(t *testing.T) {
+	at := assert.New(t)
+
+	tr, err := parseTransport("RTP/AVP;multicast,RTP/AVP;unicast;client_port=5000-5001")
+	at.Nil(err)
+	at.False(tr.tcp)
+	at.Equal([2]int{5000, 5001}, tr.clientPorts)
+
+	tr, err = parseTransport("RTP/AVP/TCP;unicast;interleaved=2-3;mode=record")
+	at.Nil(err)
+	at.True(tr.tcp)
+	at.True(tr.record)
+	at.Equal([2]int{2, 3}, tr.interleaved)
+
+	tr, err = parseTransport("RTP/AVP/TCP;interleaved=4")
+	at.Nil(err)
+	at.Equal([2]int{4, 5}, tr.interleaved)
+
+	_, err = parseTransport("RTP/AVP;unicast")
+	at.Equal(ErrInvalidMessage, err)
+	_, err = parseTransport("RTP/SAVP;unicast;client_port=5000-5001")
+	at.Equal(ErrInvalidMessage, err)
+}
+
+// testClient is an RTSP client of the tests
+type testClient struct {
+	t    *testing.T
+	nc   net.Conn
+	br   *bufio.Reader
+	cseq int
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, nc: nc, br: bufio.NewReader(nc)}
+}
+
+// do sends a request and returns the status code, the header and the body
+// of the response
+func (c *testClient) do(method, url string, header map[string]string, body []byte) (int, textproto.MIMEHeader, []byte) {
+	c.cseq++
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	if _, err := c.nc.Write(b.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+
+	code, respHeader, respBody, err := readResponse(c.br)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if respHeader.Get("CSeq") != strconv.Itoa(c.cseq) {
+		c.t.Fatalf("CSeq %s of %d", respHeader.Get("CSeq"), c.cseq)
+	}
+	return code, respHeader, respBody
+}
+
+func TestServer(t *testing.T) {
+	at := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewServer(rtmp.NewStreams(), nil).Serve(l)
+	addr := l.Addr().String()
+	base := "rtsp://" + addr + "/live/"
+
+	player := dial(t, addr)
+	defer player.nc.Close()
+	code, header, _ := player.do("OPTIONS", base+"rtspmovie", nil, nil)
+	at.Equal(200, code)
+	at.Contains(header.Get("Public"), "ANNOUNCE")
+	code, _, _ = player.do("DESCRIBE", base+"rtspmovie", nil, nil)
+	at.Equal(404, code)
+
+	video := &track{video: true, codec: codecH264, payloadType: payloadTypeH264,
+		clockRate: 90000, sps: testSPS, pps: testPPS, control: "trackID=0"}
+	audio := &track{codec: codecAAC, payloadType: payloadTypeAAC,
+		clockRate: 44100, channels: 2, config: testConfig, control: "trackID=1"}
+	sdp := marshalSDP([]*track{video, audio})
+
+	publisher := dial(t, addr)
+	defer publisher.nc.Close()
+	code, _, _ = publisher.do("ANNOUNCE", base+"invalid", nil, sdp)
+	at.Equal(403, code)
+	key, _ := configure.RoomKeys.GetKey("rtspmovie")
+	code, _, _ = publisher.do("ANNOUNCE", base+key, nil, sdp)
+	if !at.Equal(200, code) {
+		return
+	}
+	code, header, _ = publisher.do("SETUP", base+key+"/trackID=0", map[string]string{
+		"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record",
+	}, nil)
+	at.Equal(200, code)
+	at.Equal("RTP/AVP/TCP;unicast;interleaved=0-1;mode=record", header.Get("Transport"))
+	session := strings.Split(header.Get("Session"), ";")[0]
+	at.NotEmpty(session)
+	code, _, _ = publisher.do("SETUP", base+key+"/trackID=1", map[string]string{
+		"Transport": "RTP/AVP/TCP;unicast;interleaved=2-3;mode=record",
+		"Session":   session,
+	}, nil)
+	at.Equal(200, code)
+	code, _, _ = publisher.do("RECORD", base+key, map[string]string{"Session": session}, nil)
+	if !at.Equal(200, code) {
+		return
+	}
+
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88, 0x84, 0x21}, 100)...)
+	aac := bytes.Repeat([]byte{0x21, 0x10}, 50)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		var seq uint16
+		for i := uint32(0); ; i++ {
+			for _, p := range []*rtp.Packet{
+				{Header: rtp.Header{Version: 2, Marker: true, PayloadType: payloadTypeH264,
+					SequenceNumber: seq, Timestamp: i * 40 * 90, SSRC: 1}, Payload: idr},
+				{Header: rtp.Header{Version: 2, Marker: true, PayloadType: payloadTypeAAC,
+					SequenceNumber: seq, Timestamp: i * aacFrameLen, SSRC: 2}, Payload: aacPayload(aac)},
+			} {
+				b, _ := p.Marshal()
+				channel := 0
+				if p.PayloadType == payloadTypeAAC {
+					channel = 2
+				}
+				if _, err := publisher.nc.Write(interleaved(channel, b)); err != nil {
+					return
+				}
+			}
+			seq++
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	code, header, body := player.do("DESCRIBE", base+"rtspmovie", nil, nil)
+	if !at.Equal(200, code) {
+		return
+	}
+	at.Equal("application/sdp", header.Get("Content-Type"))
+	at.Equal(base+"rtspmovie/", header.Get("Content-Base"))
+	tracks, err := parseSDP(body)
+	at.Nil(err)
+	if !at.Len(tracks, 2) {
+		return
+	}
+	at.Equal(testSPS, tracks[0].sps)
+	at.Equal(testConfig, tracks[1].config)
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	code, header, _ = player.do("SETUP", base+"rtspmovie/trackID=0", map[string]string{
+		"Transport": fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1),
+	}, nil)
+	at.Equal(200, code)
+	at.Contains(header.Get("Transport"), "server_port=")
+	session = strings.Split(header.Get("Session"), ";")[0]
+	code, header, _ = player.do("PLAY", base+"rtspmovie", map[string]string{"Session": session}, nil)
+	if !at.Equal(200, code) {
+		return
+	}
+	at.Contains(header.Get("RTP-Info"), base+"rtspmovie/trackID=0;seq=")
+
+	// the video is played from a key frame, 40 ms apart
+	var depacketizer codecs.H264Packet
+	var frame []byte
+	var frames [][]byte
+	var timestamps []uint32
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxPacket)
+	for len(frames) < 2 {
+		n, err := udp.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p rtp.Packet
+		if err := p.Unmarshal(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		at.Equal(uint8(payloadTypeH264), p.PayloadType)
+		b, err := depacketizer.Unmarshal(p.Payload)
+		if err != nil {
+			continue
+		}
+		frame = append(frame, b...)
+		if p.Marker {
+			frames = append(frames, frame)
+			timestamps = append(timestamps, p.Timestamp)
+			frame = nil
+		}
+	}
+	startCode := []byte{0, 0, 0, 1}
+	at.True(bytes.Contains(frames[0], append(append([]byte(nil), startCode...), testSPS...)))
+	at.True(bytes.HasSuffix(frames[0], append(append([]byte(nil), startCode...), idr...)))
+	at.Equal(uint32(40*90), timestamps[1]-timestamps[0])
+
+	code, _, _ = player.do("TEARDOWN", base+"rtspmovie", map[string]string{"Session": session}, nil)
+	at.Equal(200, code)
+}
+
+type testHandler struct {
+	readers chan av.ReadCloser
+	writers chan av.WriteCloser
+}
+
+func (h *testHandler) HandleReader(r av.ReadCloser) {
+	h.readers <- r
+}
+
+func (h *testHandler) HandleWriter(w av.WriteCloser) {
+	h.writers <- w
+}
+
+// camera serves the H.264 and AAC of a session to the clients of digest
+// credentials, a session is closed after frames frames
+func camera(nc net.Conn, frames int) {
+	defer nc.Close()
+	video := &track{video: true, codec: codecH264, payloadType: payloadTypeH264,
+		clockRate: 90000, sps: testSPS, pps: testPPS, control: "track1"}
+	audio := &track{codec: codecAAC, payloadType: payloadTypeAAC,
+		clockRate: 44100, channels: 2, config: testConfig, control: "track2"}
+	base := "rtsp://" + nc.LocalAddr().String() + "/stream/"
+	br := bufio.NewReader(nc)
+	for {
+		req, err := readRequest(br)
+		if err != nil {
+			return
+		}
+		resp := &Response{StatusCode: 200, Header: make(map[string]string)}
+		switch req.Method {
+		case "OPTIONS":
+			resp.Header["Public"] = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+		case "DESCRIBE":
+			params := authParams(strings.TrimPrefix(req.Header.Get("Authorization"), "Digest "))
+			ha1 := md5Hex("admin:camera:secret")
+			ha2 := md5Hex("DESCRIBE:" + params["uri"])
+			if params["response"] != md5Hex(ha1+":0123:"+ha2) {
+				resp.StatusCode = 401
+				resp.Header["WWW-Authenticate"] = `Digest realm="camera", nonce="0123"`
+				break
+			}
+			resp.Header["Content-Base"] = base
+			resp.Body = marshalSDP([]*track{video, audio})
+		case "SETUP":
+			resp.Header["Transport"] = req.Header.Get("Transport")
+			resp.Header["Session"] = "camera;timeout=60"
+		}
+		if err := resp.write(nc, req.Header.Get("CSeq")); err != nil {
+			return
+		}
+		if req.Method == "PLAY" {
+			break
+		}
+	}
+
+	var payloader codecs.H264Payloader
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88, 0x84, 0x21}, 1000)...)
+	aac := bytes.Repeat([]byte{0x21, 0x10}, 50)
+	for i := 0; i < frames; i++ {
+		var packets []*rtp.Packet
+		payloads := payloader.Payload(mtu, append([]byte{0, 0, 0, 1}, idr...))
+		for j, payload := range payloads {
+			packets = append(packets, &rtp.Packet{Header: rtp.Header{Version: 2, Marker: j == len(payloads)-1,
+				PayloadType: payloadTypeH264, SequenceNumber: uint16(100*i + j),
+				Timestamp: uint32(1000 + i*40*90), SSRC: 1}, Payload: payload})
+		}
+		packets = append(packets, &rtp.Packet{Header: rtp.Header{Version: 2, Marker: true,
+			PayloadType: payloadTypeAAC, SequenceNumber: uint16(i), Timestamp: uint32(i * aacFrameLen), SSRC: 2},
+			Payload: aacPayload(aac)})
+		for _, p := range packets {
+			b, _ := p.Marshal()
+			channel := 0
+			if p.PayloadType == payloadTypeAAC {
+				channel = 2
+			}
+			if _, err := nc.Write(interleaved(channel, b)); err != nil {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPull(t *testing.T) {
+	at := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sessions := make(chan struct{}, 10)
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sessions <- struct{}{}
+			go camera(nc, 10)
+		}
+	}()
+
+	handler := &testHandler{
+		readers: make(chan av.ReadCloser, 1),
+		writers: make(chan av.WriteCloser, 1),
+	}
+	key, _ := configure.RoomKeys.GetKey("camera")
+	p, err := NewPull("rtsp://admin:wrong@"+l.Addr().String()+"/stream", "live", key, handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(ErrUnauthorized, p.Start())
+	<-sessions
+
+	p, err = NewPull("rtsp://admin:secret@"+l.Addr().String()+"/stream", "live", key, handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	r := <-handler.readers
+	at.Equal("live/camera", r.Info().Key)
+	at.Equal("rtsp://"+l.Addr().String()+"/stream", r.Info().URL)
+	<-handler.writers
+
+	// the frames of two sessions, the session is played again once closed
+	var videos, audios []*av.Packet
+	seqHeader := h264.SequenceHeader(testSPS, testPPS)
+	second := 0
+	for second == 0 || len(videos) < second+3 {
+		var pkt av.Packet
+		if err := r.Read(&pkt); err != nil {
+			t.Fatal(err)
+		}
+		if !pkt.IsVideo {
+			audios = append(audios, &pkt)
+			continue
+		}
+		if len(videos) > 0 && bytes.Equal(pkt.Data, seqHeader) {
+			second = len(videos)
+		}
+		videos = append(videos, &pkt)
+	}
+	at.Len(sessions, 2)
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88, 0x84, 0x21}, 1000)...)
+	at.Equal(seqHeader, videos[0].Data)
+	at.Equal(append([]byte{0x17, 0x01, 0, 0, 0, 0, 0, 0x0b, 0xb9}, idr...), videos[1].Data)
+	at.Equal(uint32(40), videos[2].TimeStamp-videos[1].TimeStamp)
+	// the timestamps go on in the second session
+	at.True(second > 5)
+	at.True(videos[second+1].TimeStamp >= videos[second-1].TimeStamp)
+	at.Equal(append([]byte{0xaf, 0x00}, testConfig...), audios[0].Data)
+	at.Equal(append([]byte{0xaf, 0x01}, bytes.Repeat([]byte{0x21, 0x10}, 50)...), audios[1].Data)
+
+	p.Stop()
+	var pkt av.Packet
+	for r.Read(&pkt) == nil {
+	}
+}
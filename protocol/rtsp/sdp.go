@@ -0,0 +1,186 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/parser/h264"
+)
+
+const (
+	codecH264 = "H264"
+	codecAAC  = "MPEG4-GENERIC"
+
+	payloadTypeH264 = 96
+	payloadTypeAAC  = 97
+)
+
+var (
+	// ErrInvalidSDP means a session description is invalid
+	ErrInvalidSDP = fmt.Errorf("invalid sdp")
+
+	aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+)
+
+// track is a media of a session description
+type track struct {
+	control     string
+	video       bool
+	codec       string
+	payloadType uint8
+	clockRate   int
+	channels    int
+	fmtp        map[string]string
+
+	// the sps and the pps of H.264, the AudioSpecificConfig of AAC
+	sps, pps []byte
+	config   []byte
+}
+
+// aacConfig returns the sample rate and the channels of an
+// AudioSpecificConfig
+func aacConfig(config []byte) (rate, channels int, err error) {
+	if len(config) < 2 {
+		return 0, 0, ErrInvalidSDP
+	}
+	index := int(config[0]&0x07)<<1 | int(config[1]>>7)
+	if index >= len(aacSampleRates) {
+		return 0, 0, ErrInvalidSDP
+	}
+	return aacSampleRates[index], int(config[1]>>3) & 0x0f, nil
+}
+
+// streamTracks returns the tracks of the H.264 and AAC sequence headers of
+// a stream, either may be nil
+func streamTracks(video, audio *av.Packet) []*track {
+	var tracks []*track
+	if video != nil && len(video.Data) > 5 && video.Data[0]&0x0f == av.VideoH264 {
+		if sps, pps, err := h264.ParameterSets(video.Data[5:]); err == nil && len(sps) >= 4 {
+			tracks = append(tracks, &track{
+				video:       true,
+				codec:       codecH264,
+				payloadType: payloadTypeH264,
+				clockRate:   90000,
+				sps:         sps,
+				pps:         pps,
+			})
+		}
+	}
+	if audio != nil && len(audio.Data) > 2 {
+		config := audio.Data[2:]
+		if rate, channels, err := aacConfig(config); err == nil {
+			tracks = append(tracks, &track{
+				codec:       codecAAC,
+				payloadType: payloadTypeAAC,
+				clockRate:   rate,
+				channels:    channels,
+				config:      config,
+			})
+		}
+	}
+	for i, t := range tracks {
+		t.control = fmt.Sprintf("trackID=%d", i)
+	}
+	return tracks
+}
+
+// marshalSDP returns the session description of tracks
+func marshalSDP(tracks []*track) []byte {
+	var b bytes.Buffer
+	b.WriteString("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=livego\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n")
+	for _, t := range tracks {
+		if t.video {
+			fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\n", t.payloadType)
+			fmt.Fprintf(&b, "a=rtpmap:%d %s/%d\r\n", t.payloadType, t.codec, t.clockRate)
+			fmt.Fprintf(&b, "a=fmtp:%d packetization-mode=1;profile-level-id=%x;sprop-parameter-sets=%s,%s\r\n",
+				t.payloadType, t.sps[1:4], base64.StdEncoding.EncodeToString(t.sps),
+				base64.StdEncoding.EncodeToString(t.pps))
+		} else {
+			fmt.Fprintf(&b, "m=audio 0 RTP/AVP %d\r\n", t.payloadType)
+			fmt.Fprintf(&b, "a=rtpmap:%d %s/%d/%d\r\n", t.payloadType, t.codec, t.clockRate, t.channels)
+			fmt.Fprintf(&b, "a=fmtp:%d profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%x\r\n",
+				t.payloadType, t.config)
+		}
+		fmt.Fprintf(&b, "a=control:%s\r\n", t.control)
+	}
+	return b.Bytes()
+}
+
+// parseSDP returns the tracks of a session description, the sps, the pps
+// and the AudioSpecificConfig are those of the fmtp
+func parseSDP(b []byte) ([]*track, error) {
+	var tracks []*track
+	var t *track
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(line[2:])
+			if len(fields) < 4 {
+				return nil, ErrInvalidSDP
+			}
+			pt, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, ErrInvalidSDP
+			}
+			t = &track{
+				video:       fields[0] == "video",
+				payloadType: uint8(pt),
+				fmtp:        make(map[string]string),
+			}
+			tracks = append(tracks, t)
+		case t == nil:
+		case strings.HasPrefix(line, "a=control:"):
+			t.control = line[len("a=control:"):]
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			fields := strings.Fields(line[len("a=rtpmap:"):])
+			if len(fields) != 2 || fields[0] != strconv.Itoa(int(t.payloadType)) {
+				continue
+			}
+			params := strings.Split(fields[1], "/")
+			t.codec = strings.ToUpper(params[0])
+			if len(params) > 1 {
+				t.clockRate, _ = strconv.Atoi(params[1])
+			}
+			if len(params) > 2 {
+				t.channels, _ = strconv.Atoi(params[2])
+			}
+		case strings.HasPrefix(line, "a=fmtp:"):
+			fields := strings.SplitN(line[len("a=fmtp:"):], " ", 2)
+			if len(fields) != 2 || fields[0] != strconv.Itoa(int(t.payloadType)) {
+				continue
+			}
+			for _, param := range strings.Split(fields[1], ";") {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 {
+					t.fmtp[strings.ToLower(kv[0])] = kv[1]
+				}
+			}
+		}
+	}
+	for _, t := range tracks {
+		switch t.codec {
+		case codecH264:
+			for _, v := range strings.Split(t.fmtp["sprop-parameter-sets"], ",") {
+				nalu, err := base64.StdEncoding.DecodeString(v)
+				if err != nil || len(nalu) == 0 {
+					continue
+				}
+				switch nalu[0] & 0x1f {
+				case naluTypeSPS:
+					t.sps = nalu
+				case naluTypePPS:
+					t.pps = nalu
+				}
+			}
+		case codecAAC:
+			t.config, _ = hex.DecodeString(t.fmtp["config"])
+		}
+	}
+	return tracks, nil
+}
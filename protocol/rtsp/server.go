@@ -0,0 +1,568 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionTimeout is how long a connection lives without requests,
+	// rtcp or media
+	sessionTimeout = 60 * time.Second
+	// describeTimeout is how long DESCRIBE waits for the sequence headers
+	// of a stream just published
+	describeTimeout = 2 * time.Second
+
+	methods = "OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, RECORD, TEARDOWN, GET_PARAMETER, SET_PARAMETER"
+)
+
+var (
+	// ErrNotPublished means the stream is not published
+	ErrNotPublished = fmt.Errorf("stream not published")
+	// ErrNoTracks means a stream has no H.264 or AAC
+	ErrNoTracks = fmt.Errorf("no H.264 or AAC track")
+)
+
+// Server serves the RTSP players and publishers of the streams of handler.
+// A player plays rtsp://host/{app}/{name} with DESCRIBE, SETUP and PLAY, a
+// publisher records to rtsp://host/{app}/{room key} with ANNOUNCE, SETUP
+// and RECORD. The tracks are H.264 and AAC in rtp, over the connection or
+// over udp. A session ends with its connection.
+type Server struct {
+	handler av.Handler
+	getter  av.GetWriter
+}
+
+// NewServer returns a Server
+func NewServer(h av.Handler, getter av.GetWriter) *Server {
+	return &Server{
+		handler: h,
+		getter:  getter,
+	}
+}
+
+// Serve accepts the connections of l
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go newConn(s, nc).serve()
+	}
+}
+
+// describe returns the tracks of the stream of app and name, it waits for
+// the sequence headers of a stream just published
+func (s *Server) describe(app, name string) ([]*track, error) {
+	streams, ok := s.handler.(*rtmp.Streams)
+	if !ok || !configure.CheckAppName(app) {
+		return nil, ErrNotPublished
+	}
+	deadline := time.Now().Add(describeTimeout)
+	for {
+		v, ok := streams.GetStreams().Get(configure.AliasKey(app + "/" + name))
+		if !ok || v.(*rtmp.Stream).Reader() == nil {
+			return nil, ErrNotPublished
+		}
+		stream := v.(*rtmp.Stream)
+		video, audio := stream.SequenceHeaders()
+		_, key := stream.KeyFrame()
+		tracks := streamTracks(video, audio)
+		// once a gop is received the missing sequence headers will not come
+		done := (video != nil && audio != nil) || key != nil
+		video.Release()
+		audio.Release()
+		key.Release()
+		if done || time.Now().After(deadline) {
+			if len(tracks) == 0 {
+				return nil, ErrNoTracks
+			}
+			return tracks, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// streamPath returns the application and the name of the stream of u, the
+// path may end with the control of a track
+func streamPath(u *url.URL) (app, name string, ok bool) {
+	paths := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(paths) < 2 || paths[0] == "" || paths[1] == "" {
+		return "", "", false
+	}
+	return paths[0], paths[1], true
+}
+
+// setup is the transport of a track set up, rtp and rtcp are the sockets
+// of udp
+type setup struct {
+	*transport
+	rtp, rtcp         *net.UDPConn
+	rtpAddr, rtcpAddr *net.UDPAddr
+}
+
+// conn is an RTSP connection, it has a session at most
+type conn struct {
+	server    *Server
+	nc        net.Conn
+	br        *bufio.Reader
+	wlock     sync.Mutex
+	lastSeen  int64
+	lock      sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+
+	session   string
+	app, name string
+	base      string
+	record    bool
+	tracks    []*track
+	setups    []*setup
+	writer    *Writer
+	reader    *Reader
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	return &conn{
+		server: s,
+		nc:     nc,
+		br:     bufio.NewReader(nc),
+		done:   make(chan struct{}),
+	}
+}
+
+// touch records an activity of the peer
+func (c *conn) touch() {
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+
+// watch closes the connection once idle for sessionTimeout
+func (c *conn) watch() {
+	ticker := time.NewTicker(sessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSeen))) > sessionTimeout {
+				log.Debugf("rtsp connection %s timed out", c.nc.RemoteAddr())
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// serve serves the requests and the interleaved packets of the connection
+func (c *conn) serve() {
+	var err error
+	defer func() {
+		c.Close()
+		if c.writer != nil {
+			c.writer.Close(err)
+		}
+		if c.reader != nil {
+			c.reader.Close(err)
+		}
+	}()
+	c.touch()
+	go c.watch()
+	buf := make([]byte, maxPacket)
+	for {
+		var b []byte
+		if b, err = c.br.Peek(1); err != nil {
+			return
+		}
+		if b[0] == '$' {
+			var channel int
+			if channel, b, err = readInterleaved(c.br, buf); err != nil {
+				return
+			}
+			c.touch()
+			if c.reader != nil {
+				c.reader.writeRTP(c.channelTrack(channel), b)
+			}
+			continue
+		}
+		var req *Request
+		if req, err = readRequest(c.br); err != nil {
+			return
+		}
+		c.touch()
+		log.Debugf("rtsp %s %s", req.Method, req.URL)
+		resp, after := c.handle(req)
+		if resp.Header == nil {
+			resp.Header = make(map[string]string)
+		}
+		if c.session != "" {
+			resp.Header["Session"] = fmt.Sprintf("%s;timeout=%d", c.session, sessionTimeout/time.Second)
+		}
+		c.wlock.Lock()
+		c.nc.SetWriteDeadline(time.Now().Add(writeTimeout()))
+		err = resp.write(c.nc, req.Header.Get("CSeq"))
+		c.wlock.Unlock()
+		if err != nil {
+			return
+		}
+		if after != nil {
+			after()
+		}
+	}
+}
+
+// writeTimeout returns the timeout of the writes of the connections
+func writeTimeout() time.Duration {
+	return time.Duration(configure.Config.GetInt("write_timeout")) * time.Second
+}
+
+// channelTrack returns the track of an interleaved rtp channel, -1 if none
+func (c *conn) channelTrack(channel int) int {
+	for i, s := range c.setups {
+		if s != nil && s.tcp && s.interleaved[0] == channel {
+			return i
+		}
+	}
+	return -1
+}
+
+// status returns a response of code
+func status(code int) *Response {
+	return &Response{StatusCode: code}
+}
+
+// handle returns the response to req, and what to do after it is sent
+func (c *conn) handle(req *Request) (*Response, func()) {
+	if v := req.Header.Get("Session"); v != "" && c.session != "" &&
+		strings.TrimSpace(strings.SplitN(v, ";", 2)[0]) != c.session {
+		return status(454), nil
+	}
+	switch req.Method {
+	case "OPTIONS":
+		return &Response{StatusCode: 200, Header: map[string]string{"Public": methods}}, nil
+	case "DESCRIBE":
+		return c.handleDescribe(req), nil
+	case "ANNOUNCE":
+		return c.handleAnnounce(req), nil
+	case "SETUP":
+		return c.handleSetup(req), nil
+	case "PLAY":
+		return c.handlePlay(req)
+	case "RECORD":
+		return c.handleRecord(req)
+	case "TEARDOWN":
+		return status(200), func() {
+			c.Close()
+		}
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return status(200), nil
+	}
+	return status(501), nil
+}
+
+// handleDescribe describes the stream of a player
+func (c *conn) handleDescribe(req *Request) *Response {
+	if c.session != "" {
+		return status(455)
+	}
+	app, name, ok := streamPath(req.URL)
+	if !ok {
+		return status(404)
+	}
+	tracks, err := c.server.describe(app, name)
+	if err != nil {
+		log.Debugf("rtsp describe %s/%s: %v", app, name, err)
+		return status(404)
+	}
+	c.app, c.name, c.record, c.tracks = app, name, false, tracks
+	c.base = fmt.Sprintf("rtsp://%s/%s/%s", req.URL.Host, app, name)
+	return &Response{
+		StatusCode: 200,
+		Header: map[string]string{
+			"Content-Base": c.base + "/",
+			"Content-Type": "application/sdp",
+		},
+		Body: marshalSDP(tracks),
+	}
+}
+
+// handleAnnounce checks the room key and the tracks of a publisher, name
+// is the room key like for rtmp publishers
+func (c *conn) handleAnnounce(req *Request) *Response {
+	if c.session != "" {
+		return status(455)
+	}
+	app, key, ok := streamPath(req.URL)
+	if !ok {
+		return status(404)
+	}
+	channel, err := rtmp.PublishChannel(app, key)
+	if err != nil {
+		log.Error("CheckKey err: ", err)
+		return status(403)
+	}
+	tracks, err := parseSDP(req.Body)
+	if err != nil {
+		return status(400)
+	}
+	supported := false
+	for _, t := range tracks {
+		supported = supported || t.codec == codecH264 || t.codec == codecAAC
+	}
+	if !supported {
+		return status(415)
+	}
+	c.app, c.name, c.record, c.tracks = app, channel, true, tracks
+	c.base = fmt.Sprintf("rtsp://%s/%s/%s", req.URL.Host, app, key)
+	return status(200)
+}
+
+// trackIndex returns the track of the control url u, -1 if none
+func (c *conn) trackIndex(u *url.URL) int {
+	s := strings.TrimSuffix(u.String(), "/")
+	for i, t := range c.tracks {
+		if t.control == "" || t.control == "*" {
+			continue
+		}
+		if s == t.control || strings.HasSuffix(s, "/"+t.control) {
+			return i
+		}
+	}
+	if len(c.tracks) == 1 {
+		return 0
+	}
+	return -1
+}
+
+// handleSetup sets up the transport of a track
+func (c *conn) handleSetup(req *Request) *Response {
+	if c.writer != nil || c.reader != nil {
+		return status(455)
+	}
+	if c.tracks == nil {
+		// a player may not describe the stream
+		if resp := c.handleDescribe(req); resp.StatusCode != 200 {
+			return resp
+		}
+	}
+	t, err := parseTransport(req.Header.Get("Transport"))
+	if err != nil {
+		return status(461)
+	}
+	index := c.trackIndex(req.URL)
+	if index < 0 {
+		return status(404)
+	}
+	s := &setup{transport: t}
+	var transport string
+	if t.tcp {
+		if t.interleaved == [2]int{} {
+			t.interleaved = [2]int{2 * index, 2*index + 1}
+		}
+		transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", t.interleaved[0], t.interleaved[1])
+	} else {
+		local := c.nc.LocalAddr().(*net.TCPAddr)
+		remote := c.nc.RemoteAddr().(*net.TCPAddr)
+		if s.rtp, s.rtcp, err = listenPair(local.IP); err != nil {
+			log.Warning("rtsp setup error: ", err)
+			return status(500)
+		}
+		s.rtpAddr = &net.UDPAddr{IP: remote.IP, Port: t.clientPorts[0]}
+		s.rtcpAddr = &net.UDPAddr{IP: remote.IP, Port: t.clientPorts[1]}
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d",
+			t.clientPorts[0], t.clientPorts[1],
+			s.rtp.LocalAddr().(*net.UDPAddr).Port, s.rtcp.LocalAddr().(*net.UDPAddr).Port)
+	}
+	if c.record {
+		transport += ";mode=record"
+	}
+	c.lock.Lock()
+	if c.setups == nil {
+		c.setups = make([]*setup, len(c.tracks))
+	}
+	if old := c.setups[index]; old != nil {
+		old.close()
+	}
+	c.setups[index] = s
+	c.lock.Unlock()
+	select {
+	case <-c.done:
+		// closed meanwhile
+		s.close()
+	default:
+	}
+	if c.session == "" {
+		c.session = uid.NewID()
+	}
+	return &Response{
+		StatusCode: 200,
+		Header:     map[string]string{"Transport": transport},
+	}
+}
+
+// setupTracks returns the tracks set up, nil if not set up, and if any is
+func (c *conn) setupTracks() ([]*track, bool) {
+	tracks := make([]*track, len(c.tracks))
+	any := false
+	for i, s := range c.setups {
+		if s != nil {
+			tracks[i] = c.tracks[i]
+			any = true
+		}
+	}
+	return tracks, any
+}
+
+// handlePlay plays the stream to the tracks set up, once the response is
+// sent
+func (c *conn) handlePlay(req *Request) (*Response, func()) {
+	if c.writer != nil {
+		return status(200), nil
+	}
+	tracks, ok := c.setupTracks()
+	if c.record || !ok {
+		return status(455), nil
+	}
+	c.writer = newWriter(c.app, c.name, c.base, tracks, c.send)
+	writer := c.writer
+	resp := &Response{
+		StatusCode: 200,
+		Header: map[string]string{
+			"Range":    "npt=0.000-",
+			"RTP-Info": writer.rtpInfo(c.base),
+		},
+	}
+	return resp, func() {
+		c.receive(nil)
+		go func() {
+			<-writer.Done()
+			c.Close()
+		}()
+		c.server.handler.HandleWriter(writer)
+		log.Debugf("new rtsp player: %+v", writer.Info())
+	}
+}
+
+// handleRecord publishes the tracks set up
+func (c *conn) handleRecord(req *Request) (*Response, func()) {
+	if c.reader != nil {
+		return status(200), nil
+	}
+	if _, ok := c.setupTracks(); !c.record || !ok {
+		return status(455), nil
+	}
+	reader := newReader(c.app, c.name, c.base, c.tracks)
+	if err := rtmp.HandlePublisher(c.server.handler, c.server.getter, reader); err != nil {
+		log.Warningf("[%v] rtsp publisher refused: %v", reader.Info(), err)
+		return status(409), nil
+	}
+	c.reader = reader
+	return status(200), func() {
+		c.receive(reader)
+		go func() {
+			<-reader.Done()
+			c.Close()
+		}()
+	}
+}
+
+// receive reads the udp packets of the tracks set up, the rtp ones are
+// written to r if not nil
+func (c *conn) receive(r *Reader) {
+	for i, s := range c.setups {
+		if s == nil || s.tcp {
+			continue
+		}
+		i := i
+		if r != nil {
+			go c.readUDP(s.rtp, s.rtpAddr.IP, func(b []byte) {
+				r.writeRTP(i, b)
+			})
+		}
+		go c.readUDP(s.rtcp, s.rtcpAddr.IP, nil)
+	}
+}
+
+// readUDP reads the packets of ip received on udp until it is closed,
+// they are written to write if not nil
+func (c *conn) readUDP(udp *net.UDPConn, ip net.IP, write func([]byte)) {
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(ip) {
+			continue
+		}
+		c.touch()
+		if write != nil {
+			write(buf[:n])
+		}
+	}
+}
+
+// send sends an rtp or rtcp packet of the track index
+func (c *conn) send(index int, isRTCP bool, b []byte) error {
+	s := c.setups[index]
+	if !s.tcp {
+		var err error
+		if isRTCP {
+			_, err = s.rtcp.WriteToUDP(b, s.rtcpAddr)
+		} else {
+			_, err = s.rtp.WriteToUDP(b, s.rtpAddr)
+		}
+		return err
+	}
+	channel := s.interleaved[0]
+	if isRTCP {
+		channel = s.interleaved[1]
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout()))
+	if _, err := c.nc.Write(interleaved(channel, b)); err != nil {
+		return err
+	}
+	// the player receives
+	c.touch()
+	return nil
+}
+
+// close closes the udp sockets
+func (s *setup) close() {
+	if s.rtp != nil {
+		s.rtp.Close()
+		s.rtcp.Close()
+	}
+}
+
+// Close closes the connection and the udp sockets
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.nc.Close()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, s := range c.setups {
+			if s != nil {
+				s.close()
+			}
+		}
+	})
+	return nil
+}
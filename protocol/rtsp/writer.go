@@ -0,0 +1,252 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxQueueNum = 1024
+	// srInterval is how often a sender report is sent for each track
+	srInterval = time.Second
+)
+
+// sendFunc sends an rtp or rtcp packet of the track index of a session
+type sendFunc func(index int, isRTCP bool, b []byte) error
+
+// outTrack is a track played
+type outTrack struct {
+	*track
+	index   int
+	ssrc    uint32
+	seq     uint16
+	packets uint32
+	octets  uint32
+	lastSR  time.Time
+}
+
+// Writer is an RTSP player of a stream, the H.264 frames and the AAC frames
+// are sent in rtp to the tracks set up. The packets are queued by the
+// subscriber of the stream and sent as they come.
+type Writer struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	send            sendFunc
+	video, audio    *outTrack
+	demuxer         flv.Demuxer
+	parser          *parser.CodecParser
+	payloader       codecs.H264Payloader
+	buf             bytes.Buffer
+	started         bool
+
+	// the wall clock of the timestamps in the sender reports
+	clocked bool
+	base    time.Time
+	first   uint32
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newWriter returns a player sending the tracks set up with send, tracks
+// are indexed by their index in the session, nil if not set up
+func newWriter(app, title, url string, tracks []*track, send sendFunc) *Writer {
+	w := &Writer{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:     uid.NewID(),
+		app:     app,
+		title:   title,
+		url:     url,
+		send:    send,
+		demuxer: flv.NewDemuxer(),
+		parser:  parser.NewCodecParser(),
+		done:    make(chan struct{}),
+	}
+	for i, t := range tracks {
+		if t == nil {
+			continue
+		}
+		out := &outTrack{
+			track: t,
+			index: i,
+			ssrc:  rand.Uint32(),
+			seq:   uint16(rand.Uint32()),
+		}
+		if t.video {
+			w.video = out
+		} else {
+			w.audio = out
+		}
+	}
+	return w
+}
+
+// rtpInfo returns the RTP-Info of the PLAY response
+func (w *Writer) rtpInfo(base string) string {
+	var info []string
+	for _, t := range []*outTrack{w.video, w.audio} {
+		if t != nil {
+			info = append(info, fmt.Sprintf("url=%s/%s;seq=%d", base, t.control, t.seq))
+		}
+	}
+	return strings.Join(info, ",")
+}
+
+// Write sends a packet in rtp, the writer is closed if it fails
+func (w *Writer) Write(p *av.Packet) error {
+	select {
+	case <-w.done:
+		return fmt.Errorf("rtsp writer closed")
+	default:
+	}
+	w.SetPreTime()
+	pkt := *p
+	pkt.TimeStamp += w.BaseTimestamp()
+	if pkt.IsVideo {
+		w.RecTimestamp(pkt.TimeStamp, av.TagVideo)
+	} else if pkt.IsAudio {
+		w.RecTimestamp(pkt.TimeStamp, av.TagAudio)
+	}
+	if err := w.sendPacket(&pkt); err != nil {
+		log.Debug("rtsp write error: ", err)
+		w.Close(err)
+		return err
+	}
+	return nil
+}
+
+// sendPacket sends the frame of p, which may be modified
+func (w *Writer) sendPacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	if err := w.demuxer.Demux(p); err != nil {
+		if err == flv.ErrAvcEndSEQ {
+			return nil
+		}
+		return err
+	}
+	if !w.clocked {
+		w.clocked = true
+		w.base = time.Now()
+		w.first = p.TimeStamp
+	}
+	if p.IsVideo {
+		return w.sendVideo(p)
+	}
+	ah := p.Header.(av.AudioPacketHeader)
+	if w.audio == nil || ah.SoundFormat() != av.SoundAAC || ah.AACPacketType() != av.AACRaw {
+		return nil
+	}
+	return w.sendRTP(w.audio, p.TimeStamp, uint32(int64(p.TimeStamp)*int64(w.audio.clockRate)/1000),
+		true, aacPayload(p.Data))
+}
+
+// sendVideo sends the H.264 frame of p from the first key frame, the rtp
+// timestamp is its pts
+func (w *Writer) sendVideo(p *av.Packet) error {
+	vh := p.Header.(av.VideoPacketHeader)
+	if w.video == nil || vh.CodecID() != av.VideoH264 {
+		return nil
+	}
+	if vh.IsSeq() {
+		return w.parser.Parse(p, nil)
+	}
+	if !w.started {
+		if !vh.IsKeyFrame() {
+			return nil
+		}
+		w.started = true
+	}
+	w.buf.Reset()
+	if err := w.parser.Parse(p, &w.buf); err != nil {
+		return err
+	}
+	pts := uint32(int64(p.TimeStamp) + int64(vh.CompositionTime()))
+	payloads := w.payloader.Payload(mtu, w.buf.Bytes())
+	for i, payload := range payloads {
+		if err := w.sendRTP(w.video, pts, pts*90, i == len(payloads)-1, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendRTP sends an rtp packet of t and a sender report if due, ts is the
+// timestamp of the packet in the stream
+func (w *Writer) sendRTP(t *outTrack, ts, rtpTime uint32, marker bool, payload []byte) error {
+	b, err := (&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    t.payloadType,
+			SequenceNumber: t.seq,
+			Timestamp:      rtpTime,
+			SSRC:           t.ssrc,
+		},
+		Payload: payload,
+	}).Marshal()
+	if err != nil {
+		return err
+	}
+	t.seq++
+	t.packets++
+	t.octets += uint32(len(payload))
+	if err := w.send(t.index, false, b); err != nil {
+		return err
+	}
+	if time.Since(t.lastSR) < srInterval {
+		return nil
+	}
+	t.lastSR = time.Now()
+	wall := w.base.Add(time.Duration(int32(ts-w.first)) * time.Millisecond)
+	if b, err = (&rtcp.SenderReport{
+		SSRC:        t.ssrc,
+		NTPTime:     ntpTime(wall),
+		RTPTime:     rtpTime,
+		PacketCount: t.packets,
+		OctetCount:  t.octets,
+	}).Marshal(); err != nil {
+		return err
+	}
+	return w.send(t.index, true, b)
+}
+
+// Done returns a channel closed when the writer is closed
+func (w *Writer) Done() <-chan struct{} {
+	return w.done
+}
+
+// Close closes the writer, the connection is closed when it is done
+func (w *Writer) Close(err error) {
+	w.closeOnce.Do(func() {
+		log.Debugf("rtsp player [%s/%s] closed: %v", w.app, w.title, err)
+		close(w.done)
+	})
+}
+
+// Info returns the information
+func (w *Writer) Info() (ret av.Info) {
+	ret.UID = w.uid
+	ret.URL = w.url
+	ret.Key = w.app + "/" + w.title
+	ret.Inter = true
+	return
+}
@@ -0,0 +1,169 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/mp4"
+	"github.com/gwuhaolin/livego/parser"
+	"github.com/gwuhaolin/livego/parser/h264"
+)
+
+const (
+	// flvVideoHeaderLen is the length of FrameType, CodecID, AVCPacketType and CompositionTime
+	flvVideoHeaderLen = 5
+	commandTimeout    = 10 * time.Second
+)
+
+var (
+	// ErrNoKeyFrame means no key frame received yet
+	ErrNoKeyFrame = fmt.Errorf("no key frame")
+	// ErrUnsupportedCodec means the video is not h264
+	ErrUnsupportedCodec = fmt.Errorf("unsupported video codec")
+	// ErrUnknownFormat means the format is not registered
+	ErrUnknownFormat = fmt.Errorf("unknown snapshot format")
+	// ErrNoCommand means snapshot_command is not configured
+	ErrNoCommand = fmt.Errorf("snapshot_command is not configured")
+)
+
+// Frame is the latest key frame of a stream with its sequence header
+type Frame struct {
+	Key       string
+	Timestamp uint32
+	Width     int
+	Height    int
+	videoSeq  *av.Packet
+	keyFrame  *av.Packet
+}
+
+// NewFrame returns a Frame, seq and key are flv video tag bodies
+func NewFrame(streamKey string, seq, key *av.Packet) (*Frame, error) {
+	if seq == nil || key == nil {
+		return nil, ErrNoKeyFrame
+	}
+	vh, ok := key.Header.(av.VideoPacketHeader)
+	if !ok || vh.CodecID() != av.VideoH264 ||
+		len(seq.Data) <= flvVideoHeaderLen || len(key.Data) <= flvVideoHeaderLen {
+		return nil, ErrUnsupportedCodec
+	}
+	f := &Frame{
+		Key:       streamKey,
+		Timestamp: key.TimeStamp,
+		videoSeq:  seq,
+		keyFrame:  key,
+	}
+	if sps, err := h264.ParseSequenceHeader(seq.Data[flvVideoHeaderLen:]); err == nil {
+		f.Width, f.Height = sps.Width, sps.Height
+	}
+	return f, nil
+}
+
+// AnnexB returns the key frame as h264 elementary stream with sps and pps
+func (f *Frame) AnnexB() ([]byte, error) {
+	demuxer := flv.NewDemuxer()
+	codec := parser.NewCodecParser()
+	buf := bytes.NewBuffer(nil)
+	for _, p := range []*av.Packet{f.videoSeq, f.keyFrame} {
+		pkt := *p
+		if err := demuxer.Demux(&pkt); err != nil {
+			return nil, err
+		}
+		if err := codec.Parse(&pkt, buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// FLV returns a flv file with the sequence header and the key frame
+func (f *Frame) FLV() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := flv.WriteClip(buf, f.videoSeq, f.keyFrame); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MP4 returns a mp4 file with the key frame as the only sample
+func (f *Frame) MP4() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := mp4.WriteFrame(buf,
+		f.videoSeq.Data[flvVideoHeaderLen:], f.keyFrame.Data[flvVideoHeaderLen:],
+		f.Width, f.Height); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder encodes a Frame into a snapshot
+type Encoder func(f *Frame) ([]byte, error)
+
+type format struct {
+	contentType string
+	encode      Encoder
+}
+
+var (
+	formatLock sync.RWMutex
+	formats    = map[string]format{}
+)
+
+// Register registers an encoder of format, e.g. to make jpeg snapshots
+// with an image library, it replaces the encoder of the same format
+func Register(name, contentType string, enc Encoder) {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+	formats[name] = format{contentType, enc}
+}
+
+// Encode encodes f into format name, it returns the data and its content type
+func Encode(name string, f *Frame) ([]byte, string, error) {
+	formatLock.RLock()
+	fm, ok := formats[name]
+	formatLock.RUnlock()
+	if !ok {
+		return nil, "", ErrUnknownFormat
+	}
+	data, err := fm.encode(f)
+	return data, fm.contentType, err
+}
+
+// encodeByCommand pipes the Annex-B frame into snapshot_command and
+// returns what it writes to stdout, e.g.
+// "ffmpeg -f h264 -i - -frames:v 1 -f image2 -c:v mjpeg -"
+func encodeByCommand(f *Frame) ([]byte, error) {
+	args := strings.Fields(configure.Config.GetString("snapshot_command"))
+	if len(args) == 0 {
+		return nil, ErrNoCommand
+	}
+	data, err := f.AnnexB()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("snapshot command error: %v, %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func init() {
+	Register("h264", "video/h264", (*Frame).AnnexB)
+	Register("flv", "video/x-flv", (*Frame).FLV)
+	Register("mp4", "video/mp4", (*Frame).MP4)
+	Register("jpg", "image/jpeg", encodeByCommand)
+}
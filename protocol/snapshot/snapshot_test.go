@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	// testSPS is 720x576 main profile
+	testSPS = []byte{0x67, 0x4d, 0x00, 0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28,
+		0x28, 0x2f, 0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a}
+	testPPS = []byte{0x68, 0xde, 0x31, 0x12}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x21}
+)
+
+func newTestPacket(data []byte, timestamp uint32) *av.Packet {
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, true)
+	return &av.Packet{IsVideo: true, TimeStamp: timestamp, Header: &tag, Data: data}
+}
+
+func newTestFrame(t *testing.T) *Frame {
+	seq := newTestPacket(h264.SequenceHeader(testSPS, testPPS), 0)
+	key := newTestPacket(append([]byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, byte(len(testIDR))}, testIDR...), 1000)
+	f, err := NewFrame("live/test", seq, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestNewFrame(t *testing.T) {
+	at := assert.New(t)
+	f := newTestFrame(t)
+	at.Equal("live/test", f.Key)
+	at.Equal(uint32(1000), f.Timestamp)
+	at.Equal(720, f.Width)
+	at.Equal(576, f.Height)
+
+	seq := newTestPacket(h264.SequenceHeader(testSPS, testPPS), 0)
+	_, err := NewFrame("live/test", seq, nil)
+	at.Equal(ErrNoKeyFrame, err)
+	_, err = NewFrame("live/test", nil, seq)
+	at.Equal(ErrNoKeyFrame, err)
+	// not h264, or no payload
+	_, err = NewFrame("live/test", seq, newTestPacket([]byte{0x12, 0, 0, 0, 0, 0xaa}, 0))
+	at.Equal(ErrUnsupportedCodec, err)
+	_, err = NewFrame("live/test", seq, newTestPacket([]byte{0x17, 0x01, 0, 0, 0}, 0))
+	at.Equal(ErrUnsupportedCodec, err)
+}
+
+func TestFrameAnnexB(t *testing.T) {
+	at := assert.New(t)
+	data, err := newTestFrame(t).AnnexB()
+	at.Nil(err)
+	// an access unit delimiter, then the sps, the pps and the nalus of
+	// the key frame with start codes instead of lengths
+	startCode := []byte{0, 0, 0, 1}
+	want := append(append([]byte{}, startCode...), 0x09, 0xf0)
+	for _, nalu := range [][]byte{testSPS, testPPS, testIDR} {
+		want = append(append(want, startCode...), nalu...)
+	}
+	at.Equal(want, data)
+}
+
+func TestEncode(t *testing.T) {
+	at := assert.New(t)
+	f := newTestFrame(t)
+	annexB, _ := f.AnnexB()
+
+	data, contentType, err := Encode("h264", f)
+	at.Nil(err)
+	at.Equal("video/h264", contentType)
+	at.Equal(annexB, data)
+
+	data, contentType, err = Encode("flv", f)
+	at.Nil(err)
+	at.Equal("video/x-flv", contentType)
+	r := flv.NewReader(bytes.NewReader(data))
+	var p av.Packet
+	at.Nil(r.Read(&p))
+	at.True(p.Header.(av.VideoPacketHeader).IsSeq())
+	at.Nil(r.Read(&p))
+	at.True(av.IsKeyFrame(&p))
+	// a clip of its own, it starts at 0
+	at.Equal(uint32(0), p.TimeStamp)
+
+	data, contentType, err = Encode("mp4", f)
+	at.Nil(err)
+	at.Equal("video/mp4", contentType)
+	at.Equal([]byte("ftyp"), data[4:8])
+
+	_, _, err = Encode("gif", f)
+	at.Equal(ErrUnknownFormat, err)
+	Register("gif", "image/gif", func(f *Frame) ([]byte, error) {
+		return []byte("GIF89a"), nil
+	})
+	data, contentType, err = Encode("gif", f)
+	at.Nil(err)
+	at.Equal("image/gif", contentType)
+	at.Equal([]byte("GIF89a"), data)
+}
+
+func TestEncodeByCommand(t *testing.T) {
+	at := assert.New(t)
+	defer configure.Config.Set("snapshot_command", "")
+	f := newTestFrame(t)
+	annexB, _ := f.AnnexB()
+
+	configure.Config.Set("snapshot_command", "")
+	_, _, err := Encode("jpg", f)
+	at.Equal(ErrNoCommand, err)
+
+	// the command reads the Annex-B frame
+	configure.Config.Set("snapshot_command", "cat")
+	data, contentType, err := Encode("jpg", f)
+	at.Nil(err)
+	at.Equal("image/jpeg", contentType)
+	at.Equal(annexB, data)
+
+	configure.Config.Set("snapshot_command", "false")
+	_, _, err = Encode("jpg", f)
+	at.NotNil(err)
+}
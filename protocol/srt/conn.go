@@ -0,0 +1,530 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tickInterval      = 10 * time.Millisecond
+	keepaliveInterval = time.Second
+	idleTimeout       = 5 * time.Second
+	// sendKeep is how long the sent packets are kept for retransmission
+	// beyond the latency
+	sendKeep = time.Second
+	// tsPeriod is the period of the 32 bits timestamps in µs
+	tsPeriod = 1 << 32 * time.Microsecond
+	// maxNAK is the max size of a loss list
+	maxNAK = 1400
+)
+
+var (
+	// ErrClosed means the connection is closed
+	ErrClosed = fmt.Errorf("srt connection closed")
+	// ErrTimeout means nothing was received from the peer for too long
+	ErrTimeout = fmt.Errorf("srt connection timeout")
+)
+
+// sentPacket is a data packet kept for retransmission
+type sentPacket struct {
+	seq  uint32
+	data []byte
+	time time.Time
+}
+
+// Conn is a srt connection in live mode, the payloads of the received
+// data packets are read in order once the latency has passed and every
+// Write is sent in data packets of at most MaxPayload bytes
+type Conn struct {
+	socketID uint32
+	peerID   uint32
+	streamID string
+	local    net.Addr
+	remote   net.Addr
+	latency  time.Duration
+	start    time.Time
+	send     func([]byte) error
+	onClose  func()
+
+	lock sync.Mutex
+	// sender
+	sndSeq   uint32
+	msgNo    uint32
+	sndBuf   []*sentPacket
+	lastSend time.Time
+	// receiver
+	rcvNext  uint32
+	rcvMax   uint32
+	rcvBuf   map[uint32]*packet
+	loss     map[uint32]time.Time
+	ackNo    uint32
+	ackSeq   uint32
+	acks     map[uint32]time.Time
+	lastRecv time.Time
+	rtt      time.Duration
+	rttVar   time.Duration
+	// tsBase is the local time of the timestamp 0 of the peer
+	tsBase  time.Time
+	hasBase bool
+	tsLast  uint32
+	tsWrap  time.Duration
+	ready   [][]byte
+	pending []byte
+
+	readable  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// newConn returns a Conn whose sequence numbers of both directions start
+// at initSeq
+func newConn(socketID, peerID, initSeq uint32, latency time.Duration, send func([]byte) error) *Conn {
+	now := time.Now()
+	c := &Conn{
+		socketID: socketID,
+		peerID:   peerID,
+		latency:  latency,
+		start:    now,
+		send:     send,
+		sndSeq:   initSeq,
+		msgNo:    1,
+		lastSend: now,
+		rcvNext:  initSeq,
+		rcvMax:   initSeq,
+		ackSeq:   initSeq,
+		rcvBuf:   make(map[uint32]*packet),
+		loss:     make(map[uint32]time.Time),
+		acks:     make(map[uint32]time.Time),
+		lastRecv: now,
+		rtt:      100 * time.Millisecond,
+		rttVar:   50 * time.Millisecond,
+		readable: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// StreamID returns the stream id sent by the caller
+func (c *Conn) StreamID() string {
+	return c.streamID
+}
+
+// LocalAddr returns the local address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Done returns a channel closed when the connection is closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// timestamp returns the timestamp of the packets sent now
+func (c *Conn) timestamp() uint32 {
+	return uint32(time.Since(c.start) / time.Microsecond)
+}
+
+// sendControl sends a control packet, c.lock must be held
+func (c *Conn) sendControl(typ uint16, info uint32, payload []byte) {
+	p := &packet{
+		ctrl:      true,
+		typ:       typ,
+		info:      info,
+		timestamp: c.timestamp(),
+		dst:       c.peerID,
+		payload:   payload,
+	}
+	c.lastSend = time.Now()
+	c.send(p.marshal(nil))
+}
+
+// Read reads the payloads of the data packets in order, a payload is
+// never merged with the next one
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		c.lock.Lock()
+		if len(c.ready) > 0 {
+			c.pending = c.ready[0]
+			c.ready[0] = nil
+			c.ready = c.ready[1:]
+			c.lock.Unlock()
+			break
+		}
+		c.lock.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.closed:
+			return 0, c.err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends b in data packets of at most MaxPayload bytes
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.err
+	default:
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	n := 0
+	for n < len(b) {
+		size := len(b) - n
+		if size > MaxPayload {
+			size = MaxPayload
+		}
+		p := &packet{
+			seq:       c.sndSeq,
+			msg:       msgSolo | c.msgNo&msgNoMask,
+			timestamp: c.timestamp(),
+			dst:       c.peerID,
+			payload:   b[n : n+size],
+		}
+		data := p.marshal(make([]byte, 0, headerLen+size))
+		if len(c.sndBuf) >= flowWindow {
+			c.sndBuf[0] = nil
+			c.sndBuf = c.sndBuf[1:]
+		}
+		c.sndBuf = append(c.sndBuf, &sentPacket{seq: c.sndSeq, data: data, time: now})
+		c.sndSeq = seqAdd(c.sndSeq, 1)
+		c.msgNo++
+		c.lastSend = now
+		if err := c.send(data); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// Close sends a shutdown to the peer and closes the connection
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	select {
+	case <-c.closed:
+	default:
+		c.sendControl(ctrlShutdown, 0, make([]byte, 4))
+	}
+	c.lock.Unlock()
+	c.close(ErrClosed)
+	return nil
+}
+
+// close closes the connection with err
+func (c *Conn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		close(c.closed)
+		c.lock.Unlock()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+// run delivers the received packets, sends the ACK, NAK and keepalive
+// packets and checks the peer is still there
+func (c *Conn) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			idle := now.Sub(c.lastRecv) > idleTimeout
+			if !idle {
+				c.deliver(now)
+				c.sendACK(now)
+				c.sendNAK(now, false)
+				c.dropSent(now)
+				if now.Sub(c.lastSend) >= keepaliveInterval {
+					c.sendControl(ctrlKeepalive, 0, make([]byte, 4))
+				}
+			}
+			c.lock.Unlock()
+			if idle {
+				c.close(ErrTimeout)
+				return
+			}
+		}
+	}
+}
+
+// handle handles a packet sent to the connection
+func (c *Conn) handle(p *packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	now := time.Now()
+	c.lastRecv = now
+	if !p.ctrl {
+		c.receive(p, now)
+		return
+	}
+	switch p.typ {
+	case ctrlACK:
+		c.handleACK(p)
+	case ctrlACKACK:
+		if t, ok := c.acks[p.info]; ok {
+			delete(c.acks, p.info)
+			c.updateRTT(now.Sub(t))
+		}
+	case ctrlNAK:
+		c.handleNAK(p)
+	case ctrlShutdown:
+		go c.close(ErrClosed)
+	}
+}
+
+// receive stores a data packet until it is delivered, the missing packets
+// before it are reported at once
+func (c *Conn) receive(p *packet, now time.Time) {
+	if p.msg&msgKeyMask != 0 {
+		// encrypted payloads are not supported
+		return
+	}
+	if seqDiff(p.seq, c.rcvNext) < 0 {
+		return
+	}
+	if _, ok := c.rcvBuf[p.seq]; ok {
+		return
+	}
+	if seqDiff(p.seq, c.rcvNext) >= flowWindow {
+		return
+	}
+	c.rcvBuf[p.seq] = p
+	delete(c.loss, p.seq)
+	if d := seqDiff(p.seq, c.rcvMax); d >= 0 {
+		for seq := c.rcvMax; seq != p.seq; seq = seqAdd(seq, 1) {
+			c.loss[seq] = time.Time{}
+		}
+		c.rcvMax = seqAdd(p.seq, 1)
+		if d > 0 {
+			c.sendNAK(now, true)
+		}
+	}
+	if !c.hasBase {
+		c.hasBase = true
+		c.tsLast = p.timestamp
+		c.tsBase = now.Add(-time.Duration(p.timestamp) * time.Microsecond)
+	}
+	c.deliver(now)
+}
+
+// deliveryTime returns when the packet with the timestamp ts is delivered
+func (c *Conn) deliveryTime(ts uint32) time.Time {
+	wrap := c.tsWrap
+	if ts < c.tsLast && c.tsLast-ts > 1<<31 {
+		// the timestamps wrapped around
+		wrap += tsPeriod
+	} else if ts > c.tsLast && ts-c.tsLast > 1<<31 && wrap > 0 {
+		// a late packet from before the wrap around
+		wrap -= tsPeriod
+	}
+	return c.tsBase.Add(wrap + time.Duration(ts)*time.Microsecond + c.latency)
+}
+
+// deliver makes the packets whose delivery time passed readable, the
+// missing packets before them are dropped
+func (c *Conn) deliver(now time.Time) {
+	if !c.hasBase {
+		return
+	}
+	delivered := false
+	for seqDiff(c.rcvMax, c.rcvNext) > 0 {
+		p, ok := c.rcvBuf[c.rcvNext]
+		if !ok {
+			// skips the missing packets if a later packet is due
+			next := c.rcvNext
+			for seqDiff(c.rcvMax, next) > 0 {
+				if p, ok = c.rcvBuf[next]; ok {
+					break
+				}
+				next = seqAdd(next, 1)
+			}
+			if p == nil || c.deliveryTime(p.timestamp).After(now) {
+				break
+			}
+			for ; c.rcvNext != next; c.rcvNext = seqAdd(c.rcvNext, 1) {
+				delete(c.loss, c.rcvNext)
+			}
+		}
+		if c.deliveryTime(p.timestamp).After(now) {
+			break
+		}
+		if p.timestamp < c.tsLast && c.tsLast-p.timestamp > 1<<31 {
+			c.tsWrap += tsPeriod
+		}
+		c.tsLast = p.timestamp
+		delete(c.rcvBuf, c.rcvNext)
+		c.rcvNext = seqAdd(c.rcvNext, 1)
+		c.ready = append(c.ready, p.payload)
+		delivered = true
+	}
+	if delivered {
+		select {
+		case c.readable <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sendACK acknowledges the packets received before the first missing one
+func (c *Conn) sendACK(now time.Time) {
+	ack := c.rcvNext
+	for seqDiff(c.rcvMax, ack) > 0 {
+		if _, ok := c.rcvBuf[ack]; !ok {
+			break
+		}
+		ack = seqAdd(ack, 1)
+	}
+	if ack == c.ackSeq {
+		return
+	}
+	c.ackSeq = ack
+	c.ackNo++
+	c.acks[c.ackNo] = now
+	for n, t := range c.acks {
+		if now.Sub(t) > idleTimeout {
+			delete(c.acks, n)
+		}
+	}
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint32(b[0:], ack)
+	binary.BigEndian.PutUint32(b[4:], uint32(c.rtt/time.Microsecond))
+	binary.BigEndian.PutUint32(b[8:], uint32(c.rttVar/time.Microsecond))
+	binary.BigEndian.PutUint32(b[12:], uint32(flowWindow-len(c.rcvBuf)))
+	c.sendControl(ctrlACK, c.ackNo, b)
+}
+
+// sendNAK reports the lost packets, the ones already reported are
+// reported again after a round trip unless only the new ones are asked
+func (c *Conn) sendNAK(now time.Time, onlyNew bool) {
+	if len(c.loss) == 0 {
+		return
+	}
+	again := c.rtt + 4*c.rttVar + tickInterval
+	var b []byte
+	var first, last uint32
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		if first == last {
+			b = append(b, byte(first>>24), byte(first>>16), byte(first>>8), byte(first))
+		} else {
+			f := first | 0x80000000
+			b = append(b, byte(f>>24), byte(f>>16), byte(f>>8), byte(f),
+				byte(last>>24), byte(last>>16), byte(last>>8), byte(last))
+		}
+	}
+	for seq := c.rcvNext; seqDiff(c.rcvMax, seq) > 0 && len(b) < maxNAK; seq = seqAdd(seq, 1) {
+		t, ok := c.loss[seq]
+		if !ok {
+			continue
+		}
+		if onlyNew && !t.IsZero() || !t.IsZero() && now.Sub(t) < again {
+			continue
+		}
+		c.loss[seq] = now
+		if n > 0 && seq == seqAdd(last, 1) {
+			last = seq
+			continue
+		}
+		flush()
+		first, last = seq, seq
+		n++
+	}
+	flush()
+	if len(b) > 0 {
+		c.sendControl(ctrlNAK, 0, b)
+	}
+}
+
+// handleACK releases the acknowledged packets and answers with an ACKACK
+func (c *Conn) handleACK(p *packet) {
+	if len(p.payload) < 4 {
+		return
+	}
+	ack := binary.BigEndian.Uint32(p.payload) & seqMask
+	i := 0
+	for i < len(c.sndBuf) && seqDiff(ack, c.sndBuf[i].seq) > 0 {
+		c.sndBuf[i] = nil
+		i++
+	}
+	c.sndBuf = c.sndBuf[i:]
+	if len(p.payload) >= 8 {
+		if rtt := binary.BigEndian.Uint32(p.payload[4:]); rtt > 0 {
+			c.rtt = time.Duration(rtt) * time.Microsecond
+		}
+	}
+	if p.info != 0 {
+		c.sendControl(ctrlACKACK, p.info, nil)
+	}
+}
+
+// handleNAK retransmits the reported packets
+func (c *Conn) handleNAK(p *packet) {
+	for b := p.payload; len(b) >= 4; {
+		first := binary.BigEndian.Uint32(b)
+		last := first
+		b = b[4:]
+		if first&0x80000000 != 0 {
+			if len(b) < 4 {
+				return
+			}
+			first &= seqMask
+			last = binary.BigEndian.Uint32(b) & seqMask
+			b = b[4:]
+		}
+		for _, sp := range c.sndBuf {
+			if seqDiff(sp.seq, first) >= 0 && seqDiff(last, sp.seq) >= 0 {
+				binary.BigEndian.PutUint32(sp.data[4:], binary.BigEndian.Uint32(sp.data[4:])|msgRexmit)
+				c.send(sp.data)
+			}
+		}
+	}
+}
+
+// updateRTT updates the round trip time with a sample
+func (c *Conn) updateRTT(rtt time.Duration) {
+	diff := c.rtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttVar = (3*c.rttVar + diff) / 4
+	c.rtt = (7*c.rtt + rtt) / 8
+}
+
+// dropSent drops the sent packets too old to be delivered in time
+func (c *Conn) dropSent(now time.Time) {
+	i := 0
+	for i < len(c.sndBuf) && now.Sub(c.sndBuf[i].time) > c.latency+sendKeep {
+		c.sndBuf[i] = nil
+		i++
+	}
+	c.sndBuf = c.sndBuf[i:]
+}
@@ -0,0 +1,151 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamID(t *testing.T) {
+	at := assert.New(t)
+
+	for _, s := range []string{"", "a", "live/movie", "#!::r=live/abcd,m=publish"} {
+		at.Equal(s, decodeStreamID(encodeStreamID(s)))
+	}
+	at.Equal([]byte{'e', 'v', 'i', 'l', 0, 0, 0, '/'}, encodeStreamID("live/"))
+
+	app, name, publish, err := parseStreamID("#!::r=live/key,m=publish")
+	at.Nil(err)
+	at.Equal("live", app)
+	at.Equal("key", name)
+	at.True(publish)
+	app, name, publish, err = parseStreamID("live/movie")
+	at.Nil(err)
+	at.Equal("live/movie", app+"/"+name)
+	at.False(publish)
+	_, _, publish, err = parseStreamID("#!::m=request,r=live/movie")
+	at.Nil(err)
+	at.False(publish)
+	for _, s := range []string{"movie", "#!::r=live/key,m=bidirectional", "#!::m=publish", "/live"} {
+		_, _, _, err = parseStreamID(s)
+		at.Equal(ErrInvalidStreamID, err, s)
+	}
+}
+
+func TestSeq(t *testing.T) {
+	at := assert.New(t)
+
+	at.Equal(uint32(0), seqAdd(seqMask, 1))
+	at.Equal(int32(1), seqDiff(0, seqMask))
+	at.Equal(int32(-1), seqDiff(seqMask, 0))
+	at.Equal(int32(5), seqDiff(7, 2))
+}
+
+// dialPair returns the connections of a caller and the listener l
+func dialPair(t *testing.T, l *Listener, streamID string) (*Conn, *Conn) {
+	caller, err := Dial(l.Addr().String(), streamID, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caller, accepted
+}
+
+func TestDialListen(t *testing.T) {
+	at := assert.New(t)
+
+	cfg := ListenConfig{
+		Latency: 50 * time.Millisecond,
+		Check: func(streamID string) int {
+			if streamID == "bad" {
+				return RejectForbidden
+			}
+			return 0
+		},
+	}
+	l, err := cfg.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, err = Dial(l.Addr().String(), "bad", 0)
+	at.Equal(&RejectError{Reason: RejectForbidden}, err)
+
+	caller, accepted := dialPair(t, l, "#!::r=live/movie,m=publish")
+	at.Equal("#!::r=live/movie,m=publish", accepted.StreamID())
+
+	b := make([]byte, 2*MaxPayload)
+	_, err = caller.Write(b[:MaxPayload+10])
+	at.Nil(err)
+	n, err := accepted.Read(b)
+	at.Nil(err)
+	at.Equal(MaxPayload, n)
+	n, err = accepted.Read(b)
+	at.Nil(err)
+	at.Equal(10, n)
+
+	_, err = accepted.Write([]byte("pong"))
+	at.Nil(err)
+	n, err = caller.Read(b)
+	at.Nil(err)
+	at.Equal("pong", string(b[:n]))
+
+	caller.Close()
+	select {
+	case <-accepted.Done():
+	case <-time.After(time.Second):
+		t.Fatal("shutdown not received")
+	}
+	_, err = accepted.Read(b)
+	at.Equal(ErrClosed, err)
+}
+
+func TestRetransmission(t *testing.T) {
+	at := assert.New(t)
+
+	l, err := ListenConfig{Latency: 50 * time.Millisecond}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	caller, accepted := dialPair(t, l, "live/movie")
+	defer caller.Close()
+
+	// drops the first transmission of every third data packet
+	send := caller.send
+	sent := 0
+	caller.lock.Lock()
+	caller.send = func(b []byte) error {
+		flags := binary.BigEndian.Uint32(b[4:])
+		if b[0]&0x80 == 0 && flags&msgRexmit == 0 {
+			if sent++; sent%3 == 0 {
+				return nil
+			}
+		}
+		return send(b)
+	}
+	caller.lock.Unlock()
+
+	const count = 100
+	go func() {
+		for i := 0; i < count; i++ {
+			caller.Write([]byte(fmt.Sprint(i)))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	b := make([]byte, MaxPayload)
+	for i := 0; i < count; i++ {
+		n, err := accepted.Read(b)
+		if !at.Nil(err) {
+			return
+		}
+		at.Equal(fmt.Sprint(i), string(b[:n]))
+	}
+}
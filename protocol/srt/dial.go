@@ -0,0 +1,177 @@
+package srt
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	handshakeRetry   = 250 * time.Millisecond
+	handshakeTimeout = 3 * time.Second
+)
+
+var (
+	// ErrHandshakeTimeout means the listener did not answer the handshake
+	ErrHandshakeTimeout = fmt.Errorf("srt handshake timeout")
+)
+
+// RejectError is the reason a listener rejected a caller
+type RejectError struct {
+	Reason int
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("srt connection rejected: %d", e.Reason)
+}
+
+// Dial calls the srt listener at the UDP address addr with the stream id
+func Dial(addr, streamID string, latency time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if latency <= 0 {
+		latency = DefaultLatency
+	}
+	c, err := dial(uc, streamID, latency)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial does the caller handshake on uc and starts the connection
+func dial(uc *net.UDPConn, streamID string, latency time.Duration) (*Conn, error) {
+	socketID := randomUint32()&seqMask | 1
+	hs := &handshake{
+		version:   hsVersion4,
+		extension: hsDgram,
+		initSeq:   randomUint32() & seqMask,
+		mtu:       mtu,
+		window:    flowWindow,
+		typ:       hsInduction,
+		socketID:  socketID,
+	}
+	resp, err := exchange(uc, hs, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.version != hsVersion5 || resp.extension != hsMagic {
+		return nil, &RejectError{Reason: rejectVersion}
+	}
+
+	hs.version = hsVersion5
+	hs.typ = hsConclusion
+	hs.cookie = resp.cookie
+	hs.extension = hsExtHSReq
+	if streamID != "" {
+		hs.extension |= hsExtConfig
+	}
+	hs.hsreq = true
+	hs.srtVersion = srtVersion
+	hs.srtFlags = srtFlags
+	hs.recvDelay = uint16(latency / time.Millisecond)
+	hs.sendDelay = uint16(latency / time.Millisecond)
+	hs.streamID = streamID
+	if resp, err = exchange(uc, hs, extHSReq); err != nil {
+		return nil, err
+	}
+	if resp.typ != hsConclusion {
+		if resp.typ >= hsRejection {
+			return nil, &RejectError{Reason: int(resp.typ - hsRejection)}
+		}
+		return nil, &RejectError{}
+	}
+	if d := time.Duration(resp.sendDelay) * time.Millisecond; d > latency {
+		latency = d
+	}
+
+	c := newConn(socketID, resp.socketID, hs.initSeq, latency, func(b []byte) error {
+		_, err := uc.Write(b)
+		return err
+	})
+	c.streamID = streamID
+	c.local = uc.LocalAddr()
+	c.remote = uc.RemoteAddr()
+	c.onClose = func() {
+		uc.Close()
+	}
+	go readConn(uc, c)
+	return c, nil
+}
+
+// exchange sends a handshake until the listener answers it
+func exchange(uc *net.UDPConn, hs *handshake, ext uint16) (*handshake, error) {
+	p := &packet{
+		ctrl:    true,
+		typ:     ctrlHandshake,
+		payload: hs.marshal(ext),
+	}
+	req := p.marshal(nil)
+	b := make([]byte, mtu)
+	deadline := time.Now().Add(handshakeTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := uc.Write(req); err != nil {
+			return nil, err
+		}
+		uc.SetReadDeadline(time.Now().Add(handshakeRetry))
+		for {
+			n, err := uc.Read(b)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			resp, err := parsePacket(b[:n])
+			if err != nil || !resp.ctrl || resp.typ != ctrlHandshake || resp.dst != hs.socketID {
+				continue
+			}
+			rhs, err := parseHandshake(resp.payload)
+			if err != nil {
+				continue
+			}
+			if rhs.typ == hsInduction && hs.typ != hsInduction {
+				// a late answer to the induction
+				continue
+			}
+			uc.SetReadDeadline(time.Time{})
+			return rhs, nil
+		}
+	}
+	return nil, ErrHandshakeTimeout
+}
+
+// readConn reads the packets of a caller connection
+func readConn(uc *net.UDPConn, c *Conn) {
+	b := make([]byte, mtu)
+	for {
+		n, err := uc.Read(b)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				log.Debug("srt read error: ", err)
+				c.close(err)
+			}
+			return
+		}
+		p, err := parsePacket(b[:n])
+		if err != nil || p.dst != c.socketID {
+			continue
+		}
+		if p.ctrl && p.typ == ctrlHandshake {
+			// a retransmitted answer to the conclusion
+			continue
+		}
+		c.handle(p)
+	}
+}
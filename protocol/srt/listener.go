@@ -0,0 +1,303 @@
+package srt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The reasons of the rejections of the Check of a ListenConfig
+const (
+	RejectBadRequest = 1400
+	RejectForbidden  = 1403
+	RejectNotFound   = 1404
+	RejectBadMode    = 1405
+	RejectConflict   = 1409
+)
+
+const (
+	rejectUnsecure = 11
+	rejectVersion  = 8
+	// DefaultLatency is the latency used if none is configured
+	DefaultLatency = 120 * time.Millisecond
+	acceptBacklog  = 16
+)
+
+var (
+	// ErrListenerClosed means the listener is closed
+	ErrListenerClosed = fmt.Errorf("srt listener closed")
+)
+
+// ListenConfig is the configuration of a listener
+type ListenConfig struct {
+	// Latency is the min latency of the connections
+	Latency time.Duration
+	// Check returns the reason to reject a caller with the stream id, or
+	// 0 to accept it
+	Check func(streamID string) int
+}
+
+// Listener accepts the srt callers on an UDP socket
+type Listener struct {
+	cfg    ListenConfig
+	pc     net.PacketConn
+	secret [32]byte
+
+	lock  sync.Mutex
+	conns map[uint32]*Conn
+	// peers are the accepted connections by the address and socket id of
+	// the caller, to answer the retransmitted conclusions
+	peers     map[string]*accepted
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// accepted is an accepted connection and the answer to its conclusion
+type accepted struct {
+	conn     *Conn
+	response []byte
+}
+
+// Listen listens on the UDP address addr
+func (cfg ListenConfig) Listen(addr string) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Latency <= 0 {
+		cfg.Latency = DefaultLatency
+	}
+	l := &Listener{
+		cfg:    cfg,
+		pc:     pc,
+		conns:  make(map[uint32]*Conn),
+		peers:  make(map[string]*accepted),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	if _, err := rand.Read(l.secret[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go l.serve()
+	return l, nil
+}
+
+// Addr returns the address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// Accept waits for the next connection
+func (l *Listener) Accept() (*Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener and its connections
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.pc.Close()
+	})
+	l.lock.Lock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.lock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+// serve reads the packets and dispatches them to their connection
+func (l *Listener) serve() {
+	b := make([]byte, mtu)
+	for {
+		n, addr, err := l.pc.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				log.Error("srt listener read error: ", err)
+				l.Close()
+			}
+			return
+		}
+		p, err := parsePacket(b[:n])
+		if err != nil {
+			continue
+		}
+		if p.dst == 0 {
+			if p.ctrl && p.typ == ctrlHandshake {
+				l.handshake(p, addr)
+			}
+			continue
+		}
+		l.lock.Lock()
+		c := l.conns[p.dst]
+		l.lock.Unlock()
+		if c != nil {
+			c.handle(p)
+		}
+	}
+}
+
+// cookie returns the SYN cookie of a caller for the minute of t
+func (l *Listener) cookie(addr net.Addr, t time.Time) uint32 {
+	h := sha256.New()
+	h.Write(l.secret[:])
+	h.Write([]byte(addr.String()))
+	var m [8]byte
+	binary.BigEndian.PutUint64(m[:], uint64(t.Unix()/60))
+	h.Write(m[:])
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// reply sends a handshake to a caller
+func (l *Listener) reply(hs *handshake, ext uint16, dst uint32, addr net.Addr) []byte {
+	p := &packet{
+		ctrl:    true,
+		typ:     ctrlHandshake,
+		dst:     dst,
+		payload: hs.marshal(ext),
+	}
+	b := p.marshal(nil)
+	l.pc.WriteTo(b, addr)
+	return b
+}
+
+// handshake answers the induction and conclusion of a caller
+func (l *Listener) handshake(p *packet, addr net.Addr) {
+	hs, err := parseHandshake(p.payload)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	switch hs.typ {
+	case hsInduction:
+		hs.version = hsVersion5
+		hs.encryption = 0
+		hs.extension = hsMagic
+		hs.cookie = l.cookie(addr, now)
+		l.reply(hs, 0, hs.socketID, addr)
+	case hsConclusion:
+		if hs.cookie != l.cookie(addr, now) && hs.cookie != l.cookie(addr, now.Add(-time.Minute)) {
+			return
+		}
+		key := fmt.Sprintf("%s/%d", addr, hs.socketID)
+		l.lock.Lock()
+		a := l.peers[key]
+		l.lock.Unlock()
+		if a != nil {
+			l.pc.WriteTo(a.response, addr)
+			return
+		}
+		l.conclude(hs, addr, key)
+	}
+}
+
+// reject answers a conclusion with the reason of the rejection
+func (l *Listener) reject(hs *handshake, reason int, addr net.Addr) {
+	callerID := hs.socketID
+	hs.typ = uint32(hsRejection + reason)
+	hs.hsreq = false
+	hs.socketID = 0
+	l.reply(hs, 0, callerID, addr)
+}
+
+// conclude accepts or rejects the conclusion of a caller
+func (l *Listener) conclude(hs *handshake, addr net.Addr, key string) {
+	if hs.version != hsVersion5 || !hs.hsreq {
+		l.reject(hs, rejectVersion, addr)
+		return
+	}
+	if hs.kmreq || hs.extension&hsExtKMReq != 0 {
+		l.reject(hs, rejectUnsecure, addr)
+		return
+	}
+	if l.cfg.Check != nil {
+		if reason := l.cfg.Check(hs.streamID); reason != 0 {
+			log.Warningf("srt caller %s rejected for %q: %d", addr, hs.streamID, reason)
+			l.reject(hs, reason, addr)
+			return
+		}
+	}
+
+	recvLatency := l.cfg.Latency
+	if d := time.Duration(hs.sendDelay) * time.Millisecond; d > recvLatency {
+		recvLatency = d
+	}
+	peerLatency := l.cfg.Latency
+	if d := time.Duration(hs.recvDelay) * time.Millisecond; d > peerLatency {
+		peerLatency = d
+	}
+
+	l.lock.Lock()
+	socketID := l.newSocketID()
+	callerID := hs.socketID
+	c := newConn(socketID, callerID, hs.initSeq, recvLatency, func(b []byte) error {
+		_, err := l.pc.WriteTo(b, addr)
+		return err
+	})
+	c.streamID = hs.streamID
+	c.local = l.pc.LocalAddr()
+	c.remote = addr
+	c.onClose = func() {
+		l.lock.Lock()
+		delete(l.conns, socketID)
+		delete(l.peers, key)
+		l.lock.Unlock()
+	}
+
+	hs.extension = hsExtHSReq
+	hs.socketID = socketID
+	hs.mtu = mtu
+	hs.window = flowWindow
+	hs.srtVersion = srtVersion
+	hs.srtFlags = srtFlags
+	hs.recvDelay = uint16(recvLatency / time.Millisecond)
+	hs.sendDelay = uint16(peerLatency / time.Millisecond)
+	hs.streamID = ""
+	response := l.reply(hs, extHSRsp, callerID, addr)
+	l.conns[socketID] = c
+	l.peers[key] = &accepted{conn: c, response: response}
+	l.lock.Unlock()
+
+	select {
+	case l.accept <- c:
+	default:
+		log.Warning("srt listener backlog full, drop ", addr)
+		c.Close()
+	}
+}
+
+// newSocketID returns an unused socket id, l.lock must be held
+func (l *Listener) newSocketID() uint32 {
+	for {
+		id := randomUint32() & seqMask
+		if _, ok := l.conns[id]; !ok && id != 0 {
+			return id
+		}
+	}
+}
+
+// randomUint32 returns a random number
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,265 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	headerLen = 16
+	// MaxPayload is the max payload of a data packet, 7 ts packets
+	MaxPayload = 1316
+	mtu        = 1500
+	flowWindow = 8192
+
+	ctrlHandshake = 0x0000
+	ctrlKeepalive = 0x0001
+	ctrlACK       = 0x0002
+	ctrlNAK       = 0x0003
+	ctrlShutdown  = 0x0005
+	ctrlACKACK    = 0x0006
+
+	// the flags of the message number field of data packets
+	msgSolo    = 0xc0000000
+	msgRexmit  = 0x04000000
+	msgKeyMask = 0x18000000
+	msgNoMask  = 0x03ffffff
+
+	seqMask = 0x7fffffff
+)
+
+var (
+	// ErrInvalidPacket means a packet is too short or broken
+	ErrInvalidPacket = fmt.Errorf("invalid srt packet")
+)
+
+// packet is a srt data or control packet
+type packet struct {
+	ctrl bool
+	// seq is the sequence number of a data packet
+	seq uint32
+	// msg is the message number field of a data packet
+	msg uint32
+	// typ and info are the type and the type specific information of a
+	// control packet
+	typ       uint16
+	info      uint32
+	timestamp uint32
+	dst       uint32
+	payload   []byte
+}
+
+// parsePacket parses b, the payload is copied
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < headerLen {
+		return nil, ErrInvalidPacket
+	}
+	p := &packet{
+		timestamp: binary.BigEndian.Uint32(b[8:]),
+		dst:       binary.BigEndian.Uint32(b[12:]),
+		payload:   append([]byte(nil), b[headerLen:]...),
+	}
+	w0 := binary.BigEndian.Uint32(b)
+	w1 := binary.BigEndian.Uint32(b[4:])
+	if w0&0x80000000 != 0 {
+		p.ctrl = true
+		p.typ = uint16(w0 >> 16 & 0x7fff)
+		p.info = w1
+	} else {
+		p.seq = w0
+		p.msg = w1
+	}
+	return p, nil
+}
+
+// marshal appends the packet to b
+func (p *packet) marshal(b []byte) []byte {
+	var h [headerLen]byte
+	if p.ctrl {
+		binary.BigEndian.PutUint32(h[0:], 0x80000000|uint32(p.typ)<<16)
+		binary.BigEndian.PutUint32(h[4:], p.info)
+	} else {
+		binary.BigEndian.PutUint32(h[0:], p.seq&seqMask)
+		binary.BigEndian.PutUint32(h[4:], p.msg)
+	}
+	binary.BigEndian.PutUint32(h[8:], p.timestamp)
+	binary.BigEndian.PutUint32(h[12:], p.dst)
+	b = append(b, h[:]...)
+	return append(b, p.payload...)
+}
+
+// seqAdd returns the sequence number n after seq
+func seqAdd(seq uint32, n int32) uint32 {
+	return uint32(int32(seq)+n) & seqMask
+}
+
+// seqDiff returns a - b taking the wrap around into account
+func seqDiff(a, b uint32) int32 {
+	d := int64((a - b) & seqMask)
+	if d >= 1<<30 {
+		d -= 1 << 31
+	}
+	return int32(d)
+}
+
+const (
+	hsInduction  = 1
+	hsConclusion = 0xffffffff
+	// hsRejection is added to the reason of a rejected handshake
+	hsRejection = 1000
+
+	hsVersion4 = 4
+	hsVersion5 = 5
+	hsMagic    = 0x4a17
+	hsDgram    = 2
+
+	// the flags of the extension field of a conclusion
+	hsExtHSReq  = 0x1
+	hsExtKMReq  = 0x2
+	hsExtConfig = 0x4
+
+	extHSReq = 1
+	extHSRsp = 2
+	extKMReq = 3
+	extSID   = 5
+
+	flagTSBPDSnd    = 0x01
+	flagTSBPDRcv    = 0x02
+	flagTLPktDrop   = 0x08
+	flagPeriodicNAK = 0x10
+	flagRexmit      = 0x20
+	srtFlags        = flagTSBPDSnd | flagTSBPDRcv | flagTLPktDrop | flagPeriodicNAK | flagRexmit
+
+	srtVersion = 0x00010401
+	hsCIFLen   = 48
+)
+
+// handshake is the control information of a handshake packet
+type handshake struct {
+	version    uint32
+	encryption uint16
+	extension  uint16
+	initSeq    uint32
+	mtu        uint32
+	window     uint32
+	typ        uint32
+	socketID   uint32
+	cookie     uint32
+	peerIP     [16]byte
+
+	// hsreq is if the HSREQ or HSRSP extension is present
+	hsreq      bool
+	srtVersion uint32
+	srtFlags   uint32
+	recvDelay  uint16
+	sendDelay  uint16
+	kmreq      bool
+	streamID   string
+}
+
+// parseHandshake parses the control information of a handshake
+func parseHandshake(b []byte) (*handshake, error) {
+	if len(b) < hsCIFLen {
+		return nil, ErrInvalidPacket
+	}
+	hs := &handshake{
+		version:    binary.BigEndian.Uint32(b[0:]),
+		encryption: binary.BigEndian.Uint16(b[4:]),
+		extension:  binary.BigEndian.Uint16(b[6:]),
+		initSeq:    binary.BigEndian.Uint32(b[8:]) & seqMask,
+		mtu:        binary.BigEndian.Uint32(b[12:]),
+		window:     binary.BigEndian.Uint32(b[16:]),
+		typ:        binary.BigEndian.Uint32(b[20:]),
+		socketID:   binary.BigEndian.Uint32(b[24:]),
+		cookie:     binary.BigEndian.Uint32(b[28:]),
+	}
+	copy(hs.peerIP[:], b[32:48])
+	if hs.version < hsVersion5 || hs.typ != hsConclusion {
+		return hs, nil
+	}
+	for ext := b[hsCIFLen:]; len(ext) >= 4; {
+		typ := binary.BigEndian.Uint16(ext)
+		n := int(binary.BigEndian.Uint16(ext[2:])) * 4
+		if 4+n > len(ext) {
+			return nil, ErrInvalidPacket
+		}
+		data := ext[4 : 4+n]
+		switch typ {
+		case extHSReq, extHSRsp:
+			if len(data) >= 12 {
+				hs.hsreq = true
+				hs.srtVersion = binary.BigEndian.Uint32(data)
+				hs.srtFlags = binary.BigEndian.Uint32(data[4:])
+				hs.recvDelay = binary.BigEndian.Uint16(data[8:])
+				hs.sendDelay = binary.BigEndian.Uint16(data[10:])
+			}
+		case extKMReq:
+			hs.kmreq = true
+		case extSID:
+			hs.streamID = decodeStreamID(data)
+		}
+		ext = ext[4+n:]
+	}
+	return hs, nil
+}
+
+// marshal returns the control information of the handshake, the HSREQ
+// extension is added with the type ext
+func (hs *handshake) marshal(ext uint16) []byte {
+	b := make([]byte, hsCIFLen, hsCIFLen+64)
+	binary.BigEndian.PutUint32(b[0:], hs.version)
+	binary.BigEndian.PutUint16(b[4:], hs.encryption)
+	binary.BigEndian.PutUint16(b[6:], hs.extension)
+	binary.BigEndian.PutUint32(b[8:], hs.initSeq)
+	binary.BigEndian.PutUint32(b[12:], hs.mtu)
+	binary.BigEndian.PutUint32(b[16:], hs.window)
+	binary.BigEndian.PutUint32(b[20:], hs.typ)
+	binary.BigEndian.PutUint32(b[24:], hs.socketID)
+	binary.BigEndian.PutUint32(b[28:], hs.cookie)
+	copy(b[32:], hs.peerIP[:])
+	if !hs.hsreq {
+		return b
+	}
+	var data [12]byte
+	binary.BigEndian.PutUint32(data[0:], hs.srtVersion)
+	binary.BigEndian.PutUint32(data[4:], hs.srtFlags)
+	binary.BigEndian.PutUint16(data[8:], hs.recvDelay)
+	binary.BigEndian.PutUint16(data[10:], hs.sendDelay)
+	b = appendExtension(b, ext, data[:])
+	if hs.streamID != "" {
+		b = appendExtension(b, extSID, encodeStreamID(hs.streamID))
+	}
+	return b
+}
+
+// appendExtension appends a handshake extension to b
+func appendExtension(b []byte, typ uint16, data []byte) []byte {
+	var h [4]byte
+	binary.BigEndian.PutUint16(h[0:], typ)
+	binary.BigEndian.PutUint16(h[2:], uint16(len(data)/4))
+	b = append(b, h[:]...)
+	return append(b, data...)
+}
+
+// encodeStreamID encodes the stream id like libsrt, padded to 32 bits
+// words whose bytes are in reverse order
+func encodeStreamID(s string) []byte {
+	b := make([]byte, (len(s)+3)/4*4)
+	copy(b, s)
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return b
+}
+
+// decodeStreamID decodes the stream id extension
+func decodeStreamID(data []byte) string {
+	b := make([]byte, len(data)/4*4)
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return string(b)
+}
@@ -0,0 +1,173 @@
+package srt
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pull publishes the ts stream of a srt listener called with a url like
+// srt://host:port?streamid=...&latency=ms, the listener is called again
+// when the connection fails
+type Pull struct {
+	av.RWBaser
+
+	uid            string
+	app, key, url  string
+	title          string
+	addr, streamID string
+	latency        time.Duration
+	handler        av.Handler
+	getter         av.GetWriter
+	lock           sync.Mutex
+	conn           *Conn
+	demuxer        *ts.Demuxer
+	offset, last   uint32
+	stop           chan struct{}
+	stopOnce       sync.Once
+}
+
+// NewPull returns a Pull of rawurl publishing the stream of the room key
+// of app
+func NewPull(rawurl, app, key string, h av.Handler, getter av.GetWriter) (*Pull, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pull{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:      uid.NewID(),
+		app:      app,
+		key:      key,
+		url:      rawurl,
+		addr:     u.Host,
+		streamID: u.Query().Get("streamid"),
+		latency:  time.Duration(configure.Config.GetInt("srt_latency")) * time.Millisecond,
+		handler:  h,
+		getter:   getter,
+		stop:     make(chan struct{}),
+	}
+	if v := u.Query().Get("latency"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		p.latency = time.Duration(ms) * time.Millisecond
+	}
+	return p, nil
+}
+
+// Start calls the listener and publishes its stream
+func (p *Pull) Start() error {
+	channel, err := rtmp.PublishChannel(p.app, p.key)
+	if err != nil {
+		return err
+	}
+	p.title = channel
+	conn, err := Dial(p.addr, p.streamID, p.latency)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.demuxer = ts.NewDemuxer(conn)
+	return rtmp.HandlePublisher(p.handler, p.getter, p)
+}
+
+// Stop stops the pull
+func (p *Pull) Stop() {
+	p.Close(nil)
+}
+
+// Read reads a packet, the timestamps go on from the previous connection
+// after reconnecting
+func (p *Pull) Read(pkt *av.Packet) error {
+	for {
+		err := p.demuxer.Read(pkt)
+		if err == nil {
+			pkt.TimeStamp += p.offset
+			if pkt.TimeStamp > p.last {
+				p.last = pkt.TimeStamp
+			}
+			p.SetPreTime()
+			return nil
+		}
+		if !p.reconnect(err) {
+			p.Close(err)
+			return err
+		}
+	}
+}
+
+// reconnect calls the listener again until it succeeds, it returns false
+// if reconnecting is disabled or the pull is stopped first
+func (p *Pull) reconnect(err error) bool {
+	p.lock.Lock()
+	p.conn.Close()
+	p.lock.Unlock()
+	max := time.Duration(configure.Config.GetInt("relay_reconnect")) * time.Second
+	if max <= 0 {
+		log.Warningf("srt pull %s error: %v", p.url, err)
+		return false
+	}
+	log.Warningf("srt pull %s error: %v, reconnecting", p.url, err)
+	delay := time.Second
+	for {
+		select {
+		case <-p.stop:
+			return false
+		case <-time.After(delay):
+		}
+		// the publisher is alive while reconnecting
+		p.SetPreTime()
+		conn, err := Dial(p.addr, p.streamID, p.latency)
+		if err == nil {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			select {
+			case <-p.stop:
+				conn.Close()
+				return false
+			default:
+			}
+			p.conn = conn
+			p.demuxer = ts.NewDemuxer(conn)
+			p.offset = p.last
+			return true
+		}
+		log.Debugf("srt pull %s reconnect error: %v", p.url, err)
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+}
+
+// Close stops the pull and closes the connection
+func (p *Pull) Close(err error) {
+	p.stopOnce.Do(func() {
+		log.Debugf("srt pull %s closed: %v", p.url, err)
+		p.lock.Lock()
+		close(p.stop)
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		p.lock.Unlock()
+	})
+}
+
+// Info returns the information
+func (p *Pull) Info() (ret av.Info) {
+	ret.UID = p.uid
+	ret.URL = p.url
+	ret.Key = p.app + "/" + p.title
+	return
+}
@@ -0,0 +1,272 @@
+package srt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidStreamID means the stream id is neither app/name nor
+	// #!::r=app/name,m=publish|request
+	ErrInvalidStreamID = fmt.Errorf("invalid srt stream id")
+)
+
+// parseStreamID returns the application, the name and if the caller
+// publishes, from a stream id like #!::r=live/key,m=publish or live/name
+// which is played
+func parseStreamID(streamID string) (app, name string, publish bool, err error) {
+	resource := streamID
+	if strings.HasPrefix(streamID, "#!::") {
+		resource = ""
+		for _, kv := range strings.Split(streamID[4:], ",") {
+			v := strings.SplitN(kv, "=", 2)
+			if len(v) != 2 {
+				return "", "", false, ErrInvalidStreamID
+			}
+			switch v[0] {
+			case "r":
+				resource = v[1]
+			case "m":
+				switch v[1] {
+				case "publish":
+					publish = true
+				case "request":
+				default:
+					return "", "", false, ErrInvalidStreamID
+				}
+			}
+		}
+	}
+	paths := strings.SplitN(strings.Trim(resource, "/"), "/", 2)
+	if len(paths) != 2 || paths[0] == "" || paths[1] == "" {
+		return "", "", false, ErrInvalidStreamID
+	}
+	return paths[0], paths[1], publish, nil
+}
+
+// Server serves the srt publishers and players of the streams of handler,
+// the streams are in ts with H.264 and AAC
+type Server struct {
+	handler av.Handler
+	getter  av.GetWriter
+}
+
+// NewServer returns a Server
+func NewServer(h av.Handler, getter av.GetWriter) *Server {
+	return &Server{
+		handler: h,
+		getter:  getter,
+	}
+}
+
+// Check rejects the callers with an invalid stream id or room key, and the
+// players of a stream not published
+func (s *Server) Check(streamID string) int {
+	app, name, publish, err := parseStreamID(streamID)
+	if err != nil {
+		return RejectBadRequest
+	}
+	if publish {
+		if _, err := rtmp.PublishChannel(app, name); err != nil {
+			return RejectForbidden
+		}
+		return 0
+	}
+	if !configure.CheckAppName(app) {
+		return RejectNotFound
+	}
+	if streams, ok := s.handler.(*rtmp.Streams); ok {
+		v, ok := streams.GetStreams().Get(configure.AliasKey(app + "/" + name))
+		if !ok || v.(*rtmp.Stream).Reader() == nil {
+			return RejectNotFound
+		}
+	}
+	return 0
+}
+
+// Serve accepts the connections of l
+func (s *Server) Serve(l *Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn publishes or plays the stream of conn
+func (s *Server) handleConn(conn *Conn) {
+	app, name, publish, err := parseStreamID(conn.StreamID())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	url := "srt://" + conn.RemoteAddr().String() + "?streamid=" + conn.StreamID()
+	if !publish {
+		writer := NewWriter(app, name, url, conn)
+		s.handler.HandleWriter(writer)
+		log.Debugf("new srt player: %+v", writer.Info())
+		return
+	}
+	channel, err := rtmp.PublishChannel(app, name)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	reader := NewReader(app, channel, url, conn)
+	if err := rtmp.HandlePublisher(s.handler, s.getter, reader); err != nil {
+		log.Warningf("srt publisher %s refused: %v", url, err)
+	}
+}
+
+// Reader is a srt publisher of a ts stream
+type Reader struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	conn            *Conn
+	demuxer         *ts.Demuxer
+	closeOnce       sync.Once
+}
+
+// NewReader returns a publisher reading the ts stream of conn
+func NewReader(app, title, url string, conn *Conn) *Reader {
+	return &Reader{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:     uid.NewID(),
+		app:     app,
+		title:   title,
+		url:     url,
+		conn:    conn,
+		demuxer: ts.NewDemuxer(conn),
+	}
+}
+
+// Read reads a packet
+func (r *Reader) Read(p *av.Packet) error {
+	if err := r.demuxer.Read(p); err != nil {
+		r.Close(err)
+		return err
+	}
+	r.SetPreTime()
+	return nil
+}
+
+// Close closes the connection
+func (r *Reader) Close(err error) {
+	r.closeOnce.Do(func() {
+		log.Debugf("srt publisher [%s/%s] closed: %v", r.app, r.title, err)
+		r.conn.Close()
+	})
+}
+
+// Info returns the information
+func (r *Reader) Info() (ret av.Info) {
+	ret.UID = r.uid
+	ret.URL = r.url
+	ret.Key = r.app + "/" + r.title
+	return
+}
+
+// Writer is a srt player of a stream muxed in ts, the packets are queued
+// by the subscriber of the stream and sent as they come
+type Writer struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	conn            *Conn
+	muxer           *ts.StreamMuxer
+	buf             bytes.Buffer
+	closeOnce       sync.Once
+	done            chan struct{}
+}
+
+// NewWriter returns a player writing to conn
+func NewWriter(app, title, url string, conn *Conn) *Writer {
+	w := &Writer{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:   uid.NewID(),
+		app:   app,
+		title: title,
+		url:   url,
+		conn:  conn,
+		muxer: ts.NewStreamMuxer(),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		<-conn.Done()
+		w.Close(nil)
+	}()
+	return w
+}
+
+// Write muxes a packet and sends it in data packets of MaxPayload bytes,
+// the writer is closed if it fails
+func (w *Writer) Write(p *av.Packet) error {
+	select {
+	case <-w.done:
+		return fmt.Errorf("srt writer closed")
+	default:
+	}
+	if err := w.send(p); err != nil {
+		log.Debug("srt write error: ", err)
+		w.Close(err)
+		return err
+	}
+	return nil
+}
+
+// send muxes p, which is shared with other writers, and sends it
+func (w *Writer) send(p *av.Packet) error {
+	w.SetPreTime()
+	pkt := *p
+	pkt.TimeStamp += w.BaseTimestamp()
+	if pkt.IsVideo {
+		w.RecTimestamp(pkt.TimeStamp, av.TagVideo)
+	} else if pkt.IsAudio {
+		w.RecTimestamp(pkt.TimeStamp, av.TagAudio)
+	}
+	w.buf.Reset()
+	if err := w.muxer.Mux(&pkt, &w.buf); err != nil {
+		return err
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.conn.Write(w.buf.Bytes())
+	return err
+}
+
+// Close closes the writer and the connection
+func (w *Writer) Close(err error) {
+	w.closeOnce.Do(func() {
+		log.Debugf("srt player [%s/%s] closed: %v", w.app, w.title, err)
+		close(w.done)
+		w.conn.Close()
+	})
+}
+
+// Info returns the information
+func (w *Writer) Info() (ret av.Info) {
+	ret.UID = w.uid
+	ret.URL = w.url
+	ret.Key = w.app + "/" + w.title
+	ret.Inter = true
+	return
+}
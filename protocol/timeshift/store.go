@@ -0,0 +1,179 @@
+package timeshift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// chunkDuration is the timestamp range of one chunk file of the disk store
+	chunkDuration = 60 * 1000
+	// chunkSize is the max size of one chunk file of the disk store
+	chunkSize = 64 * 1024 * 1024
+)
+
+// store keeps the payload of entries, put and get are called without the
+// buffer lock so that a slow disk holds up neither the publisher nor the readers
+type store interface {
+	put(e *entry, data []byte) error
+	get(e *entry) ([]byte, error)
+	drop(e *entry)
+	close()
+}
+
+// memoryStore keeps payloads in memory
+type memoryStore struct{}
+
+func (s *memoryStore) put(e *entry, data []byte) error {
+	e.data = make([]byte, len(data))
+	copy(e.data, data)
+	return nil
+}
+
+func (s *memoryStore) get(e *entry) ([]byte, error) {
+	return e.data, nil
+}
+
+func (s *memoryStore) drop(e *entry) {
+	e.data = nil
+}
+
+func (s *memoryStore) close() {}
+
+// chunk is one file of the disk store
+type chunk struct {
+	f     *os.File
+	size  int64
+	first uint32
+	refs  int
+}
+
+// diskStore appends payloads into chunk files,
+// a chunk file is removed once all its entries are dropped
+type diskStore struct {
+	dir     string
+	lock    sync.Mutex
+	seq     int
+	current *chunk
+	chunks  map[*chunk]struct{}
+	closed  bool
+}
+
+func newDiskStore(root, key string) (*diskStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(root, strings.Replace(key, "/", "_", -1)+"_")
+	if err != nil {
+		return nil, err
+	}
+	return &diskStore{
+		dir:    dir,
+		chunks: make(map[*chunk]struct{}),
+	}, nil
+}
+
+func (s *diskStore) newChunk(first uint32) error {
+	if s.current != nil && s.current.refs == 0 {
+		s.remove(s.current)
+	}
+	s.seq++
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%d.dat", s.seq)), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.current = &chunk{f: f, first: first}
+	s.chunks[s.current] = struct{}{}
+	return nil
+}
+
+func (s *diskStore) remove(c *chunk) {
+	delete(s.chunks, c)
+	c.f.Close()
+	if err := os.Remove(c.f.Name()); err != nil {
+		log.Warning("timeshift remove chunk error: ", err)
+	}
+}
+
+func (s *diskStore) put(e *entry, data []byte) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return os.ErrClosed
+	}
+	if s.current == nil || s.current.size >= chunkSize ||
+		(e.isKey && e.timestamp-s.current.first >= chunkDuration) {
+		if err := s.newChunk(e.timestamp); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	// the range is taken under the lock and written without it
+	c := s.current
+	offset := c.size
+	c.size += int64(len(data))
+	c.refs++
+	s.lock.Unlock()
+
+	if _, err := c.f.WriteAt(data, offset); err != nil {
+		s.lock.Lock()
+		s.unref(c)
+		s.lock.Unlock()
+		return err
+	}
+	e.chunk = c
+	e.offset = offset
+	e.size = len(data)
+	return nil
+}
+
+func (s *diskStore) get(e *entry) ([]byte, error) {
+	if e.chunk == nil {
+		return nil, ErrTrimmed
+	}
+	data := make([]byte, e.size)
+	if _, err := e.chunk.f.ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *diskStore) drop(e *entry) {
+	c := e.chunk
+	if c == nil {
+		return
+	}
+	e.chunk = nil
+	s.lock.Lock()
+	s.unref(c)
+	s.lock.Unlock()
+}
+
+// unref releases an entry of c, s.lock must be held
+func (s *diskStore) unref(c *chunk) {
+	c.refs--
+	if c.refs == 0 && c != s.current && !s.closed {
+		s.remove(c)
+	}
+}
+
+func (s *diskStore) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for c := range s.chunks {
+		c.f.Close()
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Warning("timeshift remove dir error: ", err)
+	}
+}
@@ -0,0 +1,583 @@
+package timeshift
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	cmap "github.com/orcaman/concurrent-map"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SegmentDuration is the duration of hls segments generated from the buffer
+	SegmentDuration = 3000 // ms
+)
+
+var (
+	// ErrTrimmed means the packet is already out of the window
+	ErrTrimmed = fmt.Errorf("timeshift packet trimmed")
+	// ErrNoSegment means no such segment in the buffer
+	ErrNoSegment = fmt.Errorf("timeshift segment not found")
+)
+
+var buffers = cmap.New()
+
+// Enabled returns if timeshift is enabled
+func Enabled() bool {
+	return configure.Config.GetInt("timeshift") > 0
+}
+
+// Get returns the buffer of stream key
+func Get(key string) *Buffer {
+	if v, ok := buffers.Get(key); ok {
+		return v.(*Buffer)
+	}
+	return nil
+}
+
+// entry is a packet in the buffer
+type entry struct {
+	timestamp  uint32
+	streamID   uint32
+	isVideo    bool
+	isAudio    bool
+	isMetadata bool
+	isKey      bool
+	header     av.PacketHeader
+
+	// memory store
+	data []byte
+	// disk store
+	chunk  *chunk
+	offset int64
+	size   int
+}
+
+// Buffer keeps the last minutes of a stream, so that players can
+// start playing some seconds behind live
+type Buffer struct {
+	key    string
+	window uint32
+
+	lock      sync.Mutex
+	cond      *sync.Cond
+	store     store
+	entries   []*entry
+	base      uint64
+	keyframes []uint64
+	// hls segments
+	boundaries []boundary
+	segN       uint64
+	hasVideo   bool
+	metadata   *av.Packet
+	videoSeq   *av.Packet
+	audioSeq   *av.Packet
+	lastTs     uint32
+	ended      bool
+	readers    int
+	closed     bool
+}
+
+// NewBuffer creates the buffer of stream key and registers it,
+// the buffer of previous publisher with the same key is ended
+func NewBuffer(key string) (*Buffer, error) {
+	b := &Buffer{
+		key:    key,
+		window: uint32(configure.Config.GetInt("timeshift")) * 60 * 1000,
+	}
+	b.cond = sync.NewCond(&b.lock)
+
+	switch configure.Config.GetString("timeshift_storage") {
+	case "disk":
+		dir := configure.Config.GetString("timeshift_dir")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "livego-timeshift")
+		}
+		s, err := newDiskStore(dir, key)
+		if err != nil {
+			return nil, err
+		}
+		b.store = s
+	default:
+		b.store = &memoryStore{}
+	}
+
+	if old := Get(key); old != nil {
+		old.End()
+	}
+	buffers.Set(key, b)
+	log.Debugf("timeshift buffer [%s] created", key)
+	return b, nil
+}
+
+func clonePacket(p *av.Packet) *av.Packet {
+	c := *p
+	c.Data = make([]byte, len(p.Data))
+	copy(c.Data, p.Data)
+	return &c
+}
+
+// Write appends a packet to the buffer, the payload is stored without
+// the lock so that the readers do not hold up the publisher
+func (b *Buffer) Write(p *av.Packet) {
+	e := b.newEntry(p)
+	if e == nil {
+		return
+	}
+	if err := b.store.put(e, p.Data); err != nil {
+		log.Warningf("timeshift buffer [%s] store error: %v", b.key, err)
+		return
+	}
+	b.append(e)
+}
+
+// newEntry returns the entry of p, or nil when p is kept as a sequence
+// header or the buffer is ended
+func (b *Buffer) newEntry(p *av.Packet) *entry {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ended {
+		return nil
+	}
+
+	e := &entry{
+		timestamp:  p.TimeStamp,
+		streamID:   p.StreamID,
+		isVideo:    p.IsVideo,
+		isAudio:    p.IsAudio,
+		isMetadata: p.IsMetadata,
+		header:     p.Header,
+	}
+	switch {
+	case p.IsMetadata:
+		b.metadata = clonePacket(p)
+		return nil
+	case p.IsVideo:
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return nil
+		}
+		if vh.IsSeq() {
+			b.videoSeq = clonePacket(p)
+			return nil
+		}
+		b.hasVideo = true
+		e.isKey = vh.IsKeyFrame()
+	default:
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		if !ok {
+			return nil
+		}
+		if ah.SoundFormat() == av.SoundAAC && ah.AACPacketType() == av.AACSeqHeader {
+			b.audioSeq = clonePacket(p)
+			return nil
+		}
+		e.isKey = !b.hasVideo
+	}
+	return e
+}
+
+// append appends a stored entry and drops the ones out of the window
+func (b *Buffer) append(e *entry) {
+	b.lock.Lock()
+	if b.ended {
+		// ended while it was stored
+		b.lock.Unlock()
+		b.store.drop(e)
+		return
+	}
+	seq := b.base + uint64(len(b.entries))
+	b.entries = append(b.entries, e)
+	if e.isKey {
+		b.keyframes = append(b.keyframes, seq)
+		if len(b.boundaries) == 0 ||
+			e.timestamp-b.boundaries[len(b.boundaries)-1].timestamp >= SegmentDuration {
+			b.boundaries = append(b.boundaries, boundary{seq: seq, n: b.segN, timestamp: e.timestamp})
+			b.segN++
+		}
+	}
+	if e.timestamp > b.lastTs {
+		b.lastTs = e.timestamp
+	}
+	dropped := b.trim()
+	b.cond.Broadcast()
+	b.lock.Unlock()
+
+	for _, e := range dropped {
+		b.store.drop(e)
+	}
+}
+
+// trim removes the entries out of the window and returns them,
+// b.lock must be held
+func (b *Buffer) trim() []*entry {
+	if b.lastTs < b.window {
+		return nil
+	}
+	limit := b.lastTs - b.window
+	n := 0
+	for n < len(b.entries)-1 && b.entries[n].timestamp < limit {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	dropped := make([]*entry, n)
+	copy(dropped, b.entries[:n])
+	for i := 0; i < n; i++ {
+		b.entries[i] = nil
+	}
+	b.entries = b.entries[n:]
+	b.base += uint64(n)
+	k := sort.Search(len(b.keyframes), func(i int) bool {
+		return b.keyframes[i] >= b.base
+	})
+	b.keyframes = b.keyframes[k:]
+	k = sort.Search(len(b.boundaries), func(i int) bool {
+		return b.boundaries[i].seq >= b.base
+	})
+	b.boundaries = b.boundaries[k:]
+	return dropped
+}
+
+// End stops writing to the buffer, readers still play the rest of it
+func (b *Buffer) End() {
+	b.lock.Lock()
+	if b.ended {
+		b.lock.Unlock()
+		return
+	}
+	b.ended = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+
+	buffers.RemoveCb(b.key, func(key string, v interface{}, exists bool) bool {
+		return exists && v.(*Buffer) == b
+	})
+	log.Debugf("timeshift buffer [%s] ended", b.key)
+	b.release()
+}
+
+// release frees the store when the buffer is ended and no one reads it
+func (b *Buffer) release() {
+	b.lock.Lock()
+	if !b.ended || b.readers > 0 || b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	b.entries = nil
+	b.keyframes = nil
+	b.boundaries = nil
+	b.lock.Unlock()
+	b.store.close()
+}
+
+// Duration returns the duration kept in the buffer
+func (b *Buffer) Duration() uint32 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.entries) == 0 {
+		return 0
+	}
+	return b.lastTs - b.entries[0].timestamp
+}
+
+// entryPacket returns the packet of e with its payload read from the store
+func (b *Buffer) entryPacket(e *entry) (*av.Packet, error) {
+	data, err := b.store.get(e)
+	if err != nil {
+		return nil, err
+	}
+	return &av.Packet{
+		IsVideo:    e.isVideo,
+		IsAudio:    e.isAudio,
+		IsMetadata: e.isMetadata,
+		TimeStamp:  e.timestamp,
+		StreamID:   e.streamID,
+		Header:     e.header,
+		Data:       data,
+	}, nil
+}
+
+// specials returns metadata and sequence headers rebased on timestamp
+func (b *Buffer) specials(timestamp uint32) []*av.Packet {
+	var ret []*av.Packet
+	for _, p := range []*av.Packet{b.metadata, b.videoSeq, b.audioSeq} {
+		if p != nil {
+			c := *p
+			c.TimeStamp = timestamp
+			ret = append(ret, &c)
+		}
+	}
+	return ret
+}
+
+// nearestKeyframe returns the seq of the key frame nearest to timestamp,
+// b.lock must be held
+func (b *Buffer) nearestKeyframe(timestamp uint32) (uint64, bool) {
+	if len(b.keyframes) == 0 {
+		return 0, false
+	}
+	i := sort.Search(len(b.keyframes), func(i int) bool {
+		return b.entries[b.keyframes[i]-b.base].timestamp >= timestamp
+	})
+	if i == len(b.keyframes) {
+		return b.keyframes[i-1], true
+	}
+	if i > 0 {
+		after := b.entries[b.keyframes[i]-b.base].timestamp - timestamp
+		before := timestamp - b.entries[b.keyframes[i-1]-b.base].timestamp
+		if before < after {
+			return b.keyframes[i-1], true
+		}
+	}
+	return b.keyframes[i], true
+}
+
+// Reader reads the buffer from some seconds behind live
+type Reader struct {
+	b        *Buffer
+	seq      uint64
+	specials []*av.Packet
+	closed   bool
+}
+
+// NewReader returns a Reader starting at the key frame nearest to delay ms behind live
+func (b *Buffer) NewReader(delay uint32) (*Reader, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, io.EOF
+	}
+	target := uint32(0)
+	if b.lastTs > delay {
+		target = b.lastTs - delay
+	}
+	seq, ok := b.nearestKeyframe(target)
+	if !ok {
+		return nil, ErrNoSegment
+	}
+	b.readers++
+	return &Reader{
+		b:        b,
+		seq:      seq,
+		specials: b.specials(b.entries[seq-b.base].timestamp),
+	}, nil
+}
+
+// Read reads the next packet, it blocks until a packet is written into
+// the buffer and returns io.EOF after the buffer is ended and read out
+func (r *Reader) Read(p *av.Packet) error {
+	if len(r.specials) > 0 {
+		*p = *r.specials[0]
+		r.specials = r.specials[1:]
+		return nil
+	}
+	for {
+		e, err := r.next()
+		if err != nil {
+			return err
+		}
+		pkt, err := r.b.entryPacket(&e)
+		if err == nil {
+			r.seq++
+			*p = *pkt
+			return nil
+		}
+		if !r.b.trimmed(r.seq) {
+			return err
+		}
+		// trimmed while it was read, next skips to the next key frame
+	}
+}
+
+// next waits for the entry of r.seq and returns a copy of it, its payload
+// is read from the store without the lock
+func (r *Reader) next() (entry, error) {
+	b := r.b
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for {
+		if r.closed || b.closed {
+			return entry{}, io.EOF
+		}
+		if r.seq < b.base {
+			// too slow, skip to next key frame
+			if len(b.keyframes) == 0 {
+				r.seq = b.base + uint64(len(b.entries))
+			} else {
+				r.seq = b.keyframes[0]
+			}
+		}
+		if r.seq < b.base+uint64(len(b.entries)) {
+			return *b.entries[r.seq-b.base], nil
+		}
+		if b.ended {
+			return entry{}, io.EOF
+		}
+		b.cond.Wait()
+	}
+}
+
+// trimmed returns if seq is out of the buffer
+func (b *Buffer) trimmed(seq uint64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return seq < b.base || b.closed
+}
+
+// Close closes the reader
+func (r *Reader) Close() {
+	r.b.lock.Lock()
+	if r.closed {
+		r.b.lock.Unlock()
+		return
+	}
+	r.closed = true
+	r.b.readers--
+	r.b.cond.Broadcast()
+	r.b.lock.Unlock()
+	r.b.release()
+}
+
+// Play writes packets into w at the pace of their timestamps,
+// until the buffer is ended or w fails
+func (r *Reader) Play(w av.WriteCloser) {
+	defer r.Close()
+	var p av.Packet
+	var startTime time.Time
+	var startTs uint32
+	started := false
+	for {
+		if err := r.Read(&p); err != nil {
+			w.Close(err)
+			return
+		}
+		if !started {
+			started = true
+			startTime = time.Now()
+			startTs = p.TimeStamp
+		} else if p.TimeStamp > startTs {
+			due := startTime.Add(time.Duration(p.TimeStamp-startTs) * time.Millisecond)
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		pkt := p
+		if err := w.Write(&pkt); err != nil {
+			log.Debugf("[%v] timeshift write error: %v", w.Info(), err)
+			w.Close(err)
+			return
+		}
+	}
+}
+
+// Segment is a hls segment in the buffer
+type Segment struct {
+	N        uint64
+	Start    uint32
+	Duration uint32
+}
+
+// boundary is the first key frame of a segment
+type boundary struct {
+	seq       uint64
+	n         uint64
+	timestamp uint32
+}
+
+// Segments returns at most max complete segments which end at least delay ms behind live
+func (b *Buffer) Segments(delay uint32, max int) []Segment {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	edge := uint32(0)
+	if b.lastTs > delay {
+		edge = b.lastTs - delay
+	}
+
+	var ret []Segment
+	for i := 0; i+1 < len(b.boundaries); i++ {
+		cur, next := b.boundaries[i], b.boundaries[i+1]
+		if next.timestamp > edge {
+			break
+		}
+		ret = append(ret, Segment{
+			N:        cur.n,
+			Start:    cur.timestamp,
+			Duration: next.timestamp - cur.timestamp,
+		})
+	}
+	if len(ret) > max {
+		ret = ret[len(ret)-max:]
+	}
+	return ret
+}
+
+// WriteSegment calls fn with the sequence headers and packets of the n-th
+// segment, the entries are copied under the lock so that fn and the store
+// do not hold up the publisher
+func (b *Buffer) WriteSegment(n uint64, fn func(*av.Packet) error) error {
+	b.lock.Lock()
+	i := sort.Search(len(b.boundaries), func(i int) bool {
+		return b.boundaries[i].n >= n
+	})
+	if i == len(b.boundaries) || b.boundaries[i].n != n {
+		b.lock.Unlock()
+		return ErrNoSegment
+	}
+	end := b.base + uint64(len(b.entries))
+	if i+1 < len(b.boundaries) {
+		end = b.boundaries[i+1].seq
+	} else if !b.ended {
+		// still growing
+		b.lock.Unlock()
+		return ErrNoSegment
+	}
+	specials := b.specials(b.boundaries[i].timestamp)
+	start := b.boundaries[i].seq - b.base
+	entries := make([]entry, end-b.boundaries[i].seq)
+	for j := range entries {
+		entries[j] = *b.entries[start+uint64(j)]
+	}
+	// the store is kept until the segment is written
+	b.readers++
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.readers--
+		b.lock.Unlock()
+		b.release()
+	}()
+
+	for _, p := range specials {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	for j := range entries {
+		p, err := b.entryPacket(&entries[j])
+		if err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasVideo returns if the stream has video
+func (b *Buffer) HasVideo() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.hasVideo
+}
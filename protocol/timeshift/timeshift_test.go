@@ -0,0 +1,186 @@
+package timeshift
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPacket(isKey bool, timestamp uint32) *av.Packet {
+	data := []byte{0x27, 0x01, 0, 0, 0, 0xaa}
+	if isKey {
+		data[0] = 0x17
+	}
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, true)
+	return &av.Packet{
+		IsVideo:   true,
+		TimeStamp: timestamp,
+		Header:    &tag,
+		Data:      data,
+	}
+}
+
+// writeTestStream writes d ms of 25fps video with a key frame every second
+func writeTestStream(b *Buffer, d uint32) {
+	for ts := uint32(0); ts < d; ts += 40 {
+		b.Write(newTestPacket(ts%1000 == 0, ts))
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	at := assert.New(t)
+	for _, storage := range []string{"memory", "disk"} {
+		dir, err := ioutil.TempDir("", "livego-timeshift")
+		at.Nil(err)
+		configure.Config.Set("timeshift", 1)
+		configure.Config.Set("timeshift_storage", storage)
+		configure.Config.Set("timeshift_dir", dir)
+
+		b, err := NewBuffer("live/test")
+		at.Nil(err)
+		at.Equal(b, Get("live/test"))
+		writeTestStream(b, 70000)
+		at.Equal(uint32(60000), b.Duration())
+
+		r, err := b.NewReader(10900)
+		at.Nil(err)
+		var p av.Packet
+		at.Nil(r.Read(&p))
+		at.Equal(uint32(59000), p.TimeStamp)
+		at.True(p.Header.(av.VideoPacketHeader).IsKeyFrame())
+
+		segments := b.Segments(5000, 3)
+		at.Equal(3, len(segments))
+		at.Equal(uint32(60000), segments[2].Start)
+		at.Equal(uint32(3000), segments[2].Duration)
+		n := 0
+		at.Nil(b.WriteSegment(segments[2].N, func(p *av.Packet) error {
+			n++
+			return nil
+		}))
+		at.Equal(75, n)
+
+		b.End()
+		at.Nil(Get("live/test"))
+		// readers play the rest of the buffer after end
+		for {
+			if err = r.Read(&p); err != nil {
+				break
+			}
+		}
+		at.Equal(io.EOF, err)
+		at.Equal(uint32(69960), p.TimeStamp)
+		r.Close()
+
+		at.True(b.closed)
+		os.RemoveAll(dir)
+	}
+	configure.Config.Set("timeshift", 0)
+}
+
+func TestBufferWriteSegmentUnlocked(t *testing.T) {
+	at := assert.New(t)
+	configure.Config.Set("timeshift", 1)
+	defer configure.Config.Set("timeshift", 0)
+	configure.Config.Set("timeshift_storage", "memory")
+
+	b, err := NewBuffer("live/test")
+	at.Nil(err)
+	defer b.End()
+	writeTestStream(b, 10000)
+	segments := b.Segments(0, 3)
+	at.Equal(3, len(segments))
+
+	// the publisher goes on while a segment is written
+	at.Nil(b.WriteSegment(segments[0].N, func(p *av.Packet) error {
+		written := make(chan struct{})
+		go func() {
+			b.Write(newTestPacket(false, 10000))
+			close(written)
+		}()
+		select {
+		case <-written:
+			return nil
+		case <-time.After(time.Second):
+			return fmt.Errorf("write blocked")
+		}
+	}))
+}
+
+// slowStore blocks the reads of the wrapped store until unblock is closed
+type slowStore struct {
+	store
+	reading chan struct{}
+	unblock chan struct{}
+}
+
+func (s *slowStore) get(e *entry) ([]byte, error) {
+	select {
+	case s.reading <- struct{}{}:
+	default:
+	}
+	<-s.unblock
+	return s.store.get(e)
+}
+
+func TestBufferSlowReader(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "livego-timeshift")
+	at.Nil(err)
+	defer os.RemoveAll(dir)
+	configure.Config.Set("timeshift", 1)
+	defer configure.Config.Set("timeshift", 0)
+	configure.Config.Set("timeshift_storage", "disk")
+	configure.Config.Set("timeshift_dir", dir)
+
+	b, err := NewBuffer("live/test")
+	at.Nil(err)
+	defer b.End()
+	slow := &slowStore{store: b.store, reading: make(chan struct{}, 1), unblock: make(chan struct{})}
+	b.store = slow
+	writeTestStream(b, 10000)
+
+	r, err := b.NewReader(0)
+	at.Nil(err)
+	defer r.Close()
+	var p av.Packet
+	read := make(chan error, 1)
+	go func() {
+		err := r.Read(&p)
+		for err == nil && !p.IsVideo {
+			err = r.Read(&p)
+		}
+		read <- err
+	}()
+	<-slow.reading
+
+	// the publisher goes on while the reader waits for the disk
+	written := make(chan struct{})
+	go func() {
+		for ts := uint32(10000); ts < 80000; ts += 40 {
+			b.Write(newTestPacket(ts%1000 == 0, ts))
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		close(slow.unblock)
+		t.Fatal("write blocked")
+	}
+	close(slow.unblock)
+	// trimmed while it was read, the chunk is still on the disk
+	at.Nil(<-read)
+	at.Equal(uint32(9000), p.TimeStamp)
+	at.Equal(uint32(60000), b.Duration())
+}
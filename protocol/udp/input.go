@@ -0,0 +1,201 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxDatagram is the max size of the datagrams received
+	maxDatagram = 65536
+	readBuffer  = 4 << 20
+)
+
+var (
+	// ErrClosed means the publisher or the output is closed
+	ErrClosed = fmt.Errorf("udp closed")
+)
+
+// listen returns a connection receiving the datagrams of addr, it joins
+// addr on the interface ifname if it is a multicast group
+func listen(addr, ifname string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if udpAddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if ifname != "" {
+			if ifi, err = net.InterfaceByName(ifname); err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(readBuffer)
+	return conn, nil
+}
+
+// Input publishes the ts stream received on a udp address, the stream is
+// published again when the datagrams come back after a timeout
+type Input struct {
+	key, url string
+	conn     *net.UDPConn
+	timeout  time.Duration
+	handler  av.Handler
+	getter   av.GetWriter
+}
+
+// NewInput returns an Input of the stream cfg
+func NewInput(cfg configure.UDPStream, h av.Handler, getter av.GetWriter) (*Input, error) {
+	conn, err := listen(cfg.Addr, cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	return &Input{
+		key:     cfg.Key,
+		url:     "udp://" + cfg.Addr,
+		conn:    conn,
+		timeout: time.Duration(configure.Config.GetInt("read_timeout")) * time.Second,
+		handler: h,
+		getter:  getter,
+	}, nil
+}
+
+// Addr returns the local address
+func (in *Input) Addr() net.Addr {
+	return in.conn.LocalAddr()
+}
+
+// Serve publishes the stream whenever datagrams are received, until the
+// input is closed
+func (in *Input) Serve() error {
+	buf := make([]byte, maxDatagram)
+	for {
+		in.conn.SetReadDeadline(time.Time{})
+		n, err := in.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		b, err := payload(buf[:n])
+		if err != nil {
+			continue
+		}
+		r := newReader(in, b)
+		if err := rtmp.HandlePublisher(in.handler, in.getter, r); err != nil {
+			log.Warningf("udp input %s refused: %v", in.url, err)
+			time.Sleep(in.timeout)
+			continue
+		}
+		<-r.done
+	}
+}
+
+// Close closes the input and its publisher
+func (in *Input) Close() error {
+	return in.conn.Close()
+}
+
+// datagrams reads the ts in the datagrams of a connection
+type datagrams struct {
+	r       *Reader
+	buf     []byte
+	pending []byte
+}
+
+// Read reads the ts of the datagrams, it fails if none is received in the
+// timeout or if the reader is closed
+func (d *datagrams) Read(b []byte) (int, error) {
+	for len(d.pending) == 0 {
+		select {
+		case <-d.r.done:
+			return 0, ErrClosed
+		default:
+		}
+		conn := d.r.in.conn
+		conn.SetReadDeadline(time.Now().Add(d.r.in.timeout))
+		n, err := conn.Read(d.buf)
+		if err != nil {
+			return 0, err
+		}
+		if d.pending, err = payload(d.buf[:n]); err != nil {
+			log.Debugf("udp input %s: %v", d.r.in.url, err)
+		}
+	}
+	n := copy(b, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// Reader is the publisher of an input
+type Reader struct {
+	av.RWBaser
+
+	uid       string
+	in        *Input
+	demuxer   *ts.Demuxer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newReader returns a publisher of in, first is the ts already received
+func newReader(in *Input, first []byte) *Reader {
+	r := &Reader{
+		RWBaser: av.NewRWBase(in.timeout),
+
+		uid:  uid.NewID(),
+		in:   in,
+		done: make(chan struct{}),
+	}
+	d := &datagrams{
+		r:       r,
+		buf:     make([]byte, maxDatagram),
+		pending: append([]byte(nil), first...),
+	}
+	r.demuxer = ts.NewDemuxer(d)
+	return r
+}
+
+// Read reads a packet
+func (r *Reader) Read(p *av.Packet) error {
+	if err := r.demuxer.Read(p); err != nil {
+		r.Close(err)
+		return err
+	}
+	r.SetPreTime()
+	return nil
+}
+
+// Close stops the publisher, the input goes on receiving
+func (r *Reader) Close(err error) {
+	r.closeOnce.Do(func() {
+		log.Debugf("udp publisher %s closed: %v", r.in.url, err)
+		close(r.done)
+		// interrupts a pending read
+		r.in.conn.SetReadDeadline(time.Now())
+	})
+}
+
+// Info returns the information
+func (r *Reader) Info() (ret av.Info) {
+	ret.UID = r.uid
+	ret.URL = r.in.url
+	ret.Key = r.in.key
+	return
+}
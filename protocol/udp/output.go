@@ -0,0 +1,214 @@
+package udp
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// datagramLen is the length of the ts in a datagram, 7 ts packets
+	datagramLen = 7 * 188
+	// maxSpread is the max time the datagrams of a packet are spread over
+	maxSpread = 100 * time.Millisecond
+	// maxDrift is how far the timestamps may be from the clock before the
+	// pacing starts again from the current packet
+	maxDrift = time.Second
+)
+
+// Writer sends a stream muxed in ts to a udp address, in RTP if enabled.
+// The datagrams are paced by the timestamps of the packets, so that the
+// receivers get the PCR at the rate of the stream.
+// The writer is not closed with the publisher, it sends the stream of the
+// next publisher. The packets are queued by the subscriber of the stream,
+// which waits while a packet is paced.
+type Writer struct {
+	av.RWBaser
+
+	uid, key, url string
+	conn          *net.UDPConn
+	addr          *net.UDPAddr
+	rtp           bool
+	seq           uint16
+	ssrc          uint32
+	muxer         *ts.StreamMuxer
+	buf           bytes.Buffer
+	datagram      []byte
+
+	// the pacing, the packet of timestamp first is sent at base, last is
+	// when the datagrams in buf were due
+	started   bool
+	base      time.Time
+	first     uint32
+	last      time.Time
+	lock      sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewWriter returns a Writer of the stream cfg
+func NewWriter(cfg configure.UDPStream) (*Writer, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP.IsMulticast() {
+		if err := setMulticast(conn, cfg.Interface, cfg.TTL); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	w := &Writer{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:      uid.NewID(),
+		key:      cfg.Key,
+		url:      "udp://" + cfg.Addr,
+		conn:     conn,
+		addr:     addr,
+		rtp:      cfg.RTP,
+		ssrc:     rand.Uint32(),
+		muxer:    ts.NewStreamMuxer(),
+		datagram: make([]byte, rtpHeaderLen+datagramLen),
+		done:     make(chan struct{}),
+	}
+	return w, nil
+}
+
+// Write muxes a packet, the ts of the previous packet is sent at its pace
+func (w *Writer) Write(p *av.Packet) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	select {
+	case <-w.done:
+		return ErrClosed
+	default:
+	}
+	w.sendPacket(p)
+	return nil
+}
+
+// sendPacket muxes p, the ts of a packet is sent when the next packet is
+// due
+func (w *Writer) sendPacket(p *av.Packet) {
+	w.SetPreTime()
+	pkt := *p
+	pkt.TimeStamp += w.BaseTimestamp()
+	if pkt.IsVideo {
+		w.RecTimestamp(pkt.TimeStamp, av.TagVideo)
+	} else if pkt.IsAudio {
+		w.RecTimestamp(pkt.TimeStamp, av.TagAudio)
+	}
+	w.send(w.due(pkt.TimeStamp))
+	if err := w.muxer.Mux(&pkt, &w.buf); err != nil {
+		log.Debugf("[%v] mux error: %v", w.Info(), err)
+	}
+}
+
+// due returns when the packet of timestamp ts is due, the pacing starts
+// again from ts if it is too far from the clock
+func (w *Writer) due(ts uint32) time.Time {
+	now := time.Now()
+	if w.started {
+		at := w.base.Add(time.Duration(int32(ts-w.first)) * time.Millisecond)
+		if at.After(now.Add(-maxDrift)) && at.Before(now.Add(maxDrift)) {
+			return at
+		}
+		log.Debugf("[%v] pacing reset at timestamp %d", w.Info(), ts)
+	}
+	w.started = true
+	w.base = now
+	w.first = ts
+	w.last = now
+	return now
+}
+
+// send sends the full datagrams of buf, spread from when they were due
+// until next
+func (w *Writer) send(next time.Time) {
+	n := w.buf.Len() / datagramLen
+	start := w.last
+	if next.After(w.last) {
+		w.last = next
+	}
+	if n == 0 {
+		return
+	}
+	spread := next.Sub(start)
+	if spread > maxSpread {
+		spread = maxSpread
+	}
+	for i := 0; i < n; i++ {
+		if spread > 0 {
+			if d := time.Until(start.Add(spread * time.Duration(i) / time.Duration(n))); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		w.write(w.buf.Next(datagramLen))
+	}
+}
+
+// flush sends the rest of buf
+func (w *Writer) flush() {
+	for w.buf.Len() > 0 {
+		w.write(w.buf.Next(datagramLen))
+	}
+}
+
+// write sends a datagram of ts, the errors are logged as the receivers
+// may come later
+func (w *Writer) write(b []byte) {
+	if w.rtp {
+		timestamp := uint32(time.Since(w.base) * 90 / time.Millisecond)
+		putRTPHeader(w.datagram, w.seq, timestamp+w.first*90, w.ssrc)
+		w.seq++
+		b = w.datagram[:rtpHeaderLen+copy(w.datagram[rtpHeaderLen:], b)]
+	}
+	if _, err := w.conn.WriteToUDP(b, w.addr); err != nil {
+		log.Debugf("[%v] write error: %v", w.Info(), err)
+	}
+}
+
+// Alive returns if the writer is not closed, it does not time out while
+// the stream is not published
+func (w *Writer) Alive() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Close closes the writer, the rest of the ts is sent
+func (w *Writer) Close(err error) {
+	w.closeOnce.Do(func() {
+		log.Debugf("udp output [%s] closed: %v", w.key, err)
+		close(w.done)
+		w.lock.Lock()
+		w.flush()
+		w.conn.Close()
+		w.lock.Unlock()
+	})
+}
+
+// Info returns the information
+func (w *Writer) Info() (ret av.Info) {
+	ret.UID = w.uid
+	ret.URL = w.url
+	ret.Key = w.key
+	return
+}
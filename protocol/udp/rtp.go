@@ -0,0 +1,53 @@
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	rtpHeaderLen = 12
+	// rtpPayloadMP2T is the static payload type of MPEG-TS
+	rtpPayloadMP2T = 33
+)
+
+var (
+	// ErrInvalidDatagram means a datagram is neither ts nor ts in RTP
+	ErrInvalidDatagram = fmt.Errorf("invalid udp ts datagram")
+)
+
+// payload returns the ts of a datagram, which is raw ts or ts in RTP
+func payload(b []byte) ([]byte, error) {
+	if len(b) > 0 && b[0] == 0x47 {
+		return b, nil
+	}
+	if len(b) < rtpHeaderLen || b[0]>>6 != 2 {
+		return nil, ErrInvalidDatagram
+	}
+	n := rtpHeaderLen + 4*int(b[0]&0x0f)
+	if b[0]&0x10 != 0 {
+		// the header extension
+		if len(b) < n+4 {
+			return nil, ErrInvalidDatagram
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(b[n+2:]))
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 {
+		// the padding
+		end -= int(b[len(b)-1])
+	}
+	if n > end {
+		return nil, ErrInvalidDatagram
+	}
+	return b[n:end], nil
+}
+
+// putRTPHeader writes the header of a RTP packet of ts to b
+func putRTPHeader(b []byte, seq uint16, timestamp, ssrc uint32) {
+	b[0] = 0x80
+	b[1] = rtpPayloadMP2T
+	binary.BigEndian.PutUint16(b[2:], seq)
+	binary.BigEndian.PutUint32(b[4:], timestamp)
+	binary.BigEndian.PutUint32(b[8:], ssrc)
+}
@@ -0,0 +1,48 @@
+package udp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticast sets the interface ifname and the ttl of the multicast
+// packets sent by conn
+func setMulticast(conn *net.UDPConn, ifname string, ttl int) error {
+	var ip [4]byte
+	if ifname != "" {
+		ifi, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return err
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if v, ok := addr.(*net.IPNet); ok && v.IP.To4() != nil {
+				copy(ip[:], v.IP.To4())
+				break
+			}
+		}
+	}
+	if ttl <= 0 {
+		ttl = 1
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if serr = setsockoptInt(fd, syscall.IP_MULTICAST_TTL, ttl); serr != nil {
+			return
+		}
+		if ifname != "" {
+			serr = setsockoptInet4Addr(fd, syscall.IP_MULTICAST_IF, ip)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
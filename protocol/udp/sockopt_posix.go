@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package udp
+
+import "syscall"
+
+func setsockoptInt(fd uintptr, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, opt, value)
+}
+
+func setsockoptInet4Addr(fd uintptr, opt int, value [4]byte) error {
+	return syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, opt, value)
+}
@@ -0,0 +1,11 @@
+package udp
+
+import "syscall"
+
+func setsockoptInt(fd uintptr, opt, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, opt, value)
+}
+
+func setsockoptInet4Addr(fd uintptr, opt int, value [4]byte) error {
+	return syscall.SetsockoptInet4Addr(syscall.Handle(fd), syscall.IPPROTO_IP, opt, value)
+}
@@ -0,0 +1,103 @@
+package udp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayload(t *testing.T) {
+	at := assert.New(t)
+
+	tsPacket := append([]byte{0x47}, make([]byte, 187)...)
+	b, err := payload(tsPacket)
+	at.Nil(err)
+	at.Equal(tsPacket, b)
+
+	rtp := make([]byte, rtpHeaderLen)
+	putRTPHeader(rtp, 1, 2, 3)
+	b, err = payload(append(rtp, tsPacket...))
+	at.Nil(err)
+	at.Equal(tsPacket, b)
+
+	// a csrc, an extension of one word and two bytes of padding
+	rtp = []byte{0xb1, rtpPayloadMP2T, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0xbe, 0xde, 0, 1, 0, 0, 0, 0}
+	b, err = payload(append(append(rtp, tsPacket...), 0, 2))
+	at.Nil(err)
+	at.Equal(tsPacket, b)
+
+	for _, v := range [][]byte{nil, {0x80, 33}, {0x00, 33, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		_, err = payload(v)
+		at.Equal(ErrInvalidDatagram, err)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	at := assert.New(t)
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	vseq := append([]byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	vseq = append(append(vseq, 0x01, 0, byte(len(pps))), pps...)
+	idr := append([]byte{0x17, 0x01, 0, 0, 0, 0, 0, 0x0b, 0xb8}, bytes.Repeat([]byte{0x65, 0x88, 0x84, 0x21}, 750)...)
+	inter := []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 3, 0x41, 0x9a, 0x02}
+
+	for _, rtp := range []bool{false, true} {
+		in, err := NewInput(configure.UDPStream{Addr: "127.0.0.1:0", Key: "live/udp"}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.timeout = 300 * time.Millisecond
+		w, err := NewWriter(configure.UDPStream{Addr: in.Addr().String(), RTP: rtp, Key: "live/udp"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const duration = 400
+		start := time.Now()
+		w.Write(&av.Packet{IsVideo: true, Data: vseq})
+		w.Write(&av.Packet{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}})
+		w.Write(&av.Packet{IsVideo: true, Data: idr})
+		for ts := uint32(20); ts <= duration; ts += 20 {
+			w.Write(&av.Packet{IsAudio: true, TimeStamp: ts, Data: []byte{0xaf, 0x01, 0x21, 0x10, byte(ts)}})
+			if ts%40 == 0 {
+				w.Write(&av.Packet{IsVideo: true, TimeStamp: ts, Data: inter})
+			}
+		}
+		w.Close(nil)
+
+		r := newReader(in, nil)
+		var out []*av.Packet
+		for {
+			var p av.Packet
+			if err := r.Read(&p); err != nil {
+				break
+			}
+			out = append(out, &p)
+		}
+		elapsed := time.Since(start)
+		in.Close()
+
+		// the sequence headers, the key frame, the audio and inter frames
+		if at.Len(out, 2+1+duration/20+duration/40, "rtp %v", rtp) {
+			at.Equal(vseq, out[0].Data)
+			keys := 0
+			for _, p := range out {
+				if av.IsKeyFrame(p) {
+					at.Equal(idr, p.Data)
+					keys++
+				}
+			}
+			at.Equal(1, keys)
+			last := out[len(out)-1]
+			at.Equal(uint32(duration), last.TimeStamp)
+		}
+		// paced by the timestamps
+		at.True(elapsed > duration*3/4*time.Millisecond, "rtp %v: %v", rtp, elapsed)
+	}
+}
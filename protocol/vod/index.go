@@ -0,0 +1,160 @@
+package vod
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/hls"
+)
+
+const (
+	segmentDuration = 3000 // ms
+)
+
+var (
+	// ErrNoSegment means the segment does not exist
+	ErrNoSegment = fmt.Errorf("no such segment")
+)
+
+// segment is a range of tags in the flv file starting with a key frame
+type segment struct {
+	offset   int64
+	end      int64
+	start    uint32
+	duration uint32
+}
+
+// index describes how a flv file is split into ts segments
+type index struct {
+	size     int64
+	modTime  int64
+	hasVideo bool
+	videoSeq *av.Packet
+	audioSeq *av.Packet
+	segments []segment
+}
+
+// newIndex reads the whole flv file and splits it on key frames
+func newIndex(f *os.File, fi os.FileInfo) (*index, error) {
+	idx := &index{
+		size:    fi.Size(),
+		modTime: fi.ModTime().UnixNano(),
+	}
+	r := flv.NewReader(bufio.NewReader(f))
+
+	var cur *segment
+	var last uint32
+	var p av.Packet
+	for {
+		err := r.Read(&p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.IsMetadata {
+			continue
+		}
+		pkt := p
+
+		isBoundary := false
+		if p.IsVideo {
+			vh := p.Header.(av.VideoPacketHeader)
+			if vh.IsSeq() {
+				if idx.videoSeq == nil {
+					idx.videoSeq = &pkt
+				}
+				continue
+			}
+			idx.hasVideo = true
+			isBoundary = vh.IsKeyFrame()
+		} else {
+			ah := p.Header.(av.AudioPacketHeader)
+			if ah.SoundFormat() == av.SoundAAC && ah.AACPacketType() == av.AACSeqHeader {
+				if idx.audioSeq == nil {
+					idx.audioSeq = &pkt
+				}
+				continue
+			}
+			isBoundary = !idx.hasVideo
+		}
+
+		if cur == nil {
+			cur = &segment{offset: r.TagOffset(), start: p.TimeStamp}
+		} else if isBoundary && p.TimeStamp-cur.start >= segmentDuration {
+			cur.end = r.TagOffset()
+			cur.duration = p.TimeStamp - cur.start
+			idx.segments = append(idx.segments, *cur)
+			cur = &segment{offset: r.TagOffset(), start: p.TimeStamp}
+		}
+		last = p.TimeStamp
+	}
+	if cur != nil {
+		cur.end = r.TotalBytes
+		cur.duration = last - cur.start
+		idx.segments = append(idx.segments, *cur)
+	}
+	return idx, nil
+}
+
+// playlist generates the VOD m3u8 playlist, segments are named n.ts
+// under the directory named by the file name without extension
+func (idx *index) playlist(base string) []byte {
+	var maxDuration uint32
+	body := bytes.NewBuffer(nil)
+	for i, s := range idx.segments {
+		if s.duration > maxDuration {
+			maxDuration = s.duration
+		}
+		fmt.Fprintf(body, "#EXTINF:%.3f,\n%s/%d.ts\n", float64(s.duration)/1000, base, i)
+	}
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w,
+		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n\n",
+		maxDuration/1000+1)
+	w.Write(body.Bytes())
+	w.WriteString("#EXT-X-ENDLIST\n")
+	return w.Bytes()
+}
+
+// writeSegment muxes the n-th segment into ts
+func (idx *index) writeSegment(f *os.File, n int, w io.Writer) error {
+	if n < 0 || n >= len(idx.segments) {
+		return ErrNoSegment
+	}
+	s := idx.segments[n]
+	if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	muxer := hls.NewSegmentMuxer(w, idx.hasVideo)
+	// sequence headers are only at the beginning of the file
+	for _, seq := range []*av.Packet{idx.videoSeq, idx.audioSeq} {
+		if seq != nil {
+			if err := muxer.Write(seq); err != nil {
+				return err
+			}
+		}
+	}
+
+	r := flv.NewTagReader(bufio.NewReader(io.LimitReader(f, s.end-s.offset)))
+	var p av.Packet
+	for {
+		err := r.Read(&p)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := muxer.Write(&p); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package vod
+
+import (
+	"bufio"
+	"os"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	at := assert.New(t)
+	_, file, cleanup := newTestServer(t)
+	defer cleanup()
+
+	f, err := os.Open(file)
+	at.Nil(err)
+	defer f.Close()
+	fi, err := f.Stat()
+	at.Nil(err)
+	idx, err := newIndex(f, fi)
+	at.Nil(err)
+	at.True(idx.hasVideo)
+	at.NotNil(idx.videoSeq)
+	at.NotNil(idx.audioSeq)
+
+	// the segments are split on the first key frame after 3s
+	var starts, durations []uint32
+	for i, s := range idx.segments {
+		starts = append(starts, s.start)
+		durations = append(durations, s.duration)
+		if i > 0 {
+			at.Equal(idx.segments[i-1].end, s.offset)
+		}
+		// a segment starts with its key frame
+		_, err := f.Seek(s.offset, 0)
+		at.Nil(err)
+		var p av.Packet
+		at.Nil(flv.NewTagReader(bufio.NewReader(f)).Read(&p))
+		at.True(p.IsVideo)
+		at.True(p.Header.(av.VideoPacketHeader).IsKeyFrame())
+		at.Equal(s.start, p.TimeStamp)
+	}
+	at.Equal([]uint32{0, 3000, 6000, 9000}, starts)
+	at.Equal([]uint32{3000, 3000, 3000, 960}, durations)
+	at.Equal(fi.Size(), idx.segments[len(idx.segments)-1].end)
+}
@@ -0,0 +1,168 @@
+package vod
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidReq means invalid req url path
+	ErrInvalidReq = fmt.Errorf("invalid req url path")
+)
+
+// Server serves the recorded flv files under flv_dir:
+//
+//	/APP/NAME.flv      the flv file, with range requests
+//	/APP/NAME.m3u8     the VOD HLS playlist generated from APP/NAME.flv
+//	/APP/NAME/N.ts     the N-th segment of the playlist
+type Server struct {
+	indexes *cache.Cache
+}
+
+// NewServer returns a Server
+func NewServer() *Server {
+	return &Server{
+		indexes: cache.New(10*time.Minute, time.Minute),
+	}
+}
+
+// Serve serves http requests
+func (server *Server) Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handle)
+	http.Serve(l, mux)
+	return nil
+}
+
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("vod handle panic: ", r)
+		}
+	}()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	name := strings.TrimLeft(r.URL.Path, "/")
+	switch path.Ext(name) {
+	case ".flv":
+		server.serveFile(w, r, name)
+	case ".m3u8":
+		server.servePlaylist(w, r, strings.TrimSuffix(name, ".m3u8")+".flv")
+	case ".ts":
+		dir, seg := path.Split(name)
+		n, err := strconv.Atoi(strings.TrimSuffix(seg, ".ts"))
+		if err != nil || dir == "" {
+			http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+			return
+		}
+		server.serveSegment(w, r, strings.TrimSuffix(dir, "/")+".flv", n)
+	default:
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+	}
+}
+
+// open opens a record file under flv_dir
+func (server *Server) open(w http.ResponseWriter, name string) (*os.File, os.FileInfo, bool) {
+	file, err := flv.ResolveRecordFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		http.Error(w, "file not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return f, fi, true
+}
+
+// getIndex returns the segment index of file, it is rebuilt if the file
+// changed since last time, e.g. the record is still being written
+func (server *Server) getIndex(name string, f *os.File, fi os.FileInfo) (*index, error) {
+	if v, ok := server.indexes.Get(name); ok {
+		idx := v.(*index)
+		if idx.size == fi.Size() && idx.modTime == fi.ModTime().UnixNano() {
+			return idx, nil
+		}
+	}
+	idx, err := newIndex(f, fi)
+	if err != nil {
+		return nil, err
+	}
+	server.indexes.SetDefault(name, idx)
+	return idx, nil
+}
+
+func (server *Server) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, fi, ok := server.open(w, name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "video/x-flv")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+func (server *Server) servePlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	f, fi, ok := server.open(w, name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	idx, err := server.getIndex(name, f, fi)
+	if err != nil {
+		log.Debug("vod index error: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body := idx.playlist(strings.TrimSuffix(path.Base(name), ".flv"))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+func (server *Server) serveSegment(w http.ResponseWriter, r *http.Request, name string, n int) {
+	f, fi, ok := server.open(w, name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	idx, err := server.getIndex(name, f, fi)
+	if err != nil {
+		log.Debug("vod index error: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := idx.writeSegment(f, n, buf); err != nil {
+		if err == ErrNoSegment {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Debug("vod segment error: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2ts")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,180 @@
+package vod
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func newTestPacket(isVideo bool, data []byte, timestamp uint32) *av.Packet {
+	var tag flv.Tag
+	tag.ParseMediaTagHeader(data, isVideo)
+	return &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		TimeStamp: timestamp,
+		Header:    &tag,
+		Data:      data,
+	}
+}
+
+// writeTestRecord records 10s of 25fps H.264 with a key frame every
+// second and AAC under dir as live/test.flv
+func writeTestRecord(t *testing.T, dir string) string {
+	if err := os.MkdirAll(filepath.Join(dir, "live"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "live", "test.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := flv.NewWriter("live", "test", "", f)
+	packets := []*av.Packet{
+		newTestPacket(true, append([]byte{0x17, 0x00, 0, 0, 0}, h264.SequenceHeader(testSPS, testPPS)...), 0),
+		newTestPacket(false, []byte{0xaf, 0x00, 0x12, 0x10}, 0),
+	}
+	for ts := uint32(0); ts < 10000; ts += 40 {
+		video := []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 4, 0x41, 0x9a, 0x02, 0x03}
+		if ts%1000 == 0 {
+			video = []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 4, 0x65, 0x88, 0x84, 0x21}
+		}
+		packets = append(packets,
+			newTestPacket(true, video, ts),
+			newTestPacket(false, []byte{0xaf, 0x01, 0x21, 0x10, 0x04}, ts))
+	}
+	for _, p := range packets {
+		if err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close(fmt.Errorf("test done"))
+	return f.Name()
+}
+
+func newTestServer(t *testing.T) (*Server, string, func()) {
+	dir, err := ioutil.TempDir("", "livego-vod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flvDir := filepath.Join(dir, "flv")
+	prev := configure.Config.GetString("flv_dir")
+	configure.Config.Set("flv_dir", flvDir)
+	file := writeTestRecord(t, flvDir)
+	return NewServer(), file, func() {
+		configure.Config.Set("flv_dir", prev)
+		os.RemoveAll(dir)
+	}
+}
+
+func get(server *Server, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	server.handle(w, r)
+	return w
+}
+
+func TestServerPlaylist(t *testing.T) {
+	at := assert.New(t)
+	server, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	w := get(server, "/live/test.m3u8", nil)
+	at.Equal(http.StatusOK, w.Code)
+	at.Equal("application/x-mpegURL", w.Header().Get("Content-Type"))
+	at.Equal("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n\n"+
+		"#EXTINF:3.000,\ntest/0.ts\n"+
+		"#EXTINF:3.000,\ntest/1.ts\n"+
+		"#EXTINF:3.000,\ntest/2.ts\n"+
+		"#EXTINF:0.960,\ntest/3.ts\n"+
+		"#EXT-X-ENDLIST\n", w.Body.String())
+
+	for _, target := range []string{"/live/test/0.ts", "/live/test/3.ts"} {
+		w = get(server, target, nil)
+		at.Equal(http.StatusOK, w.Code, target)
+		at.Equal("video/mp2ts", w.Header().Get("Content-Type"))
+		body := w.Body.Bytes()
+		at.True(len(body) > 0)
+		at.Equal(0, len(body)%188)
+		at.Equal(byte(0x47), body[0])
+	}
+
+	// out of range segments
+	for _, target := range []string{"/live/test/4.ts", "/live/test/-1.ts"} {
+		at.Equal(http.StatusNotFound, get(server, target, nil).Code, target)
+	}
+	at.Equal(http.StatusBadRequest, get(server, "/live/test/x.ts", nil).Code)
+	at.Equal(http.StatusNotFound, get(server, "/live/none.m3u8", nil).Code)
+}
+
+func TestServerPaths(t *testing.T) {
+	at := assert.New(t)
+	server, file, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// a record outside flv_dir
+	secret := filepath.Join(filepath.Dir(filepath.Dir(filepath.Dir(file))), "secret.flv")
+	data, err := ioutil.ReadFile(file)
+	at.Nil(err)
+	at.Nil(ioutil.WriteFile(secret, data, 0644))
+
+	for _, target := range []string{
+		"/../secret.flv",
+		"/live/../../secret.flv",
+		"/../secret.m3u8",
+		"/../secret/0.ts",
+	} {
+		at.Equal(http.StatusBadRequest, get(server, target, nil).Code, target)
+	}
+	// absolute paths are taken under flv_dir
+	for _, target := range []string{
+		"/" + filepath.ToSlash(secret),
+		"/" + filepath.ToSlash(file),
+	} {
+		at.Equal(http.StatusNotFound, get(server, target, nil).Code, target)
+	}
+	at.Equal(http.StatusOK, get(server, "/live/test.flv", nil).Code)
+}
+
+func TestServerRange(t *testing.T) {
+	at := assert.New(t)
+	server, file, cleanup := newTestServer(t)
+	defer cleanup()
+	data, err := ioutil.ReadFile(file)
+	at.Nil(err)
+
+	w := get(server, "/live/test.flv", nil)
+	at.Equal(http.StatusOK, w.Code)
+	at.Equal("video/x-flv", w.Header().Get("Content-Type"))
+	at.Equal(data, w.Body.Bytes())
+
+	w = get(server, "/live/test.flv", http.Header{"Range": {"bytes=13-112"}})
+	at.Equal(http.StatusPartialContent, w.Code)
+	at.Equal(fmt.Sprintf("bytes 13-112/%d", len(data)), w.Header().Get("Content-Range"))
+	at.Equal(data[13:113], w.Body.Bytes())
+
+	w = get(server, "/live/test.flv", http.Header{"Range": {"bytes=-10"}})
+	at.Equal(http.StatusPartialContent, w.Code)
+	at.Equal(data[len(data)-10:], w.Body.Bytes())
+
+	w = get(server, "/live/test.flv", http.Header{"Range": {fmt.Sprintf("bytes=%d-", len(data))}})
+	at.Equal(http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
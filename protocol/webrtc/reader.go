@@ -0,0 +1,304 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	pion "github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLate is how many rtp packets a sample waits for the missing ones
+	maxLate = 256
+	// keyFrameInterval is how often a key frame is asked to the publisher,
+	// the browsers send one only when asked
+	keyFrameInterval = 2 * time.Second
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+
+	// opusTag is the flv tag header of Opus, 48 kHz stereo
+	opusTag = 0xdf
+	opusSeq = 0
+)
+
+var (
+	// ErrClosed means the session is closed
+	ErrClosed = fmt.Errorf("webrtc session closed")
+)
+
+// Reader is a WebRTC publisher of a stream, the H.264 access units and the
+// Opus frames of its tracks are read as flv packets. The timestamps of a
+// track start when its first packet is received.
+type Reader struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	pc              *pion.PeerConnection
+	demuxer         flv.Demuxer
+	start           time.Time
+	packets         chan *av.Packet
+	closeOnce       sync.Once
+	done            chan struct{}
+}
+
+// NewReader returns a publisher receiving the tracks of the peer
+// connection pc, the offer is answered after
+func NewReader(app, title, url string, pc *pion.PeerConnection) *Reader {
+	r := &Reader{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:     uid.NewID(),
+		app:     app,
+		title:   title,
+		url:     url,
+		pc:      pc,
+		demuxer: flv.NewDemuxer(),
+		start:   time.Now(),
+		packets: make(chan *av.Packet, maxQueueNum),
+		done:    make(chan struct{}),
+	}
+	pc.OnTrack(func(track *pion.TrackRemote, _ *pion.RTPReceiver) {
+		mimeType := track.Codec().MimeType
+		log.Debugf("[%v] webrtc track %s", r.Info(), mimeType)
+		var err error
+		switch {
+		case strings.EqualFold(mimeType, pion.MimeTypeH264):
+			err = r.readVideo(track)
+		case strings.EqualFold(mimeType, pion.MimeTypeOpus):
+			err = r.readAudio(track)
+		default:
+			log.Infof("[%v] webrtc track %s not read", r.Info(), mimeType)
+			return
+		}
+		r.Close(err)
+	})
+	pc.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		log.Debugf("[%v] webrtc connection %s", r.Info(), state)
+		switch state {
+		case pion.PeerConnectionStateFailed, pion.PeerConnectionStateClosed:
+			r.Close(fmt.Errorf("connection %s", state))
+		}
+	})
+	return r
+}
+
+// clock converts the rtp timestamps of a track to the ms of the stream
+type clock struct {
+	rate    int64
+	started bool
+	base    int64
+	last    uint32
+	ticks   int64
+}
+
+// time returns the ms of the rtp timestamp ts, the first one is when it is
+// received
+func (c *clock) time(ts uint32, start time.Time) uint32 {
+	if !c.started {
+		c.started = true
+		c.base = int64(time.Since(start) / time.Millisecond)
+		c.last = ts
+	}
+	c.ticks += int64(int32(ts - c.last))
+	c.last = ts
+	if ms := c.base + c.ticks/c.rate; ms > 0 {
+		return uint32(ms)
+	}
+	return 0
+}
+
+// readVideo reads the H.264 access units of track, from the first key
+// frame and again after a loss
+func (r *Reader) readVideo(track *pion.TrackRemote) error {
+	builder := samplebuilder.New(maxLate, &codecs.H264Packet{IsAVC: true}, track.Codec().ClockRate)
+	c := clock{rate: videoClockRate}
+	var sps, pps []byte
+	var changed bool
+	waitKey := true
+	lastPLI := time.Now()
+	r.requestKeyFrame(track)
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			return err
+		}
+		if time.Since(lastPLI) >= keyFrameInterval {
+			lastPLI = time.Now()
+			r.requestKeyFrame(track)
+		}
+		builder.Push(p)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			ts := c.time(sample.PacketTimestamp, r.start)
+			if sample.PrevDroppedPackets > 0 && !waitKey {
+				log.Debugf("[%v] %d rtp packets lost", r.Info(), sample.PrevDroppedPackets)
+				waitKey = true
+				lastPLI = time.Now()
+				r.requestKeyFrame(track)
+			}
+			body := []byte{0x27, 0x01, 0, 0, 0}
+			key := false
+			for data := sample.Data; len(data) > 4; {
+				n := int(binary.BigEndian.Uint32(data))
+				if n > len(data)-4 {
+					break
+				}
+				nalu := data[4 : 4+n]
+				data = data[4+n:]
+				if n == 0 {
+					continue
+				}
+				switch nalu[0] & 0x1f {
+				case naluTypeSPS:
+					if !bytes.Equal(nalu, sps) {
+						sps = append([]byte(nil), nalu...)
+						changed = true
+					}
+					continue
+				case naluTypePPS:
+					if !bytes.Equal(nalu, pps) {
+						pps = append([]byte(nil), nalu...)
+						changed = true
+					}
+					continue
+				case naluTypeAUD:
+					continue
+				case naluTypeIDR:
+					key = true
+				}
+				body = append(body, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+				body = append(body, nalu...)
+			}
+			if changed && len(sps) >= 4 && pps != nil {
+				changed = false
+				r.push(true, ts, h264.SequenceHeader(sps, pps))
+			}
+			if waitKey {
+				if !key || sps == nil || pps == nil {
+					continue
+				}
+				waitKey = false
+			}
+			if len(body) == 5 {
+				continue
+			}
+			if key {
+				body[0] = 0x17
+			}
+			r.push(true, ts, body)
+		}
+	}
+}
+
+// requestKeyFrame asks the publisher of track for a key frame
+func (r *Reader) requestKeyFrame(track *pion.TrackRemote) {
+	if err := r.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+	}); err != nil {
+		log.Debugf("[%v] pli error: %v", r.Info(), err)
+	}
+}
+
+// readAudio reads the Opus frames of track, after the sequence header
+func (r *Reader) readAudio(track *pion.TrackRemote) error {
+	builder := samplebuilder.New(maxLate, &codecs.OpusPacket{}, track.Codec().ClockRate)
+	c := clock{rate: opusClockRate}
+	started := false
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			return err
+		}
+		builder.Push(p)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			ts := c.time(sample.PacketTimestamp, r.start)
+			if !started {
+				started = true
+				r.push(false, ts, opusHead(track.Codec().Channels))
+			}
+			if len(sample.Data) == 0 {
+				continue
+			}
+			r.push(false, ts, append([]byte{opusTag, opusFrame}, sample.Data...))
+		}
+	}
+}
+
+// opusHead returns the flv body of the Opus sequence header, the OpusHead
+// of RFC 7845 for 48 kHz and the pre-skip of the browsers
+func opusHead(channels uint16) []byte {
+	if channels == 0 {
+		channels = 2
+	}
+	b := []byte{opusTag, opusSeq}
+	b = append(b, "OpusHead"...)
+	b = append(b, 1, byte(channels), 0x38, 0x01, 0x80, 0xbb, 0, 0, 0, 0, 0)
+	return b
+}
+
+// push queues a packet of the flv body data
+func (r *Reader) push(isVideo bool, ts uint32, data []byte) {
+	p := &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		TimeStamp: ts,
+		Data:      data,
+	}
+	if err := r.demuxer.DemuxH(p); err != nil {
+		return
+	}
+	select {
+	case r.packets <- p:
+	case <-r.done:
+	}
+}
+
+// Read reads a packet
+func (r *Reader) Read(p *av.Packet) error {
+	select {
+	case pkt := <-r.packets:
+		*p = *pkt
+		r.SetPreTime()
+		return nil
+	case <-r.done:
+		return ErrClosed
+	}
+}
+
+// Done returns a channel closed when the reader is closed
+func (r *Reader) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close closes the reader and the peer connection
+func (r *Reader) Close(err error) {
+	r.closeOnce.Do(func() {
+		log.Debugf("webrtc publisher [%s/%s] closed: %v", r.app, r.title, err)
+		close(r.done)
+		go r.pc.Close()
+	})
+}
+
+// Info returns the information
+func (r *Reader) Info() (ret av.Info) {
+	ret.UID = r.uid
+	ret.URL = r.url
+	ret.Key = r.app + "/" + r.title
+	return
+}
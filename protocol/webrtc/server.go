@@ -0,0 +1,287 @@
+package webrtc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	"github.com/pion/interceptor"
+	pion "github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxSDPLen is the max length of an offer
+	maxSDPLen = 64 << 10
+)
+
+var (
+	// ErrNotPublished means the stream is not published
+	ErrNotPublished = fmt.Errorf("stream not published")
+)
+
+// session is the player or the publisher of a WebRTC session
+type session interface {
+	Close(error)
+	Done() <-chan struct{}
+}
+
+// Server negotiates the WebRTC sessions of the streams of handler, a WHEP
+// player posts its offer to /whep/{app}/{name} and a WHIP publisher to
+// /whip/{app}/{room key}, a session is ended by a DELETE of its Location
+type Server struct {
+	handler  av.Handler
+	getter   av.GetWriter
+	api      *pion.API
+	lock     sync.Mutex
+	sessions map[string]session
+}
+
+// NewServer returns a Server, the ICE traffic of all the sessions goes to
+// the udp port webrtc_udp_port if set, webrtc_ips are announced instead
+// of the addresses of the host
+func NewServer(h av.Handler, getter av.GetWriter) (*Server, error) {
+	var settings pion.SettingEngine
+	if port := configure.Config.GetInt("webrtc_udp_port"); port > 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return nil, err
+		}
+		settings.SetICEUDPMux(pion.NewICEUDPMux(nil, conn))
+	}
+	if ips := configure.Config.GetString("webrtc_ips"); ips != "" {
+		settings.SetNAT1To1IPs(strings.Split(ips, ","), pion.ICECandidateTypeHost)
+	}
+	return newServer(h, getter, settings), nil
+}
+
+func newServer(h av.Handler, getter av.GetWriter, settings pion.SettingEngine) *Server {
+	media := &pion.MediaEngine{}
+	registry := &interceptor.Registry{}
+	// only fails if the codecs are invalid
+	if err := registerCodecs(media); err != nil {
+		panic(err)
+	}
+	if err := pion.RegisterDefaultInterceptors(media, registry); err != nil {
+		panic(err)
+	}
+	return &Server{
+		handler: h,
+		getter:  getter,
+		api: pion.NewAPI(pion.WithMediaEngine(media), pion.WithSettingEngine(settings),
+			pion.WithInterceptorRegistry(registry)),
+		sessions: make(map[string]session),
+	}
+}
+
+// registerCodecs registers the codecs of the streams, H.264 in
+// packetization mode 1 and Opus
+func registerCodecs(media *pion.MediaEngine) error {
+	feedback := []pion.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"},
+		{Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for pt, profile := range map[pion.PayloadType]string{
+		102: "42001f",
+		106: "42e01f",
+		127: "4d001f",
+		112: "64001f",
+	} {
+		if err := media.RegisterCodec(pion.RTPCodecParameters{
+			RTPCodecCapability: pion.RTPCodecCapability{
+				MimeType:     pion.MimeTypeH264,
+				ClockRate:    videoClockRate * 1000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: pt,
+		}, pion.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return media.RegisterCodec(pion.RTPCodecParameters{
+		RTPCodecCapability: pion.RTPCodecCapability{
+			MimeType:    pion.MimeTypeOpus,
+			ClockRate:   opusClockRate * 1000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, pion.RTPCodecTypeAudio)
+}
+
+// Serve serves the http requests of l
+func (s *Server) Serve(l net.Listener) error {
+	return http.Serve(l, s)
+}
+
+// ServeHTTP serves the WHEP and WHIP requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if (paths[0] != "whep" && paths[0] != "whip") || len(paths) < 3 || len(paths) > 4 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	app, name := paths[1], paths[2]
+	switch {
+	case len(paths) == 3 && r.Method == http.MethodPost && paths[0] == "whep":
+		s.handlePlay(w, r, app, name)
+	case len(paths) == 3 && r.Method == http.MethodPost:
+		s.handlePublish(w, r, app, name)
+	case len(paths) == 4 && r.Method == http.MethodDelete:
+		s.handleDelete(w, r.URL.Path)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// check returns ErrNotPublished if the stream of app and name is not
+// published
+func (s *Server) check(app, name string) error {
+	if !configure.CheckAppName(app) {
+		return ErrNotPublished
+	}
+	if streams, ok := s.handler.(*rtmp.Streams); ok {
+		v, ok := streams.GetStreams().Get(configure.AliasKey(app + "/" + name))
+		if !ok || v.(*rtmp.Stream).Reader() == nil {
+			return ErrNotPublished
+		}
+	}
+	return nil
+}
+
+// answer returns the answer of the peer connection pc to offer, the
+// candidates are gathered before
+func answer(pc *pion.PeerConnection, offer string) (*pion.SessionDescription, error) {
+	if err := pc.SetRemoteDescription(pion.SessionDescription{
+		Type: pion.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return nil, err
+	}
+	desc, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gathered := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		return nil, err
+	}
+	<-gathered
+	return pc.LocalDescription(), nil
+}
+
+// handlePlay answers the offer of a player and plays the stream to it
+func (s *Server) handlePlay(w http.ResponseWriter, r *http.Request, app, name string) {
+	if err := s.check(app, name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSDPLen))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pc, err := s.api.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	url := fmt.Sprintf("http://%s%s", r.Host, r.URL.Path)
+	writer, err := NewWriter(app, name, url, pc)
+	if err != nil {
+		pc.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	desc, err := answer(pc, string(offer))
+	if err != nil {
+		writer.Close(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.created(w, r.URL.Path+"/"+writer.Info().UID, writer, desc)
+
+	s.handler.HandleWriter(writer)
+	log.Debugf("new whep player: %+v", writer.Info())
+}
+
+// handlePublish answers the offer of a publisher and publishes its tracks,
+// name is the room key like for rtmp publishers
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, app, name string) {
+	channel, err := rtmp.PublishChannel(app, name)
+	if err != nil {
+		log.Error("CheckKey err: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSDPLen))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pc, err := s.api.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	url := fmt.Sprintf("http://%s/whip/%s/%s", r.Host, app, channel)
+	reader := NewReader(app, channel, url, pc)
+	desc, err := answer(pc, string(offer))
+	if err != nil {
+		reader.Close(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rtmp.HandlePublisher(s.handler, s.getter, reader); err != nil {
+		log.Warningf("[%v] whip publisher refused: %v", reader.Info(), err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.created(w, r.URL.Path+"/"+reader.Info().UID, reader, desc)
+}
+
+// created keeps the session sess at location until it is closed and
+// responds with the answer desc
+func (s *Server) created(w http.ResponseWriter, location string, sess session, desc *pion.SessionDescription) {
+	s.lock.Lock()
+	s.sessions[location] = sess
+	s.lock.Unlock()
+	go func() {
+		<-sess.Done()
+		s.lock.Lock()
+		delete(s.sessions, location)
+		s.lock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(desc.SDP))
+}
+
+// handleDelete ends the session at location
+func (s *Server) handleDelete(w http.ResponseWriter, location string) {
+	s.lock.Lock()
+	sess, ok := s.sessions[location]
+	s.lock.Unlock()
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	sess.Close(fmt.Errorf("deleted"))
+	w.WriteHeader(http.StatusOK)
+}
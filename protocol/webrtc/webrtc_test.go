@@ -0,0 +1,379 @@
+package webrtc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/parser/h264"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	pion "github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	readers chan av.ReadCloser
+	writers chan av.WriteCloser
+}
+
+func (h *testHandler) HandleReader(r av.ReadCloser) {
+	h.readers <- r
+}
+
+func (h *testHandler) HandleWriter(w av.WriteCloser) {
+	h.writers <- w
+}
+
+// loopback returns the settings of the peer connections on the loopback
+// interface
+func loopback() pion.SettingEngine {
+	var settings pion.SettingEngine
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]pion.NetworkType{pion.NetworkTypeUDP4})
+	settings.SetInterfaceFilter(func(name string) bool {
+		return name == "lo"
+	})
+	settings.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	return settings
+}
+
+// client returns a peer connection of the default codecs
+func client(t *testing.T) *pion.PeerConnection {
+	engine := &pion.MediaEngine{}
+	if err := engine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := pion.NewAPI(pion.WithMediaEngine(engine), pion.WithSettingEngine(loopback()))
+	pc, err := api.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+// offer returns a peer connection receiving audio and video and its offer
+func offer(t *testing.T) (*pion.PeerConnection, string) {
+	pc := client(t)
+	for _, kind := range []pion.RTPCodecType{pion.RTPCodecTypeVideo, pion.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, pion.RTPTransceiverInit{
+			Direction: pion.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pc, localOffer(t, pc)
+}
+
+// localOffer returns the offer of pc with its candidates
+func localOffer(t *testing.T, pc *pion.PeerConnection) string {
+	desc, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func TestWHEP(t *testing.T) {
+	at := assert.New(t)
+
+	handler := &testHandler{writers: make(chan av.WriteCloser, 1)}
+	server := httptest.NewServer(newServer(handler, nil, loopback()))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/whep/unknown/movie", "application/sdp", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(http.StatusNotFound, resp.StatusCode)
+
+	pc, sdp := offer(t)
+	defer pc.Close()
+	resp, err = http.Post(server.URL+"/whep/live/movie", "application/sdp", strings.NewReader(sdp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !at.Equal(http.StatusCreated, resp.StatusCode, string(answer)) {
+		return
+	}
+	at.Equal("application/sdp", resp.Header.Get("Content-Type"))
+	location := resp.Header.Get("Location")
+	at.True(strings.HasPrefix(location, "/whep/live/movie/"))
+	if err := pc.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+	w := <-handler.writers
+	at.Equal("live/movie", w.Info().Key)
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	vseq := append([]byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	vseq = append(append(vseq, 0x01, 0, byte(len(pps))), pps...)
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88, 0x84, 0x21}, 1000)...)
+	key := append([]byte{0x17, 0x01, 0, 0, 40, 0, 0, byte(len(idr) >> 8), byte(len(idr))}, idr...)
+	opus := []byte{0xfc, 0xff, 0xfe}
+
+	type received struct {
+		timestamp uint32
+		payload   []byte
+	}
+	video := make(chan received, 100)
+	audio := make(chan received, 100)
+	pc.OnTrack(func(track *pion.TrackRemote, _ *pion.RTPReceiver) {
+		var depacketizer codecs.H264Packet
+		var frame []byte
+		for {
+			p, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if track.Kind() == pion.RTPCodecTypeAudio {
+				audio <- received{p.Timestamp, p.Payload}
+				continue
+			}
+			b, err := depacketizer.Unmarshal(p.Payload)
+			if err != nil {
+				continue
+			}
+			frame = append(frame, b...)
+			if p.Marker {
+				video <- received{p.Timestamp, frame}
+				frame = nil
+			}
+		}
+	})
+
+	// the tracks are bound once connected, the packets before are lost
+	w.Write(&av.Packet{IsVideo: true, Data: vseq})
+	var frames, sounds []received
+	deadline := time.After(10 * time.Second)
+	for ts := uint32(0); len(frames) < 2 || len(sounds) < 2; ts += 40 {
+		w.Write(&av.Packet{IsVideo: true, TimeStamp: ts, Data: key})
+		w.Write(&av.Packet{IsAudio: true, TimeStamp: ts, Data: append([]byte{0xdf, 0x01}, opus...)})
+		select {
+		case <-deadline:
+			t.Fatal("no media received")
+		case <-time.After(40 * time.Millisecond):
+		}
+	drain:
+		for {
+			select {
+			case v := <-video:
+				frames = append(frames, v)
+			case a := <-audio:
+				sounds = append(sounds, a)
+			default:
+				break drain
+			}
+		}
+	}
+
+	startCode := []byte{0, 0, 0, 1}
+	at.True(bytes.Contains(frames[0].payload, append(append([]byte(nil), startCode...), sps...)))
+	at.True(bytes.Contains(frames[0].payload, append(append([]byte(nil), startCode...), pps...)))
+	at.True(bytes.HasSuffix(frames[0].payload, append(append([]byte(nil), startCode...), idr...)))
+	// the pts of the frames 40 ms apart
+	at.Equal(uint32(40*90), frames[1].timestamp-frames[0].timestamp)
+	at.Equal(opus, sounds[0].payload)
+	at.Equal(uint32(40*48), sounds[1].timestamp-sounds[0].timestamp)
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(http.StatusOK, resp.StatusCode)
+	select {
+	case <-w.(*Writer).Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWHIP(t *testing.T) {
+	at := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "livego-whip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flvDir := configure.Config.GetString("flv_dir")
+	defer configure.Config.Set("flv_dir", flvDir)
+	configure.Config.Set("flv_dir", dir)
+
+	handler := &testHandler{
+		readers: make(chan av.ReadCloser, 1),
+		writers: make(chan av.WriteCloser, 1),
+	}
+	server := httptest.NewServer(newServer(handler, nil, loopback()))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/whip/live/invalid", "application/sdp", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(http.StatusForbidden, resp.StatusCode)
+
+	pc := client(t)
+	defer pc.Close()
+	video, err := pion.NewTrackLocalStaticSample(pion.RTPCodecCapability{MimeType: pion.MimeTypeH264}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := pion.NewTrackLocalStaticSample(pion.RTPCodecCapability{MimeType: pion.MimeTypeOpus}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plis := make(chan struct{}, 100)
+	for _, track := range []pion.TrackLocal{video, audio} {
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isVideo := track == video
+		go func() {
+			for {
+				packets, _, err := sender.ReadRTCP()
+				if err != nil {
+					return
+				}
+				for _, p := range packets {
+					if _, ok := p.(*rtcp.PictureLossIndication); ok && isVideo {
+						plis <- struct{}{}
+					}
+				}
+			}
+		}()
+	}
+
+	key, _ := configure.RoomKeys.GetKey("movie")
+	resp, err = http.Post(server.URL+"/whip/live/"+key, "application/sdp", strings.NewReader(localOffer(t, pc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !at.Equal(http.StatusCreated, resp.StatusCode, string(answer)) {
+		return
+	}
+	location := resp.Header.Get("Location")
+	at.True(strings.HasPrefix(location, "/whip/live/"+key+"/"))
+	if err := pc.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+	r := <-handler.readers
+	at.Equal("live/movie", r.Info().Key)
+	<-handler.writers
+
+	packets := make(chan *av.Packet, 100)
+	go func() {
+		for {
+			var p av.Packet
+			if err := r.Read(&p); err != nil {
+				close(packets)
+				return
+			}
+			packets <- &p
+		}
+	}()
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88, 0x84, 0x21}, 1000)...)
+	inter := []byte{0x41, 0x9a, 0x02}
+	startCode := []byte{0, 0, 0, 1}
+	keyFrame := bytes.Join([][]byte{nil, sps, pps, idr}, startCode)
+	opus := []byte{0xfc, 0xff, 0xfe}
+
+	var vseq, aseq *av.Packet
+	var keys, frames, sounds []*av.Packet
+	deadline := time.After(10 * time.Second)
+	for i := 0; len(keys) < 2 || len(frames) < 2 || len(sounds) < 2; i++ {
+		sample := media.Sample{Data: append(startCode, inter...), Duration: 40 * time.Millisecond}
+		if i%5 == 0 {
+			sample.Data = keyFrame
+		}
+		video.WriteSample(sample)
+		audio.WriteSample(media.Sample{Data: opus, Duration: 20 * time.Millisecond})
+		audio.WriteSample(media.Sample{Data: opus, Duration: 20 * time.Millisecond})
+		select {
+		case <-deadline:
+			t.Fatal("no media received")
+		case <-time.After(40 * time.Millisecond):
+		}
+	drain:
+		for {
+			select {
+			case p := <-packets:
+				switch {
+				case p.IsVideo && p.Header.(av.VideoPacketHeader).IsSeq():
+					vseq = p
+				case p.IsVideo && av.IsKeyFrame(p):
+					keys = append(keys, p)
+				case p.IsVideo && vseq != nil:
+					frames = append(frames, p)
+				case p.IsAudio && p.Header.(av.AudioPacketHeader).AACPacketType() == opusSeq:
+					aseq = p
+				case p.IsAudio:
+					sounds = append(sounds, p)
+				}
+			default:
+				break drain
+			}
+		}
+	}
+
+	if at.NotNil(vseq) {
+		at.Equal(h264.SequenceHeader(sps, pps), vseq.Data)
+	}
+	at.Equal(append([]byte{0x17, 0x01, 0, 0, 0, 0, 0, byte(len(idr) >> 8), byte(len(idr))}, idr...), keys[0].Data)
+	at.Equal([]byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 3, 0x41, 0x9a, 0x02}, frames[0].Data)
+	at.Equal(uint32(200), keys[1].TimeStamp-keys[0].TimeStamp)
+	at.Equal(uint32(40), frames[1].TimeStamp-frames[0].TimeStamp)
+	if at.NotNil(aseq) {
+		at.Equal(uint8(av.SoundOpus), aseq.Header.(av.AudioPacketHeader).SoundFormat())
+		at.Equal([]byte("OpusHead"), aseq.Data[2:10])
+	}
+	at.Equal(append([]byte{0xdf, 0x01}, opus...), sounds[0].Data)
+	at.Equal(uint32(20), sounds[1].TimeStamp-sounds[0].TimeStamp)
+	select {
+	case <-plis:
+	default:
+		t.Error("no key frame asked")
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at.Equal(http.StatusOK, resp.StatusCode)
+	select {
+	case <-r.(*Reader).Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+}
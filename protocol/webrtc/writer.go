@@ -0,0 +1,240 @@
+package webrtc
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	pion "github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxQueueNum = 1024
+	// mtu is the max size of the rtp payloads
+	mtu = 1200
+
+	videoClockRate = 90
+	opusClockRate  = 48
+	opusFrame      = 1
+)
+
+// Writer is a WebRTC player of a stream, the H.264 frames and the Opus
+// frames are sent in rtp, AAC is not sent. The packets are queued by the
+// subscriber of the stream, which waits until the peer is connected.
+type Writer struct {
+	av.RWBaser
+
+	uid             string
+	app, title, url string
+	pc              *pion.PeerConnection
+	video, audio    *pion.TrackLocalStaticRTP
+	demuxer         flv.Demuxer
+	parser          *parser.CodecParser
+	payloader       codecs.H264Payloader
+	buf             bytes.Buffer
+	videoSeq        uint16
+	audioSeq        uint16
+	started         bool
+	warned          bool
+	closeOnce       sync.Once
+	connectOnce     sync.Once
+	connected       chan struct{}
+	done            chan struct{}
+}
+
+// NewWriter returns a player sending to the peer connection pc, the
+// tracks are added to pc before the offer is answered
+func NewWriter(app, title, url string, pc *pion.PeerConnection) (*Writer, error) {
+	w := &Writer{
+		RWBaser: av.NewRWBase(time.Second * 10),
+
+		uid:       uid.NewID(),
+		app:       app,
+		title:     title,
+		url:       url,
+		pc:        pc,
+		demuxer:   flv.NewDemuxer(),
+		parser:    parser.NewCodecParser(),
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	var err error
+	w.video, err = pion.NewTrackLocalStaticRTP(pion.RTPCodecCapability{
+		MimeType:    pion.MimeTypeH264,
+		ClockRate:   videoClockRate * 1000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", w.uid)
+	if err != nil {
+		return nil, err
+	}
+	w.audio, err = pion.NewTrackLocalStaticRTP(pion.RTPCodecCapability{
+		MimeType:  pion.MimeTypeOpus,
+		ClockRate: opusClockRate * 1000,
+		Channels:  2,
+	}, "audio", w.uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, track := range []*pion.TrackLocalStaticRTP{w.video, w.audio} {
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			return nil, err
+		}
+		// the rtcp must be read for the interceptors, the key frames
+		// asked by the player come with the publisher
+		go func() {
+			b := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(b); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	pc.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		log.Debugf("[%v] webrtc connection %s", w.Info(), state)
+		switch state {
+		case pion.PeerConnectionStateConnected:
+			w.connectOnce.Do(func() {
+				close(w.connected)
+			})
+		case pion.PeerConnectionStateFailed, pion.PeerConnectionStateClosed:
+			w.Close(fmt.Errorf("connection %s", state))
+		}
+	})
+	return w, nil
+}
+
+// Write sends a packet in rtp once connected, so that the player gets the
+// cached gop, the writer is closed if it fails
+func (w *Writer) Write(p *av.Packet) error {
+	select {
+	case <-w.connected:
+	case <-w.done:
+		return fmt.Errorf("webrtc writer closed")
+	}
+	w.SetPreTime()
+	pkt := *p
+	pkt.TimeStamp += w.BaseTimestamp()
+	if pkt.IsVideo {
+		w.RecTimestamp(pkt.TimeStamp, av.TagVideo)
+	} else if pkt.IsAudio {
+		w.RecTimestamp(pkt.TimeStamp, av.TagAudio)
+	}
+	if err := w.send(&pkt); err != nil {
+		log.Debug("webrtc write error: ", err)
+		w.Close(err)
+		return err
+	}
+	return nil
+}
+
+// send sends the frame of p, which may be modified
+func (w *Writer) send(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	if err := w.demuxer.Demux(p); err != nil {
+		if err == flv.ErrAvcEndSEQ {
+			return nil
+		}
+		return err
+	}
+	if p.IsVideo {
+		return w.sendVideo(p)
+	}
+	ah := p.Header.(av.AudioPacketHeader)
+	if ah.SoundFormat() != av.SoundOpus {
+		if !w.warned {
+			w.warned = true
+			log.Infof("[%v] sound format %d not sent, only Opus is", w.Info(), ah.SoundFormat())
+		}
+		return nil
+	}
+	if ah.AACPacketType() != opusFrame || len(p.Data) == 0 {
+		return nil
+	}
+	err := w.audio.WriteRTP(&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			SequenceNumber: w.audioSeq,
+			Timestamp:      p.TimeStamp * opusClockRate,
+		},
+		Payload: p.Data,
+	})
+	w.audioSeq++
+	return err
+}
+
+// sendVideo sends the H.264 frame of p from the first key frame, the rtp
+// timestamp is its pts
+func (w *Writer) sendVideo(p *av.Packet) error {
+	vh := p.Header.(av.VideoPacketHeader)
+	if vh.CodecID() != av.VideoH264 {
+		return nil
+	}
+	if vh.IsSeq() {
+		return w.parser.Parse(p, nil)
+	}
+	if !w.started {
+		if !vh.IsKeyFrame() {
+			return nil
+		}
+		w.started = true
+	}
+	w.buf.Reset()
+	if err := w.parser.Parse(p, &w.buf); err != nil {
+		return err
+	}
+	pts := uint32(int64(p.TimeStamp) + int64(vh.CompositionTime()))
+	payloads := w.payloader.Payload(mtu, w.buf.Bytes())
+	for i, payload := range payloads {
+		err := w.video.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: w.videoSeq,
+				Timestamp:      pts * videoClockRate,
+			},
+			Payload: payload,
+		})
+		w.videoSeq++
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Done returns a channel closed when the writer is closed
+func (w *Writer) Done() <-chan struct{} {
+	return w.done
+}
+
+// Close closes the writer and the peer connection
+func (w *Writer) Close(err error) {
+	w.closeOnce.Do(func() {
+		log.Debugf("webrtc player [%s/%s] closed: %v", w.app, w.title, err)
+		close(w.done)
+		go w.pc.Close()
+	})
+}
+
+// Info returns the information
+func (w *Writer) Info() (ret av.Info) {
+	ret.UID = w.uid
+	ret.URL = w.url
+	ret.Key = w.app + "/" + w.title
+	ret.Inter = true
+	return
+}
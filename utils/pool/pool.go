@@ -1,27 +1,53 @@
 package pool
 
-// Pool is a byte pool to avoid scrappy allocation
+import (
+	"sync"
+)
+
+const (
+	// minClass is the smallest slice size, 64 bytes
+	minClass = 6
+	// maxClass is the biggest slice size kept in the pool, 4M
+	maxClass = 22
+)
+
+// Pool is a byte pool to avoid scrappy allocation, slices are kept in
+// power of two size classes and reused once given back by Put
 type Pool struct {
-	pos int
-	buf []byte
+	classes [maxClass - minClass + 1]sync.Pool
 }
 
-const maxpoolsize = 500 * 1024
+// class returns the size class index of size
+func class(size int) int {
+	c := minClass
+	for 1<<uint(c) < size {
+		c++
+	}
+	return c - minClass
+}
 
 // Get gets a byte slice of specific size
 func (pool *Pool) Get(size int) []byte {
-	if maxpoolsize-pool.pos < size {
-		pool.pos = 0
-		pool.buf = make([]byte, maxpoolsize)
+	c := class(size)
+	if c >= len(pool.classes) {
+		return make([]byte, size)
+	}
+	if b, ok := pool.classes[c].Get().([]byte); ok {
+		return b[:size]
 	}
-	b := pool.buf[pool.pos : pool.pos+size]
-	pool.pos += size
-	return b
+	return make([]byte, size, 1<<uint(c+minClass))
+}
+
+// Put gives b back to the pool, b must not be used anymore
+func (pool *Pool) Put(b []byte) {
+	c := class(cap(b))
+	if c >= len(pool.classes) || cap(b) != 1<<uint(c+minClass) {
+		return
+	}
+	pool.classes[c].Put(b[:0])
 }
 
 // NewPool return a Pool
 func NewPool() *Pool {
-	return &Pool{
-		buf: make([]byte, maxpoolsize),
-	}
+	return &Pool{}
 }